@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Cxiyuan/NTA/internal/encryption"
+	"github.com/Cxiyuan/NTA/internal/replay"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	outputFile   = flag.String("output", "flow_model.json", "Write the model to this file")
+	source       = flag.String("source", "", "Where the labelled captures came from, recorded in the model")
+	packets      = flag.Int("packets", encryption.DefaultFlowPackets, "Payload packets sampled per flow")
+	epochs       = flag.Int("epochs", 200, "Training epochs")
+	learningRate = flag.Float64("rate", 0.1, "Learning rate")
+	l2           = flag.Float64("l2", 0.001, "L2 regularization")
+	holdout      = flag.Float64("holdout", 0.2, "Fraction of flows held out for evaluation")
+	seed         = flag.Int64("seed", 1, "Random seed for shuffling")
+	logLevel     = flag.String("log-level", "info", "Log level (debug, info, warn, error)")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] data-dir\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "data-dir holds one directory of pcap/pcapng files per class, named after\n")
+		fmt.Fprintf(os.Stderr, "the class: %s, %s, %s, %s or %s.\n",
+			encryption.FlowBrowsing, encryption.FlowStreaming, encryption.FlowFileTransfer,
+			encryption.FlowInteractive, encryption.FlowC2)
+		fmt.Fprintf(os.Stderr, "Every flow of a capture is labelled with its class.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	logger := logrus.New()
+	level, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		level = logrus.InfoLevel
+	}
+	logger.SetLevel(level)
+	logger.SetOutput(os.Stderr)
+	logger.SetFormatter(&logrus.TextFormatter{
+		FullTimestamp: true,
+	})
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dataDir := flag.Arg(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		logger.Warn("Interrupted, training on flows read so far")
+		cancel()
+	}()
+
+	samples, labels, err := loadSamples(ctx, logger, dataDir)
+	if err != nil {
+		logger.Fatalf("Failed to read training data: %v", err)
+	}
+	if len(samples) == 0 {
+		logger.Fatalf("No flows with at least a few payload packets found in %s", dataDir)
+	}
+
+	// Hold out a shuffled share of the flows to estimate accuracy
+	rng := rand.New(rand.NewSource(*seed))
+	order := rng.Perm(len(samples))
+	split := len(samples) - int(float64(len(samples))**holdout)
+	var trainSamples, testSamples []*encryption.FlowSample
+	var trainLabels, testLabels []string
+	for i, idx := range order {
+		if i < split {
+			trainSamples = append(trainSamples, samples[idx])
+			trainLabels = append(trainLabels, labels[idx])
+		} else {
+			testSamples = append(testSamples, samples[idx])
+			testLabels = append(testLabels, labels[idx])
+		}
+	}
+
+	opts := encryption.FlowTrainOptions{
+		Packets:      *packets,
+		Epochs:       *epochs,
+		LearningRate: *learningRate,
+		L2:           *l2,
+		Seed:         *seed,
+	}
+	logger.Infof("Training on %d flows, evaluating on %d", len(trainSamples), len(testSamples))
+	model, err := encryption.TrainFlowModel(trainSamples, trainLabels, opts)
+	if err != nil {
+		logger.Fatalf("Training failed: %v", err)
+	}
+	if len(testSamples) > 0 {
+		evaluate(os.Stderr, model, testSamples, testLabels)
+	}
+
+	// The final model learns from every flow
+	model, err = encryption.TrainFlowModel(samples, labels, opts)
+	if err != nil {
+		logger.Fatalf("Training failed: %v", err)
+	}
+	model.Trained = fmt.Sprintf("%d flows from %s on %s", len(samples), filepath.Base(dataDir), time.Now().Format("2006-01-02"))
+	if *source != "" {
+		model.Trained += ": " + *source
+	}
+
+	if err := writeModel(*outputFile, model); err != nil {
+		logger.Fatalf("Failed to write model: %v", err)
+	}
+	logger.Infof("Model written to %s", *outputFile)
+}
+
+// loadSamples samples the flows of every capture under dataDir/<class>
+func loadSamples(ctx context.Context, logger *logrus.Logger, dataDir string) ([]*encryption.FlowSample, []string, error) {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var samples []*encryption.FlowSample
+	var labels []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		class := entry.Name()
+		files, err := filepath.Glob(filepath.Join(dataDir, class, "*"))
+		if err != nil {
+			return nil, nil, err
+		}
+		sort.Strings(files)
+
+		count := 0
+		for _, path := range files {
+			ext := strings.ToLower(filepath.Ext(path))
+			if ext != ".pcap" && ext != ".pcapng" && ext != ".cap" {
+				continue
+			}
+
+			tracker := encryption.NewFlowTracker(logger, *packets, func(sample *encryption.FlowSample) {
+				samples = append(samples, sample)
+				labels = append(labels, class)
+				count++
+			})
+			if err := readCapture(ctx, logger, path, tracker); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", path, err)
+			}
+			tracker.Flush()
+			if ctx.Err() != nil {
+				return samples, labels, nil
+			}
+		}
+		logger.Infof("Class %s: %d flows", class, count)
+	}
+	return samples, labels, nil
+}
+
+func readCapture(ctx context.Context, logger *logrus.Logger, path string, tracker *encryption.FlowTracker) error {
+	capture, err := replay.OpenCapture(path)
+	if err != nil {
+		return err
+	}
+	defer capture.Close()
+
+	for ctx.Err() == nil {
+		packet, err := capture.Source.NextPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			logger.Warnf("Stopped reading %s: %v", path, err)
+			return nil
+		}
+		tracker.Observe(packet)
+	}
+	return nil
+}
+
+// evaluate prints the accuracy and per-class precision and recall of the
+// model on held-out flows
+func evaluate(w io.Writer, model *encryption.FlowModel, samples []*encryption.FlowSample, labels []string) {
+	truePos := make(map[string]int)
+	predicted := make(map[string]int)
+	actual := make(map[string]int)
+	correct := 0
+	for i, sample := range samples {
+		label := model.Classify(sample).Label
+		predicted[label]++
+		actual[labels[i]]++
+		if label == labels[i] {
+			truePos[label]++
+			correct++
+		}
+	}
+
+	fmt.Fprintf(w, "Held-out accuracy: %.3f (%d flows)\n", float64(correct)/float64(len(samples)), len(samples))
+	fmt.Fprintf(w, "%-20s %9s %9s %7s\n", "class", "precision", "recall", "flows")
+	for _, class := range model.Classes {
+		var precision, recall float64
+		if predicted[class] > 0 {
+			precision = float64(truePos[class]) / float64(predicted[class])
+		}
+		if actual[class] > 0 {
+			recall = float64(truePos[class]) / float64(actual[class])
+		}
+		fmt.Fprintf(w, "%-20s %9.3f %9.3f %7d\n", class, precision, recall, actual[class])
+	}
+}
+
+func writeModel(path string, model *encryption.FlowModel) error {
+	data, err := json.MarshalIndent(model, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -3,21 +3,38 @@ package main
 import (
 	"context"
 	"flag"
+	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/Cxiyuan/NTA/internal/detector"
+	"github.com/Cxiyuan/NTA/internal/encryption"
 	"github.com/Cxiyuan/NTA/internal/kafka"
+	"github.com/Cxiyuan/NTA/internal/pipeline"
 	"github.com/Cxiyuan/NTA/internal/threatintel"
 	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
 var (
+	configFile   = flag.String("config", getEnv("NTA_CONFIG", ""), "Configuration file with detection settings (defaults if empty)")
 	kafkaBrokers = flag.String("kafka-brokers", getEnv("KAFKA_BROKERS", "localhost:9092"), "Kafka broker addresses")
+	kafkaTopics  = flag.String("kafka-topics", getEnv("KAFKA_TOPICS", "zeek-conn,zeek-dns,zeek-http,zeek-files,zeek-ssl,zeek-notice,zeek-ntlm,zeek-smb_files,zeek-smb_mapping,zeek-dce_rpc,zeek-ssh,zeek-rdp,zeek-kerberos,zeek-ldap,zeek-x509"), "Comma-separated Zeek topics")
+	kafkaDLQ     = flag.String("kafka-dlq-topic", getEnv("KAFKA_DLQ_TOPIC", kafka.DefaultDLQTopic), "Dead-letter topic for failed messages (empty to disable)")
+	kafkaGroup   = flag.String("kafka-group", getEnv("KAFKA_GROUP", "nta-consumer-group"), "Kafka consumer group")
+	workers      = flag.Int("workers", getEnvInt("CONSUMER_WORKERS", runtime.NumCPU()), "Concurrent message processors")
+	queueSize    = flag.Int("queue-size", getEnvInt("CONSUMER_QUEUE_SIZE", 1000), "Messages buffered per worker before fetching pauses")
+	commitBatch  = flag.Int("commit-batch", getEnvInt("CONSUMER_COMMIT_BATCH", 5000), "Processed messages per offset commit")
+	commitEvery  = flag.Duration("commit-interval", time.Second, "Maximum time between offset commits")
 	redisAddr    = flag.String("redis-addr", getEnv("REDIS_ADDR", "localhost:6379"), "Redis address")
 	postgresHost = flag.String("pg-host", getEnv("POSTGRES_HOST", "localhost"), "PostgreSQL host")
 	postgresPort = flag.String("pg-port", getEnv("POSTGRES_PORT", "5432"), "PostgreSQL port")
@@ -25,6 +42,7 @@ var (
 	postgresUser = flag.String("pg-user", getEnv("POSTGRES_USER", "nta"), "PostgreSQL user")
 	postgresPass = flag.String("pg-pass", getEnv("POSTGRES_PASSWORD", "nta_password"), "PostgreSQL password")
 	logLevel     = flag.String("log-level", getEnv("LOG_LEVEL", "info"), "Log level")
+	metricsAddr  = flag.String("metrics-addr", getEnv("METRICS_ADDR", ":9101"), "Prometheus metrics listen address (empty to disable)")
 )
 
 func main() {
@@ -64,37 +82,95 @@ func main() {
 
 	threatIntelService := threatintel.NewService(db, rdb, logger, []threatintel.Source{})
 
-	brokers := strings.Split(*kafkaBrokers, ",")
-
 	consumerCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	topics := []string{
-		"zeek-conn",
-		"zeek-dns",
-		"zeek-http",
-		"zeek-ssl",
-		"zeek-notice",
+	consumerCfg := kafka.DefaultConsumerConfig(strings.Split(*kafkaBrokers, ","))
+	consumerCfg.Topics = strings.Split(*kafkaTopics, ",")
+	consumerCfg.GroupID = *kafkaGroup
+	consumerCfg.DLQTopic = *kafkaDLQ
+	consumerCfg.Workers = *workers
+	consumerCfg.QueueSize = *queueSize
+	consumerCfg.CommitBatch = *commitBatch
+	consumerCfg.CommitInterval = *commitEvery
+
+	cfg := config.DefaultConfig()
+	if *configFile != "" {
+		cfg, err = config.LoadConfig(*configFile)
+		if err != nil {
+			logger.Fatalf("Failed to load config: %v", err)
+		}
 	}
 
-	for _, topic := range topics {
-		consumer := kafka.NewConsumer(brokers, topic, "nta-consumer-group", db, logger, threatIntelService)
-		go func(t string, c *kafka.Consumer) {
-			logger.Infof("Starting consumer for topic: %s", t)
-			if err := c.Start(consumerCtx); err != nil {
-				logger.Errorf("Consumer error for topic %s: %v", t, err)
+	assetInventory := detector.NewAssetInventory(db, logger)
+	go assetInventory.Run(consumerCtx, 5*time.Minute)
+	detectors := detector.NewDefaultRegistry(logger, threatIntelService, assetInventory, detector.NewBaselineStore(rdb))
+	detectionConfig := detector.NewConfigStore(rdb, cfg.Detection, logger)
+	if err := detectionConfig.Reload(ctx, detectors); err != nil {
+		logger.Fatalf("Failed to load detection config: %v", err)
+	}
+	go detectionConfig.Watch(consumerCtx, detectors)
+
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-consumerCtx.Done():
+				return
+			case <-ticker.C:
+				detectors.Cleanup()
 			}
-		}(topic, consumer)
+		}
+	}()
+
+	// The server syncs the fingerprint feeds and applies API changes; reload
+	// what it stored whenever it publishes an update
+	fingerprintStore := encryption.NewFingerprintStore(db, logger)
+	fingerprintStore.SetRedis(rdb)
+	go fingerprintStore.Watch(consumerCtx, time.Hour)
+
+	go fingerprintStore.PersistLastSeen(consumerCtx, time.Minute)
+	tlsAnalyzer := encryption.NewAnalyzer(logger, fingerprintStore)
+	tlsAnalyzer.SetCertificateStore(encryption.NewCertificateStore(db))
+	processor := pipeline.NewProcessor(db, logger, detectors, tlsAnalyzer)
+	if flowClassifier := encryption.LoadFlowClassifier(logger, cfg.Detection.FlowModel); flowClassifier != nil {
+		processor.SetFlowClassifier(flowClassifier)
+	}
+	consumer, err := kafka.NewConsumer(consumerCfg, processor, logger)
+	if err != nil {
+		logger.Fatalf("Failed to create consumer: %v", err)
 	}
 
-	logger.Info("Kafka consumers started successfully")
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := consumer.Start(consumerCtx); err != nil {
+			logger.Errorf("Consumer error: %v", err)
+		}
+	}()
+
+	logger.Info("Kafka consumer started successfully")
+
+	if *metricsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			logger.Infof("Serving metrics on %s", *metricsAddr)
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				logger.Errorf("Metrics server error: %v", err)
+			}
+		}()
+	}
 
 	sigterm := make(chan os.Signal, 1)
 	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
 	<-sigterm
 
-	logger.Info("Shutting down consumers...")
+	logger.Info("Shutting down consumer...")
 	cancel()
+	<-stopped
+	processor.Close()
 }
 
 func getEnv(key, defaultValue string) string {
@@ -102,4 +178,10 @@ func getEnv(key, defaultValue string) string {
 		return value
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
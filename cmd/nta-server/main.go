@@ -6,16 +6,19 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/Cxiyuan/NTA/internal/analyzer"
 	"github.com/Cxiyuan/NTA/internal/api"
 	"github.com/Cxiyuan/NTA/internal/asset"
 	"github.com/Cxiyuan/NTA/internal/audit"
 	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/Cxiyuan/NTA/internal/detector"
+	"github.com/Cxiyuan/NTA/internal/encryption"
 	"github.com/Cxiyuan/NTA/internal/kafka"
 	"github.com/Cxiyuan/NTA/internal/license"
+	"github.com/Cxiyuan/NTA/internal/pipeline"
 	"github.com/Cxiyuan/NTA/internal/probe"
 	"github.com/Cxiyuan/NTA/internal/threatintel"
 	"github.com/Cxiyuan/NTA/internal/zeek"
@@ -100,6 +103,10 @@ func main() {
 		&models.Report{},
 		&models.NotificationConfig{},
 		&models.PCAPSession{},
+		&models.Connection{},
+		&models.TLSFingerprint{},
+		&models.TLSHandshake{},
+		&models.Certificate{},
 	)
 
 	// Initialize default admin user if not exists
@@ -270,18 +277,72 @@ func main() {
 		cfg.ThreatIntel.UpdateHour,
 	)
 	
+	fingerprintStore := encryption.NewFingerprintStore(db, logger)
+	// Kafka consumers reload the fingerprints when changes are published
+	fingerprintStore.SetRedis(rdb)
+	if err := fingerprintStore.Load(ctx); err != nil {
+		logger.Errorf("Failed to load TLS fingerprints: %v", err)
+	}
+	fingerprintSyncer := encryption.NewFingerprintSyncer(fingerprintStore, logger, cfg.ThreatIntel.TLSFingerprints)
+
 	probeManager := probe.NewManager(db, rdb, logger)
 	auditService := audit.NewService(db, logger)
 	reportService := report.NewService(db, logger, "/var/lib/nta/reports")
 	notifyService := notification.NewService(db, logger)
 	pcapStorage := pcap.NewStorage(db, logger, "/var/lib/nta/pcap")
 	zeekManager := zeek.NewManager(db, logger)
-	_ = zeek.NewLogParser("/var/lib/nta/zeek-logs", logger)
+
+	// Detection settings can be changed at runtime through the API
+	detectionConfig := detector.NewConfigStore(rdb, cfg.Detection, logger)
+	assetInventory := detector.NewAssetInventory(db, logger)
+	go assetInventory.Run(ctx, 5*time.Minute)
+	detectors := detector.NewDefaultRegistry(logger, threatIntelService, assetInventory, detector.NewBaselineStore(rdb))
+	if err := detectionConfig.Reload(ctx, detectors); err != nil {
+		logger.Errorf("Failed to load detection config: %v", err)
+	}
+	go detectionConfig.Watch(ctx, detectors)
+
+	tlsAnalyzer := encryption.NewAnalyzer(logger, fingerprintStore)
+	tlsAnalyzer.SetCertificateStore(encryption.NewCertificateStore(db))
+	processor := pipeline.NewProcessor(db, logger, detectors, tlsAnalyzer)
+	defer processor.Close()
+
+	// Classify encrypted flows by packet lengths and timing to weigh the
+	// confidence of alerts on them, when a model is configured or built in
+	flowClassifier := encryption.LoadFlowClassifier(logger, cfg.Detection.FlowModel)
+
+	// Fingerprint TLS handshakes in captured traffic, so probes without the
+	// Zeek ja3 and ja4 packages still get JA3/JA4 matching. The asset
+	// scanner's capture of the monitored interface is the only live capture
+	// the server runs, so it feeds the trackers.
+	handshakes := encryption.NewHandshakeTracker(logger, func(hs *models.TLSHandshake) {
+		if err := processor.ProcessHandshake(ctx, hs); err != nil {
+			logger.Errorf("Failed to process TLS handshake %s:%d -> %s:%d: %v",
+				hs.SrcIP, hs.SrcPort, hs.DstIP, hs.DstPort, err)
+		}
+	})
+	assetScanner.AddPacketHandler(handshakes.Observe)
+	if flowClassifier != nil {
+		processor.SetFlowClassifier(flowClassifier)
+		flows := encryption.NewFlowTracker(logger, flowClassifier.Packets(), flowClassifier.Observe)
+		assetScanner.AddPacketHandler(flows.Observe)
+	}
+
+	// Tail Zeek logs directly when running without Kafka
+	if cfg.Zeek.TailLogs {
+		tailer := zeek.NewTailer(cfg.Zeek.LogDir, cfg.Zeek.CheckpointFile, nil, logger)
+		tailer.SetSync(processor.Sync)
+		go func() {
+			if err := tailer.Run(ctx, processor.Process); err != nil {
+				logger.Errorf("Zeek log tailer stopped: %v", err)
+			}
+		}()
+	}
 	
 	// Initialize Kafka manager (Flink removed - not using stream processing)
 	kafkaManager := kafka.NewManager(
-		"localhost:9092",
-		"",
+		strings.Join(cfg.Kafka.Brokers, ","),
+		cfg.Kafka.DLQTopic,
 		logger,
 	)
 
@@ -296,19 +357,12 @@ func main() {
 		}
 	}()
 
-	// Initialize analyzers
-	lateralDetector := analyzer.NewLateralMovementDetector(
-		logger,
-		cfg.Detection.Scan.Threshold,
-		cfg.Detection.Scan.TimeWindow,
-	)
-
 	// Start background tasks
 	go func() {
 		ticker := time.NewTicker(30 * time.Second)
 		defer ticker.Stop()
 		for range ticker.C {
-			lateralDetector.Cleanup()
+			detectors.Cleanup()
 		}
 	}()
 
@@ -329,6 +383,8 @@ func main() {
 	}()
 
 	go feedSyncer.Start(ctx)
+	go fingerprintSyncer.Start(ctx)
+	go fingerprintStore.PersistLastSeen(ctx, time.Minute)
 
 	go probeManager.StartHealthCheck(ctx, 30*time.Second)
 
@@ -353,6 +409,8 @@ func main() {
 		pcapStorage,
 		zeekManager,
 		kafkaManager,
+		detectionConfig,
+		fingerprintStore,
 		cfg.Security.JWTSecret,
 	)
 
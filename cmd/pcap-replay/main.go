@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/Cxiyuan/NTA/internal/replay"
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/sirupsen/logrus"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+var (
+	configFile = flag.String("config", "", "Configuration file path (detection thresholds and database)")
+	outputFile = flag.String("output", "", "Write alerts as JSON to this file ('-' for stdout)")
+	writeDB    = flag.Bool("db", false, "Write alerts to the database configured in -config")
+	logLevel   = flag.String("log-level", "info", "Log level (debug, info, warn, error)")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] capture.pcap [capture2.pcapng ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	logger := logrus.New()
+	level, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		level = logrus.InfoLevel
+	}
+	logger.SetLevel(level)
+	logger.SetOutput(os.Stderr)
+	logger.SetFormatter(&logrus.TextFormatter{
+		FullTimestamp: true,
+	})
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *outputFile == "" && !*writeDB {
+		*outputFile = "-"
+	}
+
+	cfg := config.DefaultConfig()
+	if *configFile != "" {
+		cfg, err = config.LoadConfig(*configFile)
+		if err != nil {
+			logger.Fatalf("Failed to load config: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		logger.Warn("Interrupted, finishing with packets read so far")
+		cancel()
+	}()
+
+	replayer := replay.NewReplayer(logger, cfg)
+	for _, path := range flag.Args() {
+		if err := replayer.ReplayFile(ctx, path); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			logger.Fatalf("Failed to replay %s: %v", path, err)
+		}
+	}
+
+	alerts, stats := replayer.Finish()
+	logger.Infof("Replay finished: %d files, %d packets, %d connections, %d DNS queries, %d TLS handshakes, %d alerts",
+		stats.Files, stats.Packets, stats.Connections, stats.DNSQueries, stats.Handshakes, stats.Alerts)
+
+	if *outputFile != "" {
+		if err := writeJSON(*outputFile, alerts, stats); err != nil {
+			logger.Fatalf("Failed to write alerts: %v", err)
+		}
+	}
+
+	if *writeDB {
+		db, err := gorm.Open(postgres.Open(cfg.Database.DSN), &gorm.Config{})
+		if err != nil {
+			logger.Fatalf("Failed to connect to database: %v", err)
+		}
+		if len(alerts) > 0 {
+			if err := db.CreateInBatches(alerts, 100).Error; err != nil {
+				logger.Fatalf("Failed to store alerts: %v", err)
+			}
+		}
+		logger.Infof("Stored %d alerts in database", len(alerts))
+	}
+}
+
+func writeJSON(path string, alerts []*models.Alert, stats replay.Stats) error {
+	out := os.Stdout
+	if path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if alerts == nil {
+		alerts = []*models.Alert{}
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(map[string]interface{}{
+		"stats":  stats,
+		"alerts": alerts,
+	})
+}
@@ -242,7 +242,7 @@ server:
   mode: release
 
 zeek:
-  log_dir: /var/spool/zeek
+  log_dir: /opt/zeek/logs
   script_dir: $INSTALL_DIR/zeek-scripts
   interface: eth0
 
@@ -574,7 +574,7 @@ show_native_help() {
     echo ""
     echo "日志查看:"
     echo "  系统日志:    journalctl -u nta-server -f"
-    echo "  Zeek日志:    tail -f /var/spool/zeek/current/*.log"
+    echo "  Zeek日志:    tail -f /opt/zeek/logs/current/*.log"
     echo ""
     echo "访问地址:"
     echo "  API Server: http://$(hostname -I | awk '{print $1}'):8080"
@@ -0,0 +1,374 @@
+package analyzer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/Cxiyuan/NTA/pkg/recency"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxBeaconSamples caps the connections kept per pair whose intervals
+	// look periodic
+	maxBeaconSamples = 256
+	// beaconProbeSamples caps the connections kept per pair not showing
+	// periodicity yet, which is most of them
+	beaconProbeSamples = 32
+	// beaconPeriodicScore is the interval score from which a pair keeps
+	// maxBeaconSamples connections
+	beaconPeriodicScore = 0.6
+	// maxBeaconPairs caps the pairs tracked at once; the least recently
+	// seen pair of a shard is evicted beyond its share
+	maxBeaconPairs = 100000
+	// beaconShards spreads pairs over separately locked shards
+	beaconShards = 64
+	// beaconEvalEvery is how many new connections trigger a re-evaluation
+	// once a pair has enough history
+	beaconEvalEvery = 5
+)
+
+// beaconIgnoredPorts carry legitimately periodic protocol chatter
+var beaconIgnoredPorts = map[int]bool{
+	53:   true, // DNS
+	123:  true, // NTP
+	137:  true, // NetBIOS name service
+	138:  true, // NetBIOS datagram
+	1900: true, // SSDP
+	5353: true, // mDNS
+}
+
+// BeaconAnalyzer keeps a bounded connection history per source,
+// destination and port and scores how periodic it is. Intervals are judged
+// by their skew, median absolute deviation and the share falling within the
+// jitter tolerance, so beacons with randomized sleep still score.
+type BeaconAnalyzer struct {
+	logger *logrus.Logger
+	shards [beaconShards]beaconShard
+
+	// mu guards the settings
+	mu       sync.RWMutex
+	settings beaconSettings
+}
+
+type beaconShard struct {
+	mu     sync.Mutex
+	pairs  map[beaconKey]*beaconHistory
+	recent *recency.List[beaconKey]
+}
+
+type beaconSettings struct {
+	minConnections int
+	minScore       float64
+	jitter         float64
+	minSpan        time.Duration
+}
+
+type beaconKey struct {
+	src  string
+	dst  string
+	port int
+}
+
+type beaconHistory struct {
+	samples  []beaconSample
+	lastSeen time.Time
+	pending  int
+	alerted  bool
+	// periodic is set while the last evaluation found periodic intervals,
+	// allowing the pair maxBeaconSamples connections
+	periodic bool
+}
+
+type beaconSample struct {
+	ts    time.Time
+	bytes int64
+}
+
+// beaconScore describes the periodicity of one pair
+type beaconScore struct {
+	connections int
+	period      time.Duration
+	// jitter is the median absolute deviation relative to the period
+	jitter        float64
+	intervalScore float64
+	sizeScore     float64
+	countScore    float64
+	score         float64
+	medianBytes   int64
+	spanHours     float64
+}
+
+// NewBeaconAnalyzer creates an analyzer alerting on pairs with at least
+// minConnections connections scoring minScore or more. jitter is the
+// relative deviation from the period still counted as on time and minSpan
+// the history needed for a full count score.
+func NewBeaconAnalyzer(logger *logrus.Logger, minConnections int, minScore, jitter float64, minSpan time.Duration) *BeaconAnalyzer {
+	a := &BeaconAnalyzer{
+		logger: logger,
+		settings: beaconSettings{
+			minConnections: minConnections,
+			minScore:       minScore,
+			jitter:         jitter,
+			minSpan:        minSpan,
+		},
+	}
+	for i := range a.shards {
+		a.shards[i].pairs = make(map[beaconKey]*beaconHistory)
+		a.shards[i].recent = recency.New[beaconKey]()
+	}
+	return a
+}
+
+// SetThresholds updates the analyzer settings
+func (a *BeaconAnalyzer) SetThresholds(minConnections int, minScore, jitter float64, minSpan time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.settings = beaconSettings{
+		minConnections: minConnections,
+		minScore:       minScore,
+		jitter:         jitter,
+		minSpan:        minSpan,
+	}
+}
+
+// Observe records a connection and returns an alert when its pair starts
+// beaconing
+func (a *BeaconAnalyzer) Observe(conn *models.Connection) *models.Alert {
+	if conn.SrcIP == "" || conn.DstIP == "" || beaconIgnoredPorts[conn.DstPort] {
+		return nil
+	}
+
+	a.mu.RLock()
+	settings := a.settings
+	a.mu.RUnlock()
+
+	key := beaconKey{src: conn.SrcIP, dst: conn.DstIP, port: conn.DstPort}
+	shard := a.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := conn.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	history, exists := shard.pairs[key]
+	if !exists {
+		if len(shard.pairs) >= maxBeaconPairs/beaconShards {
+			shard.evictOldest()
+		}
+		history = &beaconHistory{}
+		shard.pairs[key] = history
+	}
+	shard.recent.Touch(key)
+	if now.After(history.lastSeen) {
+		history.lastSeen = now
+	}
+
+	history.samples = append(history.samples, beaconSample{ts: now, bytes: conn.OrigBytes})
+	history.trim(settings)
+	history.pending++
+
+	if history.alerted || len(history.samples) < settings.minConnections || history.pending < beaconEvalEvery {
+		return nil
+	}
+	history.pending = 0
+
+	score := settings.score(history.samples)
+	history.periodic = score != nil && score.intervalScore >= beaconPeriodicScore
+	if score == nil || score.score < settings.minScore {
+		history.trim(settings)
+		return nil
+	}
+	history.alerted = true
+
+	a.logger.Warnf("Beacon detected: %s -> %s:%d (period %s, jitter %.2f, score %.2f)",
+		conn.SrcIP, conn.DstIP, conn.DstPort, score.period, score.jitter, score.score)
+
+	return &models.Alert{
+		Timestamp:  now,
+		Severity:   "high",
+		Type:       "c2_beacon",
+		SrcIP:      conn.SrcIP,
+		DstIP:      conn.DstIP,
+		DstPort:    conn.DstPort,
+		Protocol:   conn.Protocol,
+		Confidence: score.score,
+		Description: fmt.Sprintf("检测到C2信标通信: 周期%s, 抖动%.0f%%, %d次连接",
+			score.period, score.jitter*100, score.connections),
+		Details: marshalDetails(map[string]interface{}{
+			"period_seconds": round(score.period.Seconds(), 1),
+			"jitter":         round(score.jitter, 3),
+			"connections":    score.connections,
+			"span_hours":     round(score.spanHours, 2),
+			"median_bytes":   score.medianBytes,
+			"interval_score": round(score.intervalScore, 3),
+			"size_score":     round(score.sizeScore, 3),
+			"count_score":    round(score.countScore, 3),
+		}),
+	}
+}
+
+// Cleanup forgets pairs that have been quiet since before cutoff
+func (a *BeaconAnalyzer) Cleanup(cutoff time.Time) {
+	for i := range a.shards {
+		shard := &a.shards[i]
+		shard.mu.Lock()
+		for key, history := range shard.pairs {
+			if history.lastSeen.Before(cutoff) {
+				delete(shard.pairs, key)
+				shard.recent.Remove(key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// shard returns the shard tracking a pair
+func (a *BeaconAnalyzer) shard(key beaconKey) *beaconShard {
+	h := fnv.New32a()
+	h.Write([]byte(key.src))
+	h.Write([]byte(key.dst))
+	return &a.shards[h.Sum32()%beaconShards]
+}
+
+func (s *beaconShard) evictOldest() {
+	if oldest, ok := s.recent.Oldest(); ok {
+		delete(s.pairs, oldest)
+		s.recent.Remove(oldest)
+	}
+}
+
+// trim drops the oldest connections beyond the pair's cap. Pairs not
+// showing periodicity keep only enough connections to be evaluated.
+func (h *beaconHistory) trim(settings beaconSettings) {
+	limit := maxBeaconSamples
+	if !h.periodic {
+		limit = max(beaconProbeSamples, settings.minConnections+beaconEvalEvery)
+	}
+	if len(h.samples) > limit {
+		h.samples = append(h.samples[:0], h.samples[len(h.samples)-limit:]...)
+	}
+}
+
+// score rates the periodicity of a history. It returns nil when there are
+// too few distinct check-ins to judge.
+func (settings beaconSettings) score(samples []beaconSample) *beaconScore {
+	sorted := make([]beaconSample, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ts.Before(sorted[j].ts) })
+
+	// Connections opened within a second belong to the same check-in
+	var intervals, sizes []float64
+	for i, sample := range sorted {
+		sizes = append(sizes, float64(sample.bytes))
+		if i == 0 {
+			continue
+		}
+		if gap := sample.ts.Sub(sorted[i-1].ts).Seconds(); gap >= 1 {
+			intervals = append(intervals, gap)
+		}
+	}
+	if len(intervals) == 0 || len(intervals) < settings.minConnections-1 {
+		return nil
+	}
+
+	period := median(intervals)
+	intervalMAD := medianAbsoluteDeviation(intervals, period)
+	onTime := 0
+	for _, interval := range intervals {
+		if math.Abs(interval-period) <= settings.jitter*period {
+			onTime++
+		}
+	}
+	skewScore := 1 - math.Abs(bowleySkew(intervals))
+	madScore := clamp01(1 - intervalMAD/period)
+	jitterScore := float64(onTime) / float64(len(intervals))
+	intervalScore := (skewScore + madScore + jitterScore) / 3
+
+	// Beacons send near identical check-ins
+	medianSize := median(sizes)
+	sizeScore := 1 - math.Abs(bowleySkew(sizes))
+	if medianSize > 0 {
+		sizeScore = (sizeScore + clamp01(1-medianAbsoluteDeviation(sizes, medianSize)/medianSize)) / 2
+	}
+
+	// Long-haul beacons keep calling every hour they are observed
+	span := sorted[len(sorted)-1].ts.Sub(sorted[0].ts)
+	hours := make(map[int64]bool)
+	for _, sample := range sorted {
+		hours[sample.ts.Unix()/3600] = true
+	}
+	spanHours := math.Ceil(span.Hours())
+	coverage := 1.0
+	if spanHours > 0 && period < 3600 {
+		coverage = math.Min(float64(len(hours))/spanHours, 1)
+	}
+	countScore := coverage
+	if settings.minSpan > 0 {
+		countScore *= clamp01(span.Seconds() / settings.minSpan.Seconds())
+	}
+
+	return &beaconScore{
+		connections:   len(sorted),
+		period:        time.Duration(period * float64(time.Second)).Round(time.Second),
+		jitter:        intervalMAD / period,
+		intervalScore: intervalScore,
+		sizeScore:     sizeScore,
+		countScore:    countScore,
+		score:         0.5*intervalScore + 0.25*sizeScore + 0.25*countScore,
+		medianBytes:   int64(medianSize),
+		spanHours:     span.Hours(),
+	}
+}
+
+// median returns the median of values, which must not be empty
+func median(values []float64) float64 {
+	return quantile(values, 0.5)
+}
+
+// quantile returns the q-quantile of values by linear interpolation
+func quantile(values []float64, q float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	pos := q * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	upper := int(math.Ceil(pos))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(pos-float64(lower))
+}
+
+func medianAbsoluteDeviation(values []float64, center float64) float64 {
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - center)
+	}
+	return median(deviations)
+}
+
+// bowleySkew is the quartile skewness of values, between -1 and 1. It is 0
+// for symmetric and for constant data.
+func bowleySkew(values []float64) float64 {
+	q1, q2, q3 := quantile(values, 0.25), quantile(values, 0.5), quantile(values, 0.75)
+	if q3 == q1 || q2 == q1 || q2 == q3 {
+		return 0
+	}
+	return (q3 + q1 - 2*q2) / (q3 - q1)
+}
+
+// round rounds v to the given number of decimals
+func round(v float64, decimals int) float64 {
+	p := math.Pow(10, float64(decimals))
+	return math.Round(v*p) / p
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(v, 1))
+}
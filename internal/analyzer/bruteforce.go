@@ -0,0 +1,281 @@
+package analyzer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+// AuthAttempt is one authentication outcome taken from a protocol log
+type AuthAttempt struct {
+	Timestamp time.Time
+	SrcIP     string
+	DstIP     string
+	DstPort   int
+	Protocol  string // ssh, rdp, ntlm, kerberos, ldap
+	// Account may be empty when the protocol does not reveal it (ssh)
+	Account string
+	// Failures is the number of failed attempts, which can be more than
+	// one for a single ssh connection
+	Failures int
+	Success  bool
+}
+
+// BruteForceDetector counts authentication failures per source, protocol
+// and account within a sliding window. It tells brute force (one account,
+// many attempts) from password spraying (many accounts, few attempts each)
+// and raises a correlated alert when a failure streak ends in success.
+type BruteForceDetector struct {
+	mu            sync.Mutex
+	logger        *logrus.Logger
+	sources       map[string]*authSource
+	failThreshold int
+	sprayAccounts int
+	window        time.Duration
+}
+
+// authSource tracks one source address on one protocol
+type authSource struct {
+	accounts     map[string]*authAccount
+	lastSeen     time.Time
+	sprayAlerted bool
+}
+
+type authAccount struct {
+	name     string
+	failures []time.Time
+	targets  map[string]bool
+	alerted  bool
+}
+
+// NewBruteForceDetector creates a detector raising brute force alerts at
+// failThreshold failures per account and spraying alerts at sprayAccounts
+// accounts within window
+func NewBruteForceDetector(logger *logrus.Logger, failThreshold, sprayAccounts int, window time.Duration) *BruteForceDetector {
+	return &BruteForceDetector{
+		logger:        logger,
+		sources:       make(map[string]*authSource),
+		failThreshold: failThreshold,
+		sprayAccounts: sprayAccounts,
+		window:        window,
+	}
+}
+
+// SetThresholds updates the detector settings
+func (d *BruteForceDetector) SetThresholds(failThreshold, sprayAccounts int, window time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.failThreshold = failThreshold
+	d.sprayAccounts = sprayAccounts
+	d.window = window
+}
+
+// Observe records an authentication outcome and returns the alerts it
+// completes
+func (d *BruteForceDetector) Observe(attempt AuthAttempt) []*models.Alert {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := attempt.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	sourceKey := attempt.SrcIP + "|" + attempt.Protocol
+	src, exists := d.sources[sourceKey]
+	if !exists || now.Sub(src.lastSeen) > d.window {
+		src = &authSource{accounts: make(map[string]*authAccount)}
+		d.sources[sourceKey] = src
+	}
+	if now.After(src.lastSeen) {
+		src.lastSeen = now
+	}
+
+	// Without an account name, attempts against the same target are
+	// assumed to be for the same account
+	accountKey := "account:" + attempt.Account
+	if attempt.Account == "" {
+		accountKey = "target:" + attempt.DstIP
+	}
+	account, exists := src.accounts[accountKey]
+	if !exists {
+		account = &authAccount{name: attempt.Account, targets: make(map[string]bool)}
+		src.accounts[accountKey] = account
+	}
+	account.targets[attempt.DstIP] = true
+	for i := 0; i < attempt.Failures; i++ {
+		account.failures = append(account.failures, now)
+	}
+
+	d.slide(src, now)
+
+	var alerts []*models.Alert
+	if attempt.Success {
+		if len(account.failures) >= d.failThreshold || (src.sprayAlerted && len(account.failures) > 0) {
+			alerts = append(alerts, d.successAlert(attempt, account))
+		}
+		delete(src.accounts, accountKey)
+		return alerts
+	}
+
+	if !account.alerted && len(account.failures) >= d.failThreshold {
+		account.alerted = true
+		alerts = append(alerts, d.bruteForceAlert(attempt, account))
+	}
+
+	if !src.sprayAlerted {
+		if sprayed := d.sprayedAccounts(src); len(sprayed) >= d.sprayAccounts {
+			src.sprayAlerted = true
+			alerts = append(alerts, d.sprayAlert(attempt, sprayed))
+		}
+	}
+
+	return alerts
+}
+
+// Cleanup forgets sources that have been quiet since before cutoff
+func (d *BruteForceDetector) Cleanup(cutoff time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, src := range d.sources {
+		if src.lastSeen.Before(cutoff) {
+			delete(d.sources, key)
+		}
+	}
+}
+
+// slide drops failures that fell out of the window
+func (d *BruteForceDetector) slide(src *authSource, now time.Time) {
+	cutoff := now.Add(-d.window)
+	for key, account := range src.accounts {
+		i := 0
+		for i < len(account.failures) && account.failures[i].Before(cutoff) {
+			i++
+		}
+		account.failures = account.failures[i:]
+		if len(account.failures) == 0 && !account.alerted {
+			delete(src.accounts, key)
+		}
+	}
+}
+
+// sprayedAccounts returns the named accounts with failures that stayed
+// below the brute force threshold
+func (d *BruteForceDetector) sprayedAccounts(src *authSource) []*authAccount {
+	var sprayed []*authAccount
+	for _, account := range src.accounts {
+		if account.name == "" || len(account.failures) == 0 || len(account.failures) >= d.failThreshold {
+			continue
+		}
+		sprayed = append(sprayed, account)
+	}
+	return sprayed
+}
+
+func (d *BruteForceDetector) bruteForceAlert(attempt AuthAttempt, account *authAccount) *models.Alert {
+	d.logger.Warnf("Brute force detected: %s -> %s (%s, %d failures)",
+		attempt.SrcIP, attempt.DstIP, attempt.Protocol, len(account.failures))
+
+	return &models.Alert{
+		Timestamp:   attempt.Timestamp,
+		Severity:    "high",
+		Type:        "brute_force",
+		SrcIP:       attempt.SrcIP,
+		DstIP:       attempt.DstIP,
+		DstPort:     attempt.DstPort,
+		Protocol:    attempt.Protocol,
+		Description: fmt.Sprintf("检测到%s暴力破解: %d次失败认证", attempt.Protocol, len(account.failures)),
+		Confidence:  0.85,
+		Details: marshalDetails(map[string]interface{}{
+			"account":  account.name,
+			"failures": len(account.failures),
+			"targets":  sortedKeys(account.targets),
+		}),
+	}
+}
+
+func (d *BruteForceDetector) sprayAlert(attempt AuthAttempt, sprayed []*authAccount) *models.Alert {
+	names := make([]string, 0, len(sprayed))
+	targets := make(map[string]bool)
+	failures := 0
+	for _, account := range sprayed {
+		names = append(names, account.name)
+		for target := range account.targets {
+			targets[target] = true
+		}
+		failures += len(account.failures)
+	}
+	sort.Strings(names)
+	if len(names) > maxListedTargets {
+		names = names[:maxListedTargets]
+	}
+
+	d.logger.Warnf("Password spraying detected: %s (%s, %d accounts)", attempt.SrcIP, attempt.Protocol, len(sprayed))
+
+	alert := &models.Alert{
+		Timestamp:   attempt.Timestamp,
+		Severity:    "high",
+		Type:        "password_spray",
+		SrcIP:       attempt.SrcIP,
+		Protocol:    attempt.Protocol,
+		Description: fmt.Sprintf("检测到%s密码喷洒: %d个账户认证失败", attempt.Protocol, len(sprayed)),
+		Confidence:  0.8,
+		Details: marshalDetails(map[string]interface{}{
+			"accounts": names,
+			"failures": failures,
+			"targets":  sortedKeys(targets),
+		}),
+	}
+	if len(targets) == 1 {
+		alert.DstIP = attempt.DstIP
+		alert.DstPort = attempt.DstPort
+	}
+	return alert
+}
+
+func (d *BruteForceDetector) successAlert(attempt AuthAttempt, account *authAccount) *models.Alert {
+	d.logger.Warnf("Authentication succeeded after failures: %s -> %s (%s, %d failures)",
+		attempt.SrcIP, attempt.DstIP, attempt.Protocol, len(account.failures))
+
+	return &models.Alert{
+		Timestamp:   attempt.Timestamp,
+		Severity:    "critical",
+		Type:        "brute_force_success",
+		SrcIP:       attempt.SrcIP,
+		DstIP:       attempt.DstIP,
+		DstPort:     attempt.DstPort,
+		Protocol:    attempt.Protocol,
+		Description: fmt.Sprintf("%s暴力破解后认证成功: %d次失败后登录", attempt.Protocol, len(account.failures)),
+		Confidence:  0.95,
+		Details: marshalDetails(map[string]interface{}{
+			"account":  attempt.Account,
+			"failures": len(account.failures),
+			"targets":  sortedKeys(account.targets),
+		}),
+	}
+}
+
+// marshalDetails encodes alert details as JSON
+func marshalDetails(details map[string]interface{}) string {
+	data, _ := json.Marshal(details)
+	return string(data)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) > maxListedTargets {
+		keys = keys[:maxListedTargets]
+	}
+	return keys
+}
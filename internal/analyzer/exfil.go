@@ -0,0 +1,617 @@
+package analyzer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxBaselineWeeks is the number of past totals kept per hour of week
+	// for a host
+	maxBaselineWeeks = 8
+	// maxGroupSamples is the number of past host totals kept per hour of
+	// week for a host group
+	maxGroupSamples = 64
+	// maxKnownDestinations caps the destinations remembered per host
+	maxKnownDestinations = 1000
+	// baselineStoreTimeout bounds baseline loads and saves
+	baselineStoreTimeout = 2 * time.Second
+	// baselineLoadQueue bounds the baseline loads waiting for the store;
+	// hosts that find it full are queued again on their next connection
+	baselineLoadQueue = 4096
+	// baselineLoaders is the number of concurrent baseline loads
+	baselineLoaders = 4
+)
+
+// BaselineStore persists traffic baselines. LoadBaseline returns nil
+// without error when nothing is stored under key.
+type BaselineStore interface {
+	LoadBaseline(ctx context.Context, key string) (*TrafficBaseline, error)
+	SaveBaseline(ctx context.Context, key string, baseline *TrafficBaseline) error
+}
+
+// TrafficBaseline holds the outbound byte totals of past hours by hour of
+// week, 0 being Sunday 00:00 in the configured time zone
+type TrafficBaseline struct {
+	// Hours holds the most recent totals per hour of week, oldest first
+	Hours map[int][]int64 `json:"hours"`
+	// Destinations holds when a host last sent data to each external
+	// address; it is empty for groups
+	Destinations map[string]time.Time `json:"destinations,omitempty"`
+}
+
+func newTrafficBaseline() *TrafficBaseline {
+	return &TrafficBaseline{
+		Hours:        make(map[int][]int64),
+		Destinations: make(map[string]time.Time),
+	}
+}
+
+// ExfilSettings configures ExfilDetector
+type ExfilSettings struct {
+	// MinBytes is the hourly outbound volume always tolerated
+	MinBytes int64
+	// Factor is how far above the 95th percentile of its baseline a host
+	// must go
+	Factor   float64
+	MinScore float64
+	// MinHistory is the number of past totals needed to trust a baseline
+	MinHistory int
+	// BusinessStart and BusinessEnd are hours of the day; equal values
+	// disable the off-hours check
+	BusinessStart int
+	BusinessEnd   int
+	// WorkDays are the working days, empty for every day
+	WorkDays []time.Weekday
+	Location *time.Location
+}
+
+// ExfilDetector compares the hourly volume each internal host sends to
+// external addresses with the host's own history for that hour of the
+// week, falling back to its group's history for new hosts. Sending to a
+// destination the host never used before and sending outside business
+// hours raise the score, so recurring jobs such as backups stay quiet.
+type ExfilDetector struct {
+	mu       sync.Mutex
+	logger   *logrus.Logger
+	store    BaselineStore
+	groupOf  func(ip string) string
+	settings ExfilSettings
+	hosts    map[string]*exfilHost
+	groups   map[string]*exfilGroup
+	// loads feeds the stored baselines of new hosts and groups to a
+	// loader, so the store is never waited on while observing
+	loads    chan string
+	loadOnce sync.Once
+}
+
+// baselineState tracks whether the stored baseline of a host or group was
+// merged in. Baselines are not saved before, so the stored history is
+// never replaced by a partial one.
+type baselineState struct {
+	loaded bool
+	queued bool
+}
+
+type exfilHost struct {
+	baselineState
+	baseline *TrafficBaseline
+	group    string
+	// hour is the unix hour being accumulated
+	hour  int64
+	bytes int64
+	// newDestinations are destinations first seen in the current hour
+	newDestinations map[string]int64
+	alerted         bool
+	dirty           bool
+	lastSeen        time.Time
+}
+
+type exfilGroup struct {
+	baselineState
+	baseline *TrafficBaseline
+	dirty    bool
+}
+
+// NewExfilDetector creates a detector. store may be nil to keep baselines
+// in memory only; groupOf maps a host to its group and may be nil.
+func NewExfilDetector(logger *logrus.Logger, store BaselineStore, groupOf func(ip string) string, settings ExfilSettings) *ExfilDetector {
+	return &ExfilDetector{
+		logger:   logger,
+		store:    store,
+		groupOf:  groupOf,
+		settings: settings,
+		hosts:    make(map[string]*exfilHost),
+		groups:   make(map[string]*exfilGroup),
+		loads:    make(chan string, baselineLoadQueue),
+	}
+}
+
+// SetSettings updates the detector settings
+func (d *ExfilDetector) SetSettings(settings ExfilSettings) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.settings = settings
+}
+
+// Observe records a connection and returns an alert when its source sends
+// more than its baseline allows
+func (d *ExfilDetector) Observe(conn *models.Connection) *models.Alert {
+	if conn.OrigBytes <= 0 || !isInternalIP(conn.SrcIP) || isInternalIP(conn.DstIP) {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := conn.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	host := d.host(conn.SrcIP)
+	d.requestBaselines(conn.SrcIP, host)
+	d.roll(host, now.Unix()/3600)
+	host.bytes += conn.OrigBytes
+	if now.After(host.lastSeen) {
+		host.lastSeen = now
+	}
+
+	if _, known := host.baseline.Destinations[conn.DstIP]; !known {
+		host.newDestinations[conn.DstIP] = 0
+		d.rememberDestination(host.baseline)
+	}
+	host.baseline.Destinations[conn.DstIP] = now
+	host.dirty = true
+	if _, isNew := host.newDestinations[conn.DstIP]; isNew {
+		host.newDestinations[conn.DstIP] += conn.OrigBytes
+	}
+
+	if host.alerted || host.bytes <= d.settings.MinBytes {
+		return nil
+	}
+
+	local := now.In(d.location())
+	expected, source := d.expected(host, hourOfWeek(local))
+	threshold := math.Max(float64(expected)*d.settings.Factor, float64(d.settings.MinBytes))
+	if float64(host.bytes) <= threshold {
+		return nil
+	}
+
+	ratio := float64(host.bytes) / threshold
+	score := 0.4 + math.Min(0.2, 0.1*math.Log2(ratio))
+	var novelBytes int64
+	for _, sent := range host.newDestinations {
+		novelBytes += sent
+	}
+	// Most of the volume going to new destinations, which are only known
+	// once the stored baseline is in
+	novel := host.loaded && novelBytes*2 > host.bytes
+	if novel {
+		score += 0.2
+	}
+	offHours := !d.isBusinessHour(local)
+	if offHours {
+		score += 0.1
+	}
+	if source == "" {
+		// Nothing to compare with yet, only report large anomalies
+		score *= 0.7
+	}
+	score = math.Min(score, 1.0)
+	if score < d.settings.MinScore {
+		return nil
+	}
+	host.alerted = true
+
+	severity := "high"
+	if score >= 0.85 {
+		severity = "critical"
+	}
+	newDestinations := make([]string, 0, len(host.newDestinations))
+	for dst := range host.newDestinations {
+		newDestinations = append(newDestinations, dst)
+	}
+	sort.Strings(newDestinations)
+	if len(newDestinations) > maxListedTargets {
+		newDestinations = newDestinations[:maxListedTargets]
+	}
+
+	d.logger.Warnf("Data exfiltration suspected: %s sent %d bytes this hour (baseline %d, %s)",
+		conn.SrcIP, host.bytes, expected, source)
+
+	return &models.Alert{
+		Timestamp:  now,
+		Severity:   severity,
+		Type:       "data_exfiltration",
+		SrcIP:      conn.SrcIP,
+		DstIP:      conn.DstIP,
+		DstPort:    conn.DstPort,
+		Protocol:   conn.Protocol,
+		Confidence: score,
+		Description: fmt.Sprintf("检测到数据渗出行为: 本小时外发%s, 为基线阈值的%.1f倍",
+			formatBytes(host.bytes), ratio),
+		Details: marshalDetails(map[string]interface{}{
+			"hour_bytes":        host.bytes,
+			"expected_bytes":    expected,
+			"threshold_bytes":   int64(threshold),
+			"baseline":          baselineSource(source),
+			"hour_of_week":      hourOfWeek(local),
+			"novel_destination": novel,
+			"new_destinations":  newDestinations,
+			"off_hours":         offHours,
+		}),
+	}
+}
+
+// Flush saves the baselines that changed since the last flush
+func (d *ExfilDetector) Flush(ctx context.Context) {
+	if d.store == nil {
+		return
+	}
+
+	d.mu.Lock()
+	pending := make(map[string]*TrafficBaseline)
+	for ip, host := range d.hosts {
+		if host.dirty && host.loaded {
+			pending["host:"+ip] = host.baseline.clone()
+			host.dirty = false
+		}
+	}
+	for name, group := range d.groups {
+		if group.dirty && group.loaded {
+			pending["group:"+name] = group.baseline.clone()
+			group.dirty = false
+		}
+	}
+	d.mu.Unlock()
+
+	for key, baseline := range pending {
+		saveCtx, cancel := context.WithTimeout(ctx, baselineStoreTimeout)
+		if err := d.store.SaveBaseline(saveCtx, key, baseline); err != nil {
+			d.logger.Errorf("Failed to save traffic baseline %s: %v", key, err)
+		}
+		cancel()
+	}
+}
+
+// Cleanup forgets hosts without traffic for idle before now, the latest
+// record time, after saving all changed baselines. Their last hour is
+// recorded only once it is over, so a partial hour never enters the
+// baseline as a full one. Without a store their history is lost.
+func (d *ExfilDetector) Cleanup(ctx context.Context, now time.Time, idle time.Duration) {
+	cutoff := now.Add(-idle)
+	currentHour := now.Unix() / 3600
+
+	d.mu.Lock()
+	var quiet []string
+	for ip, host := range d.hosts {
+		if host.lastSeen.Before(cutoff) {
+			if host.hour < currentHour {
+				d.roll(host, host.hour+1)
+			}
+			quiet = append(quiet, ip)
+		}
+	}
+	d.mu.Unlock()
+
+	d.Flush(ctx)
+
+	d.mu.Lock()
+	for _, ip := range quiet {
+		if host, ok := d.hosts[ip]; ok && host.lastSeen.Before(cutoff) {
+			delete(d.hosts, ip)
+		}
+	}
+	d.mu.Unlock()
+}
+
+// host returns the state of a host, adding it and its group with empty
+// baselines if they are new
+func (d *ExfilDetector) host(ip string) *exfilHost {
+	if host, ok := d.hosts[ip]; ok {
+		return host
+	}
+
+	var group string
+	if d.groupOf != nil {
+		group = d.groupOf(ip)
+	}
+	if _, ok := d.groups[group]; group != "" && !ok {
+		d.groups[group] = &exfilGroup{
+			baselineState: baselineState{loaded: d.store == nil},
+			baseline:      newTrafficBaseline(),
+		}
+	}
+
+	host := &exfilHost{
+		baselineState:   baselineState{loaded: d.store == nil},
+		baseline:        newTrafficBaseline(),
+		group:           group,
+		newDestinations: make(map[string]int64),
+	}
+	d.hosts[ip] = host
+	return host
+}
+
+// requestBaselines queues the loads of the stored baselines of a host and
+// its group that are not in yet. Until they arrive the host is judged
+// without them.
+func (d *ExfilDetector) requestBaselines(ip string, host *exfilHost) {
+	if d.store == nil {
+		return
+	}
+	d.loadOnce.Do(func() {
+		for i := 0; i < baselineLoaders; i++ {
+			go d.loadBaselines()
+		}
+	})
+
+	d.queueLoad(&host.baselineState, "host:"+ip)
+	if group, ok := d.groups[host.group]; ok {
+		d.queueLoad(&group.baselineState, "group:"+host.group)
+	}
+}
+
+func (d *ExfilDetector) queueLoad(state *baselineState, key string) {
+	if state.loaded || state.queued {
+		return
+	}
+	select {
+	case d.loads <- key:
+		state.queued = true
+	default:
+	}
+}
+
+// loadBaselines loads queued baselines from the store and merges them in
+func (d *ExfilDetector) loadBaselines() {
+	for key := range d.loads {
+		ctx, cancel := context.WithTimeout(context.Background(), baselineStoreTimeout)
+		stored, err := d.store.LoadBaseline(ctx, key)
+		cancel()
+		if err != nil {
+			d.logger.Errorf("Failed to load traffic baseline %s: %v", key, err)
+		}
+
+		d.mu.Lock()
+		d.mergeBaseline(key, stored, err)
+		d.mu.Unlock()
+	}
+}
+
+// mergeBaseline adds what was recorded while a baseline was loading to the
+// stored one. A failed load is queued again on the next connection.
+func (d *ExfilDetector) mergeBaseline(key string, stored *TrafficBaseline, err error) {
+	var state *baselineState
+	var current **TrafficBaseline
+	var host *exfilHost
+	limit := maxBaselineWeeks
+	if ip, ok := strings.CutPrefix(key, "host:"); ok {
+		if host, ok = d.hosts[ip]; !ok {
+			return
+		}
+		state, current = &host.baselineState, &host.baseline
+	} else if name, ok := strings.CutPrefix(key, "group:"); ok {
+		group, ok := d.groups[name]
+		if !ok {
+			return
+		}
+		state, current, limit = &group.baselineState, &group.baseline, maxGroupSamples
+	} else {
+		return
+	}
+
+	state.queued = false
+	if err != nil {
+		return
+	}
+	state.loaded = true
+	if stored == nil {
+		return
+	}
+
+	if stored.Hours == nil {
+		stored.Hours = make(map[int][]int64)
+	}
+	if stored.Destinations == nil {
+		stored.Destinations = make(map[string]time.Time)
+	}
+	for how, totals := range (*current).Hours {
+		for _, total := range totals {
+			stored.Hours[how] = appendCapped(stored.Hours[how], total, limit)
+		}
+	}
+	if host != nil {
+		// Destinations sent to before are not new after all
+		for dst := range host.newDestinations {
+			if _, known := stored.Destinations[dst]; known {
+				delete(host.newDestinations, dst)
+			}
+		}
+	}
+	for dst, seen := range (*current).Destinations {
+		if seen.After(stored.Destinations[dst]) {
+			stored.Destinations[dst] = seen
+		}
+	}
+	for len(stored.Destinations) > maxKnownDestinations {
+		d.rememberDestination(stored)
+	}
+	*current = stored
+}
+
+// roll closes the hours before hour, recording their totals. Hours without
+// traffic are recorded as zero, up to a week of them.
+func (d *ExfilDetector) roll(host *exfilHost, hour int64) {
+	if host.hour == 0 {
+		host.hour = hour
+		return
+	}
+	if hour <= host.hour {
+		// Late records count towards the current hour
+		return
+	}
+
+	d.record(host, host.hour, host.bytes)
+	start := host.hour + 1
+	if hour-start > 7*24 {
+		start = hour - 7*24
+	}
+	for h := start; h < hour; h++ {
+		d.record(host, h, 0)
+	}
+
+	host.hour = hour
+	host.bytes = 0
+	host.alerted = false
+	host.newDestinations = make(map[string]int64)
+}
+
+func (d *ExfilDetector) record(host *exfilHost, hour int64, bytes int64) {
+	how := hourOfWeek(time.Unix(hour*3600, 0).In(d.location()))
+	host.baseline.Hours[how] = appendCapped(host.baseline.Hours[how], bytes, maxBaselineWeeks)
+	host.dirty = true
+
+	if group, ok := d.groups[host.group]; ok {
+		group.baseline.Hours[how] = appendCapped(group.baseline.Hours[how], bytes, maxGroupSamples)
+		group.dirty = true
+	}
+}
+
+// expected returns the 95th percentile of the host's history for an hour
+// of week, or of its group's when the host has too little, and which one
+// was used ("" when neither has enough history)
+func (d *ExfilDetector) expected(host *exfilHost, how int) (int64, string) {
+	if totals := host.baseline.Hours[how]; len(totals) >= d.settings.MinHistory {
+		return percentile95(totals), "host"
+	}
+	if group, ok := d.groups[host.group]; ok {
+		if totals := group.baseline.Hours[how]; len(totals) >= d.settings.MinHistory {
+			return percentile95(totals), "group"
+		}
+	}
+	return 0, ""
+}
+
+// rememberDestination makes room for a new destination
+func (d *ExfilDetector) rememberDestination(baseline *TrafficBaseline) {
+	if len(baseline.Destinations) < maxKnownDestinations {
+		return
+	}
+	var oldest string
+	var oldestSeen time.Time
+	for dst, seen := range baseline.Destinations {
+		if oldest == "" || seen.Before(oldestSeen) {
+			oldest, oldestSeen = dst, seen
+		}
+	}
+	delete(baseline.Destinations, oldest)
+}
+
+func (d *ExfilDetector) isBusinessHour(t time.Time) bool {
+	start, end := d.settings.BusinessStart, d.settings.BusinessEnd
+	if start == end {
+		return true
+	}
+	if len(d.settings.WorkDays) > 0 {
+		workDay := false
+		for _, day := range d.settings.WorkDays {
+			if t.Weekday() == day {
+				workDay = true
+				break
+			}
+		}
+		if !workDay {
+			return false
+		}
+	}
+
+	h := t.Hour()
+	if start < end {
+		return h >= start && h < end
+	}
+	return h >= start || h < end
+}
+
+func (d *ExfilDetector) location() *time.Location {
+	if d.settings.Location == nil {
+		return time.Local
+	}
+	return d.settings.Location
+}
+
+func (b *TrafficBaseline) clone() *TrafficBaseline {
+	c := &TrafficBaseline{
+		Hours:        make(map[int][]int64, len(b.Hours)),
+		Destinations: make(map[string]time.Time, len(b.Destinations)),
+	}
+	for how, totals := range b.Hours {
+		c.Hours[how] = append([]int64(nil), totals...)
+	}
+	for dst, seen := range b.Destinations {
+		c.Destinations[dst] = seen
+	}
+	return c
+}
+
+func hourOfWeek(t time.Time) int {
+	return int(t.Weekday())*24 + t.Hour()
+}
+
+func appendCapped(values []int64, v int64, max int) []int64 {
+	values = append(values, v)
+	if len(values) > max {
+		values = values[len(values)-max:]
+	}
+	return values
+}
+
+func percentile95(values []int64) int64 {
+	floats := make([]float64, len(values))
+	for i, v := range values {
+		floats[i] = float64(v)
+	}
+	return int64(quantile(floats, 0.95))
+}
+
+func baselineSource(source string) string {
+	if source == "" {
+		return "none"
+	}
+	return source
+}
+
+// isInternalIP reports whether ip is a private, loopback or link-local
+// address
+func isInternalIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	return parsed.IsPrivate() || parsed.IsLoopback() || parsed.IsLinkLocalUnicast() ||
+		parsed.IsMulticast() || parsed.IsUnspecified()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
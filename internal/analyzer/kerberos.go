@@ -0,0 +1,349 @@
+package analyzer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+// KerberosRequest is one exchange from kerberos.log
+type KerberosRequest struct {
+	Timestamp   time.Time
+	SrcIP       string
+	DstIP       string
+	DstPort     int
+	RequestType string // AS or TGS
+	Client      string
+	Service     string
+	Cipher      string
+	ErrorMsg    string
+	Success     bool
+	// From and Till are the requested ticket validity, zero when absent
+	From time.Time
+	Till time.Time
+}
+
+// kerberosNeverExpires is the end time Windows clients request to get the
+// longest lifetime the KDC allows. The KDC caps it, so it says nothing about
+// the ticket actually used.
+var kerberosNeverExpires = time.Date(2037, 9, 13, 2, 48, 5, 0, time.UTC)
+
+// KerberosDetector looks for Kerberoasting, AS-REP roasting and forged
+// (golden) tickets in Kerberos exchanges
+type KerberosDetector struct {
+	mu           sync.Mutex
+	logger       *logrus.Logger
+	spnThreshold int
+	window       time.Duration
+	maxLifetime  time.Duration
+
+	// firstSeen is when the detector saw its first exchange. Ticket checks
+	// are skipped until a whole ticket lifetime has been observed, since
+	// tickets issued before that are legitimately unknown.
+	firstSeen time.Time
+	// roasting tracks RC4 service tickets per source
+	roasting map[string]*spnRequests
+	// preauth holds the last KDC_ERR_PREAUTH_REQUIRED per source and client
+	preauth map[string]time.Time
+	// tickets holds when each client last obtained or renewed a TGT
+	tickets map[string]time.Time
+	// reported suppresses repeated alerts per type, source and client
+	reported map[string]time.Time
+}
+
+type spnRequests struct {
+	services map[string]time.Time
+	alerted  bool
+}
+
+// NewKerberosDetector creates a detector flagging spnThreshold RC4 service
+// ticket requests within window and TGTs older than maxLifetime
+func NewKerberosDetector(logger *logrus.Logger, spnThreshold int, window, maxLifetime time.Duration) *KerberosDetector {
+	return &KerberosDetector{
+		logger:       logger,
+		spnThreshold: spnThreshold,
+		window:       window,
+		maxLifetime:  maxLifetime,
+		roasting:     make(map[string]*spnRequests),
+		preauth:      make(map[string]time.Time),
+		tickets:      make(map[string]time.Time),
+		reported:     make(map[string]time.Time),
+	}
+}
+
+// SetThresholds updates the detector settings
+func (d *KerberosDetector) SetThresholds(spnThreshold int, window, maxLifetime time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.spnThreshold = spnThreshold
+	d.window = window
+	d.maxLifetime = maxLifetime
+}
+
+// Observe records an exchange and returns the alerts it raises
+func (d *KerberosDetector) Observe(req KerberosRequest) []*models.Alert {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if req.Timestamp.IsZero() {
+		req.Timestamp = time.Now()
+	}
+	if d.firstSeen.IsZero() {
+		d.firstSeen = req.Timestamp
+	}
+	client := strings.ToLower(req.Client)
+	clientKey := req.SrcIP + "|" + client
+
+	var alerts []*models.Alert
+	switch req.RequestType {
+	case "AS":
+		if req.ErrorMsg == "KDC_ERR_PREAUTH_REQUIRED" {
+			d.preauth[clientKey] = req.Timestamp
+			break
+		}
+		if !req.Success || client == "" {
+			break
+		}
+		d.tickets[client] = req.Timestamp
+
+		// Roasting tools ask for RC4 without ever sending pre-authentication
+		last, asked := d.preauth[clientKey]
+		if isRC4(req.Cipher) && (!asked || req.Timestamp.Sub(last) > d.window) {
+			if alert := d.asrepRoastingAlert(req, client); alert != nil {
+				alerts = append(alerts, alert)
+			}
+		}
+
+	case "TGS":
+		if !req.Success {
+			break
+		}
+		service := strings.ToLower(req.Service)
+		if strings.HasPrefix(service, "krbtgt/") {
+			// TGT renewal
+			if client != "" {
+				d.tickets[client] = req.Timestamp
+			}
+			break
+		}
+
+		if isRC4(req.Cipher) && service != "" {
+			if alert := d.trackServiceTicket(req, service); alert != nil {
+				alerts = append(alerts, alert)
+			}
+		}
+		if alert := d.checkTicket(req, client); alert != nil {
+			alerts = append(alerts, alert)
+		}
+	}
+
+	return alerts
+}
+
+// Cleanup forgets state older than cutoff. Issued tickets are kept for a
+// whole ticket lifetime.
+func (d *KerberosDetector) Cleanup(cutoff time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for src, requests := range d.roasting {
+		for service, seen := range requests.services {
+			if seen.Before(cutoff) {
+				delete(requests.services, service)
+			}
+		}
+		if len(requests.services) == 0 {
+			delete(d.roasting, src)
+		}
+	}
+	for key, seen := range d.preauth {
+		if seen.Before(cutoff) {
+			delete(d.preauth, key)
+		}
+	}
+	for key, seen := range d.reported {
+		if seen.Before(cutoff) {
+			delete(d.reported, key)
+		}
+	}
+	ticketCutoff := cutoff.Add(-d.maxLifetime)
+	for client, seen := range d.tickets {
+		if seen.Before(ticketCutoff) {
+			delete(d.tickets, client)
+		}
+	}
+}
+
+// trackServiceTicket counts distinct SPNs requested with RC4 by one source
+func (d *KerberosDetector) trackServiceTicket(req KerberosRequest, service string) *models.Alert {
+	requests, exists := d.roasting[req.SrcIP]
+	if !exists {
+		requests = &spnRequests{services: make(map[string]time.Time)}
+		d.roasting[req.SrcIP] = requests
+	}
+
+	cutoff := req.Timestamp.Add(-d.window)
+	for s, seen := range requests.services {
+		if seen.Before(cutoff) {
+			delete(requests.services, s)
+		}
+	}
+	// A quiet window ends the episode
+	if len(requests.services) == 0 {
+		requests.alerted = false
+	}
+	requests.services[service] = req.Timestamp
+
+	if requests.alerted || len(requests.services) < d.spnThreshold {
+		return nil
+	}
+	requests.alerted = true
+
+	services := make([]string, 0, len(requests.services))
+	for s := range requests.services {
+		services = append(services, s)
+	}
+	sort.Strings(services)
+	if len(services) > maxListedTargets {
+		services = services[:maxListedTargets]
+	}
+
+	d.logger.Warnf("Kerberoasting detected: %s requested %d RC4 service tickets", req.SrcIP, len(requests.services))
+	return &models.Alert{
+		Timestamp:   req.Timestamp,
+		Severity:    "high",
+		Type:        "kerberoasting",
+		SrcIP:       req.SrcIP,
+		DstIP:       req.DstIP,
+		DstPort:     req.DstPort,
+		Protocol:    "kerberos",
+		Description: fmt.Sprintf("检测到Kerberoasting攻击: %d个SPN的RC4服务票据请求", len(requests.services)),
+		Confidence:  0.85,
+		Details: marshalDetails(map[string]interface{}{
+			"client":   req.Client,
+			"services": services,
+			"cipher":   req.Cipher,
+		}),
+	}
+}
+
+func (d *KerberosDetector) asrepRoastingAlert(req KerberosRequest, client string) *models.Alert {
+	if !d.report("asrep_roasting|"+req.SrcIP+"|"+client, req.Timestamp) {
+		return nil
+	}
+
+	d.logger.Warnf("AS-REP roasting detected: %s -> %s (%s)", req.SrcIP, req.DstIP, req.Client)
+	return &models.Alert{
+		Timestamp:   req.Timestamp,
+		Severity:    "high",
+		Type:        "asrep_roasting",
+		SrcIP:       req.SrcIP,
+		DstIP:       req.DstIP,
+		DstPort:     req.DstPort,
+		Protocol:    "kerberos",
+		Description: "检测到AS-REP Roasting攻击: 未预认证的AS请求 " + req.Client,
+		Confidence:  0.8,
+		Details: marshalDetails(map[string]interface{}{
+			"client": req.Client,
+			"cipher": req.Cipher,
+		}),
+	}
+}
+
+// checkTicket flags service tickets valid for longer than the maximum ticket
+// lifetime, or requested with a TGT older than it, as forged tickets carry
+// lifetimes no KDC policy grants. A TGT that was never seen issued is only a
+// weak signal, since its AS exchange may predate the capture or have crossed
+// another segment.
+func (d *KerberosDetector) checkTicket(req KerberosRequest, client string) *models.Alert {
+	if client == "" {
+		return nil
+	}
+	if lifetime := requestedLifetime(req); lifetime > d.maxLifetime {
+		return d.ticketAlert(req, client, "ticket_lifetime_exceeded", lifetime)
+	}
+	if req.Timestamp.Sub(d.firstSeen) < d.maxLifetime {
+		return nil
+	}
+
+	issued, known := d.tickets[client]
+	switch {
+	case !known:
+		return d.ticketAlert(req, client, "no_as_exchange", 0)
+	case req.Timestamp.Sub(issued) > d.maxLifetime:
+		return d.ticketAlert(req, client, "ticket_age_exceeded", req.Timestamp.Sub(issued))
+	}
+	return nil
+}
+
+func (d *KerberosDetector) ticketAlert(req KerberosRequest, client, reason string, lifetime time.Duration) *models.Alert {
+	if !d.report("golden_ticket|"+reason+"|"+req.SrcIP+"|"+client, req.Timestamp) {
+		return nil
+	}
+
+	details := map[string]interface{}{
+		"client":  req.Client,
+		"service": req.Service,
+		"reason":  reason,
+	}
+	if lifetime > 0 {
+		details["ticket_lifetime_hours"] = int(lifetime.Hours())
+		details["max_lifetime_hours"] = int(d.maxLifetime.Hours())
+	}
+
+	severity, confidence := "critical", 0.75
+	var description string
+	switch reason {
+	case "ticket_lifetime_exceeded":
+		description = fmt.Sprintf("疑似黄金票据: %s 的票据有效期%d小时，超出策略上限%d小时",
+			req.Client, int(lifetime.Hours()), int(d.maxLifetime.Hours()))
+	case "ticket_age_exceeded":
+		description = fmt.Sprintf("疑似黄金票据: %s 使用签发于%d小时前的TGT，超出策略上限%d小时",
+			req.Client, int(lifetime.Hours()), int(d.maxLifetime.Hours()))
+	default:
+		severity, confidence = "low", 0.3
+		description = "疑似黄金票据: " + req.Client + " 的TGS请求缺少对应的AS交换"
+	}
+
+	d.logger.Warnf("Possible golden ticket: %s used by %s (%s)", req.Client, req.SrcIP, reason)
+	return &models.Alert{
+		Timestamp:   req.Timestamp,
+		Severity:    severity,
+		Type:        "golden_ticket",
+		SrcIP:       req.SrcIP,
+		DstIP:       req.DstIP,
+		DstPort:     req.DstPort,
+		Protocol:    "kerberos",
+		Description: description,
+		Confidence:  confidence,
+		Details:     marshalDetails(details),
+	}
+}
+
+// requestedLifetime returns the validity span of the ticket in req, or zero
+// when the request leaves it to the KDC
+func requestedLifetime(req KerberosRequest) time.Duration {
+	if req.From.IsZero() || req.Till.IsZero() || req.Till.Equal(kerberosNeverExpires) {
+		return 0
+	}
+	return req.Till.Sub(req.From)
+}
+
+// report returns true the first time key is seen within the window
+func (d *KerberosDetector) report(key string, now time.Time) bool {
+	if last, seen := d.reported[key]; seen && now.Sub(last) < d.window {
+		return false
+	}
+	d.reported[key] = now
+	return true
+}
+
+func isRC4(cipher string) bool {
+	return strings.HasPrefix(strings.ToLower(cipher), "rc4")
+}
@@ -1,6 +1,7 @@
 package analyzer
 
 import (
+	"strings"
 	"sync"
 	"time"
 
@@ -10,187 +11,234 @@ import (
 
 // LateralMovementDetector detects lateral movement attacks
 type LateralMovementDetector struct {
-	scanTracker   map[string]*ScanTracker
-	authTracker   map[string]*AuthTracker
-	execTracker   map[string]*ExecTracker
-	mu            sync.RWMutex
-	logger        *logrus.Logger
-	scanThreshold int
-	timeWindow    int
-}
-
-type ScanTracker struct {
-	SourceIP     string
-	TargetIPs    map[string]bool
-	Timestamps   []time.Time
-	FailureCount int
+	scans       *ScanEngine
+	authTracker map[string]*AuthTracker
+	execTracker map[string]*ExecTracker
+	replTracker map[string]time.Time // last replication alert per type and host pair
+	mu          sync.RWMutex
+	logger      *logrus.Logger
 }
 
 type AuthTracker struct {
-	SourceIP      string
+	SourceIP       string
 	FailedAttempts int
-	HashSeen      map[string][]string // hash -> list of target IPs
-	LastSeen      time.Time
+	HashSeen       map[string][]string // hash -> list of target IPs
+	LastSeen       time.Time
+	// Alerted is when the last alert was raised, with AlertedTargets
+	// hosts reached at that point
+	Alerted        time.Time
+	AlertedTargets int
 }
 
+const (
+	// pthTargets is how many hosts one account must reach from a source
+	pthTargets = 3
+	// pthAlertWindow suppresses repeated alerts for a source and account
+	pthAlertWindow = time.Hour
+)
+
 type ExecTracker struct {
 	SourceIP  string
 	TargetIP  string
-	Events    []string
+	Events    []ExecEvent
+	Alerted   map[string]time.Time // alert type -> last alert
 	Timestamp time.Time
 }
 
 // NewLateralMovementDetector creates a new detector
 func NewLateralMovementDetector(logger *logrus.Logger, scanThreshold, timeWindow int) *LateralMovementDetector {
 	return &LateralMovementDetector{
-		scanTracker:   make(map[string]*ScanTracker),
-		authTracker:   make(map[string]*AuthTracker),
-		execTracker:   make(map[string]*ExecTracker),
-		logger:        logger,
-		scanThreshold: scanThreshold,
-		timeWindow:    timeWindow,
+		scans:       NewScanEngine(scanThreshold, time.Duration(timeWindow)*time.Second, 0),
+		authTracker: make(map[string]*AuthTracker),
+		execTracker: make(map[string]*ExecTracker),
+		replTracker: make(map[string]time.Time),
+		logger:      logger,
 	}
 }
 
-// DetectScan detects port scanning and host discovery
-func (d *LateralMovementDetector) DetectScan(conn *models.Connection) *models.Alert {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	tracker, exists := d.scanTracker[conn.SrcIP]
-	if !exists {
-		tracker = &ScanTracker{
-			SourceIP:  conn.SrcIP,
-			TargetIPs: make(map[string]bool),
-			Timestamps: []time.Time{},
-		}
-		d.scanTracker[conn.SrcIP] = tracker
-	}
-
-	tracker.TargetIPs[conn.DstIP] = true
-	tracker.Timestamps = append(tracker.Timestamps, conn.Timestamp)
-
-	// Clean old timestamps
-	cutoff := time.Now().Add(-time.Duration(d.timeWindow) * time.Second)
-	validTimestamps := []time.Time{}
-	for _, ts := range tracker.Timestamps {
-		if ts.After(cutoff) {
-			validTimestamps = append(validTimestamps, ts)
-		}
-	}
-	tracker.Timestamps = validTimestamps
-
-	// Check if threshold exceeded
-	if len(tracker.TargetIPs) >= d.scanThreshold {
-		return &models.Alert{
-			Timestamp:   time.Now(),
-			Severity:    "high",
-			Type:        "lateral_scan",
-			SrcIP:       conn.SrcIP,
-			Description: "Lateral movement scan detected",
-			Confidence:  0.9,
-		}
-	}
+// SetScanThresholds updates the scan threshold, time window (seconds) and
+// the minimum share of failed connections
+func (d *LateralMovementDetector) SetScanThresholds(scanThreshold, timeWindow int, minFailRate float64) {
+	d.scans.SetThresholds(scanThreshold, time.Duration(timeWindow)*time.Second, minFailRate)
+}
 
-	return nil
+// DetectScan detects horizontal, vertical and block scans. It alerts once
+// per scan episode.
+func (d *LateralMovementDetector) DetectScan(conn *models.Connection) *models.Alert {
+	return d.scans.Observe(conn)
 }
 
-// DetectPTH detects Pass-the-Hash attacks
-func (d *LateralMovementDetector) DetectPTH(srcIP, hash, dstIP string) *models.Alert {
+// DetectPTH detects Pass-the-Hash attacks: one account authenticating from
+// a source to pthTargets or more hosts. It alerts once per episode and
+// again only after pthAlertWindow when further hosts were reached.
+func (d *LateralMovementDetector) DetectPTH(srcIP, account, dstIP string, ts time.Time) *models.Alert {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	key := srcIP + ":" + hash
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	key := srcIP + ":" + account
 	tracker, exists := d.authTracker[key]
 	if !exists {
 		tracker = &AuthTracker{
 			SourceIP: srcIP,
 			HashSeen: make(map[string][]string),
-			LastSeen: time.Now(),
 		}
 		d.authTracker[key] = tracker
 	}
+	if ts.After(tracker.LastSeen) {
+		tracker.LastSeen = ts
+	}
 
-	tracker.HashSeen[hash] = append(tracker.HashSeen[hash], dstIP)
-	tracker.LastSeen = time.Now()
+	if contains(tracker.HashSeen[account], dstIP) {
+		return nil
+	}
+	tracker.HashSeen[account] = append(tracker.HashSeen[account], dstIP)
 
-	// If same hash used on 3+ different hosts
-	if len(tracker.HashSeen[hash]) >= 3 {
-		return &models.Alert{
-			Timestamp:   time.Now(),
-			Severity:    "critical",
-			Type:        "pass_the_hash",
-			SrcIP:       srcIP,
-			Description: "Pass-the-Hash attack detected",
-			Confidence:  0.95,
-		}
+	targets := tracker.HashSeen[account]
+	if len(targets) < pthTargets {
+		return nil
+	}
+	if !tracker.Alerted.IsZero() && (ts.Sub(tracker.Alerted) < pthAlertWindow || len(targets) <= tracker.AlertedTargets) {
+		return nil
 	}
+	tracker.Alerted = ts
+	tracker.AlertedTargets = len(targets)
 
-	return nil
+	return &models.Alert{
+		Timestamp:   ts,
+		Severity:    "critical",
+		Type:        "pass_the_hash",
+		SrcIP:       srcIP,
+		Description: "Pass-the-Hash attack detected",
+		Confidence:  0.95,
+		Details: marshalDetails(map[string]interface{}{
+			"account": account,
+			"targets": targets,
+		}),
+	}
 }
 
-// DetectRemoteExec detects PSExec/WMI remote execution
-func (d *LateralMovementDetector) DetectRemoteExec(srcIP, dstIP, method string) *models.Alert {
+// DetectRemoteExec correlates remote execution events between two hosts
+// and detects service (PSExec), scheduled task, WMI, DCOM and WinRM
+// execution. Each technique is reported once per execTrailWindow with the
+// ordered events that led to it.
+func (d *LateralMovementDetector) DetectRemoteExec(srcIP, dstIP string, event ExecEvent) *models.Alert {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
 	key := srcIP + ":" + dstIP
 	tracker, exists := d.execTracker[key]
 	if !exists {
 		tracker = &ExecTracker{
-			SourceIP:  srcIP,
-			TargetIP:  dstIP,
-			Events:    []string{},
-			Timestamp: time.Now(),
+			SourceIP: srcIP,
+			TargetIP: dstIP,
+			Events:   []ExecEvent{},
+			Alerted:  make(map[string]time.Time),
 		}
 		d.execTracker[key] = tracker
 	}
 
-	tracker.Events = append(tracker.Events, method)
-	tracker.Timestamp = time.Now()
+	tracker.Events = appendExecEvent(tracker.Events, event)
+	if event.Timestamp.After(tracker.Timestamp) {
+		tracker.Timestamp = event.Timestamp
+	}
 
-	// Detect PSExec pattern: ADMIN$ access + svcctl
-	if contains(tracker.Events, "admin_share") && contains(tracker.Events, "svcctl") {
-		return &models.Alert{
-			Timestamp:   time.Now(),
-			Severity:    "critical",
-			Type:        "psexec",
-			SrcIP:       srcIP,
-			DstIP:       dstIP,
-			Description: "PSExec remote execution detected",
-			Confidence:  0.92,
+	var technique *execTechnique
+	for _, t := range matchExecTechniques(tracker.Events) {
+		if last, seen := tracker.Alerted[t.alertType]; !seen || event.Timestamp.Sub(last) >= execTrailWindow {
+			technique = t
+			break
 		}
 	}
+	if technique == nil {
+		return nil
+	}
+	tracker.Alerted[technique.alertType] = event.Timestamp
 
-	// Detect WMI execution
-	if contains(tracker.Events, "wmi_exec") {
-		return &models.Alert{
-			Timestamp:   time.Now(),
-			Severity:    "high",
-			Type:        "wmi_exec",
-			SrcIP:       srcIP,
-			DstIP:       dstIP,
-			Description: "WMI remote execution detected",
-			Confidence:  0.88,
+	return &models.Alert{
+		Timestamp:   event.Timestamp,
+		Severity:    technique.severity,
+		Type:        technique.alertType,
+		SrcIP:       srcIP,
+		DstIP:       dstIP,
+		Description: technique.description,
+		Confidence:  technique.confidence,
+		Details: marshalDetails(map[string]interface{}{
+			"technique": technique.name,
+			"evidence":  tracker.Events,
+		}),
+	}
+}
+
+// DetectReplication detects DCSync and DCShadow from DRSUAPI calls.
+// operation is the dce_rpc operation name, e.g. DRSGetNCChanges; srcIsDC
+// and dstIsDC tell whether the caller and callee are domain controllers;
+// ts is the time of the call.
+func (d *LateralMovementDetector) DetectReplication(srcIP, dstIP, operation string, srcIsDC, dstIsDC bool, ts time.Time) *models.Alert {
+	op := strings.ToLower(operation)
+	op = strings.TrimPrefix(strings.TrimPrefix(op, "drs"), "ds")
+
+	var alert *models.Alert
+	switch {
+	// Only domain controllers replicate directory changes from each other
+	case (op == "getncchanges" || op == "replicasync") && !srcIsDC && dstIsDC:
+		alert = &models.Alert{
+			Severity:    "critical",
+			Type:        "dcsync",
+			Description: "DCSync attack detected: directory replication requested by a non-DC host",
+			Confidence:  0.95,
 		}
+
+	// A rogue DC registers itself and then gets replicated from
+	case (op == "addentry" || op == "replicaadd" || op == "updaterefs") && !srcIsDC && dstIsDC,
+		(op == "getncchanges" || op == "replicasync") && srcIsDC && !dstIsDC:
+		alert = &models.Alert{
+			Severity:    "critical",
+			Type:        "dcshadow",
+			Description: "DCShadow attack detected: replication registration involving a non-DC host",
+			Confidence:  0.9,
+		}
+
+	default:
+		return nil
+	}
+
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := alert.Type + ":" + srcIP + ":" + dstIP
+	if last, seen := d.replTracker[key]; seen && ts.Sub(last) < time.Hour {
+		return nil
 	}
+	d.replTracker[key] = ts
 
-	return nil
+	alert.Timestamp = ts
+	alert.SrcIP = srcIP
+	alert.DstIP = dstIP
+	alert.Details = marshalDetails(map[string]interface{}{"operation": operation})
+	return alert
 }
 
-// Cleanup removes old tracking data
-func (d *LateralMovementDetector) Cleanup() {
+// Cleanup removes tracking data older than an hour before now
+func (d *LateralMovementDetector) Cleanup(now time.Time) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	cutoff := time.Now().Add(-1 * time.Hour)
+	cutoff := now.Add(-1 * time.Hour)
 
 	// Clean scan tracker
-	for ip, tracker := range d.scanTracker {
-		if len(tracker.Timestamps) == 0 || tracker.Timestamps[len(tracker.Timestamps)-1].Before(cutoff) {
-			delete(d.scanTracker, ip)
-		}
-	}
+	d.scans.Cleanup(cutoff)
 
 	// Clean auth tracker
 	for key, tracker := range d.authTracker {
@@ -199,6 +247,13 @@ func (d *LateralMovementDetector) Cleanup() {
 		}
 	}
 
+	// Clean replication tracker
+	for key, last := range d.replTracker {
+		if last.Before(cutoff) {
+			delete(d.replTracker, key)
+		}
+	}
+
 	// Clean exec tracker
 	for key, tracker := range d.execTracker {
 		if tracker.Timestamp.Before(cutoff) {
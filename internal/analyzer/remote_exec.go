@@ -0,0 +1,139 @@
+package analyzer
+
+import (
+	"sort"
+	"time"
+)
+
+// Remote execution events derived from SMB, DCE/RPC and WinRM traffic
+const (
+	ExecAdminShare     = "admin_share"     // ADMIN$ or C$ mounted
+	ExecIPCShare       = "ipc_share"       // IPC$ mounted
+	ExecFileWrite      = "file_write"      // executable or script written to a share
+	ExecServiceControl = "svcctl"          // service control manager opened
+	ExecServiceCreate  = "service_create"  // svcctl CreateService
+	ExecServiceStart   = "service_start"   // svcctl StartService
+	ExecTaskRegister   = "task_register"   // ITaskSchedulerService or atsvc job
+	ExecTaskRun        = "task_run"        // scheduled task started on demand
+	ExecWMILogin       = "wmi_login"       // IWbemLevel1Login
+	ExecWMIMethod      = "wmi_exec"        // IWbemServices ExecMethod
+	ExecRemoteRegistry = "remote_registry" // winreg write
+	ExecDCOMActivation = "dcom_activation" // remote COM object activation
+	ExecDCOMInvoke     = "dcom_invoke"     // IDispatch call (MMC20, ShellWindows)
+	ExecWinRM          = "winrm"           // WS-Management session
+)
+
+const (
+	// execTrailWindow is how long events are kept for correlation
+	execTrailWindow = 10 * time.Minute
+	// maxExecEvents caps the evidence kept per host pair
+	maxExecEvents = 50
+)
+
+// ExecEvent is one step of a remote execution
+type ExecEvent struct {
+	Timestamp time.Time `json:"ts"`
+	Method    string    `json:"method"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+type execTechnique struct {
+	name        string
+	alertType   string
+	severity    string
+	description string
+	confidence  float64
+}
+
+// appendExecEvent adds event in time order and drops events that are
+// older than the window or over the cap
+func appendExecEvent(events []ExecEvent, event ExecEvent) []ExecEvent {
+	i := sort.Search(len(events), func(i int) bool {
+		return events[i].Timestamp.After(event.Timestamp)
+	})
+	events = append(events, ExecEvent{})
+	copy(events[i+1:], events[i:])
+	events[i] = event
+
+	cutoff := events[len(events)-1].Timestamp.Add(-execTrailWindow)
+	start := 0
+	for start < len(events) && events[start].Timestamp.Before(cutoff) {
+		start++
+	}
+	if len(events)-start > maxExecEvents {
+		start = len(events) - maxExecEvents
+	}
+	return events[start:]
+}
+
+// matchExecTechniques returns the techniques the events show, most
+// specific first
+func matchExecTechniques(events []ExecEvent) []*execTechnique {
+	seen := make(map[string]bool, len(events))
+	for _, e := range events {
+		seen[e.Method] = true
+	}
+
+	var techniques []*execTechnique
+	serviceExec := seen[ExecServiceCreate] || seen[ExecServiceStart]
+	switch {
+	case serviceExec && (seen[ExecAdminShare] || seen[ExecFileWrite]):
+		techniques = append(techniques, &execTechnique{
+			name:        "service",
+			alertType:   "psexec",
+			severity:    "critical",
+			description: "PSExec remote execution detected: admin share access and service creation",
+			confidence:  0.95,
+		})
+	case serviceExec:
+		techniques = append(techniques, &execTechnique{
+			name:        "service",
+			alertType:   "service_exec",
+			severity:    "high",
+			description: "Remote service execution detected",
+			confidence:  0.85,
+		})
+	}
+	if seen[ExecTaskRegister] {
+		confidence := 0.85
+		if seen[ExecTaskRun] {
+			confidence = 0.92
+		}
+		techniques = append(techniques, &execTechnique{
+			name:        "scheduled_task",
+			alertType:   "scheduled_task_exec",
+			severity:    "high",
+			description: "Remote scheduled task execution detected",
+			confidence:  confidence,
+		})
+	}
+	if seen[ExecWMIMethod] {
+		techniques = append(techniques, &execTechnique{
+			name:        "wmi",
+			alertType:   "wmi_exec",
+			severity:    "high",
+			description: "WMI remote execution detected",
+			confidence:  0.88,
+		})
+	}
+	if seen[ExecDCOMActivation] && seen[ExecDCOMInvoke] {
+		techniques = append(techniques, &execTechnique{
+			name:        "dcom",
+			alertType:   "dcom_exec",
+			severity:    "high",
+			description: "DCOM remote execution detected (MMC20/ShellWindows)",
+			confidence:  0.8,
+		})
+	}
+	if seen[ExecWinRM] {
+		techniques = append(techniques, &execTechnique{
+			name:        "winrm",
+			alertType:   "winrm_exec",
+			severity:    "medium",
+			description: "WinRM remote execution detected",
+			confidence:  0.7,
+		})
+	}
+
+	return techniques
+}
@@ -0,0 +1,391 @@
+package analyzer
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/Cxiyuan/NTA/pkg/recency"
+)
+
+// Scan types reported by ScanEngine
+const (
+	ScanHorizontal = "horizontal" // many hosts, one port
+	ScanVertical   = "vertical"   // one host, many ports
+	ScanBlock      = "block"      // many hosts and many ports
+)
+
+// maxListedTargets caps the host and port lists stored in alert details
+const maxListedTargets = 100
+
+// scanShards spreads sources over separately locked shards, so connections
+// from different sources are tracked in parallel
+const scanShards = 64
+
+// failedConnStates are Zeek conn_state values of attempts that never got a
+// proper answer from the target
+var failedConnStates = map[string]bool{
+	"S0":     true,
+	"REJ":    true,
+	"RSTOS0": true,
+	"RSTRH":  true,
+	"SH":     true,
+	"SHR":    true,
+	"OTH":    true,
+}
+
+// ScanEngine tracks the targets each source touches within a sliding
+// window and reports one alert per scan episode. An episode ends once the
+// source has been quiet for a whole window.
+type ScanEngine struct {
+	shards [scanShards]scanShard
+
+	// mu guards the settings
+	mu          sync.RWMutex
+	threshold   int
+	window      time.Duration
+	minFailRate float64
+}
+
+type scanShard struct {
+	mu      sync.Mutex
+	sources map[string]*scanSource
+}
+
+type scanSource struct {
+	targets map[scanTarget]*scanProbe
+	// order lists the targets from least to most recently seen, so the
+	// window slides without scanning every target
+	order     *recency.List[scanTarget]
+	firstSeen time.Time
+	lastSeen  time.Time
+	alerted   bool
+
+	// Running counts over targets, so a busy source is classified without
+	// walking its targets on every connection. wideHosts and widePorts
+	// count the hosts and ports with at least wideAt targets.
+	hostTargets map[string]int
+	portTargets map[int]int
+	wideAt      int
+	wideHosts   int
+	widePorts   int
+	attempts    int
+	known       int
+	failures    int
+}
+
+type scanTarget struct {
+	host string
+	port int
+}
+
+type scanProbe struct {
+	lastSeen time.Time
+	attempts int
+	// known counts attempts with a conn_state; packet-derived connections
+	// may not have one
+	known    int
+	failures int
+}
+
+// NewScanEngine creates a scan engine. threshold is the number of distinct
+// targets, window the sliding window and minFailRate the share of failed
+// attempts required (0 disables the check).
+func NewScanEngine(threshold int, window time.Duration, minFailRate float64) *ScanEngine {
+	e := &ScanEngine{
+		threshold:   threshold,
+		window:      window,
+		minFailRate: minFailRate,
+	}
+	for i := range e.shards {
+		e.shards[i].sources = make(map[string]*scanSource)
+	}
+	return e
+}
+
+// SetThresholds updates the engine settings
+func (e *ScanEngine) SetThresholds(threshold int, window time.Duration, minFailRate float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.threshold = threshold
+	e.window = window
+	e.minFailRate = minFailRate
+}
+
+// Observe records a connection and returns an alert when it completes a
+// new scan episode
+func (e *ScanEngine) Observe(conn *models.Connection) *models.Alert {
+	e.mu.RLock()
+	threshold, window, minFailRate := e.threshold, e.window, e.minFailRate
+	e.mu.RUnlock()
+
+	shard := e.shard(conn.SrcIP)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := conn.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	src, exists := shard.sources[conn.SrcIP]
+	if !exists || now.Sub(src.lastSeen) > window {
+		src = &scanSource{
+			targets:     make(map[scanTarget]*scanProbe),
+			order:       recency.New[scanTarget](),
+			firstSeen:   now,
+			hostTargets: make(map[string]int),
+			portTargets: make(map[int]int),
+			wideAt:      threshold,
+		}
+		shard.sources[conn.SrcIP] = src
+	}
+	if now.After(src.lastSeen) {
+		src.lastSeen = now
+	}
+
+	target := scanTarget{host: conn.DstIP, port: conn.DstPort}
+	probe, exists := src.targets[target]
+	if !exists {
+		probe = &scanProbe{}
+		src.targets[target] = probe
+		src.count(target, 1)
+	}
+	if now.After(probe.lastSeen) {
+		probe.lastSeen = now
+		src.order.Touch(target)
+	}
+	probe.attempts++
+	src.attempts++
+	if conn.ConnState != "" {
+		probe.known++
+		src.known++
+		if failedConnStates[conn.ConnState] {
+			probe.failures++
+			src.failures++
+		}
+	}
+
+	// Slide the window, starting with the target seen longest ago
+	cutoff := src.lastSeen.Add(-window)
+	for {
+		t, ok := src.order.Oldest()
+		if !ok || !src.targets[t].lastSeen.Before(cutoff) {
+			break
+		}
+		src.forget(t)
+	}
+
+	if src.alerted || len(src.targets) < threshold {
+		return nil
+	}
+
+	scanType := src.classify(threshold)
+	if scanType == "" {
+		return nil
+	}
+	if src.known > 0 && float64(src.failures)/float64(src.known) < minFailRate {
+		return nil
+	}
+
+	src.alerted = true
+	return summarizeScan(src.targets).alert(conn.SrcIP, scanType, src.firstSeen, now)
+}
+
+// forget drops a target that slid out of the window
+func (src *scanSource) forget(t scanTarget) {
+	probe := src.targets[t]
+	src.attempts -= probe.attempts
+	src.known -= probe.known
+	src.failures -= probe.failures
+	src.count(t, -1)
+	src.order.Remove(t)
+	delete(src.targets, t)
+}
+
+// count adds delta to the targets of a host and port
+func (src *scanSource) count(t scanTarget, delta int) {
+	before := src.hostTargets[t.host]
+	src.hostTargets[t.host] = before + delta
+	src.wideHosts += crossed(before, before+delta, src.wideAt)
+	if before+delta == 0 {
+		delete(src.hostTargets, t.host)
+	}
+
+	before = src.portTargets[t.port]
+	src.portTargets[t.port] = before + delta
+	src.widePorts += crossed(before, before+delta, src.wideAt)
+	if before+delta == 0 {
+		delete(src.portTargets, t.port)
+	}
+}
+
+// classify returns the scan type, or "" if the targets do not form a scan
+func (src *scanSource) classify(threshold int) string {
+	if src.wideAt != threshold {
+		// The threshold changed; recount against the new one
+		src.wideAt = threshold
+		src.wideHosts, src.widePorts = 0, 0
+		for _, n := range src.hostTargets {
+			src.wideHosts += crossed(0, n, threshold)
+		}
+		for _, n := range src.portTargets {
+			src.widePorts += crossed(0, n, threshold)
+		}
+	}
+
+	horizontal := src.widePorts > 0
+	vertical := src.wideHosts > 0
+	switch {
+	case horizontal && vertical:
+		return ScanBlock
+	case horizontal:
+		return ScanHorizontal
+	case vertical:
+		return ScanVertical
+	case len(src.targets) >= threshold && len(src.hostTargets) > 1 && len(src.portTargets) > 1:
+		return ScanBlock
+	}
+	return ""
+}
+
+// crossed returns 1 when a count rises to at, -1 when it falls below it
+// and 0 otherwise
+func crossed(before, after, at int) int {
+	switch {
+	case before < at && after >= at:
+		return 1
+	case before >= at && after < at:
+		return -1
+	}
+	return 0
+}
+
+// Cleanup forgets sources that have been quiet since before cutoff
+func (e *ScanEngine) Cleanup(cutoff time.Time) {
+	for i := range e.shards {
+		shard := &e.shards[i]
+		shard.mu.Lock()
+		for ip, src := range shard.sources {
+			if src.lastSeen.Before(cutoff) {
+				delete(shard.sources, ip)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// shard returns the shard tracking a source
+func (e *ScanEngine) shard(srcIP string) *scanShard {
+	h := fnv.New32a()
+	h.Write([]byte(srcIP))
+	return &e.shards[h.Sum32()%scanShards]
+}
+
+// scanSummary describes the targets of one source within the window
+type scanSummary struct {
+	hostsByPort map[int]map[string]bool
+	portsByHost map[string]map[int]bool
+	pairs       int
+	attempts    int
+	known       int
+	failures    int
+}
+
+func summarizeScan(targets map[scanTarget]*scanProbe) *scanSummary {
+	s := &scanSummary{
+		hostsByPort: make(map[int]map[string]bool),
+		portsByHost: make(map[string]map[int]bool),
+		pairs:       len(targets),
+	}
+	for t, p := range targets {
+		if s.hostsByPort[t.port] == nil {
+			s.hostsByPort[t.port] = make(map[string]bool)
+		}
+		s.hostsByPort[t.port][t.host] = true
+		if s.portsByHost[t.host] == nil {
+			s.portsByHost[t.host] = make(map[int]bool)
+		}
+		s.portsByHost[t.host][t.port] = true
+
+		s.attempts += p.attempts
+		s.known += p.known
+		s.failures += p.failures
+	}
+	return s
+}
+
+func (s *scanSummary) failRate() float64 {
+	if s.known == 0 {
+		return 0
+	}
+	return float64(s.failures) / float64(s.known)
+}
+
+func (s *scanSummary) alert(srcIP, scanType string, firstSeen, lastSeen time.Time) *models.Alert {
+	hosts := make([]string, 0, len(s.portsByHost))
+	for host := range s.portsByHost {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	ports := make([]int, 0, len(s.hostsByPort))
+	for port := range s.hostsByPort {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+
+	alert := &models.Alert{
+		Timestamp:  lastSeen,
+		Severity:   "high",
+		Type:       "lateral_scan",
+		SrcIP:      srcIP,
+		Confidence: 0.7,
+		Description: fmt.Sprintf("Lateral movement %s scan detected: %d hosts, %d ports",
+			scanType, len(hosts), len(ports)),
+	}
+	switch scanType {
+	case ScanHorizontal:
+		if len(ports) == 1 {
+			alert.DstPort = ports[0]
+		}
+	case ScanVertical:
+		alert.Severity = "medium"
+		if len(hosts) == 1 {
+			alert.DstIP = hosts[0]
+		}
+	}
+	if s.known > 0 {
+		alert.Confidence += 0.25 * s.failRate()
+	}
+
+	details := map[string]interface{}{
+		"scan_type":   scanType,
+		"hosts":       len(hosts),
+		"ports":       len(ports),
+		"targets":     s.pairs,
+		"connections": s.attempts,
+		"first_seen":  firstSeen,
+		"last_seen":   lastSeen,
+	}
+	if s.known > 0 {
+		details["fail_rate"] = math.Round(s.failRate()*100) / 100
+	}
+	if len(hosts) > maxListedTargets {
+		hosts = hosts[:maxListedTargets]
+	}
+	if len(ports) > maxListedTargets {
+		ports = ports[:maxListedTargets]
+	}
+	details["host_list"] = hosts
+	details["port_list"] = ports
+
+	data, _ := json.Marshal(details)
+	alert.Details = string(data)
+	return alert
+}
@@ -0,0 +1,575 @@
+package analyzer
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/Cxiyuan/NTA/pkg/recency"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// webShellCorrelation is how long http.log and files.log entries wait
+	// for their counterpart
+	webShellCorrelation = 2 * time.Minute
+	// webShellDedupe suppresses repeated alerts for one client and script
+	webShellDedupe = time.Hour
+	// maxWebServers caps the servers whose paths are tracked
+	maxWebServers = 10000
+	// maxWebPaths caps the paths tracked per server
+	maxWebPaths = 5000
+	// maxWebClients caps the distinct clients remembered per server or path
+	maxWebClients = 1024
+	// maxPendingFiles caps the entries waiting for correlation
+	maxPendingFiles = 50000
+)
+
+// webShellMIMETypes are response types a script or static file should not
+// serve: executables and archives of dumped data
+var webShellMIMETypes = map[string]bool{
+	"application/x-dosexec":             true,
+	"application/x-executable":          true,
+	"application/x-elf":                 true,
+	"application/x-sharedlib":           true,
+	"application/zip":                   true,
+	"application/x-rar":                 true,
+	"application/x-7z-compressed":       true,
+	"application/x-tar":                 true,
+	"application/gzip":                  true,
+	"application/x-gzip":                true,
+	"text/x-php":                        true,
+	"text/x-shellscript":                true,
+	"application/x-httpd-php":           true,
+	"application/x-ms-shortcut":         true,
+	"application/vnd.ms-cab-compressed": true,
+}
+
+// WebShellRules holds the precompiled web shell patterns of a rules file
+type WebShellRules struct {
+	scriptExtensions map[string]bool
+	staticExtensions map[string]bool
+	commandParams    []webShellPattern
+	userAgents       []webShellPattern
+}
+
+type webShellPattern struct {
+	name  string
+	re    *regexp.Regexp
+	score float64
+}
+
+type webShellRuleFile struct {
+	ScriptExtensions []string              `yaml:"script_extensions"`
+	StaticExtensions []string              `yaml:"static_extensions"`
+	CommandParams    []webShellPatternSpec `yaml:"command_params"`
+	UserAgents       []webShellPatternSpec `yaml:"user_agents"`
+}
+
+type webShellPatternSpec struct {
+	Name    string  `yaml:"name"`
+	Pattern string  `yaml:"pattern"`
+	Score   float64 `yaml:"score"`
+}
+
+// CompileWebShellRules parses and compiles a YAML rules file
+func CompileWebShellRules(data []byte) (*WebShellRules, error) {
+	var file webShellRuleFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse web shell rules: %w", err)
+	}
+
+	rules := &WebShellRules{
+		scriptExtensions: extensionSet(file.ScriptExtensions),
+		staticExtensions: extensionSet(file.StaticExtensions),
+	}
+	var err error
+	if rules.commandParams, err = compilePatterns(file.CommandParams); err != nil {
+		return nil, err
+	}
+	if rules.userAgents, err = compilePatterns(file.UserAgents); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func extensionSet(extensions []string) map[string]bool {
+	set := make(map[string]bool, len(extensions))
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext != "" && !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		set[ext] = true
+	}
+	return set
+}
+
+func compilePatterns(specs []webShellPatternSpec) ([]webShellPattern, error) {
+	patterns := make([]webShellPattern, 0, len(specs))
+	for _, spec := range specs {
+		re, err := regexp.Compile("(?i)" + spec.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid web shell rule %q: %w", spec.Name, err)
+		}
+		patterns = append(patterns, webShellPattern{name: spec.Name, re: re, score: spec.Score})
+	}
+	return patterns, nil
+}
+
+// MatchCommand returns the command parameter rules matching s and their
+// combined score, at most 1
+func (r *WebShellRules) MatchCommand(s string) ([]string, float64) {
+	return matchPatterns(r.commandParams, s)
+}
+
+// MatchUserAgent returns the user agent rules matching ua and their
+// combined score, at most 1
+func (r *WebShellRules) MatchUserAgent(ua string) ([]string, float64) {
+	return matchPatterns(r.userAgents, ua)
+}
+
+func matchPatterns(patterns []webShellPattern, s string) ([]string, float64) {
+	if s == "" {
+		return nil, 0
+	}
+	var names []string
+	score := 0.0
+	for _, p := range patterns {
+		if p.re.MatchString(s) {
+			names = append(names, p.name)
+			score += p.score
+		}
+	}
+	return names, clamp01(score)
+}
+
+// HTTPTransaction is one request and response pair from http.log
+type HTTPTransaction struct {
+	Timestamp     time.Time
+	UID           string
+	SrcIP         string
+	SrcPort       int
+	DstIP         string
+	DstPort       int
+	Method        string
+	Host          string
+	URI           string
+	UserAgent     string
+	StatusCode    int
+	RequestBytes  int64
+	ResponseBytes int64
+	RespFUIDs     []string
+	RespMIMETypes []string
+}
+
+// HTTPFile is a response body from files.log
+type HTTPFile struct {
+	Timestamp time.Time
+	FUID      string
+	MIMEType  string
+	Filename  string
+	Bytes     int64
+}
+
+// WebShellSettings holds the web shell detector thresholds
+type WebShellSettings struct {
+	// MinScore is the score needed for an alert
+	MinScore float64
+	// RareClients is the most distinct clients a rarely accessed path has
+	RareClients int
+	// MinServerClients is the distinct clients a server needs before any of
+	// its paths counts as rare
+	MinServerClients int
+}
+
+// WebShellDetector scores HTTP transactions to internal servers for web
+// shell use. It learns which clients access each script so that requests
+// to scripts only one or two clients ever touch stand out, and correlates
+// responses with files.log to catch scripts and images serving binaries.
+type WebShellDetector struct {
+	mu       sync.Mutex
+	logger   *logrus.Logger
+	rules    *WebShellRules
+	settings WebShellSettings
+	servers  map[string]*webServer
+	// serverOrder picks the server to evict when maxWebServers is reached
+	serverOrder *recency.List[string]
+	// files and pending hold whichever of a response's http.log and
+	// files.log entries arrived first, keyed by file ID
+	files    map[string]*HTTPFile
+	pending  map[string]*HTTPTransaction
+	reported map[string]time.Time
+	latest   time.Time
+}
+
+type webServer struct {
+	clients  map[string]bool
+	paths    map[string]*webPath
+	order    *recency.List[string]
+	lastSeen time.Time
+}
+
+type webPath struct {
+	clients  map[string]bool
+	lastSeen time.Time
+}
+
+// NewWebShellDetector creates a detector using rules
+func NewWebShellDetector(logger *logrus.Logger, rules *WebShellRules, settings WebShellSettings) *WebShellDetector {
+	return &WebShellDetector{
+		logger:   logger,
+		rules:    rules,
+		settings: settings,
+		servers:  make(map[string]*webServer),
+		files:    make(map[string]*HTTPFile),
+		pending:  make(map[string]*HTTPTransaction),
+		reported: make(map[string]time.Time),
+
+		serverOrder: recency.New[string](),
+	}
+}
+
+// SetSettings updates the detector thresholds
+func (d *WebShellDetector) SetSettings(settings WebShellSettings) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.settings = settings
+}
+
+// SetRules replaces the rules used for new transactions
+func (d *WebShellDetector) SetRules(rules *WebShellRules) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rules = rules
+}
+
+// Observe records a transaction and returns an alert when it looks like
+// web shell use. Transactions whose response body is not yet in files.log
+// are kept and scored again once it arrives.
+func (d *WebShellDetector) Observe(tx *HTTPTransaction) *models.Alert {
+	if tx.SrcIP == "" || !isInternalIP(tx.DstIP) {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if tx.Timestamp.IsZero() {
+		tx.Timestamp = time.Now()
+	}
+	if tx.Timestamp.After(d.latest) {
+		d.latest = tx.Timestamp
+	}
+	d.record(tx)
+
+	var file *HTTPFile
+	for _, fuid := range tx.RespFUIDs {
+		if f, ok := d.files[fuid]; ok {
+			file = f
+			delete(d.files, fuid)
+			break
+		}
+	}
+	if alert := d.evaluate(tx, file); alert != nil {
+		return alert
+	}
+	if file == nil && len(tx.RespFUIDs) > 0 && len(d.pending) < maxPendingFiles {
+		d.pending[tx.RespFUIDs[0]] = tx
+	}
+	return nil
+}
+
+// ObserveFile records a response body from files.log and returns an alert
+// when it completes a suspicious transaction
+func (d *WebShellDetector) ObserveFile(file *HTTPFile) *models.Alert {
+	if file.FUID == "" {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if file.Timestamp.After(d.latest) {
+		d.latest = file.Timestamp
+	}
+	tx, ok := d.pending[file.FUID]
+	if !ok {
+		if len(d.files) < maxPendingFiles {
+			d.files[file.FUID] = file
+		}
+		return nil
+	}
+	delete(d.pending, file.FUID)
+	return d.evaluate(tx, file)
+}
+
+// Cleanup forgets servers and paths idle since before cutoff and expires
+// uncorrelated entries
+func (d *WebShellDetector) Cleanup(cutoff time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, server := range d.servers {
+		if server.lastSeen.Before(cutoff) {
+			delete(d.servers, key)
+			d.serverOrder.Remove(key)
+			continue
+		}
+		for p, stats := range server.paths {
+			if stats.lastSeen.Before(cutoff) {
+				delete(server.paths, p)
+				server.order.Remove(p)
+			}
+		}
+	}
+
+	expired := d.latest.Add(-webShellCorrelation)
+	for fuid, file := range d.files {
+		if file.Timestamp.Before(expired) {
+			delete(d.files, fuid)
+		}
+	}
+	for fuid, tx := range d.pending {
+		if tx.Timestamp.Before(expired) {
+			delete(d.pending, fuid)
+		}
+	}
+	for key, ts := range d.reported {
+		if ts.Before(d.latest.Add(-webShellDedupe)) {
+			delete(d.reported, key)
+		}
+	}
+}
+
+// record counts the client against the server and path
+func (d *WebShellDetector) record(tx *HTTPTransaction) {
+	server, exists := d.servers[tx.DstIP]
+	if !exists {
+		if len(d.servers) >= maxWebServers {
+			d.evictServer()
+		}
+		server = &webServer{
+			clients: make(map[string]bool),
+			paths:   make(map[string]*webPath),
+			order:   recency.New[string](),
+		}
+		d.servers[tx.DstIP] = server
+	}
+	d.serverOrder.Touch(tx.DstIP)
+	if tx.Timestamp.After(server.lastSeen) {
+		server.lastSeen = tx.Timestamp
+	}
+	if len(server.clients) < maxWebClients {
+		server.clients[tx.SrcIP] = true
+	}
+
+	p := requestPath(tx)
+	stats, exists := server.paths[p]
+	if !exists {
+		if len(server.paths) >= maxWebPaths {
+			evictPath(server)
+		}
+		stats = &webPath{clients: make(map[string]bool)}
+		server.paths[p] = stats
+	}
+	server.order.Touch(p)
+	if tx.Timestamp.After(stats.lastSeen) {
+		stats.lastSeen = tx.Timestamp
+	}
+	if len(stats.clients) < maxWebClients {
+		stats.clients[tx.SrcIP] = true
+	}
+}
+
+// pathStats returns the tracked clients of a server path, or nil if the
+// server or path is not tracked
+func (d *WebShellDetector) pathStats(server, p string) *webPath {
+	srv, ok := d.servers[server]
+	if !ok {
+		return nil
+	}
+	return srv.paths[p]
+}
+
+// evictServer forgets the least recently requested server
+func (d *WebShellDetector) evictServer() {
+	if oldest, ok := d.serverOrder.Oldest(); ok {
+		delete(d.servers, oldest)
+		d.serverOrder.Remove(oldest)
+	}
+}
+
+// evictPath forgets the server's least recently requested path
+func evictPath(server *webServer) {
+	if oldest, ok := server.order.Oldest(); ok {
+		delete(server.paths, oldest)
+		server.order.Remove(oldest)
+	}
+}
+
+// evaluate scores a transaction together with its response body, which
+// may be nil
+func (d *WebShellDetector) evaluate(tx *HTTPTransaction, file *HTTPFile) *models.Alert {
+	if d.rules == nil {
+		return nil
+	}
+
+	p := requestPath(tx)
+	ext := strings.ToLower(path.Ext(p))
+	script := d.rules.scriptExtensions[ext]
+	post := strings.EqualFold(tx.Method, "POST")
+
+	score := 0.0
+	var signals, rules []string
+
+	// Scripts only one or two clients ever touch on a busy server. A
+	// transaction scored when its file arrives may have had its server or
+	// path evicted since it was recorded.
+	if stats := d.pathStats(tx.DstIP, p); script && stats != nil &&
+		len(d.servers[tx.DstIP].clients) >= d.settings.MinServerClients &&
+		len(stats.clients) <= d.settings.RareClients {
+		score += 0.2
+		signals = append(signals, "rare_script")
+		if post {
+			score += 0.1
+			signals = append(signals, "rare_script_post")
+		}
+	}
+
+	// Short commands returning long output
+	if script && tx.RequestBytes <= 1024 && tx.ResponseBytes >= 4096 &&
+		tx.ResponseBytes >= 10*maxInt64(tx.RequestBytes, 1) {
+		score += 0.15
+		signals = append(signals, "small_request_large_response")
+	}
+
+	query := tx.URI
+	if i := strings.IndexByte(query, '?'); i >= 0 {
+		query = query[i+1:]
+		if decoded, err := url.QueryUnescape(query); err == nil {
+			query = decoded
+		}
+		if matched, s := d.rules.MatchCommand(query); len(matched) > 0 {
+			score += s
+			signals = append(signals, "command_parameters")
+			rules = append(rules, matched...)
+		}
+	}
+
+	if matched, s := d.rules.MatchUserAgent(tx.UserAgent); len(matched) > 0 {
+		score += s
+		signals = append(signals, "webshell_user_agent")
+		rules = append(rules, matched...)
+	}
+
+	mimeTypes := append([]string(nil), tx.RespMIMETypes...)
+	if file != nil && file.MIMEType != "" {
+		mimeTypes = append(mimeTypes, file.MIMEType)
+	}
+	if mismatch, s := d.mimeMismatch(ext, script, tx.StatusCode, mimeTypes); mismatch != "" {
+		score += s
+		signals = append(signals, "mime_mismatch")
+		mimeTypes = []string{mismatch}
+	}
+
+	score = clamp01(score)
+	if score < d.settings.MinScore {
+		return nil
+	}
+
+	key := tx.SrcIP + "|" + tx.DstIP + "|" + tx.Host + "|" + p
+	if last, ok := d.reported[key]; ok && tx.Timestamp.Sub(last) < webShellDedupe {
+		return nil
+	}
+	d.reported[key] = tx.Timestamp
+
+	d.logger.Warnf("Web shell activity: %s:%d -> %s:%d %s %s%s (score %.2f, %s)",
+		tx.SrcIP, tx.SrcPort, tx.DstIP, tx.DstPort, tx.Method, tx.Host, tx.URI, score, strings.Join(signals, ","))
+
+	details := map[string]interface{}{
+		"uid":            tx.UID,
+		"src_port":       tx.SrcPort,
+		"host":           tx.Host,
+		"uri":            tx.URI,
+		"method":         tx.Method,
+		"user_agent":     tx.UserAgent,
+		"status_code":    tx.StatusCode,
+		"request_bytes":  tx.RequestBytes,
+		"response_bytes": tx.ResponseBytes,
+		"mime_types":     mimeTypes,
+		"signals":        signals,
+		"rules":          rules,
+	}
+	if file != nil {
+		details["fuid"] = file.FUID
+		details["filename"] = file.Filename
+	}
+
+	severity := "medium"
+	switch {
+	case score >= 0.9:
+		severity = "critical"
+	case score >= 0.75:
+		severity = "high"
+	}
+
+	return &models.Alert{
+		Timestamp:   tx.Timestamp,
+		Severity:    severity,
+		Type:        "webshell",
+		SrcIP:       tx.SrcIP,
+		DstIP:       tx.DstIP,
+		DstPort:     tx.DstPort,
+		Protocol:    "tcp",
+		Confidence:  score,
+		Description: fmt.Sprintf("疑似WebShell访问: %s %s%s", tx.Method, tx.Host, tx.URI),
+		Details:     marshalDetails(details),
+	}
+}
+
+// mimeMismatch returns the first response type a script or static file
+// should not serve and how suspicious it is
+func (d *WebShellDetector) mimeMismatch(ext string, script bool, status int, mimeTypes []string) (string, float64) {
+	static := d.rules.staticExtensions[ext]
+	if !script && !static {
+		return "", 0
+	}
+	for _, mime := range mimeTypes {
+		mime = strings.ToLower(mime)
+		switch {
+		case webShellMIMETypes[mime] && static:
+			// An image or stylesheet URL delivering a binary or script
+			return mime, 0.6
+		case webShellMIMETypes[mime]:
+			return mime, 0.3
+		case static && mime == "text/html" && status == 200:
+			// Images answering with a page were replaced by a script;
+			// error pages are expected to be HTML
+			return mime, 0.3
+		}
+	}
+	return "", 0
+}
+
+// requestPath returns the lower-cased path of a request without its query
+func requestPath(tx *HTTPTransaction) string {
+	p := tx.URI
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	return strings.ToLower(p)
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/Cxiyuan/NTA/pkg/models"
 	"github.com/gin-gonic/gin"
@@ -68,7 +69,7 @@ func (s *Server) login(c *gin.Context) {
 	}
 
 	token, err := s.authMiddleware.GenerateToken(
-		string(user.ID),
+		strconv.FormatUint(uint64(user.ID), 10),
 		user.Username,
 		roles,
 	)
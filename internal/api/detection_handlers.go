@@ -1,7 +1,9 @@
 package api
 
 import (
+	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/Cxiyuan/NTA/internal/detector"
 	"github.com/Cxiyuan/NTA/pkg/models"
@@ -19,13 +21,7 @@ func (s *Server) detectDGA(c *gin.Context) {
 	}
 
 	advancedDetector := detector.NewAdvancedDetector(s.logger)
-	isDGA, confidence := advancedDetector.DetectDGA(req.Domain)
-
-	c.JSON(http.StatusOK, gin.H{
-		"is_dga":     isDGA,
-		"confidence": confidence,
-		"domain":     req.Domain,
-	})
+	c.JSON(http.StatusOK, advancedDetector.ScoreDomain(req.Domain))
 }
 
 func (s *Server) detectDNSTunnel(c *gin.Context) {
@@ -39,20 +35,32 @@ func (s *Server) detectDNSTunnel(c *gin.Context) {
 		return
 	}
 
-	var connections []models.Connection
-	s.db.Where("src_ip = ? AND dst_port = 53", req.SrcIP).
-		Order("timestamp DESC").
-		Limit(100).
-		Find(&connections)
+	if req.TimeWindow <= 0 {
+		req.TimeWindow = 300
+	}
 
-	advancedDetector := detector.NewAdvancedDetector(s.logger)
-	isTunnel, confidence := advancedDetector.DetectDNSTunnel(connections)
+	// DNS state lives in the detector pipeline, so report what it found for
+	// this source within the window
+	var alerts []models.Alert
+	since := time.Now().Add(-time.Duration(req.TimeWindow) * time.Second)
+	if err := s.db.Where("type = ? AND src_ip = ? AND timestamp > ?", "dns_tunnel", req.SrcIP, since).
+		Order("confidence DESC").
+		Limit(1).
+		Find(&alerts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"is_tunnel":   isTunnel,
-		"confidence":  confidence,
-		"query_count": len(connections),
-	})
+	result := detector.DNSTunnelResult{}
+	if len(alerts) > 0 {
+		if err := json.Unmarshal([]byte(alerts[0].Details), &result); err != nil {
+			s.logger.Warnf("Invalid dns_tunnel alert details: %v", err)
+		}
+		result.IsTunnel = true
+		result.Confidence = alerts[0].Confidence
+	}
+
+	c.JSON(http.StatusOK, result)
 }
 
 func (s *Server) detectC2(c *gin.Context) {
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Cxiyuan/NTA/internal/kafka"
+	"github.com/gin-gonic/gin"
+)
+
+func (s *Server) listDeadLetters(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	entries, err := s.kafkaManager.DeadLetters().List(c.Request.Context(), limit)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	if entries == nil {
+		entries = []kafka.DeadLetter{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"topic":   s.kafkaManager.DeadLetters().Topic(),
+		"entries": entries,
+		"total":   len(entries),
+	})
+}
+
+func (s *Server) getDeadLetter(c *gin.Context) {
+	partition, offset, ok := parseDeadLetterPosition(c)
+	if !ok {
+		return
+	}
+
+	entry, err := s.kafkaManager.DeadLetters().Get(c.Request.Context(), partition, offset)
+	if err != nil {
+		respondDeadLetterError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
+
+func (s *Server) replayDeadLetter(c *gin.Context) {
+	partition, offset, ok := parseDeadLetterPosition(c)
+	if !ok {
+		return
+	}
+
+	entry, err := s.kafkaManager.DeadLetters().Replay(c.Request.Context(), partition, offset)
+	if err != nil {
+		respondDeadLetterError(c, err)
+		return
+	}
+
+	username, _ := c.Get("username")
+	s.auditService.Log(username.(string), "replay_dead_letter", fmt.Sprintf("%d/%d", partition, offset), map[string]interface{}{
+		"topic":     entry.Topic,
+		"partition": entry.Partition,
+		"offset":    entry.Offset,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"status": "replayed", "topic": entry.Topic})
+}
+
+func parseDeadLetterPosition(c *gin.Context) (int, int64, bool) {
+	partition, err := strconv.Atoi(c.Param("partition"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid partition"})
+		return 0, 0, false
+	}
+
+	offset, err := strconv.ParseInt(c.Param("offset"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+		return 0, 0, false
+	}
+
+	return partition, offset, true
+}
+
+func respondDeadLetterError(c *gin.Context, err error) {
+	if errors.Is(err, kafka.ErrDeadLetterNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+		return
+	}
+	c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Cxiyuan/NTA/internal/encryption"
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/gin-gonic/gin"
+)
+
+// maxFingerprintImport caps an uploaded fingerprint list
+const maxFingerprintImport = 64 << 20
+
+func (s *Server) listFingerprints(c *gin.Context) {
+	fingerprints := s.fingerprints.List(c.Query("type"))
+
+	if label := strings.ToLower(c.Query("label")); label != "" {
+		filtered := fingerprints[:0]
+		for _, fp := range fingerprints {
+			if strings.Contains(strings.ToLower(fp.Label), label) {
+				filtered = append(filtered, fp)
+			}
+		}
+		fingerprints = filtered
+	}
+	if category := c.Query("category"); category != "" {
+		filtered := fingerprints[:0]
+		for _, fp := range fingerprints {
+			if fp.Category == category {
+				filtered = append(filtered, fp)
+			}
+		}
+		fingerprints = filtered
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total":        len(fingerprints),
+		"fingerprints": fingerprints,
+	})
+}
+
+func (s *Server) checkFingerprint(c *gin.Context) {
+	matches := s.fingerprints.Match(&models.TLSHandshake{
+		JA3:  c.Query("ja3"),
+		JA3S: c.Query("ja3s"),
+		JA4:  c.Query("ja4"),
+		JA4S: c.Query("ja4s"),
+	})
+	if fp := s.fingerprints.LookupCertificate(c.Query("cert")); fp != nil {
+		matches = append(matches, *fp)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"matched": len(matches) > 0,
+		"matches": matches,
+	})
+}
+
+// addFingerprint adds or merges a fingerprint. With override=true it also
+// relabels a malicious fingerprint, e.g. to mark a false positive as an
+// application.
+func (s *Server) addFingerprint(c *gin.Context) {
+	var fp models.TLSFingerprint
+	if err := c.ShouldBindJSON(&fp); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if fp.Source == "" {
+		fp.Source = "manual"
+	}
+	if err := encryption.NormalizeFingerprint(&fp); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	upsert := s.fingerprints.Upsert
+	override := c.Query("override") == "true"
+	if override {
+		upsert = s.fingerprints.Override
+	}
+	added, _, err := upsert(c.Request.Context(), []models.TLSFingerprint{fp})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	username, _ := c.Get("username")
+	s.auditService.Log(username.(string), "add_tls_fingerprint", fp.Value, map[string]interface{}{
+		"type":     fp.Type,
+		"label":    fp.Label,
+		"override": override,
+	})
+
+	status := http.StatusOK
+	if added > 0 {
+		status = http.StatusCreated
+	}
+	c.JSON(status, s.fingerprints.Lookup(fp.Type, fp.Value))
+}
+
+// deleteFingerprint removes a fingerprint added by a feed, an import or an
+// analyst
+func (s *Server) deleteFingerprint(c *gin.Context) {
+	fp := models.TLSFingerprint{Type: c.Param("type"), Value: c.Param("value")}
+	if err := encryption.NormalizeFingerprint(&fp); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deleted, err := s.fingerprints.Delete(c.Request.Context(), fp.Type, fp.Value)
+	if errors.Is(err, encryption.ErrBuiltinFingerprint) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "fingerprint not found"})
+		return
+	}
+
+	username, _ := c.Get("username")
+	s.auditService.Log(username.(string), "delete_tls_fingerprint", fp.Value, map[string]interface{}{
+		"type": fp.Type,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// importFingerprints loads a list uploaded as the "file" form field or as
+// the request body. The format query parameter selects json (default),
+// sslbl_ja3, sslbl_cert or ja4db.
+func (s *Server) importFingerprints(c *gin.Context) {
+	format := c.DefaultQuery("format", encryption.FormatJSON)
+
+	body := io.Reader(http.MaxBytesReader(c.Writer, c.Request.Body, maxFingerprintImport))
+	if header, err := c.FormFile("file"); err == nil {
+		file, err := header.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	fingerprints, err := encryption.ParseFingerprints(format, "import", body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	valid := fingerprints[:0]
+	var rejected []string
+	for _, fp := range fingerprints {
+		if err := encryption.NormalizeFingerprint(&fp); err != nil {
+			rejected = append(rejected, err.Error())
+			continue
+		}
+		valid = append(valid, fp)
+	}
+
+	added, updated, err := s.fingerprints.Upsert(c.Request.Context(), valid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	username, _ := c.Get("username")
+	s.auditService.Log(username.(string), "import_tls_fingerprints", format, map[string]interface{}{
+		"added":    added,
+		"updated":  updated,
+		"rejected": len(rejected),
+	})
+
+	if len(rejected) > 100 {
+		rejected = rejected[:100]
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"added":    added,
+		"updated":  updated,
+		"rejected": rejected,
+	})
+}
+
+// exportFingerprints returns the fingerprints in the format accepted by
+// importFingerprints
+func (s *Server) exportFingerprints(c *gin.Context) {
+	fingerprints := s.fingerprints.List(c.Query("type"))
+	for i := range fingerprints {
+		fingerprints[i].ID = 0
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=tls_fingerprints.json")
+	c.JSON(http.StatusOK, fingerprints)
+}
@@ -1,11 +1,15 @@
 package api
 
 import (
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/Cxiyuan/NTA/internal/asset"
 	"github.com/Cxiyuan/NTA/internal/audit"
+	"github.com/Cxiyuan/NTA/internal/detector"
+	"github.com/Cxiyuan/NTA/internal/encryption"
 	"github.com/Cxiyuan/NTA/internal/kafka"
 	"github.com/Cxiyuan/NTA/internal/license"
 	"github.com/Cxiyuan/NTA/internal/probe"
@@ -38,6 +42,8 @@ type Server struct {
 	pcapStorage    *pcap.Storage
 	zeekManager    *zeek.Manager
 	kafkaManager   *kafka.Manager
+	detection      *detector.ConfigStore
+	fingerprints   *encryption.FingerprintStore
 }
 
 // NewServer creates a new API server
@@ -54,6 +60,8 @@ func NewServer(
 	pcapStorage *pcap.Storage,
 	zeekManager *zeek.Manager,
 	kafkaManager *kafka.Manager,
+	detection *detector.ConfigStore,
+	fingerprints *encryption.FingerprintStore,
 	jwtSecret string,
 ) *Server {
 	router := gin.Default()
@@ -75,6 +83,8 @@ func NewServer(
 		pcapStorage:    pcapStorage,
 		zeekManager:    zeekManager,
 		kafkaManager:   kafkaManager,
+		detection:      detection,
+		fingerprints:   fingerprints,
 	}
 
 	s.setupRoutes()
@@ -106,6 +116,7 @@ func (s *Server) setupRoutes() {
 	{
 		assets.GET("", s.listAssets)
 		assets.GET("/:ip", s.getAsset)
+		assets.PUT("/:ip/role", s.authMiddleware.RequireRole("admin"), s.updateAssetRole)
 	}
 
 	alerts := api.Group("/alerts")
@@ -121,6 +132,16 @@ func (s *Server) setupRoutes() {
 		threatIntel.POST("/update", s.authMiddleware.RequireRole("admin"), s.updateThreatIntel)
 	}
 
+	fingerprints := api.Group("/fingerprints")
+	{
+		fingerprints.GET("", s.listFingerprints)
+		fingerprints.GET("/check", s.checkFingerprint)
+		fingerprints.GET("/export", s.exportFingerprints)
+		fingerprints.POST("", s.authMiddleware.RequireRole("admin", "analyst"), s.addFingerprint)
+		fingerprints.POST("/import", s.authMiddleware.RequireRole("admin"), s.importFingerprints)
+		fingerprints.DELETE("/:type/:value", s.authMiddleware.RequireRole("admin"), s.deleteFingerprint)
+	}
+
 	probes := api.Group("/probes")
 	{
 		probes.POST("/register", s.registerProbe)
@@ -199,6 +220,7 @@ func (s *Server) setupRoutes() {
 	config.Use(s.authMiddleware.RequireRole("admin"))
 	{
 		config.GET("", s.getSystemConfig)
+		config.GET("/detection", s.getDetectionConfig)
 		config.PUT("/detection", s.updateDetectionConfig)
 		config.PUT("/backup", s.updateBackupConfig)
 		config.GET("/threat-intel", s.getThreatIntelConfig)
@@ -222,6 +244,14 @@ func (s *Server) setupRoutes() {
 		builtinProbe.GET("/interfaces", s.getBuiltinProbeInterfaces)
 	}
 
+	deadLetters := api.Group("/dlq")
+	deadLetters.Use(s.authMiddleware.RequireRole("admin", "analyst"))
+	{
+		deadLetters.GET("", s.listDeadLetters)
+		deadLetters.GET("/:partition/:offset", s.getDeadLetter)
+		deadLetters.POST("/:partition/:offset/replay", s.authMiddleware.RequireRole("admin"), s.replayDeadLetter)
+	}
+
 	// Stream processing routes
 	streamHandlers := NewStreamProcessingHandlers(s.kafkaManager)
 	streamHandlers.RegisterRoutes(api)
@@ -251,6 +281,48 @@ func (s *Server) getAsset(c *gin.Context) {
 	c.JSON(http.StatusOK, asset)
 }
 
+// updateAssetRole tags an asset, e.g. as a domain controller for the
+// DCSync and DCShadow detection or as a management host whose WinRM
+// sessions are expected
+func (s *Server) updateAssetRole(c *gin.Context) {
+	ip := c.Param("ip")
+	if net.ParseIP(ip) == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ip"})
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	switch req.Role {
+	case "", models.AssetRoleDomainController, models.AssetRoleManagementHost:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown role"})
+		return
+	}
+
+	asset := models.Asset{IP: ip, FirstSeen: time.Now(), LastSeen: time.Now()}
+	if err := s.db.Where("ip = ?", ip).FirstOrCreate(&asset).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.db.Model(&asset).Update("role", req.Role).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	asset.Role = req.Role
+	s.assetScanner.SetRole(ip, req.Role)
+
+	username, _ := c.Get("username")
+	s.auditService.Log(username.(string), "update_asset_role", ip, map[string]interface{}{"role": req.Role})
+
+	c.JSON(http.StatusOK, asset)
+}
+
 func (s *Server) listAlerts(c *gin.Context) {
 	var alerts []models.Alert
 	
@@ -23,67 +23,58 @@ func (h *StreamProcessingHandlers) RegisterRoutes(r *gin.RouterGroup) {
 		stream.GET("/kafka/status", h.GetKafkaStatus)
 		stream.GET("/kafka/topics", h.GetKafkaTopics)
 		stream.GET("/kafka/consumer-groups", h.GetConsumerGroups)
+		stream.GET("/kafka/consumer-groups/:group", h.GetConsumerGroup)
 	}
 }
 
 func (h *StreamProcessingHandlers) GetKafkaStatus(c *gin.Context) {
 	status, err := h.kafkaManager.GetKafkaStatus(c.Request.Context())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, status)
 }
 
+// GetKafkaTopics lists topics with the lag of one consumer group
+// (?group=, the Zeek consumer group by default)
 func (h *StreamProcessingHandlers) GetKafkaTopics(c *gin.Context) {
-	topics := []gin.H{
-		{
-			"name":       "zeek-conn",
-			"partitions": 8,
-			"messages":   125000,
-			"lag":        120,
-		},
-		{
-			"name":       "zeek-dns",
-			"partitions": 8,
-			"messages":   85000,
-			"lag":        50,
-		},
-		{
-			"name":       "zeek-http",
-			"partitions": 8,
-			"messages":   45000,
-			"lag":        30,
-		},
-		{
-			"name":       "zeek-ssl",
-			"partitions": 8,
-			"messages":   32000,
-			"lag":        15,
-		},
-		{
-			"name":       "zeek-notice",
-			"partitions": 8,
-			"messages":   1200,
-			"lag":        0,
-		},
+	ctx := c.Request.Context()
+
+	topics, err := h.kafkaManager.ListTopics(ctx)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	groupID := c.DefaultQuery("group", "nta-consumer-group")
+	if group, err := h.kafkaManager.GetConsumerGroup(ctx, groupID); err == nil {
+		lagByTopic := make(map[string]int64)
+		for _, p := range group.PartitionLags {
+			lagByTopic[p.Topic] += p.Lag
+		}
+		for i := range topics {
+			topics[i].Lag = lagByTopic[topics[i].Name]
+		}
+	}
+
+	if topics == nil {
+		topics = []kafka.TopicInfo{}
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"topics": topics,
 		"total":  len(topics),
+		"group":  groupID,
 	})
 }
 
 func (h *StreamProcessingHandlers) GetConsumerGroups(c *gin.Context) {
-	groups := []gin.H{
-		{
-			"group_id": "nta-consumer-group",
-			"members":  1,
-			"lag":      0,
-			"state":    "Stable",
-		},
+	groups, err := h.kafkaManager.ListConsumerGroups(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -91,3 +82,13 @@ func (h *StreamProcessingHandlers) GetConsumerGroups(c *gin.Context) {
 		"total":  len(groups),
 	})
 }
+
+func (h *StreamProcessingHandlers) GetConsumerGroup(c *gin.Context) {
+	group, err := h.kafkaManager.GetConsumerGroup(c.Request.Context(), c.Param("group"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, group)
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"encoding/json"
 	"net/http"
 	"strconv"
 
@@ -119,22 +120,14 @@ func (s *Server) uploadLicense(c *gin.Context) {
 }
 
 func (s *Server) getSystemConfig(c *gin.Context) {
+	detection, err := s.detection.Load(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	config := map[string]interface{}{
-		"detection": map[string]interface{}{
-			"scan": map[string]interface{}{
-				"threshold":     20,
-				"time_window":   300,
-				"min_fail_rate": 0.6,
-			},
-			"auth": map[string]interface{}{
-				"fail_threshold": 5,
-				"pth_window":     3600,
-			},
-			"ml": map[string]interface{}{
-				"enabled":       true,
-				"contamination": 0.01,
-			},
-		},
+		"detection": detection,
 		"backup": map[string]interface{}{
 			"enabled":        true,
 			"backup_dir":     "/opt/nta-probe/backups",
@@ -145,17 +138,54 @@ func (s *Server) getSystemConfig(c *gin.Context) {
 	c.JSON(http.StatusOK, config)
 }
 
+func (s *Server) getDetectionConfig(c *gin.Context) {
+	detection, err := s.detection.Load(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, detection)
+}
+
+// updateDetectionConfig merges the request into the current settings, so
+// partial updates leave other sections untouched. Running detectors pick
+// up the change without a restart.
 func (s *Server) updateDetectionConfig(c *gin.Context) {
-	var config map[string]interface{}
-	if err := c.ShouldBindJSON(&config); err != nil {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var changes map[string]interface{}
+	if err := json.Unmarshal(body, &changes); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	config, err := s.detection.Load(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := json.Unmarshal(body, &config); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := config.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.detection.Save(c.Request.Context(), config); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	username, _ := c.Get("username")
-	s.auditService.Log(username.(string), "update_detection_config", "", config)
+	s.auditService.Log(username.(string), "update_detection_config", "", changes)
 
-	c.JSON(http.StatusOK, gin.H{"status": "updated"})
+	c.JSON(http.StatusOK, gin.H{"status": "updated", "detection": config})
 }
 
 func (s *Server) updateBackupConfig(c *gin.Context) {
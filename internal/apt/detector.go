@@ -1,6 +1,7 @@
 package apt
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
@@ -101,6 +102,27 @@ func (d *Detector) mapEventToPhase(eventType string) string {
 		"beacon_traffic":        "command_control",
 		"data_exfiltration":     "actions_objectives",
 		"lateral_movement":      "actions_objectives",
+		"lateral_scan":          "reconnaissance",
+		"dga_domain":            "command_control",
+		"dns_tunnel":            "command_control",
+		"dga_nxdomain_burst":    "command_control",
+		"c2_beacon":             "command_control",
+		"pass_the_hash":         "actions_objectives",
+		"psexec":                "actions_objectives",
+		"wmi_exec":              "actions_objectives",
+		"service_exec":          "actions_objectives",
+		"scheduled_task_exec":   "actions_objectives",
+		"dcom_exec":             "actions_objectives",
+		"winrm_exec":            "actions_objectives",
+		"webshell":              "installation",
+		"brute_force":           "exploitation",
+		"password_spray":        "exploitation",
+		"brute_force_success":   "exploitation",
+		"kerberoasting":         "exploitation",
+		"asrep_roasting":        "exploitation",
+		"golden_ticket":         "installation",
+		"dcsync":                "actions_objectives",
+		"dcshadow":              "installation",
 	}
 
 	return mapping[eventType]
@@ -20,6 +20,8 @@ type Scanner struct {
 	logger *logrus.Logger
 	assets map[string]*models.Asset
 	mu     sync.RWMutex
+	// handlers see every packet captured for discovery
+	handlers []func(gopacket.Packet)
 }
 
 // NewScanner creates a new asset scanner
@@ -31,6 +33,13 @@ func NewScanner(db *gorm.DB, logger *logrus.Logger) *Scanner {
 	}
 }
 
+// AddPacketHandler registers a function called with every captured packet,
+// e.g. to fingerprint TLS handshakes. Handlers must be added before
+// discovery starts.
+func (s *Scanner) AddPacketHandler(handler func(gopacket.Packet)) {
+	s.handlers = append(s.handlers, handler)
+}
+
 // DiscoverFromTraffic discovers assets from network traffic
 func (s *Scanner) DiscoverFromTraffic(ctx context.Context, iface string) error {
 	handle, err := pcap.OpenLive(iface, 1600, true, pcap.BlockForever)
@@ -52,6 +61,10 @@ func (s *Scanner) DiscoverFromTraffic(ctx context.Context, iface string) error {
 }
 
 func (s *Scanner) processPacket(packet gopacket.Packet) {
+	for _, handler := range s.handlers {
+		handler(packet)
+	}
+
 	// Extract IP layer
 	ipLayer := packet.Layer(layers.LayerTypeIPv4)
 	if ipLayer == nil {
@@ -125,6 +138,16 @@ func (s *Scanner) GetAssets() []*models.Asset {
 	return assets
 }
 
+// SetRole updates the role of a discovered asset
+func (s *Scanner) SetRole(ip, role string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if asset, exists := s.assets[ip]; exists {
+		asset.Role = role
+	}
+}
+
 // ScanNetwork performs active network scanning (nmap-style)
 func (s *Scanner) ScanNetwork(network string) ([]*models.Asset, error) {
 	// Parse CIDR
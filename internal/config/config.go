@@ -2,7 +2,11 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"time"
+	// Embedded so time zones resolve in minimal containers
+	_ "time/tzdata"
 
 	"gopkg.in/yaml.v3"
 )
@@ -12,6 +16,7 @@ type Config struct {
 	Server      ServerConfig      `yaml:"server"`
 	Zeek        ZeekConfig        `yaml:"zeek"`
 	Redis       RedisConfig       `yaml:"redis"`
+	Kafka       KafkaConfig       `yaml:"kafka"`
 	Database    DatabaseConfig    `yaml:"database"`
 	Detection   DetectionConfig   `yaml:"detection"`
 	ThreatIntel ThreatIntelConfig `yaml:"threat_intel"`
@@ -27,9 +32,19 @@ type ServerConfig struct {
 }
 
 type ZeekConfig struct {
+	// LogDir is the zeekctl log directory, holding the current/ spool link
+	// and the dated archive directories
 	LogDir    string `yaml:"log_dir"`
 	ScriptDir string `yaml:"script_dir"`
 	Interface string `yaml:"interface"`
+	// TailLogs processes logs from LogDir directly instead of via Kafka
+	TailLogs       bool   `yaml:"tail_logs"`
+	CheckpointFile string `yaml:"checkpoint_file"`
+}
+
+type KafkaConfig struct {
+	Brokers  []string `yaml:"brokers"`
+	DLQTopic string   `yaml:"dlq_topic"`
 }
 
 type RedisConfig struct {
@@ -44,25 +59,108 @@ type DatabaseConfig struct {
 }
 
 type DetectionConfig struct {
-	Scan ScanConfig `yaml:"scan"`
-	Auth AuthConfig `yaml:"auth"`
-	ML   MLConfig   `yaml:"ml"`
+	Scan ScanConfig `yaml:"scan" json:"scan"`
+	Auth AuthConfig `yaml:"auth" json:"auth"`
+	ML   MLConfig   `yaml:"ml" json:"ml"`
+	// BusinessHours is used to weigh activity outside working time
+	BusinessHours BusinessHoursConfig `yaml:"business_hours" json:"business_hours"`
+	// WebShellRules is a rules file replacing the built-in web shell rules.
+	// File paths are only read from the config file, never from the API.
+	WebShellRules string `yaml:"webshell_rules" json:"-"`
+	// FlowModel is an encrypted flow model written by cmd/flow-trainer
+	// replacing the built-in one
+	FlowModel string `yaml:"flow_model" json:"-"`
+	// Detectors holds per-detector settings keyed by detector name.
+	// Detectors without an entry run with their default thresholds.
+	Detectors map[string]DetectorConfig `yaml:"detectors" json:"detectors"`
 }
 
 type ScanConfig struct {
-	Threshold   int     `yaml:"threshold"`
-	TimeWindow  int     `yaml:"time_window"`
-	MinFailRate float64 `yaml:"min_fail_rate"`
+	Threshold   int     `yaml:"threshold" json:"threshold"`
+	TimeWindow  int     `yaml:"time_window" json:"time_window"`
+	MinFailRate float64 `yaml:"min_fail_rate" json:"min_fail_rate"`
 }
 
 type AuthConfig struct {
-	FailThreshold int `yaml:"fail_threshold"`
-	PTHWindow     int `yaml:"pth_window"`
+	FailThreshold int `yaml:"fail_threshold" json:"fail_threshold"`
+	PTHWindow     int `yaml:"pth_window" json:"pth_window"`
+	FailWindow    int `yaml:"fail_window" json:"fail_window"` // seconds
+}
+
+// BusinessHoursConfig defines working time. Start and End are hours of the
+// day, End is exclusive and may be smaller than Start for shifts past
+// midnight. Equal values disable the off-hours check.
+type BusinessHoursConfig struct {
+	Start    int    `yaml:"start" json:"start"`
+	End      int    `yaml:"end" json:"end"`
+	TimeZone string `yaml:"time_zone" json:"time_zone"` // IANA name, empty for server local time
+	WorkDays []int  `yaml:"work_days" json:"work_days"` // 0 is Sunday, empty for every day
+}
+
+// Location returns the configured time zone
+func (b BusinessHoursConfig) Location() (*time.Location, error) {
+	if b.TimeZone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(b.TimeZone)
 }
 
 type MLConfig struct {
-	Enabled       bool    `yaml:"enabled"`
-	Contamination float64 `yaml:"contamination"`
+	Enabled       bool    `yaml:"enabled" json:"enabled"`
+	Contamination float64 `yaml:"contamination" json:"contamination"`
+}
+
+type DetectorConfig struct {
+	Enabled    *bool              `yaml:"enabled" json:"enabled,omitempty"`
+	Thresholds map[string]float64 `yaml:"thresholds" json:"thresholds,omitempty"`
+}
+
+// Detector returns the settings for a detector, empty if none are configured
+func (c DetectionConfig) Detector(name string) DetectorConfig {
+	return c.Detectors[name]
+}
+
+// IsEnabled reports whether the detector should run; detectors are enabled
+// unless explicitly disabled
+func (d DetectorConfig) IsEnabled() bool {
+	return d.Enabled == nil || *d.Enabled
+}
+
+// Threshold returns a configured threshold or def when it is not set
+func (d DetectorConfig) Threshold(key string, def float64) float64 {
+	if v, ok := d.Thresholds[key]; ok {
+		return v
+	}
+	return def
+}
+
+func (c DetectionConfig) Validate() error {
+	if c.Scan.Threshold < 1 {
+		return errors.New("scan threshold must be positive")
+	}
+
+	if c.BusinessHours.Start < 0 || c.BusinessHours.Start > 23 ||
+		c.BusinessHours.End < 0 || c.BusinessHours.End > 24 {
+		return errors.New("business hours must be between 0 and 24")
+	}
+	if _, err := c.BusinessHours.Location(); err != nil {
+		return fmt.Errorf("invalid business hours time zone: %w", err)
+	}
+	for _, day := range c.BusinessHours.WorkDays {
+		if day < 0 || day > 6 {
+			return fmt.Errorf("invalid work day %d, expected 0 (Sunday) to 6", day)
+		}
+	}
+
+	for name, d := range c.Detectors {
+		for key, v := range d.Thresholds {
+			if v < 0 {
+				return fmt.Errorf("threshold %s of detector %s must not be negative", key, name)
+			}
+		}
+	}
+
+	return nil
 }
 
 type ThreatIntelConfig struct {
@@ -71,6 +169,27 @@ type ThreatIntelConfig struct {
 	UpdateHour     int            `yaml:"update_hour"`
 	LocalFeedPath  string         `yaml:"local_feed_path"`
 	EnableLocalDB  bool           `yaml:"enable_local_db"`
+	// TLSFingerprints lists where known JA3/JA3S/JA4 fingerprints come from
+	TLSFingerprints TLSFingerprintConfig `yaml:"tls_fingerprints"`
+}
+
+// TLSFingerprintConfig lists the fingerprint feeds and local files loaded
+// into the fingerprint store
+type TLSFingerprintConfig struct {
+	Feeds      []FingerprintFeed `yaml:"feeds"`
+	LocalFiles []string          `yaml:"local_files"`
+	// UpdateInterval is how often feeds are refreshed, in hours
+	UpdateInterval int `yaml:"update_interval_hours"`
+}
+
+// FingerprintFeed is a downloadable fingerprint list. Format is sslbl_ja3
+// or sslbl_cert (abuse.ch SSLBL CSV), ja4db (ja4db.com JSON) or json (the
+// export format).
+type FingerprintFeed struct {
+	Name    string `yaml:"name"`
+	URL     string `yaml:"url"`
+	Format  string `yaml:"format"`
+	Enabled bool   `yaml:"enabled"`
 }
 
 type ThreatSource struct {
@@ -147,8 +266,8 @@ func (c *Config) Validate() error {
 		}
 	}
 
-	if c.Detection.Scan.Threshold < 1 {
-		return errors.New("scan threshold must be positive")
+	if err := c.Detection.Validate(); err != nil {
+		return err
 	}
 
 	if c.Backup.Enabled && c.Backup.BackupDir == "" {
@@ -167,9 +286,15 @@ func DefaultConfig() *Config {
 			Mode: "release",
 		},
 		Zeek: ZeekConfig{
-			LogDir:    "/var/spool/zeek",
+			LogDir:    "/opt/zeek/logs",
 			ScriptDir: "/opt/nta-probe/zeek-scripts",
-			Interface: "eth0",
+			Interface:      "eth0",
+			TailLogs:       false,
+			CheckpointFile: "/var/lib/nta/zeek-tail.json",
+		},
+		Kafka: KafkaConfig{
+			Brokers:  []string{"localhost:9092"},
+			DLQTopic: "zeek-dlq",
 		},
 		Redis: RedisConfig{
 			Addr:     "localhost:6379",
@@ -189,11 +314,17 @@ func DefaultConfig() *Config {
 			Auth: AuthConfig{
 				FailThreshold: 5,
 				PTHWindow:     3600,
+				FailWindow:    600,
 			},
 			ML: MLConfig{
 				Enabled:       true,
 				Contamination: 0.01,
 			},
+			BusinessHours: BusinessHoursConfig{
+				Start:    7,
+				End:      19,
+				WorkDays: []int{1, 2, 3, 4, 5},
+			},
 		},
 		ThreatIntel: ThreatIntelConfig{
 			Sources: []ThreatSource{
@@ -214,6 +345,29 @@ func DefaultConfig() *Config {
 			UpdateHour:     2,
 			LocalFeedPath:  "/opt/nta-probe/data/threat_intel.db",
 			EnableLocalDB:  true,
+			TLSFingerprints: TLSFingerprintConfig{
+				Feeds: []FingerprintFeed{
+					{
+						Name:    "sslbl_ja3",
+						URL:     "https://sslbl.abuse.ch/blacklist/ja3_fingerprints.csv",
+						Format:  "sslbl_ja3",
+						Enabled: true,
+					},
+					{
+						Name:    "sslbl_cert",
+						URL:     "https://sslbl.abuse.ch/blacklist/sslblacklist.csv",
+						Format:  "sslbl_cert",
+						Enabled: true,
+					},
+					{
+						Name:    "ja4db",
+						URL:     "https://ja4db.com/api/read/",
+						Format:  "ja4db",
+						Enabled: true,
+					},
+				},
+				UpdateInterval: 24,
+			},
 		},
 		License: LicenseConfig{
 			LicenseFile:   "/opt/nta-probe/config/license.key",
@@ -2,7 +2,6 @@ package detector
 
 import (
 	"math"
-	"regexp"
 	"strings"
 	"time"
 
@@ -20,104 +19,90 @@ func NewAdvancedDetector(logger *logrus.Logger) *AdvancedDetector {
 	}
 }
 
+// DetectDGA reports whether a domain looks algorithmically generated
 func (d *AdvancedDetector) DetectDGA(domain string) (bool, float64) {
-	if len(domain) < 5 {
-		return false, 0
-	}
+	result := d.ScoreDomain(domain)
+	return result.IsDGA, result.Confidence
+}
 
-	score := 0.0
-	parts := strings.Split(domain, ".")
-	if len(parts) < 2 {
-		return false, 0
-	}
-
-	subdomain := parts[0]
-
-	vowelCount := 0
-	consonantCount := 0
-	digitCount := 0
-	for _, c := range subdomain {
-		if c >= '0' && c <= '9' {
-			digitCount++
-		} else if strings.ContainsRune("aeiouAEIOU", c) {
-			vowelCount++
-		} else if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
-			consonantCount++
+// DetectDNSTunnel scores the queries one source sent for one parent domain
+// within window. Tunnels (iodine, dnscat2) show long, high-entropy and
+// mostly unique subdomains, many TXT/NULL/CNAME lookups and large answers.
+func (d *AdvancedDetector) DetectDNSTunnel(domain string, queries []DNSQuery, window time.Duration) DNSTunnelResult {
+	result := DNSTunnelResult{Domain: domain, QueryCount: len(queries)}
+	if len(queries) == 0 {
+		return result
+	}
+
+	var totalLength, totalResponse, tunnelTypes, nxdomains int
+	var totalEntropy float64
+	subdomains := make(map[string]bool)
+	for _, q := range queries {
+		sub := strings.TrimSuffix(strings.TrimSuffix(q.Query, domain), ".")
+		subdomains[sub] = true
+		totalLength += len(sub)
+		totalEntropy += d.calculateEntropy(strings.ReplaceAll(sub, ".", ""))
+		for _, label := range strings.Split(sub, ".") {
+			if len(label) > result.MaxLabelLength {
+				result.MaxLabelLength = len(label)
+			}
 		}
-	}
-
-	totalChars := float64(len(subdomain))
-	if totalChars == 0 {
-		return false, 0
-	}
-
-	vowelRatio := float64(vowelCount) / totalChars
-	digitRatio := float64(digitCount) / totalChars
 
-	if vowelRatio < 0.2 || vowelRatio > 0.6 {
-		score += 0.3
+		switch q.QType {
+		case "TXT", "NULL", "CNAME":
+			tunnelTypes++
+		}
+		if q.RCode == "NXDOMAIN" {
+			nxdomains++
+		}
+		totalResponse += q.ResponseSize
 	}
 
-	if digitRatio > 0.3 {
-		score += 0.2
+	n := float64(len(queries))
+	result.AvgLength = float64(totalLength) / n
+	result.AvgEntropy = totalEntropy / n
+	result.UniqueDomains = len(subdomains)
+	result.RecordTypeRatio = float64(tunnelTypes) / n
+	result.NXDomainRate = float64(nxdomains) / n
+	result.AvgResponseSize = float64(totalResponse) / n
+	// Rate over the span the queries cover, at most the window
+	span := queries[len(queries)-1].Timestamp.Sub(queries[0].Timestamp)
+	if span < time.Second || (window > 0 && span > window) {
+		span = window
 	}
-
-	if len(subdomain) > 15 {
-		score += 0.2
+	if span > 0 {
+		result.RequestRate = n / span.Seconds()
 	}
 
-	entropy := d.calculateEntropy(subdomain)
-	if entropy > 3.5 {
-		score += 0.3
+	score := 0.0
+	switch {
+	case result.AvgLength > 40 || result.MaxLabelLength > 50:
+		score += 0.25
+	case result.AvgLength > 25:
+		score += 0.15
 	}
-
-	if matched, _ := regexp.MatchString(`^[a-z0-9]{10,}$`, subdomain); matched {
+	if result.AvgEntropy > 3.5 {
 		score += 0.2
 	}
-
-	isDGA := score > 0.6
-	return isDGA, math.Min(score, 1.0)
-}
-
-func (d *AdvancedDetector) DetectDNSTunnel(dnsQueries []models.Connection) (bool, float64) {
-	if len(dnsQueries) < 10 {
-		return false, 0
-	}
-
-	var totalLength int
-	var queryCount int
-	domainLengthMap := make(map[string]int)
-
-	for _, query := range dnsQueries {
-		if query.DstPort == 53 {
-			queryCount++
-			domainLengthMap[query.Service]++
-		}
+	if result.UniqueDomains >= 20 && float64(result.UniqueDomains)/n > 0.8 {
+		score += 0.2
 	}
-
-	if queryCount == 0 {
-		return false, 0
+	if result.RecordTypeRatio > 0.5 {
+		score += 0.2
 	}
-
-	score := 0.0
-
-	avgLength := float64(totalLength) / float64(queryCount)
-	if avgLength > 50 {
-		score += 0.4
+	if result.AvgResponseSize > 100 {
+		score += 0.1
 	}
-
-	requestRate := float64(queryCount) / 60.0
-	if requestRate > 10 {
-		score += 0.3
+	if result.NXDomainRate > 0.5 {
+		score += 0.1
 	}
-
-	uniqueDomains := len(domainLengthMap)
-	if uniqueDomains > 20 {
-		score += 0.3
+	if result.RequestRate > 1 {
+		score += 0.1
 	}
 
-	isTunnel := score > 0.6
-	return isTunnel, math.Min(score, 1.0)
+	result.Confidence = math.Min(score, 1.0)
+	result.IsTunnel = result.Confidence > 0.6
+	return result
 }
 
 func (d *AdvancedDetector) DetectC2Communication(conn *models.Connection) (bool, float64, string) {
@@ -159,67 +144,20 @@ func (d *AdvancedDetector) DetectC2Communication(conn *models.Connection) (bool,
 	return isC2, math.Min(score, 1.0), c2Type
 }
 
+// DetectWebShell scores request strings, such as URIs, payloads and user
+// agents, against the precompiled built-in web shell rules
 func (d *AdvancedDetector) DetectWebShell(httpLogs []string) (bool, float64) {
-	if len(httpLogs) == 0 {
-		return false, 0
-	}
+	rules := defaultWebShellRules()
 
 	score := 0.0
-	suspiciousPatterns := []string{
-		"eval\\(",
-		"base64_decode",
-		"system\\(",
-		"exec\\(",
-		"passthru",
-		"shell_exec",
-		"phpinfo\\(",
-		"assert\\(",
-		"<?php",
-		"cmd=",
-		"<?=",
-	}
-
-	matchCount := 0
 	for _, log := range httpLogs {
-		for _, pattern := range suspiciousPatterns {
-			if matched, _ := regexp.MatchString(pattern, log); matched {
-				matchCount++
-				break
-			}
-		}
-	}
-
-	if matchCount > 0 {
-		score = math.Min(float64(matchCount)*0.3, 1.0)
-	}
-
-	isWebShell := score > 0.5
-	return isWebShell, score
-}
-
-func (d *AdvancedDetector) DetectDataExfiltration(conn *models.Connection, baseline int64) (bool, float64) {
-	score := 0.0
-
-	if conn.OrigBytes > baseline*5 {
-		score += 0.4
-	}
-
-	if conn.Duration < 60 && conn.OrigBytes > 10*1024*1024 {
-		score += 0.3
-	}
-
-	uncommonPorts := conn.DstPort > 1024 && conn.DstPort != 8080 && conn.DstPort != 8443
-	if uncommonPorts {
-		score += 0.2
-	}
-
-	outsideBusinessHours := time.Now().Hour() < 7 || time.Now().Hour() > 19
-	if outsideBusinessHours {
-		score += 0.1
+		_, command := rules.MatchCommand(log)
+		_, agent := rules.MatchUserAgent(log)
+		score += math.Max(command, agent)
 	}
+	score = math.Min(score, 1.0)
 
-	isExfiltration := score > 0.6
-	return isExfiltration, math.Min(score, 1.0)
+	return score > 0.5, score
 }
 
 func (d *AdvancedDetector) calculateEntropy(s string) float64 {
@@ -0,0 +1,134 @@
+package detector
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Cxiyuan/NTA/internal/analyzer"
+	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/Cxiyuan/NTA/internal/zeek"
+	"github.com/Cxiyuan/NTA/pkg/models"
+)
+
+// bruteForceDetector feeds authentication outcomes from ssh, rdp, ntlm,
+// kerberos and ldap logs to the brute force tracker
+type bruteForceDetector struct {
+	tracker *analyzer.BruteForceDetector
+}
+
+func (d *bruteForceDetector) Name() string { return "brute_force" }
+func (d *bruteForceDetector) LogTypes() []string {
+	return []string{"ssh", "rdp", "ntlm", "kerberos", "ldap"}
+}
+
+func (d *bruteForceDetector) Configure(cfg config.DetectionConfig) {
+	threshold, window := cfg.Auth.FailThreshold, cfg.Auth.FailWindow
+	if threshold < 1 {
+		threshold = 5
+	}
+	if window < 1 {
+		window = 600
+	}
+	spray := int(cfg.Detector(d.Name()).Threshold("spray_accounts", 10))
+	d.tracker.SetThresholds(threshold, spray, time.Duration(window)*time.Second)
+}
+
+// Cleanup forgets sources without authentication activity for an hour
+func (d *bruteForceDetector) Cleanup(now time.Time) {
+	d.tracker.Cleanup(now.Add(-1 * time.Hour))
+}
+
+func (d *bruteForceDetector) Inspect(ctx context.Context, ev *Event) []*models.Alert {
+	attempt, ok := authAttempt(ev.Record)
+	if !ok {
+		return nil
+	}
+	attempt.Timestamp = ev.Timestamp
+
+	alerts := d.tracker.Observe(attempt)
+	for _, alert := range alerts {
+		stamp(alert, ev)
+	}
+	return alerts
+}
+
+// authAttempt extracts the authentication outcome from a record. ok is
+// false for records that carry no outcome.
+func authAttempt(record interface{}) (attempt analyzer.AuthAttempt, ok bool) {
+	var id zeek.ConnID
+
+	switch rec := record.(type) {
+	case *zeek.SSHRecord:
+		if rec.AuthSuccess == nil {
+			return attempt, false
+		}
+		id = rec.ConnID
+		attempt.Protocol = "ssh"
+		attempt.Success = *rec.AuthSuccess
+		// auth_attempts includes the successful one
+		attempt.Failures = rec.AuthAttempts
+		if attempt.Success {
+			attempt.Failures--
+		} else if attempt.Failures < 1 {
+			attempt.Failures = 1
+		}
+
+	case *zeek.RDPRecord:
+		// The outcome of encrypted (NLA/TLS) sessions is not visible
+		if rec.Result == "" || rec.SecurityProtocol == "HYBRID" || rec.SecurityProtocol == "HYBRID_EX" {
+			return attempt, false
+		}
+		id = rec.ConnID
+		attempt.Protocol = "rdp"
+		attempt.Account = strings.ToLower(rec.Cookie)
+		attempt.Success = rec.Result == "Success"
+
+	case *zeek.NTLMRecord:
+		if rec.Success == nil || rec.Username == "" {
+			return attempt, false
+		}
+		id = rec.ConnID
+		attempt.Protocol = "ntlm"
+		attempt.Account = strings.ToLower(rec.DomainName + `\` + rec.Username)
+		attempt.Success = *rec.Success
+
+	case *zeek.KerberosRecord:
+		// KDC_ERR_PREAUTH_REQUIRED is the normal first round of an AS
+		// exchange, not a failed logon
+		if rec.RequestType != "AS" || rec.Success == nil || rec.Client == "" ||
+			rec.ErrorMsg == "KDC_ERR_PREAUTH_REQUIRED" {
+			return attempt, false
+		}
+		id = rec.ConnID
+		attempt.Protocol = "kerberos"
+		attempt.Account = strings.ToLower(rec.Client)
+		attempt.Success = *rec.Success
+
+	case *zeek.LDAPRecord:
+		if !strings.HasPrefix(rec.Opcode, "bind") || rec.Object == "" {
+			return attempt, false
+		}
+		switch rec.Result {
+		case "success":
+			attempt.Success = true
+		case "invalidCredentials":
+		default:
+			return attempt, false
+		}
+		id = rec.ConnID
+		attempt.Protocol = "ldap"
+		attempt.Account = strings.ToLower(rec.Object)
+
+	default:
+		return attempt, false
+	}
+
+	if !attempt.Success && attempt.Failures == 0 {
+		attempt.Failures = 1
+	}
+	attempt.SrcIP = id.OrigH
+	attempt.DstIP = id.RespH
+	attempt.DstPort = id.RespP
+	return attempt, true
+}
@@ -0,0 +1,54 @@
+package detector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Cxiyuan/NTA/internal/analyzer"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	baselineKeyPrefix = "baseline:"
+	// baselineTTL expires baselines of hosts that are gone
+	baselineTTL = 60 * 24 * time.Hour
+)
+
+// RedisBaselineStore keeps traffic baselines in Redis so they survive
+// restarts and are shared by every process running detectors
+type RedisBaselineStore struct {
+	redis *redis.Client
+}
+
+// NewBaselineStore creates a Redis backed baseline store
+func NewBaselineStore(rdb *redis.Client) *RedisBaselineStore {
+	return &RedisBaselineStore{redis: rdb}
+}
+
+// LoadBaseline implements analyzer.BaselineStore
+func (s *RedisBaselineStore) LoadBaseline(ctx context.Context, key string) (*analyzer.TrafficBaseline, error) {
+	data, err := s.redis.Get(ctx, baselineKeyPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var baseline analyzer.TrafficBaseline
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return nil, err
+	}
+	return &baseline, nil
+}
+
+// SaveBaseline implements analyzer.BaselineStore
+func (s *RedisBaselineStore) SaveBaseline(ctx context.Context, key string, baseline *analyzer.TrafficBaseline) error {
+	data, err := json.Marshal(baseline)
+	if err != nil {
+		return err
+	}
+	return s.redis.Set(ctx, baselineKeyPrefix+key, data, baselineTTL).Err()
+}
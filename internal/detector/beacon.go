@@ -0,0 +1,51 @@
+package detector
+
+import (
+	"context"
+	"time"
+
+	"github.com/Cxiyuan/NTA/internal/analyzer"
+	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/Cxiyuan/NTA/pkg/models"
+)
+
+// beaconIdleTimeout is how long a pair is kept without connections. It
+// bounds the longest beacon period that can be detected.
+const beaconIdleTimeout = 24 * time.Hour
+
+// beaconDetector feeds connections to the streaming beacon analyzer
+type beaconDetector struct {
+	analyzer *analyzer.BeaconAnalyzer
+}
+
+func (d *beaconDetector) Name() string       { return "c2_beacon" }
+func (d *beaconDetector) LogTypes() []string { return []string{"conn"} }
+
+func (d *beaconDetector) Configure(cfg config.DetectionConfig) {
+	settings := cfg.Detector(d.Name())
+	// Periodicity needs at least two intervals to be judged
+	minConnections := int(settings.Threshold("min_connections", 10))
+	if minConnections < 3 {
+		minConnections = 3
+	}
+	d.analyzer.SetThresholds(
+		minConnections,
+		settings.Threshold("min_score", 0.8),
+		settings.Threshold("jitter", 0.3),
+		time.Duration(settings.Threshold("min_span_hours", 2)*float64(time.Hour)),
+	)
+}
+
+// Cleanup forgets pairs without connections for a day
+func (d *beaconDetector) Cleanup(now time.Time) {
+	d.analyzer.Cleanup(now.Add(-beaconIdleTimeout))
+}
+
+func (d *beaconDetector) Inspect(ctx context.Context, ev *Event) []*models.Alert {
+	alert := d.analyzer.Observe(ev.Conn)
+	if alert == nil {
+		return nil
+	}
+	stamp(alert, ev)
+	return []*models.Alert{alert}
+}
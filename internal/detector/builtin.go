@@ -0,0 +1,197 @@
+package detector
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Cxiyuan/NTA/internal/analyzer"
+	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/Cxiyuan/NTA/internal/threatintel"
+	"github.com/Cxiyuan/NTA/internal/zeek"
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+// NewDefaultRegistry registers the built-in detectors. threatIntel, assets
+// and baselines may be nil, e.g. for offline replay, in which case no
+// intel lookups are made, domain controllers are only learned from
+// Kerberos traffic, WinRM from management hosts is not exempted and
+// traffic baselines are kept in memory.
+func NewDefaultRegistry(logger *logrus.Logger, threatIntel *threatintel.Service, assets AssetRoles, baselines analyzer.BaselineStore) *Registry {
+	advanced := NewAdvancedDetector(logger)
+	// Thresholds are set when the registry is configured
+	lateral := analyzer.NewLateralMovementDetector(logger, 0, 0)
+
+	registry := NewRegistry(logger)
+	if threatIntel != nil {
+		registry.Register(&threatIntelDetector{service: threatIntel, logger: logger})
+	}
+	registry.Register(&lateralScanDetector{lateral: lateral})
+	registry.Register(&passTheHashDetector{lateral: lateral})
+	registry.Register(&remoteExecDetector{lateral: lateral, assets: assets})
+	registry.Register(&replicationDetector{
+		lateral:   lateral,
+		inventory: assets,
+		kdc:       make(map[string]time.Time),
+	})
+	registry.Register(&bruteForceDetector{
+		tracker: analyzer.NewBruteForceDetector(logger, 5, 10, 10*time.Minute),
+	})
+	registry.Register(&kerberosAttackDetector{
+		tracker: analyzer.NewKerberosDetector(logger, 5, 10*time.Minute, 10*time.Hour),
+	})
+	registry.Register(&c2Detector{advanced: advanced, logger: logger})
+	registry.Register(&beaconDetector{
+		analyzer: analyzer.NewBeaconAnalyzer(logger, 10, 0.8, 0.3, 2*time.Hour),
+	})
+	registry.Register(newExfiltrationDetector(logger, baselines, assets))
+	registry.Register(&dgaDetector{
+		advanced: advanced,
+		hosts:    make(map[string]*nxHost),
+		reported: make(map[string]time.Time),
+	})
+	registry.Register(&dnsTunnelDetector{
+		advanced: advanced,
+		flows:    make(map[string]*tunnelFlow),
+	})
+	registry.Register(newWebShellDetector(logger))
+	registry.Register(&noticeDetector{})
+
+	return registry
+}
+
+// threatIntelDetector matches connection endpoints and queried domains
+// against threat intelligence
+type threatIntelDetector struct {
+	service *threatintel.Service
+	logger  *logrus.Logger
+}
+
+func (d *threatIntelDetector) Name() string       { return "threat_intel" }
+func (d *threatIntelDetector) LogTypes() []string { return []string{"conn", "dns"} }
+
+func (d *threatIntelDetector) Configure(cfg config.DetectionConfig) {}
+
+func (d *threatIntelDetector) Inspect(ctx context.Context, ev *Event) []*models.Alert {
+	var alerts []*models.Alert
+
+	switch ev.LogType {
+	case "conn":
+		conn := ev.Conn
+		for _, ip := range []string{conn.SrcIP, conn.DstIP} {
+			intel, err := d.service.CheckIP(ctx, ip)
+			if err != nil || intel == nil || intel.Severity == "none" {
+				continue
+			}
+			alerts = append(alerts, &models.Alert{
+				Type:         "threat_intel_match",
+				Severity:     intel.Severity,
+				SrcIP:        conn.SrcIP,
+				DstIP:        conn.DstIP,
+				DstPort:      conn.DstPort,
+				Protocol:     conn.Protocol,
+				Description:  fmt.Sprintf("威胁情报匹配 [%s]: %s - %s", intel.ThreatLabel, ip, intel.Description),
+				ThreatLabel:  intel.ThreatLabel,
+				ThreatSource: intel.Source,
+				Confidence:   0.95,
+				Timestamp:    ev.Timestamp,
+				Status:       "new",
+			})
+			d.logger.Warnf("Threat intel match: %s (%s)", ip, intel.ThreatLabel)
+		}
+
+	case "dns":
+		rec, ok := ev.Record.(*zeek.DNSRecord)
+		if !ok || rec.Query == "" {
+			return nil
+		}
+		intel, err := d.service.CheckDomain(ctx, rec.Query)
+		if err != nil || intel == nil || intel.Severity == "none" {
+			return nil
+		}
+		alerts = append(alerts, &models.Alert{
+			Type:         "threat_intel_match",
+			Severity:     intel.Severity,
+			SrcIP:        rec.OrigH,
+			Description:  fmt.Sprintf("威胁情报匹配 [%s]: %s - %s", intel.ThreatLabel, rec.Query, intel.Description),
+			ThreatLabel:  intel.ThreatLabel,
+			ThreatSource: intel.Source,
+			Confidence:   0.95,
+			Timestamp:    ev.Timestamp,
+			Status:       "new",
+		})
+		d.logger.Warnf("Threat intel match (domain): %s (%s)", rec.Query, intel.ThreatLabel)
+	}
+
+	return alerts
+}
+
+// c2Detector flags single connections that look like C2 traffic
+type c2Detector struct {
+	advanced *AdvancedDetector
+	logger   *logrus.Logger
+	minScore float64
+}
+
+func (d *c2Detector) Name() string       { return "c2_communication" }
+func (d *c2Detector) LogTypes() []string { return []string{"conn"} }
+
+func (d *c2Detector) Configure(cfg config.DetectionConfig) {
+	d.minScore = cfg.Detector(d.Name()).Threshold("min_score", 0.5)
+}
+
+func (d *c2Detector) Inspect(ctx context.Context, ev *Event) []*models.Alert {
+	conn := ev.Conn
+	_, score, c2Type := d.advanced.DetectC2Communication(conn)
+	if score <= d.minScore {
+		return nil
+	}
+	if c2Type == "" {
+		c2Type = "suspicious"
+	}
+
+	d.logger.Warnf("C2 detected: %s -> %s (score: %.2f)", conn.SrcIP, conn.DstIP, score)
+	return []*models.Alert{{
+		Type:        "c2_communication",
+		Severity:    "high",
+		SrcIP:       conn.SrcIP,
+		DstIP:       conn.DstIP,
+		DstPort:     conn.DstPort,
+		Protocol:    conn.Protocol,
+		Description: "检测到C2通信: " + c2Type,
+		Confidence:  score,
+		Timestamp:   ev.Timestamp,
+		Status:      "new",
+	}}
+}
+
+// noticeDetector turns Zeek notices into alerts
+type noticeDetector struct{}
+
+func (d *noticeDetector) Name() string       { return "zeek_notice" }
+func (d *noticeDetector) LogTypes() []string { return []string{"notice"} }
+
+func (d *noticeDetector) Configure(cfg config.DetectionConfig) {}
+
+func (d *noticeDetector) Inspect(ctx context.Context, ev *Event) []*models.Alert {
+	rec, ok := ev.Record.(*zeek.NoticeRecord)
+	if !ok || rec.Note == "" {
+		return nil
+	}
+
+	srcIP := rec.Src
+	if srcIP == "" {
+		srcIP = rec.OrigH
+	}
+
+	return []*models.Alert{{
+		Type:        rec.Note,
+		Severity:    "high",
+		SrcIP:       srcIP,
+		DstIP:       rec.Dst,
+		Description: rec.Msg,
+		Timestamp:   ev.Timestamp,
+		Status:      "new",
+	}}
+}
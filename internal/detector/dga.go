@@ -0,0 +1,382 @@
+package detector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/Cxiyuan/NTA/internal/zeek"
+	"github.com/Cxiyuan/NTA/pkg/models"
+)
+
+//go:embed data/benign_domains.txt
+var benignDomainData []byte
+
+//go:embed data/dga_allowlist.txt
+var dgaAllowlistData []byte
+
+// dgaAllowlist holds CDN and cloud domains whose host names look random
+var dgaAllowlist = loadDomainList(dgaAllowlistData)
+
+// maxListedDomains caps the domain lists stored in alert details
+const maxListedDomains = 50
+
+// DGAResult describes how a domain was scored by ScoreDomain
+type DGAResult struct {
+	IsDGA       bool    `json:"is_dga"`
+	Confidence  float64 `json:"confidence"`
+	Domain      string  `json:"domain"`
+	Registered  string  `json:"registered_domain"`
+	Label       string  `json:"label"`
+	Allowlisted bool    `json:"allowlisted"`
+	Length      int     `json:"length"`
+	Entropy     float64 `json:"entropy"`
+	VowelRatio  float64 `json:"vowel_ratio"`
+	DigitRatio  float64 `json:"digit_ratio"`
+	// Likelihood is the mean per-character log2 probability of the label
+	// under the benign n-gram model
+	Likelihood float64 `json:"likelihood"`
+	// ModelScore is how far below benign names the likelihood falls, 0-1
+	ModelScore float64 `json:"model_score"`
+}
+
+// ScoreDomain scores the registrable label of a domain, combining the
+// n-gram model likelihood with character entropy and digit mix
+func (d *AdvancedDetector) ScoreDomain(domain string) DGAResult {
+	result := DGAResult{Domain: domain}
+	label, suffix := SplitDomain(domain)
+	if label == "" {
+		return result
+	}
+	result.Label = label
+	result.Registered = label + "." + suffix
+	result.Length = len(label)
+	if inDomainList(dgaAllowlist, domain) {
+		result.Allowlisted = true
+		return result
+	}
+	// Internationalized labels are punycode and always look random
+	if strings.HasPrefix(label, "xn--") {
+		return result
+	}
+
+	var vowels, digits, letters int
+	for _, c := range label {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case strings.ContainsRune("aeiou", c):
+			vowels++
+			letters++
+		case c >= 'a' && c <= 'z':
+			letters++
+		}
+	}
+	n := float64(len(label))
+	result.VowelRatio = float64(vowels) / n
+	result.DigitRatio = float64(digits) / n
+	result.Entropy = d.calculateEntropy(label)
+
+	model := domainModel()
+	result.Likelihood = model.likelihood(label)
+	result.ModelScore = model.score(result.Likelihood)
+
+	entropyScore := clamp01((result.Entropy - 2.5) / 1.5)
+	digitScore := 0.0
+	if letters > 0 && digits > 0 {
+		digitScore = clamp01(result.DigitRatio / 0.4)
+	}
+
+	score := 0.65*result.ModelScore + 0.25*entropyScore + 0.1*digitScore
+	// Short labels carry too little signal to judge
+	if len(label) < 6 {
+		score *= n / 6
+	}
+
+	result.Confidence = math.Min(score, 1.0)
+	result.IsDGA = result.Confidence > 0.6
+	return result
+}
+
+// ngramModel is a character trigram model of benign domain labels,
+// interpolated with bigram and unigram estimates
+type ngramModel struct {
+	trigrams map[string]int
+	bigrams  map[string]int
+	unigrams map[byte]int
+	// context counts of the trigram and bigram estimates
+	trigramCtx map[string]int
+	bigramCtx  map[byte]int
+	total      int
+
+	// mean is the mean likelihood of the training labels
+	mean float64
+}
+
+// ngramAlphabet is the number of distinct symbols in labels: letters,
+// digits, hyphen and the end marker
+const ngramAlphabet = 38
+
+var (
+	benignModel     *ngramModel
+	benignModelOnce sync.Once
+)
+
+// domainModel returns the model trained on the embedded benign domains
+func domainModel() *ngramModel {
+	benignModelOnce.Do(func() {
+		var labels []string
+		scanner := bufio.NewScanner(bytes.NewReader(benignDomainData))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			// Lines without a dot are plain words
+			label := line
+			if strings.Contains(line, ".") {
+				label, _ = SplitDomain(line)
+			}
+			if label != "" {
+				labels = append(labels, strings.ToLower(label))
+			}
+		}
+		benignModel = trainNgramModel(labels)
+	})
+	return benignModel
+}
+
+func trainNgramModel(labels []string) *ngramModel {
+	m := &ngramModel{
+		trigrams:   make(map[string]int),
+		bigrams:    make(map[string]int),
+		unigrams:   make(map[byte]int),
+		trigramCtx: make(map[string]int),
+		bigramCtx:  make(map[byte]int),
+	}
+	for _, label := range labels {
+		padded := "^^" + label + "$"
+		for i := 2; i < len(padded); i++ {
+			m.trigrams[padded[i-2:i+1]]++
+			m.trigramCtx[padded[i-2:i]]++
+			m.bigrams[padded[i-1:i+1]]++
+			m.bigramCtx[padded[i-1]]++
+			m.unigrams[padded[i]]++
+			m.total++
+		}
+	}
+
+	var sum float64
+	for _, label := range labels {
+		sum += m.likelihood(label)
+	}
+	if len(labels) > 0 {
+		m.mean = sum / float64(len(labels))
+	}
+	return m
+}
+
+// likelihood returns the mean log2 probability per character of a label
+func (m *ngramModel) likelihood(label string) float64 {
+	padded := "^^" + label + "$"
+	var total float64
+	for i := 2; i < len(padded); i++ {
+		p := 0.1 * float64(m.unigrams[padded[i]]+1) / float64(m.total+ngramAlphabet)
+		if ctx := m.bigramCtx[padded[i-1]]; ctx > 0 {
+			p += 0.3 * float64(m.bigrams[padded[i-1:i+1]]) / float64(ctx)
+		}
+		if ctx := m.trigramCtx[padded[i-2:i]]; ctx > 0 {
+			p += 0.6 * float64(m.trigrams[padded[i-2:i+1]]) / float64(ctx)
+		}
+		total += math.Log2(p)
+	}
+	return total / float64(len(padded)-2)
+}
+
+// score maps a likelihood to 0-1. The training labels fit the model
+// better than unseen benign names do, so names within 1.5 bits per
+// character of the mean score 0 and names 4 bits below it score 1.
+func (m *ngramModel) score(likelihood float64) float64 {
+	return clamp01((m.mean - likelihood - 1.5) / 2.5)
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(v, 1))
+}
+
+// dgaDetector flags queried domains that look algorithmically generated
+// and hosts producing bursts of NXDOMAIN answers, as bots cycling through
+// generated domains do
+type dgaDetector struct {
+	advanced *AdvancedDetector
+
+	mu          sync.Mutex
+	minScore    float64
+	nxThreshold int
+	window      time.Duration
+	hosts       map[string]*nxHost
+	// reported suppresses repeated alerts per source and domain
+	reported map[string]time.Time
+}
+
+// nxHost holds the domains a host failed to resolve within the window
+type nxHost struct {
+	domains  map[string]nxDomain
+	lastSeen time.Time
+	alerted  bool
+}
+
+type nxDomain struct {
+	seen  time.Time
+	score float64
+}
+
+func (d *dgaDetector) Name() string       { return "dga_domain" }
+func (d *dgaDetector) LogTypes() []string { return []string{"dns"} }
+
+func (d *dgaDetector) Configure(cfg config.DetectionConfig) {
+	settings := cfg.Detector(d.Name())
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.minScore = settings.Threshold("min_score", 0.6)
+	d.nxThreshold = int(settings.Threshold("nxdomain_threshold", 10))
+	d.window = time.Duration(settings.Threshold("window_seconds", 300)) * time.Second
+}
+
+// Cleanup forgets hosts and reports older than the window
+func (d *dgaDetector) Cleanup(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cutoff := now.Add(-d.window)
+	for ip, host := range d.hosts {
+		if host.lastSeen.Before(cutoff) {
+			delete(d.hosts, ip)
+		}
+	}
+	for key, seen := range d.reported {
+		if seen.Before(cutoff) {
+			delete(d.reported, key)
+		}
+	}
+}
+
+func (d *dgaDetector) Inspect(ctx context.Context, ev *Event) []*models.Alert {
+	rec, ok := ev.Record.(*zeek.DNSRecord)
+	if !ok || rec.Query == "" {
+		return nil
+	}
+	result := d.advanced.ScoreDomain(rec.Query)
+	if result.Registered == "" || result.Allowlisted {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var alerts []*models.Alert
+	if rec.RCodeName == "NXDOMAIN" {
+		if alert := d.trackNXDomain(rec, result, ev.Timestamp); alert != nil {
+			alerts = append(alerts, alert)
+		}
+	}
+
+	if result.Confidence > d.minScore && d.report(rec.OrigH+"|"+result.Registered, ev.Timestamp) {
+		details, _ := json.Marshal(result)
+		alerts = append(alerts, &models.Alert{
+			Type:        "dga_domain",
+			Severity:    "medium",
+			SrcIP:       rec.OrigH,
+			DstIP:       rec.RespH,
+			DstPort:     rec.RespP,
+			Protocol:    rec.Proto,
+			Description: "检测到DGA生成域名: " + rec.Query,
+			Confidence:  result.Confidence,
+			Details:     string(details),
+			Timestamp:   ev.Timestamp,
+			Status:      "new",
+		})
+	}
+
+	return alerts
+}
+
+// trackNXDomain counts the distinct registered domains a host failed to
+// resolve and raises one alert per burst
+func (d *dgaDetector) trackNXDomain(rec *zeek.DNSRecord, result DGAResult, now time.Time) *models.Alert {
+	host, exists := d.hosts[rec.OrigH]
+	if !exists {
+		host = &nxHost{domains: make(map[string]nxDomain)}
+		d.hosts[rec.OrigH] = host
+	}
+	if now.After(host.lastSeen) {
+		host.lastSeen = now
+	}
+
+	cutoff := now.Add(-d.window)
+	for domain, nx := range host.domains {
+		if nx.seen.Before(cutoff) {
+			delete(host.domains, domain)
+		}
+	}
+	// A quiet window ends the burst
+	if len(host.domains) == 0 {
+		host.alerted = false
+	}
+	host.domains[result.Registered] = nxDomain{seen: now, score: result.Confidence}
+
+	if host.alerted || len(host.domains) < d.nxThreshold {
+		return nil
+	}
+	host.alerted = true
+
+	domains := make([]string, 0, len(host.domains))
+	var totalScore float64
+	for domain, nx := range host.domains {
+		domains = append(domains, domain)
+		totalScore += nx.score
+	}
+	sort.Strings(domains)
+	if len(domains) > maxListedDomains {
+		domains = domains[:maxListedDomains]
+	}
+	avgScore := totalScore / float64(len(host.domains))
+
+	details, _ := json.Marshal(map[string]interface{}{
+		"nxdomains":     len(host.domains),
+		"avg_dga_score": math.Round(avgScore*100) / 100,
+		"domains":       domains,
+	})
+	return &models.Alert{
+		Type:        "dga_nxdomain_burst",
+		Severity:    "high",
+		SrcIP:       rec.OrigH,
+		DstIP:       rec.RespH,
+		DstPort:     rec.RespP,
+		Protocol:    rec.Proto,
+		Description: fmt.Sprintf("检测到DGA行为: %d个域名解析失败(NXDOMAIN)", len(host.domains)),
+		Confidence:  math.Min(0.6+0.4*avgScore, 1.0),
+		Details:     string(details),
+		Timestamp:   now,
+		Status:      "new",
+	}
+}
+
+// report returns true the first time key is seen within the window
+func (d *dgaDetector) report(key string, now time.Time) bool {
+	if last, seen := d.reported[key]; seen && now.Sub(last) < d.window {
+		return false
+	}
+	d.reported[key] = now
+	return true
+}
@@ -0,0 +1,152 @@
+package detector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/Cxiyuan/NTA/internal/zeek"
+	"github.com/Cxiyuan/NTA/pkg/models"
+)
+
+// maxTunnelQueries caps the queries kept per source and parent domain
+const maxTunnelQueries = 1000
+
+// DNSQuery is one query from dns.log
+type DNSQuery struct {
+	Timestamp    time.Time
+	Query        string
+	QType        string // qtype_name, e.g. TXT
+	RCode        string // rcode_name, e.g. NXDOMAIN
+	ResponseSize int    // total length of the answers
+}
+
+// DNSTunnelResult holds the features and score of DetectDNSTunnel
+type DNSTunnelResult struct {
+	IsTunnel        bool    `json:"is_tunnel"`
+	Confidence      float64 `json:"confidence"`
+	Domain          string  `json:"domain"`
+	QueryCount      int     `json:"query_count"`
+	AvgLength       float64 `json:"avg_length"`
+	MaxLabelLength  int     `json:"max_label_length"`
+	AvgEntropy      float64 `json:"avg_entropy"`
+	UniqueDomains   int     `json:"unique_domains"`
+	RecordTypeRatio float64 `json:"record_type_ratio"`
+	AvgResponseSize float64 `json:"avg_response_size"`
+	NXDomainRate    float64 `json:"nxdomain_rate"`
+	RequestRate     float64 `json:"request_rate"`
+}
+
+// dnsTunnelDetector keeps the recent queries of each source per parent
+// domain and scores them with DetectDNSTunnel
+type dnsTunnelDetector struct {
+	advanced *AdvancedDetector
+
+	mu         sync.Mutex
+	window     time.Duration
+	minQueries int
+	minScore   float64
+	flows      map[string]*tunnelFlow
+}
+
+type tunnelFlow struct {
+	queries []DNSQuery
+	alerted time.Time
+}
+
+func (d *dnsTunnelDetector) Name() string       { return "dns_tunnel" }
+func (d *dnsTunnelDetector) LogTypes() []string { return []string{"dns"} }
+
+func (d *dnsTunnelDetector) Configure(cfg config.DetectionConfig) {
+	settings := cfg.Detector(d.Name())
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.window = time.Duration(settings.Threshold("window_seconds", 300)) * time.Second
+	d.minQueries = int(settings.Threshold("min_queries", 20))
+	d.minScore = settings.Threshold("min_score", 0.6)
+}
+
+// Cleanup drops flows without queries in the current window
+func (d *dnsTunnelDetector) Cleanup(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cutoff := now.Add(-d.window)
+	for key, flow := range d.flows {
+		if last := flow.queries[len(flow.queries)-1].Timestamp; last.Before(cutoff) {
+			delete(d.flows, key)
+		}
+	}
+}
+
+func (d *dnsTunnelDetector) Inspect(ctx context.Context, ev *Event) []*models.Alert {
+	rec, ok := ev.Record.(*zeek.DNSRecord)
+	if !ok || rec.Query == "" {
+		return nil
+	}
+	domain := RegisteredDomain(rec.Query)
+	if domain == "" {
+		return nil
+	}
+
+	query := DNSQuery{
+		Timestamp: ev.Timestamp,
+		Query:     strings.ToLower(strings.TrimSuffix(rec.Query, ".")),
+		QType:     rec.QTypeName,
+		RCode:     rec.RCodeName,
+	}
+	for _, answer := range rec.Answers {
+		query.ResponseSize += len(answer)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := rec.OrigH + "|" + domain
+	flow, exists := d.flows[key]
+	if !exists {
+		flow = &tunnelFlow{}
+		d.flows[key] = flow
+	}
+
+	cutoff := query.Timestamp.Add(-d.window)
+	start := 0
+	for start < len(flow.queries) && flow.queries[start].Timestamp.Before(cutoff) {
+		start++
+	}
+	if len(flow.queries)-start >= maxTunnelQueries {
+		start = len(flow.queries) - maxTunnelQueries + 1
+	}
+	flow.queries = append(flow.queries[start:], query)
+
+	if len(flow.queries) < d.minQueries || query.Timestamp.Sub(flow.alerted) < d.window {
+		return nil
+	}
+
+	result := d.advanced.DetectDNSTunnel(domain, flow.queries, d.window)
+	if result.Confidence < d.minScore {
+		return nil
+	}
+	flow.alerted = query.Timestamp
+
+	details, _ := json.Marshal(result)
+	return []*models.Alert{{
+		Type:     "dns_tunnel",
+		Severity: "high",
+		SrcIP:    rec.OrigH,
+		DstIP:    rec.RespH,
+		DstPort:  rec.RespP,
+		Protocol: rec.Proto,
+		Description: fmt.Sprintf("检测到DNS隧道: %s (%d次查询, %d个唯一子域名)",
+			domain, result.QueryCount, result.UniqueDomains),
+		Confidence: result.Confidence,
+		Details:    string(details),
+		Timestamp:  ev.Timestamp,
+		Status:     "new",
+	}}
+}
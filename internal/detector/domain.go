@@ -0,0 +1,63 @@
+package detector
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// SplitDomain splits a host name into its registrable label and public
+// suffix by the Public Suffix List, e.g. www.example.co.uk into example
+// and co.uk. Both are empty for names without a registrable label.
+func SplitDomain(name string) (label, suffix string) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return "", ""
+	}
+
+	i := strings.IndexByte(domain, '.')
+	return domain[:i], domain[i+1:]
+}
+
+// RegisteredDomain returns the registrable domain of a host name, e.g.
+// example.com for a.b.example.com or example.co.uk for x.example.co.uk
+func RegisteredDomain(name string) string {
+	label, suffix := SplitDomain(name)
+	if label == "" {
+		return ""
+	}
+	return label + "." + suffix
+}
+
+// inDomainList reports whether name or one of its parent domains is listed
+func inDomainList(list map[string]bool, name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for name != "" {
+		if list[name] {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return false
+}
+
+// loadDomainList reads one domain per line, skipping blanks and # comments
+func loadDomainList(data []byte) map[string]bool {
+	list := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list[strings.ToLower(line)] = true
+	}
+	return list
+}
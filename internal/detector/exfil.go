@@ -0,0 +1,91 @@
+package detector
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/Cxiyuan/NTA/internal/analyzer"
+	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+// exfilIdleTimeout is how long a host is kept in memory without outbound
+// traffic; its baseline stays in the store
+const exfilIdleTimeout = 2 * time.Hour
+
+// exfiltrationDetector feeds connections to the baselining exfiltration
+// detector
+type exfiltrationDetector struct {
+	tracker *analyzer.ExfilDetector
+	logger  *logrus.Logger
+}
+
+func newExfiltrationDetector(logger *logrus.Logger, store analyzer.BaselineStore, assets AssetRoles) *exfiltrationDetector {
+	return &exfiltrationDetector{
+		tracker: analyzer.NewExfilDetector(logger, store, hostGroup(assets), analyzer.ExfilSettings{}),
+		logger:  logger,
+	}
+}
+
+func (d *exfiltrationDetector) Name() string       { return "data_exfiltration" }
+func (d *exfiltrationDetector) LogTypes() []string { return []string{"conn"} }
+
+func (d *exfiltrationDetector) Configure(cfg config.DetectionConfig) {
+	settings := cfg.Detector(d.Name())
+	hours := cfg.BusinessHours
+
+	location, err := hours.Location()
+	if err != nil {
+		d.logger.Warnf("Invalid business hours time zone %q, using local time: %v", hours.TimeZone, err)
+		location = time.Local
+	}
+	workDays := make([]time.Weekday, 0, len(hours.WorkDays))
+	for _, day := range hours.WorkDays {
+		workDays = append(workDays, time.Weekday(day))
+	}
+
+	d.tracker.SetSettings(analyzer.ExfilSettings{
+		MinBytes:      int64(settings.Threshold("min_bytes", 50*1024*1024)),
+		Factor:        settings.Threshold("factor", 3),
+		MinScore:      settings.Threshold("min_score", 0.6),
+		MinHistory:    int(settings.Threshold("min_history", 3)),
+		BusinessStart: hours.Start,
+		BusinessEnd:   hours.End,
+		WorkDays:      workDays,
+		Location:      location,
+	})
+}
+
+// Cleanup saves changed baselines and forgets idle hosts. now is record
+// time, so hosts are not evicted and their hours not closed early while
+// old logs are replayed.
+func (d *exfiltrationDetector) Cleanup(now time.Time) {
+	d.tracker.Cleanup(context.Background(), now, exfilIdleTimeout)
+}
+
+func (d *exfiltrationDetector) Inspect(ctx context.Context, ev *Event) []*models.Alert {
+	alert := d.tracker.Observe(ev.Conn)
+	if alert == nil {
+		return nil
+	}
+	stamp(alert, ev)
+	return []*models.Alert{alert}
+}
+
+// hostGroup groups hosts by asset role, or by /24 subnet when they have
+// none
+func hostGroup(assets AssetRoles) func(ip string) string {
+	return func(ip string) string {
+		if assets != nil {
+			if role := assets.Role(ip); role != "" {
+				return "role:" + role
+			}
+		}
+		if v4 := net.ParseIP(ip).To4(); v4 != nil {
+			return "net:" + v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+		}
+		return ""
+	}
+}
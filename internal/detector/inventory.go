@@ -0,0 +1,96 @@
+package detector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// DomainControllers tells whether an address belongs to a known domain
+// controller
+type DomainControllers interface {
+	IsDomainController(ip string) bool
+}
+
+// AssetRoles gives the role assigned to an address, "" if it has none
+type AssetRoles interface {
+	DomainControllers
+	Role(ip string) string
+}
+
+// AssetInventory caches the asset roles stored in the database
+type AssetInventory struct {
+	db     *gorm.DB
+	logger *logrus.Logger
+
+	mu    sync.RWMutex
+	roles map[string]string
+}
+
+// NewAssetInventory creates an inventory; call Refresh or Run to load it
+func NewAssetInventory(db *gorm.DB, logger *logrus.Logger) *AssetInventory {
+	return &AssetInventory{
+		db:     db,
+		logger: logger,
+		roles:  make(map[string]string),
+	}
+}
+
+// IsDomainController implements DomainControllers
+func (i *AssetInventory) IsDomainController(ip string) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.roles[ip] == models.AssetRoleDomainController
+}
+
+// Role implements AssetRoles
+func (i *AssetInventory) Role(ip string) string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.roles[ip]
+}
+
+// Refresh reloads the asset roles
+func (i *AssetInventory) Refresh(ctx context.Context) error {
+	var assets []models.Asset
+	err := i.db.WithContext(ctx).Select("ip", "role").
+		Where("role <> ''").
+		Find(&assets).Error
+	if err != nil {
+		return err
+	}
+
+	roles := make(map[string]string, len(assets))
+	for _, asset := range assets {
+		roles[asset.IP] = asset.Role
+	}
+
+	i.mu.Lock()
+	i.roles = roles
+	i.mu.Unlock()
+	return nil
+}
+
+// Run refreshes the inventory every interval until ctx is cancelled
+func (i *AssetInventory) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := i.Refresh(ctx); err != nil && ctx.Err() == nil {
+			i.logger.Errorf("Failed to refresh asset inventory: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package detector
+
+import (
+	"context"
+	"time"
+
+	"github.com/Cxiyuan/NTA/internal/analyzer"
+	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/Cxiyuan/NTA/internal/zeek"
+	"github.com/Cxiyuan/NTA/pkg/models"
+)
+
+// kerberosAttackDetector feeds kerberos.log to the Kerberoasting, AS-REP
+// roasting and golden ticket heuristics
+type kerberosAttackDetector struct {
+	tracker *analyzer.KerberosDetector
+}
+
+func (d *kerberosAttackDetector) Name() string       { return "kerberos_attack" }
+func (d *kerberosAttackDetector) LogTypes() []string { return []string{"kerberos"} }
+
+func (d *kerberosAttackDetector) Configure(cfg config.DetectionConfig) {
+	settings := cfg.Detector(d.Name())
+	d.tracker.SetThresholds(
+		int(settings.Threshold("spn_threshold", 5)),
+		time.Duration(settings.Threshold("window_seconds", 600))*time.Second,
+		time.Duration(settings.Threshold("max_ticket_hours", 10))*time.Hour,
+	)
+}
+
+// Cleanup forgets Kerberos state older than an hour
+func (d *kerberosAttackDetector) Cleanup(now time.Time) {
+	d.tracker.Cleanup(now.Add(-1 * time.Hour))
+}
+
+func (d *kerberosAttackDetector) Inspect(ctx context.Context, ev *Event) []*models.Alert {
+	rec, ok := ev.Record.(*zeek.KerberosRecord)
+	if !ok {
+		return nil
+	}
+
+	alerts := d.tracker.Observe(analyzer.KerberosRequest{
+		Timestamp:   ev.Timestamp,
+		SrcIP:       rec.OrigH,
+		DstIP:       rec.RespH,
+		DstPort:     rec.RespP,
+		RequestType: rec.RequestType,
+		Client:      rec.Client,
+		Service:     rec.Service,
+		Cipher:      rec.Cipher,
+		ErrorMsg:    rec.ErrorMsg,
+		Success:     rec.Success != nil && *rec.Success,
+		From:        rec.From.Time,
+		Till:        rec.Till.Time,
+	})
+	for _, alert := range alerts {
+		stamp(alert, ev)
+	}
+	return alerts
+}
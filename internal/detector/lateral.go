@@ -0,0 +1,246 @@
+package detector
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Cxiyuan/NTA/internal/analyzer"
+	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/Cxiyuan/NTA/internal/zeek"
+	"github.com/Cxiyuan/NTA/pkg/models"
+)
+
+// dceRPCExecEvents maps dce_rpc.log endpoints and operations to remote
+// execution events. An empty operation matches any operation of the
+// endpoint.
+var dceRPCExecEvents = map[string]map[string]string{
+	"svcctl": {
+		"CreateServiceW": analyzer.ExecServiceCreate,
+		"CreateServiceA": analyzer.ExecServiceCreate,
+		"StartServiceW":  analyzer.ExecServiceStart,
+		"StartServiceA":  analyzer.ExecServiceStart,
+		"":               analyzer.ExecServiceControl,
+	},
+	"ITaskSchedulerService": {
+		"SchRpcRegisterTask": analyzer.ExecTaskRegister,
+		"SchRpcRun":          analyzer.ExecTaskRun,
+	},
+	"atsvc": {
+		"NetrJobAdd": analyzer.ExecTaskRegister,
+		"JobAdd":     analyzer.ExecTaskRegister,
+	},
+	"IWbemLevel1Login": {
+		"": analyzer.ExecWMILogin,
+	},
+	"IWbemServices": {
+		"ExecMethod":      analyzer.ExecWMIMethod,
+		"ExecMethodAsync": analyzer.ExecWMIMethod,
+	},
+	"winreg": {
+		"BaseRegCreateKey": analyzer.ExecRemoteRegistry,
+		"BaseRegSetValue":  analyzer.ExecRemoteRegistry,
+	},
+	"IRemoteSCMActivator": {
+		"RemoteCreateInstance": analyzer.ExecDCOMActivation,
+		"RemoteGetClassObject": analyzer.ExecDCOMActivation,
+	},
+	"ISystemActivator": {
+		"RemoteCreateInstance": analyzer.ExecDCOMActivation,
+	},
+	// MMC20.Application and ShellWindows are driven through IDispatch;
+	// Zeek logs the interface UUID when it has no name for it
+	"IDispatch": {
+		"": analyzer.ExecDCOMInvoke,
+	},
+	"00020400-0000-0000-c000-000000000046": {
+		"": analyzer.ExecDCOMInvoke,
+	},
+}
+
+// winRMPorts are the WS-Management HTTP and HTTPS ports
+var winRMPorts = map[int]bool{5985: true, 5986: true}
+
+// droppedFileExtensions are payloads commonly copied to a share before
+// remote execution
+var droppedFileExtensions = []string{".exe", ".dll", ".bat", ".cmd", ".ps1", ".vbs"}
+
+// lateralScanDetector feeds connections to the lateral movement scan tracker
+type lateralScanDetector struct {
+	lateral *analyzer.LateralMovementDetector
+}
+
+func (d *lateralScanDetector) Name() string       { return "lateral_scan" }
+func (d *lateralScanDetector) LogTypes() []string { return []string{"conn"} }
+
+func (d *lateralScanDetector) Configure(cfg config.DetectionConfig) {
+	threshold, window := cfg.Scan.Threshold, cfg.Scan.TimeWindow
+	if threshold < 1 {
+		threshold = 20
+	}
+	if window < 1 {
+		window = 300
+	}
+	d.lateral.SetScanThresholds(threshold, window, cfg.Scan.MinFailRate)
+}
+
+// Cleanup expires old tracking data. The tracker is shared by all lateral
+// movement detectors, so only this one implements Cleaner.
+func (d *lateralScanDetector) Cleanup(now time.Time) {
+	d.lateral.Cleanup(now)
+}
+
+func (d *lateralScanDetector) Inspect(ctx context.Context, ev *Event) []*models.Alert {
+	alert := d.lateral.DetectScan(ev.Conn)
+	if alert == nil {
+		return nil
+	}
+
+	alert.Protocol = ev.Conn.Protocol
+	return []*models.Alert{stamp(alert, ev)}
+}
+
+// passTheHashDetector flags NTLM credentials reused across many hosts from
+// one source. Zeek does not log the hash itself, so the account stands in
+// for it.
+type passTheHashDetector struct {
+	lateral *analyzer.LateralMovementDetector
+}
+
+func (d *passTheHashDetector) Name() string       { return "pass_the_hash" }
+func (d *passTheHashDetector) LogTypes() []string { return []string{"ntlm"} }
+
+func (d *passTheHashDetector) Configure(cfg config.DetectionConfig) {}
+
+func (d *passTheHashDetector) Inspect(ctx context.Context, ev *Event) []*models.Alert {
+	rec, ok := ev.Record.(*zeek.NTLMRecord)
+	if !ok || rec.Username == "" {
+		return nil
+	}
+	// Only successful logons prove the credential works on the target
+	if rec.Success != nil && !*rec.Success {
+		return nil
+	}
+
+	account := strings.ToLower(rec.DomainName + `\` + rec.Username)
+	alert := d.lateral.DetectPTH(rec.OrigH, account, rec.RespH, ev.Timestamp)
+	if alert == nil {
+		return nil
+	}
+
+	alert.DstIP = rec.RespH
+	alert.DstPort = rec.RespP
+	alert.Protocol = "tcp"
+	return []*models.Alert{stamp(alert, ev)}
+}
+
+// remoteExecDetector derives remote execution events from SMB, DCE/RPC
+// and WinRM traffic and correlates them per pair of hosts. WinRM from
+// management hosts is routine administration and is ignored.
+type remoteExecDetector struct {
+	lateral *analyzer.LateralMovementDetector
+	assets  AssetRoles
+}
+
+func (d *remoteExecDetector) Name() string { return "remote_exec" }
+func (d *remoteExecDetector) LogTypes() []string {
+	return []string{"smb_mapping", "smb_files", "dce_rpc", "conn"}
+}
+
+func (d *remoteExecDetector) Configure(cfg config.DetectionConfig) {}
+
+func (d *remoteExecDetector) Inspect(ctx context.Context, ev *Event) []*models.Alert {
+	var id zeek.ConnID
+	event := analyzer.ExecEvent{Timestamp: ev.Timestamp}
+
+	switch rec := ev.Record.(type) {
+	case *zeek.SMBMappingRecord:
+		id = rec.ConnID
+		event.Method = shareEvent(rec.Path)
+		event.Detail = rec.Path
+
+	case *zeek.SMBFilesRecord:
+		id = rec.ConnID
+		event.Method = shareEvent(rec.Path)
+		event.Detail = rec.Path
+		if event.Method == analyzer.ExecAdminShare && strings.Contains(rec.Action, "WRITE") && isDroppedFile(rec.Name) {
+			event.Method = analyzer.ExecFileWrite
+			event.Detail = rec.Path + `\` + rec.Name
+		}
+
+	case *zeek.DCERPCRecord:
+		id = rec.ConnID
+		operations, ok := dceRPCExecEvents[rec.Endpoint]
+		if !ok {
+			operations = dceRPCExecEvents[strings.ToLower(rec.Endpoint)]
+		}
+		if event.Method = operations[rec.Operation]; event.Method == "" {
+			event.Method = operations[""]
+		}
+		event.Detail = rec.Endpoint + "::" + rec.Operation
+
+	default:
+		// conn records only matter for WinRM sessions that carried data
+		conn := ev.Conn
+		if conn == nil || !winRMPorts[conn.DstPort] || conn.OrigBytes == 0 || conn.RespBytes == 0 {
+			return nil
+		}
+		if d.assets != nil && d.assets.Role(conn.SrcIP) == models.AssetRoleManagementHost {
+			return nil
+		}
+		id = zeek.ConnID{OrigH: conn.SrcIP, OrigP: conn.SrcPort, RespH: conn.DstIP, RespP: conn.DstPort}
+		event.Method = analyzer.ExecWinRM
+		event.Detail = conn.Service
+	}
+	if event.Method == "" {
+		return nil
+	}
+
+	alert := d.lateral.DetectRemoteExec(id.OrigH, id.RespH, event)
+	if alert == nil {
+		return nil
+	}
+
+	alert.DstPort = id.RespP
+	alert.Protocol = "tcp"
+	return []*models.Alert{stamp(alert, ev)}
+}
+
+// shareEvent classifies an SMB share path
+func shareEvent(path string) string {
+	share := strings.ToUpper(path)
+	if i := strings.LastIndex(share, `\`); i >= 0 {
+		share = share[i+1:]
+	}
+
+	switch {
+	case share == "IPC$":
+		return analyzer.ExecIPCShare
+	case isAdminShare(share):
+		return analyzer.ExecAdminShare
+	}
+	return ""
+}
+
+func isDroppedFile(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range droppedFileExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdminShare reports whether an upper-case share name is ADMIN$ or a
+// drive share such as C$
+func isAdminShare(share string) bool {
+	return share == "ADMIN$" || (len(share) == 2 && share[1] == '$' && share[0] >= 'A' && share[0] <= 'Z')
+}
+
+// stamp sets the event time and initial status on an analyzer alert
+func stamp(alert *models.Alert, ev *Event) *models.Alert {
+	alert.Timestamp = ev.Timestamp
+	alert.Status = "new"
+	return alert
+}
@@ -0,0 +1,210 @@
+package detector
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/Cxiyuan/NTA/pkg/metrics"
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Event is one Zeek record handed to the detectors
+type Event struct {
+	LogType string
+	// Record is the decoded record, e.g. *zeek.DNSRecord for dns. It may be
+	// nil for conn events built from packets, which only carry Conn.
+	Record interface{}
+	// Conn is set for conn events
+	Conn *models.Connection
+	// Timestamp is the record time, used for detection windows and the
+	// alerts raised on this event
+	Timestamp time.Time
+}
+
+// Detector inspects records of the log types it handles.
+//
+// Inspect may run concurrently for different records; Configure never runs
+// concurrently with Inspect.
+type Detector interface {
+	Name() string
+	LogTypes() []string
+	Configure(cfg config.DetectionConfig)
+	Inspect(ctx context.Context, ev *Event) []*models.Alert
+}
+
+// Cleaner is implemented by detectors that keep per-host state which has to
+// be expired periodically. now is the record time the registry has
+// reached, so state is not expired early while catching up on old logs.
+type Cleaner interface {
+	Cleanup(now time.Time)
+}
+
+// Status describes a registered detector
+type Status struct {
+	Name     string   `json:"name"`
+	LogTypes []string `json:"log_types"`
+	Enabled  bool     `json:"enabled"`
+}
+
+// Registry runs the registered detectors that handle each event
+type Registry struct {
+	logger    *logrus.Logger
+	mu        sync.RWMutex
+	detectors []Detector
+	enabled   map[string]bool
+	// clock is the latest event time seen in Unix nanoseconds
+	clock atomic.Int64
+}
+
+func NewRegistry(logger *logrus.Logger) *Registry {
+	return &Registry{
+		logger:  logger,
+		enabled: make(map[string]bool),
+	}
+}
+
+// Register adds an enabled detector with its default settings
+func (r *Registry) Register(d Detector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d.Configure(config.DetectionConfig{})
+	r.detectors = append(r.detectors, d)
+	r.enabled[d.Name()] = true
+}
+
+// Apply enables, disables and reconfigures detectors. It can be called at
+// any time to reload settings.
+func (r *Registry) Apply(cfg config.DetectionConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	known := make(map[string]bool, len(r.detectors))
+	for _, d := range r.detectors {
+		name := d.Name()
+		known[name] = true
+		r.enabled[name] = cfg.Detector(name).IsEnabled()
+		d.Configure(cfg)
+	}
+
+	for name := range cfg.Detectors {
+		if !known[name] {
+			r.logger.Warnf("Ignoring settings for unknown detector: %s", name)
+		}
+	}
+}
+
+// Handles reports whether any enabled detector inspects logType
+func (r *Registry) Handles(logType string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, d := range r.detectors {
+		if r.enabled[d.Name()] && handles(d, logType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Inspect runs every enabled detector for the event's log type
+func (r *Registry) Inspect(ctx context.Context, ev *Event) []*models.Alert {
+	r.advance(ev.Timestamp)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var alerts []*models.Alert
+	for _, d := range r.detectors {
+		if !r.enabled[d.Name()] || !handles(d, ev.LogType) {
+			continue
+		}
+
+		start := time.Now()
+		alerts = append(alerts, r.inspect(ctx, d, ev)...)
+		metrics.DetectorDuration.WithLabelValues(d.Name()).Observe(time.Since(start).Seconds())
+	}
+
+	return alerts
+}
+
+// inspect runs one detector. A panicking detector loses the event but
+// does not take down the other detectors or the process.
+func (r *Registry) inspect(ctx context.Context, d Detector, ev *Event) (alerts []*models.Alert) {
+	defer func() {
+		if p := recover(); p != nil {
+			r.logger.Errorf("Detector %s panicked on %s record: %v", d.Name(), ev.LogType, p)
+			alerts = nil
+		}
+	}()
+	return d.Inspect(ctx, ev)
+}
+
+// advance moves the clock to an event time. Times ahead of the wall clock
+// are capped so one bad record cannot expire all state.
+func (r *Registry) advance(ts time.Time) {
+	if ts.IsZero() {
+		return
+	}
+	if now := time.Now(); ts.After(now) {
+		ts = now
+	}
+	for {
+		cur := r.clock.Load()
+		if ts.UnixNano() <= cur || r.clock.CompareAndSwap(cur, ts.UnixNano()) {
+			return
+		}
+	}
+}
+
+// Now returns the latest event time seen, or the current time before the
+// first event
+func (r *Registry) Now() time.Time {
+	if ns := r.clock.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Now()
+}
+
+// Cleanup expires state kept by the registered detectors
+func (r *Registry) Cleanup() {
+	now := r.Now()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, d := range r.detectors {
+		if c, ok := d.(Cleaner); ok {
+			c.Cleanup(now)
+		}
+	}
+}
+
+// Status lists the registered detectors by name
+func (r *Registry) Status() []Status {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := make([]Status, 0, len(r.detectors))
+	for _, d := range r.detectors {
+		result = append(result, Status{Name: d.Name(), LogTypes: d.LogTypes(), Enabled: r.enabled[d.Name()]})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func handles(d Detector, logType string) bool {
+	for _, t := range d.LogTypes() {
+		if t == logType {
+			return true
+		}
+	}
+	return false
+}
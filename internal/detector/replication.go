@@ -0,0 +1,80 @@
+package detector
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/internal/analyzer"
+	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/Cxiyuan/NTA/internal/zeek"
+	"github.com/Cxiyuan/NTA/pkg/models"
+)
+
+// replicationDetector flags DRSUAPI replication calls that do not run
+// between domain controllers (DCSync, DCShadow). Besides the asset
+// inventory, hosts answering Kerberos requests are taken as domain
+// controllers.
+type replicationDetector struct {
+	lateral   *analyzer.LateralMovementDetector
+	inventory DomainControllers
+
+	mu  sync.RWMutex
+	kdc map[string]time.Time
+}
+
+func (d *replicationDetector) Name() string       { return "dc_replication" }
+func (d *replicationDetector) LogTypes() []string { return []string{"dce_rpc", "kerberos"} }
+
+func (d *replicationDetector) Configure(cfg config.DetectionConfig) {}
+
+// Cleanup forgets KDCs that have not answered for a day
+func (d *replicationDetector) Cleanup(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cutoff := now.Add(-24 * time.Hour)
+	for ip, seen := range d.kdc {
+		if seen.Before(cutoff) {
+			delete(d.kdc, ip)
+		}
+	}
+}
+
+func (d *replicationDetector) Inspect(ctx context.Context, ev *Event) []*models.Alert {
+	switch rec := ev.Record.(type) {
+	case *zeek.KerberosRecord:
+		if rec.Success != nil && *rec.Success && rec.RespH != "" {
+			d.mu.Lock()
+			d.kdc[rec.RespH] = ev.Timestamp
+			d.mu.Unlock()
+		}
+
+	case *zeek.DCERPCRecord:
+		if !strings.EqualFold(rec.Endpoint, "drsuapi") {
+			return nil
+		}
+		alert := d.lateral.DetectReplication(rec.OrigH, rec.RespH, rec.Operation,
+			d.isDomainController(rec.OrigH), d.isDomainController(rec.RespH), ev.Timestamp)
+		if alert == nil {
+			return nil
+		}
+		alert.DstPort = rec.RespP
+		alert.Protocol = "tcp"
+		return []*models.Alert{stamp(alert, ev)}
+	}
+
+	return nil
+}
+
+func (d *replicationDetector) isDomainController(ip string) bool {
+	if d.inventory != nil && d.inventory.IsDomainController(ip) {
+		return true
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	_, ok := d.kdc[ip]
+	return ok
+}
@@ -0,0 +1,124 @@
+package detector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	detectionConfigKey     = "config:detection"
+	detectionConfigChannel = "config:detection:updated"
+)
+
+// ConfigStore shares detection settings changed through the API with every
+// process running detectors. Stored settings override the config file.
+type ConfigStore struct {
+	redis  *redis.Client
+	base   config.DetectionConfig
+	logger *logrus.Logger
+}
+
+// NewConfigStore creates a store on top of the settings from the config file
+func NewConfigStore(rdb *redis.Client, base config.DetectionConfig, logger *logrus.Logger) *ConfigStore {
+	return &ConfigStore{
+		redis:  rdb,
+		base:   base,
+		logger: logger,
+	}
+}
+
+// Load returns the effective detection settings
+func (s *ConfigStore) Load(ctx context.Context) (config.DetectionConfig, error) {
+	cfg, err := s.copyBase()
+	if err != nil {
+		return cfg, err
+	}
+
+	data, err := s.redis.Get(ctx, detectionConfigKey).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// Save stores the settings and notifies watchers
+func (s *ConfigStore) Save(ctx context.Context, cfg config.DetectionConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := s.redis.Set(ctx, detectionConfigKey, data, 0).Err(); err != nil {
+		return err
+	}
+	return s.redis.Publish(ctx, detectionConfigChannel, "").Err()
+}
+
+// Reload applies the effective settings to registry
+func (s *ConfigStore) Reload(ctx context.Context, registry *Registry) error {
+	cfg, err := s.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	registry.Apply(cfg)
+	return nil
+}
+
+// Watch reloads registry after every Save until ctx is cancelled
+func (s *ConfigStore) Watch(ctx context.Context, registry *Registry) {
+	pubsub := s.redis.Subscribe(ctx, detectionConfigChannel)
+	defer pubsub.Close()
+
+	// Catch changes saved before the subscription was active
+	if err := s.Reload(ctx, registry); err != nil {
+		s.logger.Errorf("Failed to reload detection config: %v", err)
+	}
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			if err := s.Reload(ctx, registry); err != nil {
+				s.logger.Errorf("Failed to reload detection config: %v", err)
+				continue
+			}
+			s.logger.Info("Detection config reloaded")
+		}
+	}
+}
+
+// copyBase deep-copies the file settings so overrides never modify them.
+// File paths are not serialized and are carried over separately.
+func (s *ConfigStore) copyBase() (config.DetectionConfig, error) {
+	var cfg config.DetectionConfig
+
+	data, err := json.Marshal(s.base)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	cfg.WebShellRules = s.base.WebShellRules
+	cfg.FlowModel = s.base.FlowModel
+	return cfg, nil
+}
@@ -0,0 +1,124 @@
+package detector
+
+import (
+	"context"
+	_ "embed"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/internal/analyzer"
+	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/Cxiyuan/NTA/internal/zeek"
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed data/webshell_rules.yaml
+var webShellRuleData []byte
+
+// webShellIdleTimeout is how long a server's path history is kept without
+// requests
+const webShellIdleTimeout = 7 * 24 * time.Hour
+
+var (
+	builtinWebShellRules     *analyzer.WebShellRules
+	builtinWebShellRulesOnce sync.Once
+)
+
+// defaultWebShellRules returns the compiled built-in rules
+func defaultWebShellRules() *analyzer.WebShellRules {
+	builtinWebShellRulesOnce.Do(func() {
+		rules, err := analyzer.CompileWebShellRules(webShellRuleData)
+		if err != nil {
+			panic("invalid built-in web shell rules: " + err.Error())
+		}
+		builtinWebShellRules = rules
+	})
+	return builtinWebShellRules
+}
+
+// webShellDetector correlates http.log with files.log to find web shell
+// requests against internal servers
+type webShellDetector struct {
+	tracker *analyzer.WebShellDetector
+	logger  *logrus.Logger
+}
+
+func newWebShellDetector(logger *logrus.Logger) *webShellDetector {
+	return &webShellDetector{
+		tracker: analyzer.NewWebShellDetector(logger, defaultWebShellRules(), analyzer.WebShellSettings{}),
+		logger:  logger,
+	}
+}
+
+func (d *webShellDetector) Name() string       { return "webshell" }
+func (d *webShellDetector) LogTypes() []string { return []string{"http", "files"} }
+
+func (d *webShellDetector) Configure(cfg config.DetectionConfig) {
+	settings := cfg.Detector(d.Name())
+	d.tracker.SetSettings(analyzer.WebShellSettings{
+		MinScore:         settings.Threshold("min_score", 0.6),
+		RareClients:      int(settings.Threshold("rare_clients", 2)),
+		MinServerClients: int(settings.Threshold("min_server_clients", 10)),
+	})
+
+	rules := defaultWebShellRules()
+	if cfg.WebShellRules != "" {
+		data, err := os.ReadFile(cfg.WebShellRules)
+		if err == nil {
+			rules, err = analyzer.CompileWebShellRules(data)
+		}
+		if err != nil {
+			d.logger.Errorf("Failed to load web shell rules from %s, using built-in rules: %v", cfg.WebShellRules, err)
+			rules = defaultWebShellRules()
+		}
+	}
+	d.tracker.SetRules(rules)
+}
+
+// Cleanup forgets idle servers and uncorrelated log entries
+func (d *webShellDetector) Cleanup(now time.Time) {
+	d.tracker.Cleanup(now.Add(-webShellIdleTimeout))
+}
+
+func (d *webShellDetector) Inspect(ctx context.Context, ev *Event) []*models.Alert {
+	var alert *models.Alert
+	switch rec := ev.Record.(type) {
+	case *zeek.HTTPRecord:
+		alert = d.tracker.Observe(&analyzer.HTTPTransaction{
+			Timestamp:     ev.Timestamp,
+			UID:           rec.UID,
+			SrcIP:         rec.OrigH,
+			SrcPort:       rec.OrigP,
+			DstIP:         rec.RespH,
+			DstPort:       rec.RespP,
+			Method:        rec.Method,
+			Host:          rec.Host,
+			URI:           rec.URI,
+			UserAgent:     rec.UserAgent,
+			StatusCode:    rec.StatusCode,
+			RequestBytes:  rec.RequestBodyLen,
+			ResponseBytes: rec.ResponseBodyLen,
+			RespFUIDs:     rec.RespFUIDs,
+			RespMIMETypes: rec.RespMIMETypes,
+		})
+	case *zeek.FilesRecord:
+		// Only response bodies served over HTTP
+		if rec.Source != "HTTP" || rec.IsOrig {
+			return nil
+		}
+		alert = d.tracker.ObserveFile(&analyzer.HTTPFile{
+			Timestamp: ev.Timestamp,
+			FUID:      rec.FUID,
+			MIMEType:  rec.MIMEType,
+			Filename:  rec.Filename,
+			Bytes:     rec.SeenBytes,
+		})
+	}
+	if alert == nil {
+		return nil
+	}
+	stamp(alert, ev)
+	return []*models.Alert{alert}
+}
@@ -1,134 +1,481 @@
 package encryption
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Cxiyuan/NTA/pkg/models"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// maxCertificates caps the server certificates remembered for
+	// handshakes that reference them
+	maxCertificates = 100000
+	// certificateTTL is how long a certificate is remembered after it was
+	// last seen. Zeek logs a certificate again after a day.
+	certificateTTL = 25 * time.Hour
+	// certificateMissTTL is how long a fingerprint missing from the
+	// certificate store is not looked up again
+	certificateMissTTL = time.Minute
+	// certificateLookupTimeout bounds a certificate store lookup
+	certificateLookupTimeout = 2 * time.Second
+)
+
+// Anomaly is a finding of the analyzer that can be raised as an alert
+type Anomaly struct {
+	Type         string                 `json:"type"`
+	Severity     string                 `json:"severity"`
+	Confidence   float64                `json:"confidence"`
+	Description  string                 `json:"description"`
+	ThreatLabel  string                 `json:"threat_label,omitempty"`
+	ThreatSource string                 `json:"threat_source,omitempty"`
+	Details      map[string]interface{} `json:"details,omitempty"`
+}
+
+// Alertable reports whether the anomaly is raised as an alert; the others
+// are only recorded on the handshake
+func (an Anomaly) Alertable() bool {
+	switch an.Severity {
+	case "critical", "high", "medium":
+		return true
+	}
+	return false
+}
+
+// Alert builds the alert for an anomaly of the given handshake
+func (an Anomaly) Alert(hs *models.TLSHandshake) *models.Alert {
+	details := map[string]interface{}{
+		"uid":              hs.UID,
+		"server_name":      hs.ServerName,
+		"version":          hs.Version,
+		"cipher":           hs.CipherSuite,
+		"ja3":              hs.JA3,
+		"ja3s":             hs.JA3S,
+		"ja4":              hs.JA4,
+		"ja4s":             hs.JA4S,
+		"cert_fingerprint": hs.CertFingerprint,
+	}
+	for k, v := range an.Details {
+		details[k] = v
+	}
+	data, _ := json.Marshal(details)
+
+	timestamp := hs.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	return &models.Alert{
+		Timestamp:    timestamp,
+		Severity:     an.Severity,
+		Type:         an.Type,
+		SrcIP:        hs.SrcIP,
+		DstIP:        hs.DstIP,
+		SrcPort:      hs.SrcPort,
+		DstPort:      hs.DstPort,
+		Protocol:     "tcp",
+		Description:  an.Description,
+		ThreatLabel:  an.ThreatLabel,
+		ThreatSource: an.ThreatSource,
+		Confidence:   an.Confidence,
+		Details:      string(data),
+	}
+}
+
+// CertificateSettings tunes certificate analysis
+type CertificateSettings struct {
+	// MinValidity flags certificates valid for a shorter period
+	MinValidity time.Duration
+	// FreshPeriod flags certificates issued this long before they are seen
+	FreshPeriod time.Duration
+	// SuspiciousIssuers are case-insensitive substrings of issuer names
+	// used by default and attack tool certificates
+	SuspiciousIssuers []string
+}
+
+// DefaultCertificateSettings returns the settings used by NewAnalyzer
+func DefaultCertificateSettings() CertificateSettings {
+	return CertificateSettings{
+		MinValidity: 72 * time.Hour,
+		FreshPeriod: 24 * time.Hour,
+		SuspiciousIssuers: []string{
+			"O=Internet Widgits Pty Ltd", // OpenSSL defaults
+			"ST=Some-State",
+			"O=Default Company Ltd",
+			"L=Default City",
+			"O=Acme Co", // Go generate_cert
+			"Major Cobalt Strike",
+			"cobaltstrike",
+			"CN=localhost",
+			"CN=example.com",
+		},
+	}
+}
+
 // Analyzer analyzes encrypted traffic (TLS/SSL)
 type Analyzer struct {
-	logger          *logrus.Logger
-	suspiciousJA3   map[string]string // JA3 hash -> malware name
-	minTLSVersion   string
+	logger        *logrus.Logger
+	fingerprints  *FingerprintStore
+	minTLSVersion uint16
+
+	mu       sync.RWMutex
+	settings CertificateSettings
+	certs    map[string]*cachedCertificate
+	store    *CertificateStore
+	// misses are fingerprints recently not found in the store
+	misses map[string]time.Time
+}
+
+type cachedCertificate struct {
+	cert     *models.Certificate
+	lastSeen time.Time
 }
 
-// NewAnalyzer creates a new encryption analyzer
-func NewAnalyzer(logger *logrus.Logger) *Analyzer {
+// NewAnalyzer creates a new encryption analyzer matching handshakes against
+// fingerprints
+func NewAnalyzer(logger *logrus.Logger, fingerprints *FingerprintStore) *Analyzer {
 	return &Analyzer{
-		logger: logger,
-		suspiciousJA3: map[string]string{
-			"6734f37431670b3ab4292b8f60f29984": "Metasploit",
-			"51c64c77e60f3980eea90869b68c58a8": "Cobalt Strike",
-			"a0e9f5d64349fb13191bc781f81f42e1": "Trickbot",
-		},
-		minTLSVersion: "TLS 1.2",
+		logger:        logger,
+		fingerprints:  fingerprints,
+		minTLSVersion: tls.VersionTLS12,
+		settings:      DefaultCertificateSettings(),
+		certs:         make(map[string]*cachedCertificate),
+		misses:        make(map[string]time.Time),
+	}
+}
+
+// SetCertificateSettings replaces the certificate analysis settings
+func (a *Analyzer) SetCertificateSettings(settings CertificateSettings) {
+	a.mu.Lock()
+	a.settings = settings
+	a.mu.Unlock()
+}
+
+// SetCertificateStore persists observed certificates in store and looks up
+// the certificates of handshakes there when they are not cached
+func (a *Analyzer) SetCertificateStore(store *CertificateStore) {
+	a.mu.Lock()
+	a.store = store
+	a.mu.Unlock()
+}
+
+// ObserveCertificate remembers a server certificate from x509.log so
+// handshakes referencing its fingerprint are checked against it. It
+// reports whether the certificate is a server certificate.
+func (a *Analyzer) ObserveCertificate(ctx context.Context, cert *models.Certificate) (bool, error) {
+	if cert.Fingerprint == "" || (cert.ClientCert && !cert.HostCert) {
+		return false, nil
+	}
+	a.cacheCertificate(cert)
+
+	a.mu.RLock()
+	store := a.store
+	a.mu.RUnlock()
+	if store == nil {
+		return true, nil
+	}
+	return true, store.Save(ctx, cert)
+}
+
+func (a *Analyzer) cacheCertificate(cert *models.Certificate) {
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, exists := a.certs[cert.Fingerprint]; !exists && len(a.certs) >= maxCertificates {
+		a.expireCertificates(now)
+	}
+	a.certs[cert.Fingerprint] = &cachedCertificate{cert: cert, lastSeen: now}
+	delete(a.misses, cert.Fingerprint)
+}
+
+// expireCertificates drops certificates not seen within certificateTTL, or
+// arbitrary ones if the cache is still full
+func (a *Analyzer) expireCertificates(now time.Time) {
+	cutoff := now.Add(-certificateTTL)
+	for fp, c := range a.certs {
+		if c.lastSeen.Before(cutoff) {
+			delete(a.certs, fp)
+		}
+	}
+	for fp := range a.certs {
+		if len(a.certs) < maxCertificates {
+			break
+		}
+		delete(a.certs, fp)
+	}
+}
+
+// certificate returns the certificate with the given fingerprint from the
+// cache or the certificate store, or nil
+func (a *Analyzer) certificate(fingerprint string) *models.Certificate {
+	if fingerprint == "" {
+		return nil
+	}
+	now := time.Now()
+
+	a.mu.Lock()
+	if c, ok := a.certs[fingerprint]; ok {
+		c.lastSeen = now
+		a.mu.Unlock()
+		return c.cert
+	}
+	store := a.store
+	missed, ok := a.misses[fingerprint]
+	a.mu.Unlock()
+	if store == nil || (ok && now.Sub(missed) < certificateMissTTL) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), certificateLookupTimeout)
+	defer cancel()
+	cert, err := store.Load(ctx, fingerprint)
+	if err != nil {
+		a.logger.Warnf("Certificate lookup failed: %v", err)
+		return nil
 	}
+	if cert == nil {
+		a.mu.Lock()
+		if len(a.misses) >= maxCertificates {
+			a.misses = make(map[string]time.Time)
+		}
+		a.misses[fingerprint] = now
+		a.mu.Unlock()
+		return nil
+	}
+
+	a.cacheCertificate(cert)
+	return cert
 }
 
-// AnalyzeTLS analyzes TLS handshake
-func (a *Analyzer) AnalyzeTLS(hs *models.TLSHandshake) []string {
-	var anomalies []string
+// AnalyzeTLS analyzes a TLS handshake and its server certificate, if it
+// was seen in x509.log, and sets CertChecked when it was
+func (a *Analyzer) AnalyzeTLS(hs *models.TLSHandshake) []Anomaly {
+	var anomalies []Anomaly
 
 	// Check TLS version
-	if hs.Version < a.minTLSVersion {
-		anomalies = append(anomalies, "outdated_tls_version")
+	if version, ok := ParseVersion(hs.Version); ok && version < a.minTLSVersion {
+		severity, confidence := "medium", 0.6
+		if version < tls.VersionTLS10 {
+			severity, confidence = "high", 0.8
+		}
+		anomalies = append(anomalies, Anomaly{
+			Type:        "outdated_tls_version",
+			Severity:    severity,
+			Confidence:  confidence,
+			Description: fmt.Sprintf("过时的TLS版本: %s", hs.Version),
+			Details:     map[string]interface{}{"version": hs.Version},
+		})
 	}
 
-	// Check JA3 fingerprint
-	if malware, exists := a.suspiciousJA3[hs.JA3]; exists {
-		anomalies = append(anomalies, fmt.Sprintf("malicious_ja3:%s", malware))
+	// Check cipher suite
+	switch ClassifyCipher(hs.CipherSuite) {
+	case CipherInsecure:
+		anomalies = append(anomalies, Anomaly{
+			Type:        "weak_cipher",
+			Severity:    "high",
+			Confidence:  0.8,
+			Description: fmt.Sprintf("不安全的加密套件: %s", hs.CipherSuite),
+			Details:     map[string]interface{}{"cipher": hs.CipherSuite, "strength": CipherInsecure},
+		})
+	case CipherWeak:
+		anomalies = append(anomalies, Anomaly{
+			Type:        "weak_cipher",
+			Severity:    "medium",
+			Confidence:  0.6,
+			Description: fmt.Sprintf("弱加密套件: %s", hs.CipherSuite),
+			Details:     map[string]interface{}{"cipher": hs.CipherSuite, "strength": CipherWeak},
+		})
+	}
+
+	// Check JA3, JA3S, the JA3+JA3S pair and JA4 fingerprints
+	if a.fingerprints != nil {
+		for _, fp := range a.fingerprints.Match(hs) {
+			a.fingerprints.Touch(fp.Type, fp.Value, seenAt(hs.Timestamp))
+			if fp.Category == CategoryMalicious {
+				anomalies = append(anomalies, maliciousAnomaly(fp))
+			}
+		}
 	}
 
 	// Check missing SNI
 	if hs.ServerName == "" {
-		anomalies = append(anomalies, "missing_sni")
+		anomalies = append(anomalies, Anomaly{
+			Type:        "missing_sni",
+			Severity:    "info",
+			Confidence:  0.3,
+			Description: "TLS握手缺少SNI",
+		})
 	}
 
 	// Check non-standard port
 	if hs.DstPort != 443 && hs.DstPort != 8443 {
-		anomalies = append(anomalies, "non_standard_tls_port")
+		anomalies = append(anomalies, Anomaly{
+			Type:        "non_standard_tls_port",
+			Severity:    "info",
+			Confidence:  0.3,
+			Description: fmt.Sprintf("非标准端口TLS通信: %d", hs.DstPort),
+			Details:     map[string]interface{}{"port": hs.DstPort},
+		})
+	}
+
+	if cert := a.certificate(hs.CertFingerprint); cert != nil {
+		anomalies = append(anomalies, a.AnalyzeCertificate(cert, hs.ServerName, seenAt(hs.Timestamp))...)
+		hs.CertChecked = true
 	}
 
 	return anomalies
 }
 
-// CalculateJA3 calculates JA3 fingerprint
-func (a *Analyzer) CalculateJA3(version, ciphers, extensions string) string {
-	ja3String := fmt.Sprintf("%s,%s,%s", version, ciphers, extensions)
-	hash := md5.Sum([]byte(ja3String))
-	return fmt.Sprintf("%x", hash)
-}
+// AnalyzeCertificate checks a server certificate seen at the given time.
+// serverName is the SNI of the handshake, or empty to skip name checks.
+func (a *Analyzer) AnalyzeCertificate(cert *models.Certificate, serverName string, seen time.Time) []Anomaly {
+	a.mu.RLock()
+	settings := a.settings
+	a.mu.RUnlock()
+
+	var anomalies []Anomaly
+	certDetails := func(extra map[string]interface{}) map[string]interface{} {
+		details := map[string]interface{}{
+			"fingerprint": cert.Fingerprint,
+			"subject":     cert.Subject,
+			"issuer":      cert.Issuer,
+		}
+		for k, v := range extra {
+			details[k] = v
+		}
+		return details
+	}
 
-// DetectC2Beacon detects command and control beacon traffic
-func (a *Analyzer) DetectC2Beacon(conns []*models.Connection) []*models.Alert {
-	// Group connections by src-dst pair
-	connMap := make(map[string][]*models.Connection)
-	
-	for _, conn := range conns {
-		key := fmt.Sprintf("%s-%s:%d", conn.SrcIP, conn.DstIP, conn.DstPort)
-		connMap[key] = append(connMap[key], conn)
+	if a.fingerprints != nil {
+		if fp := a.fingerprints.LookupCertificate(cert.Fingerprint); fp != nil {
+			a.fingerprints.Touch(fp.Type, fp.Value, seen)
+			if fp.Category == CategoryMalicious {
+				anomaly := maliciousAnomaly(*fp)
+				anomaly.Type = "malicious_certificate"
+				anomaly.Description = fmt.Sprintf("命中恶意证书: %s (%s)", cert.Subject, fp.Label)
+				anomaly.Details = certDetails(nil)
+				anomalies = append(anomalies, anomaly)
+			}
+		}
 	}
 
-	var alerts []*models.Alert
+	if cert.Subject != "" && cert.Subject == cert.Issuer {
+		anomalies = append(anomalies, Anomaly{
+			Type:        "self_signed_certificate",
+			Severity:    "medium",
+			Confidence:  0.6,
+			Description: fmt.Sprintf("自签名证书: %s", cert.Subject),
+			Details:     certDetails(nil),
+		})
+	}
 
-	// Detect beaconing patterns
-	for key, group := range connMap {
-		if len(group) < 5 {
-			continue
-		}
+	switch {
+	case !cert.NotAfter.IsZero() && seen.After(cert.NotAfter):
+		anomalies = append(anomalies, Anomaly{
+			Type:        "expired_certificate",
+			Severity:    "medium",
+			Confidence:  0.7,
+			Description: fmt.Sprintf("证书已过期: %s (过期时间 %s)", cert.Subject, cert.NotAfter.Format(time.RFC3339)),
+			Details:     certDetails(map[string]interface{}{"not_after": cert.NotAfter}),
+		})
+	case !cert.NotBefore.IsZero() && seen.Before(cert.NotBefore):
+		anomalies = append(anomalies, Anomaly{
+			Type:        "certificate_not_yet_valid",
+			Severity:    "medium",
+			Confidence:  0.7,
+			Description: fmt.Sprintf("证书尚未生效: %s (生效时间 %s)", cert.Subject, cert.NotBefore.Format(time.RFC3339)),
+			Details:     certDetails(map[string]interface{}{"not_before": cert.NotBefore}),
+		})
+	}
 
-		// Check for regular intervals
-		if isRegularInterval(group) {
-			parts := strings.Split(key, "-")
-			alerts = append(alerts, &models.Alert{
-				Type:        "c2_beacon",
-				Severity:    "high",
-				SrcIP:       parts[0],
-				DstIP:       strings.Split(parts[1], ":")[0],
-				Description: "C2 beacon traffic detected",
-				Confidence:  0.85,
+	if !cert.NotBefore.IsZero() && !cert.NotAfter.IsZero() {
+		validity := cert.NotAfter.Sub(cert.NotBefore)
+		if validity < settings.MinValidity {
+			anomalies = append(anomalies, Anomaly{
+				Type:        "short_validity_certificate",
+				Severity:    "medium",
+				Confidence:  0.5,
+				Description: fmt.Sprintf("证书有效期过短: %s (%s)", cert.Subject, validity),
+				Details:     certDetails(map[string]interface{}{"validity_hours": validity.Hours()}),
 			})
 		}
-	}
-
-	return alerts
-}
 
-func isRegularInterval(conns []*models.Connection) bool {
-	if len(conns) < 5 {
-		return false
+		age := seen.Sub(cert.NotBefore)
+		if age >= 0 && age < settings.FreshPeriod {
+			anomalies = append(anomalies, Anomaly{
+				Type:        "new_certificate",
+				Severity:    "low",
+				Confidence:  0.3,
+				Description: fmt.Sprintf("新签发的证书: %s", cert.Subject),
+				Details:     certDetails(map[string]interface{}{"age_hours": age.Hours()}),
+			})
+		}
 	}
 
-	// Calculate intervals
-	var intervals []float64
-	for i := 1; i < len(conns); i++ {
-		interval := conns[i].Timestamp.Sub(conns[i-1].Timestamp).Seconds()
-		intervals = append(intervals, interval)
+	if serverName != "" && !MatchesServerName(cert, serverName) {
+		anomalies = append(anomalies, Anomaly{
+			Type:        "certificate_name_mismatch",
+			Severity:    "medium",
+			Confidence:  0.6,
+			Description: fmt.Sprintf("证书与SNI不匹配: %s", serverName),
+			Details: certDetails(map[string]interface{}{
+				"server_name": serverName,
+				"dns_names":   cert.DNSNames,
+			}),
+		})
 	}
 
-	// Check if intervals are similar (within 20% variance)
-	avg := average(intervals)
-	for _, interval := range intervals {
-		variance := (interval - avg) / avg
-		if variance > 0.2 || variance < -0.2 {
-			return false
+	issuer := strings.ToLower(cert.Issuer)
+	for _, pattern := range settings.SuspiciousIssuers {
+		if pattern != "" && strings.Contains(issuer, strings.ToLower(pattern)) {
+			anomalies = append(anomalies, Anomaly{
+				Type:        "suspicious_certificate_issuer",
+				Severity:    "medium",
+				Confidence:  0.6,
+				Description: fmt.Sprintf("可疑证书签发者: %s", cert.Issuer),
+				Details:     certDetails(map[string]interface{}{"pattern": pattern}),
+			})
+			break
 		}
 	}
 
-	return true
+	return anomalies
 }
 
-func average(nums []float64) float64 {
-	if len(nums) == 0 {
-		return 0
+func maliciousAnomaly(fp models.TLSFingerprint) Anomaly {
+	return Anomaly{
+		Type:         "malicious_" + fp.Type,
+		Severity:     fp.Severity,
+		Confidence:   0.9,
+		Description:  fmt.Sprintf("命中恶意TLS指纹(%s): %s", fp.Type, fp.Label),
+		ThreatLabel:  fp.Label,
+		ThreatSource: fp.Source,
+		Details: map[string]interface{}{
+			"fingerprint_type":  fp.Type,
+			"fingerprint_value": fp.Value,
+		},
 	}
-	sum := 0.0
-	for _, n := range nums {
-		sum += n
+}
+
+// CalculateJA3 calculates JA3 fingerprint
+func (a *Analyzer) CalculateJA3(version, ciphers, extensions string) string {
+	ja3String := fmt.Sprintf("%s,%s,%s", version, ciphers, extensions)
+	hash := md5.Sum([]byte(ja3String))
+	return fmt.Sprintf("%x", hash)
+}
+
+// seenAt returns the time a handshake was seen, or now if it has none
+func seenAt(ts time.Time) time.Time {
+	if ts.IsZero() {
+		return time.Now()
 	}
-	return sum / float64(len(nums))
+	return ts
 }
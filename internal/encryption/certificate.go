@@ -0,0 +1,121 @@
+package encryption
+
+import (
+	"net"
+	"strings"
+
+	"github.com/Cxiyuan/NTA/pkg/models"
+)
+
+// Cipher suite strengths
+const (
+	CipherStrong   = "strong"
+	CipherWeak     = "weak"
+	CipherInsecure = "insecure"
+	CipherUnknown  = "unknown"
+)
+
+var (
+	// insecureCipherParts break confidentiality or authentication outright
+	insecureCipherParts = []string{
+		"_NULL_", "_EXPORT", "_anon_", "_RC4_", "_RC2_",
+		"_DES_", "_DES40_", "_MD5",
+		// Integrity-only suites
+		"TLS_SHA256_SHA256", "TLS_SHA384_SHA384",
+	}
+	// weakCipherParts are deprecated but not practically broken
+	weakCipherParts = []string{"_3DES_", "_IDEA_"}
+)
+
+// ClassifyCipher rates a cipher suite by its IANA name, as logged by Zeek
+// and returned by CipherSuiteName
+func ClassifyCipher(name string) string {
+	if !strings.HasPrefix(name, "TLS_") && !strings.HasPrefix(name, "SSL_") {
+		return CipherUnknown
+	}
+
+	for _, part := range insecureCipherParts {
+		if strings.Contains(name, part) {
+			return CipherInsecure
+		}
+	}
+	for _, part := range weakCipherParts {
+		if strings.Contains(name, part) {
+			return CipherWeak
+		}
+	}
+	return CipherStrong
+}
+
+// MatchesServerName reports whether a certificate is valid for a server
+// name. The subject CN is only used when there are no DNS names.
+func MatchesServerName(cert *models.Certificate, serverName string) bool {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	if ip := net.ParseIP(serverName); ip != nil {
+		for _, addr := range cert.IPAddresses {
+			if certIP := net.ParseIP(addr); certIP != nil && certIP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	names := cert.DNSNames
+	if len(names) == 0 {
+		if cn := subjectField(cert.Subject, "CN"); cn != "" {
+			names = []string{cn}
+		}
+	}
+	for _, name := range names {
+		if matchHostname(strings.ToLower(name), serverName) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHostname matches a host against a name with an optional leftmost
+// wildcard label
+func matchHostname(pattern, host string) bool {
+	pattern = strings.TrimSuffix(pattern, ".")
+	if pattern == host {
+		return true
+	}
+	if !strings.HasPrefix(pattern, "*.") {
+		return false
+	}
+	label, rest, ok := strings.Cut(host, ".")
+	return ok && label != "" && rest == pattern[2:]
+}
+
+// subjectField returns an attribute of a distinguished name in the RFC 2253
+// form Zeek logs, such as "CN=example.com,O=Example\, Inc.,C=US"
+func subjectField(dn, attr string) string {
+	var part strings.Builder
+	escaped := false
+	fields := []string{}
+	for _, r := range dn {
+		switch {
+		case escaped:
+			part.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',':
+			fields = append(fields, part.String())
+			part.Reset()
+		default:
+			part.WriteRune(r)
+		}
+	}
+	fields = append(fields, part.String())
+
+	for _, field := range fields {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if ok && strings.EqualFold(key, attr) {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,49 @@
+package encryption
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CertificateStore persists certificates from x509.log in the certificates
+// table, so handshakes processed by another consumer or after a restart
+// are still checked against them
+type CertificateStore struct {
+	db *gorm.DB
+}
+
+// NewCertificateStore creates a store backed by db
+func NewCertificateStore(db *gorm.DB) *CertificateStore {
+	return &CertificateStore{db: db}
+}
+
+// Save stores a certificate, replacing the row with the same fingerprint
+func (s *CertificateStore) Save(ctx context.Context, cert *models.Certificate) error {
+	err := s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "fingerprint"}},
+		UpdateAll: true,
+	}).Create(cert).Error
+	if err != nil {
+		return fmt.Errorf("failed to save certificate %s: %w", cert.Fingerprint, err)
+	}
+	return nil
+}
+
+// Load returns the certificate with the given fingerprint, or nil if it
+// was never stored
+func (s *CertificateStore) Load(ctx context.Context, fingerprint string) (*models.Certificate, error) {
+	var cert models.Certificate
+	err := s.db.WithContext(ctx).Where("fingerprint = ?", fingerprint).First(&cert).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate %s: %w", fingerprint, err)
+	}
+	return &cert, nil
+}
@@ -0,0 +1,314 @@
+package encryption
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Cxiyuan/NTA/internal/config"
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Fingerprint list formats
+const (
+	FormatSSLBL     = "sslbl_ja3"
+	FormatSSLBLCert = "sslbl_cert"
+	FormatJA4DB     = "ja4db"
+	FormatJSON      = "json"
+)
+
+// maxFeedSize caps a downloaded fingerprint list
+const maxFeedSize = 256 << 20
+
+// ParseFingerprints reads a fingerprint list in the given format. source
+// is recorded on fingerprints that do not name one.
+func ParseFingerprints(format, source string, r io.Reader) ([]models.TLSFingerprint, error) {
+	var fingerprints []models.TLSFingerprint
+	var err error
+	switch format {
+	case FormatSSLBL:
+		fingerprints, err = parseSSLBL(r)
+	case FormatSSLBLCert:
+		fingerprints, err = parseSSLBLCert(r)
+	case FormatJA4DB:
+		fingerprints, err = parseJA4DB(r)
+	case FormatJSON, "":
+		err = json.NewDecoder(r).Decode(&fingerprints)
+	default:
+		return nil, fmt.Errorf("unknown fingerprint format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s fingerprints: %w", format, err)
+	}
+
+	for i := range fingerprints {
+		if fingerprints[i].Source == "" {
+			fingerprints[i].Source = source
+		}
+	}
+	return fingerprints, nil
+}
+
+// parseSSLBL reads the abuse.ch SSLBL JA3 list: ja3_md5, first seen, last
+// seen and listing reason, with # comments
+func parseSSLBL(r io.Reader) ([]models.TLSFingerprint, error) {
+	reader := newSSLBLReader(r)
+
+	var fingerprints []models.TLSFingerprint
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return fingerprints, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 4 {
+			continue
+		}
+
+		fp := models.TLSFingerprint{
+			Type:        FingerprintJA3,
+			Value:       record[0],
+			Label:       record[3],
+			Category:    CategoryMalicious,
+			Severity:    "high",
+			Description: "SSLBL: " + record[3],
+		}
+		fp.FirstSeen, _ = time.Parse("2006-01-02 15:04:05", record[1])
+		fp.LastSeen, _ = time.Parse("2006-01-02 15:04:05", record[2])
+		fingerprints = append(fingerprints, fp)
+	}
+}
+
+// parseSSLBLCert reads the abuse.ch SSLBL certificate list: listing
+// date, certificate SHA1 and listing reason, with # comments
+func parseSSLBLCert(r io.Reader) ([]models.TLSFingerprint, error) {
+	reader := newSSLBLReader(r)
+
+	var fingerprints []models.TLSFingerprint
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return fingerprints, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			continue
+		}
+
+		fp := models.TLSFingerprint{
+			Type:        FingerprintCertSHA1,
+			Value:       record[1],
+			Label:       record[2],
+			Category:    CategoryMalicious,
+			Severity:    "high",
+			Description: "SSLBL: " + record[2],
+		}
+		fp.FirstSeen, _ = time.Parse("2006-01-02 15:04:05", record[0])
+		fp.LastSeen = fp.FirstSeen
+		fingerprints = append(fingerprints, fp)
+	}
+}
+
+func newSSLBLReader(r io.Reader) *csv.Reader {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	return reader
+}
+
+// ja4dbEntry is a record of the ja4db.com database
+type ja4dbEntry struct {
+	Application     string `json:"application"`
+	Library         string `json:"library"`
+	Device          string `json:"device"`
+	OS              string `json:"os"`
+	Notes           string `json:"notes"`
+	JA4Fingerprint  string `json:"ja4_fingerprint"`
+	JA4SFingerprint string `json:"ja4s_fingerprint"`
+}
+
+// parseJA4DB reads the ja4db.com database, which names the applications and
+// libraries behind JA4 and JA4S fingerprints
+func parseJA4DB(r io.Reader) ([]models.TLSFingerprint, error) {
+	var entries []ja4dbEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	var fingerprints []models.TLSFingerprint
+	for _, e := range entries {
+		label := firstNonEmpty(e.Application, e.Library, e.Device, e.OS)
+		if label == "" {
+			continue
+		}
+		for kind, value := range map[string]string{
+			FingerprintJA4:  e.JA4Fingerprint,
+			FingerprintJA4S: e.JA4SFingerprint,
+		} {
+			if value == "" {
+				continue
+			}
+			fingerprints = append(fingerprints, models.TLSFingerprint{
+				Type:        kind,
+				Value:       value,
+				Label:       label,
+				Category:    "application",
+				Severity:    "info",
+				Description: e.Notes,
+			})
+		}
+	}
+	return fingerprints, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// FingerprintSyncer periodically loads fingerprint feeds and local files
+// into a store
+type FingerprintSyncer struct {
+	store    *FingerprintStore
+	logger   *logrus.Logger
+	feeds    []config.FingerprintFeed
+	files    []string
+	interval time.Duration
+	client   *http.Client
+}
+
+// NewFingerprintSyncer creates a syncer refreshing the store every
+// interval, or once a day when interval is not positive
+func NewFingerprintSyncer(store *FingerprintStore, logger *logrus.Logger, cfg config.TLSFingerprintConfig) *FingerprintSyncer {
+	interval := time.Duration(cfg.UpdateInterval) * time.Hour
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	return &FingerprintSyncer{
+		store:    store,
+		logger:   logger,
+		feeds:    cfg.Feeds,
+		files:    cfg.LocalFiles,
+		interval: interval,
+		client:   &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+// Start syncs immediately and then on every interval until ctx is done
+func (fs *FingerprintSyncer) Start(ctx context.Context) {
+	fs.SyncNow(ctx)
+
+	ticker := time.NewTicker(fs.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			fs.logger.Info("TLS fingerprint syncer stopped")
+			return
+		case <-ticker.C:
+			fs.SyncNow(ctx)
+		}
+	}
+}
+
+// SyncNow loads every enabled feed and local file once
+func (fs *FingerprintSyncer) SyncNow(ctx context.Context) {
+	var totalAdded, totalUpdated int
+
+	for _, feed := range fs.feeds {
+		if !feed.Enabled || feed.URL == "" {
+			continue
+		}
+		fingerprints, err := fs.download(ctx, feed)
+		if err != nil {
+			fs.logger.Errorf("TLS fingerprint feed %s failed: %v", feed.Name, err)
+			continue
+		}
+		added, updated := fs.apply(ctx, feed.Name, fingerprints)
+		totalAdded += added
+		totalUpdated += updated
+	}
+
+	for _, path := range fs.files {
+		fingerprints, err := fs.readFile(path)
+		if err != nil {
+			fs.logger.Errorf("TLS fingerprint file %s failed: %v", path, err)
+			continue
+		}
+		added, updated := fs.apply(ctx, path, fingerprints)
+		totalAdded += added
+		totalUpdated += updated
+	}
+
+	fs.logger.Infof("TLS fingerprint sync completed: %d added, %d updated", totalAdded, totalUpdated)
+}
+
+// apply upserts the valid fingerprints of one list
+func (fs *FingerprintSyncer) apply(ctx context.Context, name string, fingerprints []models.TLSFingerprint) (int, int) {
+	valid := fingerprints[:0]
+	for _, fp := range fingerprints {
+		if err := NormalizeFingerprint(&fp); err != nil {
+			fs.logger.Debugf("Skipping fingerprint from %s: %v", name, err)
+			continue
+		}
+		valid = append(valid, fp)
+	}
+
+	added, updated, err := fs.store.Upsert(ctx, valid)
+	if err != nil {
+		fs.logger.Errorf("Failed to store fingerprints from %s: %v", name, err)
+	}
+	return added, updated
+}
+
+func (fs *FingerprintSyncer) download(ctx context.Context, feed config.FingerprintFeed) ([]models.TLSFingerprint, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", feed.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := fs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("feed returned status %d", resp.StatusCode)
+	}
+	return ParseFingerprints(feed.Format, feed.Name, io.LimitReader(resp.Body, maxFeedSize))
+}
+
+// readFile reads a local list, as CSV in the SSLBL format or JSON in the
+// export format
+func (fs *FingerprintSyncer) readFile(path string) ([]models.TLSFingerprint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	format := FormatJSON
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		format = FormatSSLBL
+	}
+	return ParseFingerprints(format, "local", f)
+}
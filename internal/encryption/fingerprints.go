@@ -0,0 +1,540 @@
+package encryption
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Fingerprint types
+const (
+	FingerprintJA3     = "ja3"
+	FingerprintJA3S    = "ja3s"
+	FingerprintJA3Pair = "ja3_pair"
+	FingerprintJA4     = "ja4"
+	FingerprintJA4S    = "ja4s"
+	// Certificate hashes, as in x509.log and the SSLBL certificate list
+	FingerprintCertSHA1   = "cert_sha1"
+	FingerprintCertSHA256 = "cert_sha256"
+)
+
+// CategoryMalicious marks fingerprints of malware and attack tooling;
+// other categories only identify software
+const CategoryMalicious = "malicious"
+
+// upsertBatchSize is the number of fingerprints written per statement
+const upsertBatchSize = 500
+
+// lastSeenResolution is how far a match must be past the last seen time of
+// a fingerprint to update it
+const lastSeenResolution = time.Minute
+
+// fingerprintsChannel is notified after fingerprints are stored or
+// deleted, so other processes reload them
+const fingerprintsChannel = "tls_fingerprints:updated"
+
+//go:embed data/fingerprints.json
+var builtinFingerprintData []byte
+
+var (
+	md5Pattern    = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	sha1Pattern   = regexp.MustCompile(`^[0-9a-f]{40}$`)
+	sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	ja4Pattern    = regexp.MustCompile(`^[tqd][0-9a-z]{9}_[0-9a-f]{12}_[0-9a-f]{12}$`)
+	ja4sPattern   = regexp.MustCompile(`^[tqd][0-9a-z]{6}_[0-9a-f]{4}_[0-9a-f]{12}$`)
+)
+
+// ErrBuiltinFingerprint is returned for deleting a built-in fingerprint,
+// which would be restored on the next load
+var ErrBuiltinFingerprint = errors.New("built-in fingerprints cannot be deleted, relabel them with override instead")
+
+// FingerprintStore holds known TLS fingerprints in memory, backed by the
+// tls_fingerprints table
+type FingerprintStore struct {
+	db      *gorm.DB
+	redis   *redis.Client
+	logger  *logrus.Logger
+	builtin map[fingerprintKey]models.TLSFingerprint
+	mu      sync.RWMutex
+	entries map[fingerprintKey]*models.TLSFingerprint
+	// seen holds the last seen times of matched fingerprints that are not
+	// written yet
+	seen map[fingerprintKey]time.Time
+}
+
+type fingerprintKey struct {
+	kind  string
+	value string
+}
+
+// NewFingerprintStore creates a store holding the built-in fingerprints.
+// db may be nil to keep fingerprints in memory only.
+func NewFingerprintStore(db *gorm.DB, logger *logrus.Logger) *FingerprintStore {
+	s := &FingerprintStore{
+		db:      db,
+		logger:  logger,
+		builtin: make(map[fingerprintKey]models.TLSFingerprint),
+		entries: make(map[fingerprintKey]*models.TLSFingerprint),
+		seen:    make(map[fingerprintKey]time.Time),
+	}
+
+	var builtin []models.TLSFingerprint
+	if err := json.Unmarshal(builtinFingerprintData, &builtin); err != nil {
+		panic("invalid built-in fingerprints: " + err.Error())
+	}
+	for i := range builtin {
+		fp := &builtin[i]
+		key := fingerprintKey{fp.Type, fp.Value}
+		s.builtin[key] = *fp
+		s.entries[key] = fp
+	}
+	return s
+}
+
+// Load reads the stored fingerprints into memory and saves the built-in
+// ones missing from the database
+func (s *FingerprintStore) Load(ctx context.Context) error {
+	if s.db == nil {
+		return nil
+	}
+
+	var stored []models.TLSFingerprint
+	if err := s.db.WithContext(ctx).Find(&stored).Error; err != nil {
+		return fmt.Errorf("failed to load TLS fingerprints: %w", err)
+	}
+
+	// Replace the entries, so fingerprints deleted through another
+	// instance are dropped here too
+	entries := make(map[fingerprintKey]*models.TLSFingerprint, len(stored)+len(s.builtin))
+	for i := range stored {
+		entries[fingerprintKey{stored[i].Type, stored[i].Value}] = &stored[i]
+	}
+	var missing []models.TLSFingerprint
+	for key, fp := range s.builtin {
+		if _, ok := entries[key]; !ok {
+			builtin := fp
+			entries[key] = &builtin
+			missing = append(missing, fp)
+		}
+	}
+
+	s.mu.Lock()
+	for key, ts := range s.seen {
+		if fp, ok := entries[key]; ok && ts.After(fp.LastSeen) {
+			fp.LastSeen = ts
+		}
+	}
+	s.entries = entries
+	s.mu.Unlock()
+
+	s.logger.Infof("Loaded %d TLS fingerprints", len(stored))
+	if len(missing) == 0 {
+		return nil
+	}
+	return s.save(ctx, missing)
+}
+
+// SetRedis publishes changes to the fingerprints on rdb, so stores in other
+// processes running Watch reload them
+func (s *FingerprintStore) SetRedis(rdb *redis.Client) {
+	s.redis = rdb
+}
+
+// Watch reloads the fingerprints whenever another process changes them,
+// and every interval in case a notification was missed, until ctx is
+// cancelled
+func (s *FingerprintStore) Watch(ctx context.Context, interval time.Duration) {
+	var notified <-chan *redis.Message
+	if s.redis != nil {
+		pubsub := s.redis.Subscribe(ctx, fingerprintsChannel)
+		defer pubsub.Close()
+		notified = pubsub.Channel()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// Also catches changes made before the subscription was active
+		if err := s.Load(ctx); err != nil {
+			s.logger.Errorf("Failed to load TLS fingerprints: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-notified:
+		case <-ticker.C:
+		}
+	}
+}
+
+// notify tells watching processes the fingerprints changed. The change is
+// already stored, so a failure only delays their reload.
+func (s *FingerprintStore) notify(ctx context.Context) {
+	if s.redis == nil {
+		return
+	}
+	if err := s.redis.Publish(ctx, fingerprintsChannel, "").Err(); err != nil {
+		s.logger.Warnf("Failed to publish TLS fingerprint update: %v", err)
+	}
+}
+
+// Lookup returns the fingerprint of the given type and value, or nil
+func (s *FingerprintStore) Lookup(kind, value string) *models.TLSFingerprint {
+	if value == "" {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if fp, ok := s.entries[fingerprintKey{kind, strings.ToLower(value)}]; ok {
+		match := *fp
+		return &match
+	}
+	return nil
+}
+
+// Match returns the known fingerprints of a handshake: its JA3, JA3S,
+// JA3+JA3S pair, JA4 and JA4S
+func (s *FingerprintStore) Match(hs *models.TLSHandshake) []models.TLSFingerprint {
+	candidates := []fingerprintKey{
+		{FingerprintJA3, hs.JA3},
+		{FingerprintJA3S, hs.JA3S},
+		{FingerprintJA4, hs.JA4},
+		{FingerprintJA4S, hs.JA4S},
+	}
+	if hs.JA3 != "" && hs.JA3S != "" {
+		candidates = append(candidates, fingerprintKey{FingerprintJA3Pair, PairValue(hs.JA3, hs.JA3S)})
+	}
+
+	var matches []models.TLSFingerprint
+	for _, c := range candidates {
+		if fp := s.Lookup(c.kind, c.value); fp != nil {
+			matches = append(matches, *fp)
+		}
+	}
+	return matches
+}
+
+// LookupCertificate returns the known certificate with the given SHA1 or
+// SHA256 hash, or nil
+func (s *FingerprintStore) LookupCertificate(hash string) *models.TLSFingerprint {
+	hash = strings.ToLower(strings.ReplaceAll(hash, ":", ""))
+	switch {
+	case sha1Pattern.MatchString(hash):
+		return s.Lookup(FingerprintCertSHA1, hash)
+	case sha256Pattern.MatchString(hash):
+		return s.Lookup(FingerprintCertSHA256, hash)
+	}
+	return nil
+}
+
+// Touch records that a fingerprint matched traffic at ts. The time is
+// written by PersistLastSeen, at lastSeenResolution.
+func (s *FingerprintStore) Touch(kind, value string, ts time.Time) {
+	key := fingerprintKey{kind, value}
+
+	// Application fingerprints match most handshakes; skip the write lock
+	// while the last seen time is recent
+	s.mu.RLock()
+	fp, ok := s.entries[key]
+	stale := ok && ts.Sub(fp.LastSeen) >= lastSeenResolution
+	s.mu.RUnlock()
+	if !stale {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fp, ok := s.entries[key]; ok && ts.After(fp.LastSeen) {
+		fp.LastSeen = ts
+		s.seen[key] = ts
+	}
+}
+
+// PersistLastSeen writes the last seen times recorded by Touch every
+// interval until ctx is done
+func (s *FingerprintStore) PersistLastSeen(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			saveCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := s.saveLastSeen(saveCtx); err != nil {
+				s.logger.Errorf("Failed to save TLS fingerprint last seen times: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.saveLastSeen(ctx); err != nil {
+				s.logger.Errorf("Failed to save TLS fingerprint last seen times: %v", err)
+			}
+		}
+	}
+}
+
+// saveLastSeen writes the pending last seen times, keeping them for the
+// next round if the database is unavailable
+func (s *FingerprintStore) saveLastSeen(ctx context.Context) error {
+	if s.db == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	pending := s.seen
+	s.seen = make(map[fingerprintKey]time.Time)
+	s.mu.Unlock()
+
+	for key, ts := range pending {
+		err := s.db.WithContext(ctx).Model(&models.TLSFingerprint{}).
+			Where("type = ? AND value = ? AND last_seen < ?", key.kind, key.value, ts).
+			Update("last_seen", ts).Error
+		if err != nil {
+			s.mu.Lock()
+			for key, ts := range pending {
+				if ts.After(s.seen[key]) {
+					s.seen[key] = ts
+				}
+			}
+			s.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the fingerprints of the given type, or all of them when
+// kind is empty, ordered by type and value
+func (s *FingerprintStore) List(kind string) []models.TLSFingerprint {
+	s.mu.RLock()
+	list := make([]models.TLSFingerprint, 0, len(s.entries))
+	for key, fp := range s.entries {
+		if kind == "" || key.kind == kind {
+			list = append(list, *fp)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Type != list[j].Type {
+			return list[i].Type < list[j].Type
+		}
+		return list[i].Value < list[j].Value
+	})
+	return list
+}
+
+// Upsert validates and merges fingerprints into the store. Existing
+// entries keep their earliest first seen and latest last seen time and take
+// the non-empty attributes of the update, unless a malicious entry would
+// be relabeled as benign.
+func (s *FingerprintStore) Upsert(ctx context.Context, fingerprints []models.TLSFingerprint) (added, updated int, err error) {
+	return s.upsert(ctx, fingerprints, false)
+}
+
+// Override merges fingerprints like Upsert, but also relabels malicious
+// entries, so analysts can correct false positives
+func (s *FingerprintStore) Override(ctx context.Context, fingerprints []models.TLSFingerprint) (added, updated int, err error) {
+	return s.upsert(ctx, fingerprints, true)
+}
+
+// upsert stores the merged fingerprints and only then updates memory, so a
+// failed write leaves both unchanged
+func (s *FingerprintStore) upsert(ctx context.Context, fingerprints []models.TLSFingerprint, override bool) (added, updated int, err error) {
+	normalized := make([]models.TLSFingerprint, len(fingerprints))
+	for i, fp := range fingerprints {
+		if err := NormalizeFingerprint(&fp); err != nil {
+			return 0, 0, err
+		}
+		normalized[i] = fp
+	}
+
+	now := time.Now()
+	merged := make(map[fingerprintKey]models.TLSFingerprint, len(normalized))
+
+	s.mu.RLock()
+	for _, fp := range normalized {
+		key := fingerprintKey{fp.Type, fp.Value}
+		if existing, ok := merged[key]; ok {
+			// Repeated in this batch
+			fp = mergeFingerprint(existing, fp, override)
+		} else if existing, ok := s.entries[key]; ok {
+			fp = mergeFingerprint(*existing, fp, override)
+			updated++
+		} else {
+			if fp.FirstSeen.IsZero() {
+				fp.FirstSeen = now
+			}
+			if fp.LastSeen.IsZero() {
+				fp.LastSeen = fp.FirstSeen
+			}
+			added++
+		}
+		merged[key] = fp
+	}
+	s.mu.RUnlock()
+
+	rows := make([]models.TLSFingerprint, 0, len(merged))
+	for _, fp := range merged {
+		rows = append(rows, fp)
+	}
+	if err := s.save(ctx, rows); err != nil {
+		return 0, 0, err
+	}
+
+	s.mu.Lock()
+	for key, fp := range merged {
+		stored := fp
+		s.entries[key] = &stored
+	}
+	s.mu.Unlock()
+
+	s.notify(ctx)
+	return added, updated, nil
+}
+
+// Delete removes a fingerprint from the database and then from memory. It
+// reports whether the fingerprint was known.
+func (s *FingerprintStore) Delete(ctx context.Context, kind, value string) (bool, error) {
+	key := fingerprintKey{kind, value}
+	if _, ok := s.builtin[key]; ok {
+		return false, ErrBuiltinFingerprint
+	}
+
+	s.mu.RLock()
+	_, exists := s.entries[key]
+	s.mu.RUnlock()
+	if !exists {
+		return false, nil
+	}
+
+	if s.db != nil {
+		err := s.db.WithContext(ctx).Where("type = ? AND value = ?", kind, value).Delete(&models.TLSFingerprint{}).Error
+		if err != nil {
+			return false, fmt.Errorf("failed to delete TLS fingerprint: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+
+	s.notify(ctx)
+	return true, nil
+}
+
+// save writes fingerprints, replacing stored rows with the same type and
+// value
+func (s *FingerprintStore) save(ctx context.Context, rows []models.TLSFingerprint) error {
+	if s.db == nil || len(rows) == 0 {
+		return nil
+	}
+	for i := range rows {
+		rows[i].ID = 0
+	}
+
+	err := s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "type"}, {Name: "value"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"label", "category", "severity", "source", "description",
+			"first_seen", "last_seen", "updated_at",
+		}),
+	}).CreateInBatches(rows, upsertBatchSize).Error
+	if err != nil {
+		return fmt.Errorf("failed to save TLS fingerprints: %w", err)
+	}
+	return nil
+}
+
+func mergeFingerprint(existing, update models.TLSFingerprint, override bool) models.TLSFingerprint {
+	merged := existing
+	// Application lists must not relabel known-bad fingerprints
+	if !override && existing.Category == CategoryMalicious && update.Category != CategoryMalicious {
+		update.Label, update.Category, update.Severity, update.Source, update.Description = "", "", "", "", ""
+	}
+	if update.Label != "" {
+		merged.Label = update.Label
+	}
+	if update.Category != "" {
+		merged.Category = update.Category
+	}
+	if update.Severity != "" {
+		merged.Severity = update.Severity
+	}
+	if update.Source != "" {
+		merged.Source = update.Source
+	}
+	if update.Description != "" {
+		merged.Description = update.Description
+	}
+	if !update.FirstSeen.IsZero() && (merged.FirstSeen.IsZero() || update.FirstSeen.Before(merged.FirstSeen)) {
+		merged.FirstSeen = update.FirstSeen
+	}
+	if update.LastSeen.After(merged.LastSeen) {
+		merged.LastSeen = update.LastSeen
+	}
+	return merged
+}
+
+// NormalizeFingerprint lower-cases a fingerprint, fills in its defaults and
+// checks that the value is well formed for its type
+func NormalizeFingerprint(fp *models.TLSFingerprint) error {
+	fp.Type = strings.ToLower(strings.TrimSpace(fp.Type))
+	fp.Value = strings.ToLower(strings.TrimSpace(fp.Value))
+	if fp.Category == "" {
+		fp.Category = CategoryMalicious
+	}
+	if fp.Severity == "" {
+		fp.Severity = "medium"
+		if fp.Category != CategoryMalicious {
+			fp.Severity = "info"
+		}
+	}
+
+	valid := false
+	switch fp.Type {
+	case FingerprintJA3, FingerprintJA3S:
+		valid = md5Pattern.MatchString(fp.Value)
+	case FingerprintJA3Pair:
+		ja3, ja3s, ok := strings.Cut(fp.Value, ",")
+		valid = ok && md5Pattern.MatchString(ja3) && md5Pattern.MatchString(ja3s)
+	case FingerprintJA4:
+		valid = ja4Pattern.MatchString(fp.Value)
+	case FingerprintJA4S:
+		valid = ja4sPattern.MatchString(fp.Value)
+	case FingerprintCertSHA1:
+		fp.Value = strings.ReplaceAll(fp.Value, ":", "")
+		valid = sha1Pattern.MatchString(fp.Value)
+	case FingerprintCertSHA256:
+		fp.Value = strings.ReplaceAll(fp.Value, ":", "")
+		valid = sha256Pattern.MatchString(fp.Value)
+	default:
+		return fmt.Errorf("unknown fingerprint type %q", fp.Type)
+	}
+	if !valid {
+		return fmt.Errorf("invalid %s fingerprint %q", fp.Type, fp.Value)
+	}
+	return nil
+}
+
+// PairValue returns the value of a JA3+JA3S pair fingerprint
+func PairValue(ja3, ja3s string) string {
+	return strings.ToLower(ja3) + "," + strings.ToLower(ja3s)
+}
@@ -0,0 +1,472 @@
+package encryption
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultFlowPackets is the number of payload packets sampled per flow
+	DefaultFlowPackets = 20
+	// minFlowPackets is the fewest payload packets worth classifying
+	minFlowPackets = 4
+	// flowIdleTimeout ends the sample of a flow that went quiet
+	flowIdleTimeout = time.Minute
+	// maxSampledFlows caps the flows sampled at once
+	maxSampledFlows = 50000
+	// flowSweepEvery is how often idle flows are swept, in packet time
+	flowSweepEvery = 10 * time.Second
+	// spltFeatures is the number of leading packets kept as raw features
+	spltFeatures = 10
+)
+
+// FlowPacket is one payload-carrying packet at the start of a flow
+type FlowPacket struct {
+	// Length is the payload size, negative for packets of the responder
+	Length int
+	// Gap is the time since the previous payload packet
+	Gap time.Duration
+}
+
+// FlowSample is the sequence of packet lengths and times (SPLT) at the
+// start of a flow, with its byte distribution and TLS ClientHello when the
+// payload was seen
+type FlowSample struct {
+	SrcIP   string
+	DstIP   string
+	SrcPort int
+	DstPort int
+	Proto   string
+	Start   time.Time
+	Packets []FlowPacket
+	// ByteCounts counts payload byte values; nil when only lengths are known
+	ByteCounts []uint32
+	Hello      *ClientHello
+}
+
+// FlowFeatureNames names the values returned by FlowSample.Features, in
+// order. Models list them to guard against feature drift.
+var FlowFeatureNames = flowFeatureNames()
+
+func flowFeatureNames() []string {
+	names := []string{
+		"packets", "out_fraction",
+		"out_mean_len", "out_std_len", "out_max_len",
+		"in_mean_len", "in_std_len", "in_max_len",
+		"byte_ratio", "direction_changes",
+		"iat_mean", "iat_std", "iat_max", "duration",
+		"small_fraction", "large_fraction",
+	}
+	for i := 0; i < spltFeatures; i++ {
+		names = append(names, "splt_len_"+strconv.Itoa(i))
+	}
+	for i := 0; i < spltFeatures; i++ {
+		names = append(names, "splt_iat_"+strconv.Itoa(i))
+	}
+	return append(names,
+		"payload_seen", "byte_entropy", "printable_fraction",
+		"tls", "tls13", "tls_grease", "tls_sni", "tls_alpn_h2", "tls_alpn_http1",
+		"tls_cipher_count", "tls_ext_count",
+		"dst_port_tls", "dst_port_high", "udp",
+	)
+}
+
+// Features returns the feature vector of the sample. Lengths are scaled by
+// the MTU and times are log milliseconds so the values share a range.
+func (s *FlowSample) Features() []float64 {
+	f := make([]float64, 0, len(FlowFeatureNames))
+
+	var out, in []float64
+	var outBytes, inBytes float64
+	var gaps []float64
+	changes, small, large := 0, 0, 0
+	for i, p := range s.Packets {
+		size := math.Abs(float64(p.Length))
+		if p.Length >= 0 {
+			out = append(out, size)
+			outBytes += size
+		} else {
+			in = append(in, size)
+			inBytes += size
+		}
+		if i > 0 {
+			gaps = append(gaps, logMillis(p.Gap))
+			if (p.Length >= 0) != (s.Packets[i-1].Length >= 0) {
+				changes++
+			}
+		}
+		if size <= 100 {
+			small++
+		}
+		if size >= 1200 {
+			large++
+		}
+	}
+
+	n := float64(len(s.Packets))
+	if n == 0 {
+		n = 1
+	}
+	var duration time.Duration
+	for _, p := range s.Packets {
+		duration += p.Gap
+	}
+
+	outMean, outStd, outMax := moments(out)
+	inMean, inStd, inMax := moments(in)
+	gapMean, gapStd, gapMax := moments(gaps)
+	f = append(f,
+		float64(len(s.Packets))/DefaultFlowPackets, float64(len(out))/n,
+		outMean/1500, outStd/1500, outMax/1500,
+		inMean/1500, inStd/1500, inMax/1500,
+		math.Log((outBytes+1)/(inBytes+1)), float64(changes)/n,
+		gapMean, gapStd, gapMax, logMillis(duration),
+		float64(small)/n, float64(large)/n,
+	)
+
+	for i := 0; i < spltFeatures; i++ {
+		v := 0.0
+		if i < len(s.Packets) {
+			v = float64(s.Packets[i].Length) / 1500
+		}
+		f = append(f, v)
+	}
+	for i := 0; i < spltFeatures; i++ {
+		v := 0.0
+		if i < len(s.Packets) && i > 0 {
+			v = logMillis(s.Packets[i].Gap)
+		}
+		f = append(f, v)
+	}
+
+	if s.ByteCounts != nil {
+		entropy, printable := byteDistribution(s.ByteCounts)
+		f = append(f, 1, entropy/8, printable)
+	} else {
+		f = append(f, 0, 0, 0)
+	}
+
+	if h := s.Hello; h != nil {
+		tls13, grease, h2, http1 := 0.0, 0.0, 0.0, 0.0
+		for _, v := range h.SupportedVersions {
+			if v == 0x0304 {
+				tls13 = 1
+			}
+		}
+		for _, v := range h.CipherSuites {
+			if isGREASE(v) {
+				grease = 1
+			}
+		}
+		for _, proto := range h.ALPN {
+			switch proto {
+			case "h2":
+				h2 = 1
+			case "http/1.1":
+				http1 = 1
+			}
+		}
+		sni := 0.0
+		if h.ServerName != "" {
+			sni = 1
+		}
+		f = append(f, 1, tls13, grease, sni, h2, http1,
+			float64(len(h.CipherSuites))/64, float64(len(h.Extensions))/32)
+	} else {
+		f = append(f, 0, 0, 0, 0, 0, 0, 0, 0)
+	}
+
+	tlsPort, highPort, udp := 0.0, 0.0, 0.0
+	if s.DstPort == 443 || s.DstPort == 8443 || s.DstPort == 993 || s.DstPort == 995 {
+		tlsPort = 1
+	}
+	if s.DstPort >= 1024 {
+		highPort = 1
+	}
+	if s.Proto == "udp" {
+		udp = 1
+	}
+	return append(f, tlsPort, highPort, udp)
+}
+
+func moments(values []float64) (mean, std, max float64) {
+	if len(values) == 0 {
+		return 0, 0, 0
+	}
+	for _, v := range values {
+		mean += v
+		if v > max {
+			max = v
+		}
+	}
+	mean /= float64(len(values))
+	for _, v := range values {
+		std += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(std / float64(len(values))), max
+}
+
+func logMillis(d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return math.Log1p(float64(d) / float64(time.Millisecond))
+}
+
+// byteDistribution returns the Shannon entropy in bits and the printable
+// ASCII fraction of a byte histogram
+func byteDistribution(counts []uint32) (entropy, printable float64) {
+	var total, text float64
+	for b, c := range counts {
+		total += float64(c)
+		if (b >= 0x20 && b < 0x7f) || b == '\r' || b == '\n' || b == '\t' {
+			text += float64(c)
+		}
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / total
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy, text / total
+}
+
+// FlowTracker samples the first payload packets of TCP and UDP flows from
+// captured packets and reports each sample once it is complete, the flow
+// closes or it goes idle
+type FlowTracker struct {
+	mu        sync.Mutex
+	logger    *logrus.Logger
+	packets   int
+	onSample  func(*FlowSample)
+	flows     map[sampleKey]*sampledFlow
+	lastSweep time.Time
+}
+
+type sampleKey struct {
+	udp bool
+	flowKey
+}
+
+func (k sampleKey) reverse() sampleKey {
+	return sampleKey{udp: k.udp, flowKey: k.flowKey.reverse()}
+}
+
+type sampledFlow struct {
+	sample *FlowSample
+	// lastPayload times the packet gaps, lastSeen the idle timeout
+	lastPayload time.Time
+	lastSeen    time.Time
+	// done flows are ignored until they close or go idle
+	done bool
+	// hello buffers the client's first bytes until a ClientHello parses
+	hello     []byte
+	helloDone bool
+}
+
+// NewFlowTracker creates a tracker sampling up to packets payload packets
+// per flow, DefaultFlowPackets if not positive
+func NewFlowTracker(logger *logrus.Logger, packets int, onSample func(*FlowSample)) *FlowTracker {
+	if packets <= 0 {
+		packets = DefaultFlowPackets
+	}
+	return &FlowTracker{
+		logger:   logger,
+		packets:  packets,
+		onSample: onSample,
+		flows:    make(map[sampleKey]*sampledFlow),
+	}
+}
+
+// Observe feeds a captured packet to the tracker
+func (t *FlowTracker) Observe(packet gopacket.Packet) {
+	var src, dst string
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		src, dst = ip.SrcIP.String(), ip.DstIP.String()
+	case *layers.IPv6:
+		src, dst = ip.SrcIP.String(), ip.DstIP.String()
+	default:
+		return
+	}
+
+	key := sampleKey{flowKey: flowKey{src: src, dst: dst}}
+	var payload []byte
+	var tcp *layers.TCP
+	switch l := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		tcp = l
+		key.sport, key.dport = uint16(l.SrcPort), uint16(l.DstPort)
+		payload = l.Payload
+	case *layers.UDP:
+		key.udp = true
+		key.sport, key.dport = uint16(l.SrcPort), uint16(l.DstPort)
+		payload = l.Payload
+	default:
+		return
+	}
+
+	now := packet.Metadata().Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var done []*FlowSample
+	t.mu.Lock()
+	if sample := t.observe(key, tcp, payload, now); sample != nil {
+		done = append(done, sample)
+	}
+	if now.Sub(t.lastSweep) >= flowSweepEvery {
+		done = append(done, t.expire(now)...)
+		t.lastSweep = now
+	}
+	t.mu.Unlock()
+
+	for _, sample := range done {
+		t.onSample(sample)
+	}
+}
+
+// Flush reports every flow sampled so far
+func (t *FlowTracker) Flush() {
+	t.mu.Lock()
+	var done []*FlowSample
+	for key, f := range t.flows {
+		if sample := t.finish(key, f); sample != nil {
+			done = append(done, sample)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, sample := range done {
+		t.onSample(sample)
+	}
+}
+
+func (t *FlowTracker) observe(key sampleKey, tcp *layers.TCP, payload []byte, now time.Time) *FlowSample {
+	f, fromOrig := t.flows[key], true
+	if f == nil {
+		if f = t.flows[key.reverse()]; f != nil {
+			key, fromOrig = key.reverse(), false
+		}
+	}
+
+	closing := tcp != nil && (tcp.FIN || tcp.RST)
+	if f == nil {
+		if closing || len(t.flows) >= maxSampledFlows {
+			return nil
+		}
+		switch {
+		case tcp != nil && tcp.SYN && tcp.ACK:
+			// The SYN was missed, so the sender is the responder
+			key, fromOrig = key.reverse(), false
+		case tcp != nil && !tcp.SYN && len(payload) == 0:
+			return nil
+		}
+		f = &sampledFlow{sample: &FlowSample{
+			SrcIP:      key.src,
+			DstIP:      key.dst,
+			SrcPort:    int(key.sport),
+			DstPort:    int(key.dport),
+			Proto:      "tcp",
+			Start:      now,
+			ByteCounts: make([]uint32, 256),
+		}}
+		if key.udp {
+			f.sample.Proto = "udp"
+		}
+		f.lastPayload = now
+		t.flows[key] = f
+	}
+	f.lastSeen = now
+
+	if len(payload) > 0 && !f.done {
+		length := len(payload)
+		if !fromOrig {
+			length = -length
+		}
+		s := f.sample
+		s.Packets = append(s.Packets, FlowPacket{Length: length, Gap: now.Sub(f.lastPayload)})
+		if len(s.Packets) == 1 {
+			s.Packets[0].Gap = 0
+		}
+		for _, b := range payload {
+			s.ByteCounts[b]++
+		}
+		if fromOrig && tcp != nil && !f.helloDone {
+			t.parseHello(f, payload)
+		}
+		f.lastPayload = now
+		if len(s.Packets) >= t.packets {
+			f.done = true
+			return f.take()
+		}
+	}
+
+	if closing {
+		return t.finish(key, f)
+	}
+	return nil
+}
+
+// parseHello collects the client's first bytes until a ClientHello parses
+// or the flow turns out not to be TLS
+func (t *FlowTracker) parseHello(f *sampledFlow, payload []byte) {
+	if len(f.hello) == 0 && payload[0] != recordTypeHandshake {
+		f.helloDone = true
+		return
+	}
+	f.hello = append(f.hello, payload...)
+
+	hello, err := ParseClientHello(f.hello)
+	if err == ErrIncomplete && len(f.hello) < maxHandshakeMessage {
+		return
+	}
+	f.helloDone, f.hello = true, nil
+	if err != nil {
+		t.logger.Debugf("Malformed ClientHello in flow sample: %v", err)
+		return
+	}
+	f.sample.Hello = hello
+}
+
+// take returns the sample of a flow, once
+func (f *sampledFlow) take() *FlowSample {
+	sample := f.sample
+	f.sample, f.hello = nil, nil
+	if sample == nil || len(sample.Packets) < minFlowPackets {
+		return nil
+	}
+	return sample
+}
+
+func (t *FlowTracker) finish(key sampleKey, f *sampledFlow) *FlowSample {
+	delete(t.flows, key)
+	if f.done {
+		return nil
+	}
+	return f.take()
+}
+
+// expire finishes flows idle for flowIdleTimeout
+func (t *FlowTracker) expire(now time.Time) []*FlowSample {
+	var done []*FlowSample
+	for key, f := range t.flows {
+		if now.Sub(f.lastSeen) >= flowIdleTimeout {
+			if sample := t.finish(key, f); sample != nil {
+				done = append(done, sample)
+			}
+		}
+	}
+	return done
+}
@@ -0,0 +1,483 @@
+package encryption
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/Cxiyuan/NTA/pkg/recency"
+	"github.com/sirupsen/logrus"
+)
+
+// Flow classes
+const (
+	FlowBrowsing     = "browsing"
+	FlowStreaming    = "streaming"
+	FlowFileTransfer = "file_transfer"
+	FlowInteractive  = "interactive_shell"
+	FlowC2           = "c2"
+)
+
+const (
+	// flowLabelTTL is how long a classification applies to alerts between
+	// the same client and server port
+	flowLabelTTL = time.Hour
+	// maxFlowLabels caps the classifications remembered
+	maxFlowLabels = 100000
+)
+
+// flowConfidenceWeights moves alert confidence toward 1 for positive
+// weights and toward 0 for negative ones, scaled by the class probability
+var flowConfidenceWeights = map[string]float64{
+	FlowC2:           0.5,
+	FlowInteractive:  0.2,
+	FlowFileTransfer: -0.1,
+	FlowBrowsing:     -0.3,
+	FlowStreaming:    -0.3,
+}
+
+// builtinFlowModelPath is where a release build carries the model trained
+// with cmd/flow-trainer on the reference labelled captures; see the README
+// next to it
+const builtinFlowModelPath = "data/flow_model/flow_model.json"
+
+//go:embed data/flow_model
+var builtinFlowModelFS embed.FS
+
+// FlowModel is a multinomial logistic regression over standardized flow
+// features
+type FlowModel struct {
+	Packets  int         `json:"packets"`
+	Classes  []string    `json:"classes"`
+	Features []string    `json:"features"`
+	Mean     []float64   `json:"mean"`
+	Scale    []float64   `json:"scale"`
+	Weights  [][]float64 `json:"weights"`
+	Bias     []float64   `json:"bias"`
+	// Trained records what the model was trained on
+	Trained string `json:"trained,omitempty"`
+}
+
+// FlowClass is the classification of a flow
+type FlowClass struct {
+	Label         string             `json:"label"`
+	Probability   float64            `json:"probability"`
+	Probabilities map[string]float64 `json:"probabilities"`
+}
+
+// LoadFlowModel reads a model file written by cmd/flow-trainer
+func LoadFlowModel(path string) (*FlowModel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFlowModel(data)
+}
+
+// BuiltinFlowModel returns the model embedded in this build, or nil if it
+// was built without one
+func BuiltinFlowModel() (*FlowModel, error) {
+	data, err := builtinFlowModelFS.ReadFile(builtinFlowModelPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseFlowModel(data)
+}
+
+// LoadFlowClassifier creates a classifier from a model file written by
+// cmd/flow-trainer, or from the built-in model when path is empty. It
+// returns nil, leaving flow classification off, when neither is usable.
+func LoadFlowClassifier(logger *logrus.Logger, path string) *FlowClassifier {
+	if path != "" {
+		model, err := LoadFlowModel(path)
+		if err != nil {
+			logger.Errorf("Failed to load flow model from %s, flow classification disabled: %v", path, err)
+			return nil
+		}
+		logger.Infof("Loaded flow model from %s (%s)", path, model.Trained)
+		return NewFlowClassifier(logger, model)
+	}
+
+	model, err := BuiltinFlowModel()
+	if err != nil {
+		logger.Errorf("Invalid built-in flow model, flow classification disabled: %v", err)
+		return nil
+	}
+	if model == nil {
+		logger.Warn("This build has no built-in flow model and detection.flow_model is not set, flow classification disabled")
+		return nil
+	}
+	logger.Infof("Using built-in flow model (%s)", model.Trained)
+	return NewFlowClassifier(logger, model)
+}
+
+// ParseFlowModel decodes a model and checks it matches the features
+// computed by this build
+func ParseFlowModel(data []byte) (*FlowModel, error) {
+	var m FlowModel
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse flow model: %w", err)
+	}
+	if len(m.Features) != len(FlowFeatureNames) {
+		return nil, fmt.Errorf("flow model has %d features, expected %d", len(m.Features), len(FlowFeatureNames))
+	}
+	for i, name := range m.Features {
+		if name != FlowFeatureNames[i] {
+			return nil, fmt.Errorf("flow model feature %d is %q, expected %q", i, name, FlowFeatureNames[i])
+		}
+	}
+	if len(m.Classes) == 0 || len(m.Weights) != len(m.Classes) || len(m.Bias) != len(m.Classes) {
+		return nil, errors.New("flow model classes, weights and bias do not match")
+	}
+	if len(m.Mean) != len(m.Features) || len(m.Scale) != len(m.Features) {
+		return nil, errors.New("flow model mean and scale do not match its features")
+	}
+	for _, w := range m.Weights {
+		if len(w) != len(m.Features) {
+			return nil, errors.New("flow model weights do not match its features")
+		}
+	}
+	if m.Packets <= 0 {
+		m.Packets = DefaultFlowPackets
+	}
+	return &m, nil
+}
+
+// Classify returns the most likely class of a flow sample
+func (m *FlowModel) Classify(sample *FlowSample) FlowClass {
+	probs := m.probabilities(m.standardize(sample.Features()))
+
+	class := FlowClass{Probabilities: make(map[string]float64, len(m.Classes))}
+	for i, label := range m.Classes {
+		class.Probabilities[label] = probs[i]
+		if probs[i] > class.Probability {
+			class.Label, class.Probability = label, probs[i]
+		}
+	}
+	return class
+}
+
+func (m *FlowModel) standardize(features []float64) []float64 {
+	x := make([]float64, len(features))
+	for i, v := range features {
+		x[i] = (v - m.Mean[i]) / m.Scale[i]
+	}
+	return x
+}
+
+// probabilities applies the softmax to the class scores of x
+func (m *FlowModel) probabilities(x []float64) []float64 {
+	scores := make([]float64, len(m.Classes))
+	max := math.Inf(-1)
+	for c := range m.Classes {
+		score := m.Bias[c]
+		for i, v := range x {
+			score += m.Weights[c][i] * v
+		}
+		scores[c] = score
+		max = math.Max(max, score)
+	}
+
+	var sum float64
+	for c := range scores {
+		scores[c] = math.Exp(scores[c] - max)
+		sum += scores[c]
+	}
+	for c := range scores {
+		scores[c] /= sum
+	}
+	return scores
+}
+
+// AdjustConfidence moves an alert confidence by what the flow class says
+// about it
+func (c FlowClass) AdjustConfidence(confidence float64) float64 {
+	weight := flowConfidenceWeights[c.Label] * c.Probability
+	if weight >= 0 {
+		return confidence + (1-confidence)*weight
+	}
+	return confidence * (1 + weight)
+}
+
+// FlowTrainOptions controls TrainFlowModel
+type FlowTrainOptions struct {
+	Packets      int
+	Epochs       int
+	LearningRate float64
+	L2           float64
+	Seed         int64
+}
+
+// TrainFlowModel fits a model to labelled samples with mini-batch gradient
+// descent on the cross-entropy loss
+func TrainFlowModel(samples []*FlowSample, labels []string, opts FlowTrainOptions) (*FlowModel, error) {
+	if len(samples) == 0 || len(samples) != len(labels) {
+		return nil, errors.New("need one label per sample")
+	}
+	if opts.Packets <= 0 {
+		opts.Packets = DefaultFlowPackets
+	}
+	if opts.Epochs <= 0 {
+		opts.Epochs = 200
+	}
+	if opts.LearningRate <= 0 {
+		opts.LearningRate = 0.1
+	}
+
+	classIndex := make(map[string]int)
+	for _, label := range labels {
+		classIndex[label] = 0
+	}
+	if len(classIndex) < 2 {
+		return nil, errors.New("need samples of at least two classes")
+	}
+	classes := make([]string, 0, len(classIndex))
+	for label := range classIndex {
+		classes = append(classes, label)
+	}
+	sort.Strings(classes)
+	for i, label := range classes {
+		classIndex[label] = i
+	}
+
+	m := &FlowModel{
+		Packets:  opts.Packets,
+		Classes:  classes,
+		Features: append([]string(nil), FlowFeatureNames...),
+		Mean:     make([]float64, len(FlowFeatureNames)),
+		Scale:    make([]float64, len(FlowFeatureNames)),
+		Weights:  make([][]float64, len(classes)),
+		Bias:     make([]float64, len(classes)),
+	}
+	for c := range m.Weights {
+		m.Weights[c] = make([]float64, len(FlowFeatureNames))
+	}
+
+	// Samples from Zeek conn records carry lengths and times only, so each
+	// sample is also learned without its payload features
+	var raw [][]float64
+	var rawLabels []string
+	for i, s := range samples {
+		raw = append(raw, s.Features())
+		rawLabels = append(rawLabels, labels[i])
+		if s.ByteCounts != nil || s.Hello != nil {
+			stripped := *s
+			stripped.ByteCounts, stripped.Hello = nil, nil
+			raw = append(raw, stripped.Features())
+			rawLabels = append(rawLabels, labels[i])
+		}
+	}
+	for _, features := range raw {
+		for j, v := range features {
+			m.Mean[j] += v
+		}
+	}
+	for j := range m.Mean {
+		m.Mean[j] /= float64(len(raw))
+	}
+	for _, features := range raw {
+		for j, v := range features {
+			m.Scale[j] += (v - m.Mean[j]) * (v - m.Mean[j])
+		}
+	}
+	for j := range m.Scale {
+		m.Scale[j] = math.Sqrt(m.Scale[j] / float64(len(raw)))
+		if m.Scale[j] < 1e-9 {
+			m.Scale[j] = 1
+		}
+	}
+
+	x := make([][]float64, len(raw))
+	y := make([]int, len(raw))
+	for i := range raw {
+		x[i] = m.standardize(raw[i])
+		y[i] = classIndex[rawLabels[i]]
+	}
+
+	// Weight classes inversely to their frequency so small classes such
+	// as C2 are not drowned out by browsing
+	counts := make([]float64, len(classes))
+	for _, c := range y {
+		counts[c]++
+	}
+	classWeight := make([]float64, len(classes))
+	for c := range classes {
+		classWeight[c] = float64(len(y)) / (float64(len(classes)) * counts[c])
+	}
+
+	const batchSize = 32
+	rng := rand.New(rand.NewSource(opts.Seed))
+	order := rng.Perm(len(x))
+	for epoch := 0; epoch < opts.Epochs; epoch++ {
+		rng.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+		for start := 0; start < len(order); start += batchSize {
+			end := start + batchSize
+			if end > len(order) {
+				end = len(order)
+			}
+			m.step(x, y, classWeight, order[start:end], opts.LearningRate, opts.L2)
+		}
+	}
+	return m, nil
+}
+
+// step applies one gradient descent update over a batch
+func (m *FlowModel) step(x [][]float64, y []int, classWeight []float64, batch []int, rate, l2 float64) {
+	gradW := make([][]float64, len(m.Classes))
+	for c := range gradW {
+		gradW[c] = make([]float64, len(m.Features))
+	}
+	gradB := make([]float64, len(m.Classes))
+
+	for _, i := range batch {
+		probs := m.probabilities(x[i])
+		for c := range m.Classes {
+			err := probs[c]
+			if c == y[i] {
+				err--
+			}
+			err *= classWeight[y[i]]
+			gradB[c] += err
+			for j, v := range x[i] {
+				gradW[c][j] += err * v
+			}
+		}
+	}
+
+	n := float64(len(batch))
+	for c := range m.Classes {
+		m.Bias[c] -= rate * gradB[c] / n
+		for j := range m.Features {
+			m.Weights[c][j] -= rate * (gradW[c][j]/n + l2*m.Weights[c][j])
+		}
+	}
+}
+
+// FlowClassifier classifies sampled flows and uses the classes to adjust
+// the confidence of alerts between the same client and server port. It
+// never raises alerts itself.
+type FlowClassifier struct {
+	logger *logrus.Logger
+	mu     sync.RWMutex
+	model  *FlowModel
+	labels map[flowPair]flowLabel
+	// order picks the label to evict when maxFlowLabels is reached
+	order *recency.List[flowPair]
+}
+
+// flowPair identifies the flows of a client to a server port
+type flowPair struct {
+	client, server string
+	port           int
+}
+
+type flowLabel struct {
+	class FlowClass
+	seen  time.Time
+}
+
+// NewFlowClassifier creates a classifier using model
+func NewFlowClassifier(logger *logrus.Logger, model *FlowModel) *FlowClassifier {
+	return &FlowClassifier{
+		logger: logger,
+		model:  model,
+		labels: make(map[flowPair]flowLabel),
+		order:  recency.New[flowPair](),
+	}
+}
+
+// SetModel replaces the model
+func (fc *FlowClassifier) SetModel(model *FlowModel) {
+	fc.mu.Lock()
+	fc.model = model
+	fc.mu.Unlock()
+}
+
+// Packets returns the number of packets per flow the model expects
+func (fc *FlowClassifier) Packets() int {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.model.Packets
+}
+
+// Observe classifies a flow sample and remembers the class for its client
+// and server port
+func (fc *FlowClassifier) Observe(sample *FlowSample) {
+	if len(sample.Packets) < minFlowPackets {
+		return
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	class := fc.model.Classify(sample)
+	seen := sample.Start
+	if seen.IsZero() {
+		seen = time.Now()
+	}
+
+	key := flowPair{sample.SrcIP, sample.DstIP, sample.DstPort}
+	if _, exists := fc.labels[key]; !exists && len(fc.labels) >= maxFlowLabels {
+		if oldest, ok := fc.order.Oldest(); ok {
+			delete(fc.labels, oldest)
+			fc.order.Remove(oldest)
+		}
+	}
+	fc.labels[key] = flowLabel{class: class, seen: seen}
+	fc.order.Touch(key)
+
+	fc.logger.Debugf("Flow %s:%d -> %s:%d classified as %s (%.2f)",
+		sample.SrcIP, sample.SrcPort, sample.DstIP, sample.DstPort, class.Label, class.Probability)
+}
+
+// Lookup returns the class of flows from client to the server port seen
+// within flowLabelTTL of at
+func (fc *FlowClassifier) Lookup(client, server string, port int, at time.Time) (FlowClass, bool) {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+
+	label, ok := fc.labels[flowPair{client, server, port}]
+	if !ok {
+		return FlowClass{}, false
+	}
+	if age := at.Sub(label.seen); age >= flowLabelTTL || age <= -flowLabelTTL {
+		return FlowClass{}, false
+	}
+	return label.class, true
+}
+
+// Adjust moves the confidence of an alert by the class of its flows and
+// records the class in the alert details
+func (fc *FlowClassifier) Adjust(alert *models.Alert) {
+	at := alert.Timestamp
+	if at.IsZero() {
+		at = time.Now()
+	}
+	class, ok := fc.Lookup(alert.SrcIP, alert.DstIP, alert.DstPort, at)
+	if !ok {
+		return
+	}
+	alert.Confidence = class.AdjustConfidence(alert.Confidence)
+
+	details := map[string]interface{}{}
+	if alert.Details != "" && json.Unmarshal([]byte(alert.Details), &details) != nil {
+		return
+	}
+	details["flow_class"] = class.Label
+	details["flow_class_probability"] = class.Probability
+	if data, err := json.Marshal(details); err == nil {
+		alert.Details = string(data)
+	}
+}
@@ -0,0 +1,446 @@
+package encryption
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TLS record and handshake types
+const (
+	recordTypeHandshake  = 22
+	handshakeClientHello = 1
+	handshakeServerHello = 2
+	recordHeaderLen      = 5
+	handshakeHeaderLen   = 4
+	extServerName        = 0x0000
+	extSupportedGroups   = 0x000a
+	extECPointFormats    = 0x000b
+	extSignatureAlgs     = 0x000d
+	extALPN              = 0x0010
+	extSupportedVersions = 0x002b
+	maxHandshakeMessage  = 64 << 10
+)
+
+var (
+	// ErrIncomplete means the hello continues in data not seen yet
+	ErrIncomplete = errors.New("incomplete TLS handshake message")
+	errMalformed  = errors.New("malformed TLS handshake message")
+)
+
+// ClientHello holds the ClientHello fields used for fingerprinting. Lists
+// keep their wire order and include GREASE values.
+type ClientHello struct {
+	Version             uint16
+	SupportedVersions   []uint16
+	CipherSuites        []uint16
+	Extensions          []uint16
+	SupportedGroups     []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	ServerName          string
+	ALPN                []string
+}
+
+// ServerHello holds the ServerHello fields used for fingerprinting
+type ServerHello struct {
+	Version          uint16
+	SupportedVersion uint16
+	CipherSuite      uint16
+	Extensions       []uint16
+	ALPN             string
+}
+
+// ParseClientHello parses a ClientHello from the start of a TCP stream,
+// which may span several TLS records
+func ParseClientHello(stream []byte) (*ClientHello, error) {
+	body, err := handshakeMessage(stream, handshakeClientHello)
+	if err != nil {
+		return nil, err
+	}
+
+	r := reader(body)
+	hello := &ClientHello{Version: r.uint16()}
+	r.skip(32) // random
+	r.skip(int(r.uint8()))
+	for suites := reader(r.bytes(int(r.uint16()))); len(suites) > 0; {
+		hello.CipherSuites = append(hello.CipherSuites, suites.uint16())
+	}
+	r.skip(int(r.uint8())) // compression methods
+	if r.failed() {
+		return nil, errMalformed
+	}
+
+	err = parseExtensions(&r, func(kind uint16, data reader) {
+		hello.Extensions = append(hello.Extensions, kind)
+		switch kind {
+		case extServerName:
+			list := reader(data.bytes(int(data.uint16())))
+			for len(list) > 0 {
+				nameType := list.uint8()
+				name := list.bytes(int(list.uint16()))
+				if nameType == 0 && hello.ServerName == "" {
+					hello.ServerName = string(name)
+				}
+			}
+		case extSupportedGroups:
+			for list := reader(data.bytes(int(data.uint16()))); len(list) > 0; {
+				hello.SupportedGroups = append(hello.SupportedGroups, list.uint16())
+			}
+		case extECPointFormats:
+			hello.PointFormats = append(hello.PointFormats, data.bytes(int(data.uint8()))...)
+		case extSignatureAlgs:
+			for list := reader(data.bytes(int(data.uint16()))); len(list) > 0; {
+				hello.SignatureAlgorithms = append(hello.SignatureAlgorithms, list.uint16())
+			}
+		case extALPN:
+			for list := reader(data.bytes(int(data.uint16()))); len(list) > 0; {
+				hello.ALPN = append(hello.ALPN, string(list.bytes(int(list.uint8()))))
+			}
+		case extSupportedVersions:
+			for list := reader(data.bytes(int(data.uint8()))); len(list) > 0; {
+				hello.SupportedVersions = append(hello.SupportedVersions, list.uint16())
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hello, nil
+}
+
+// ParseServerHello parses a ServerHello from the start of a TCP stream
+func ParseServerHello(stream []byte) (*ServerHello, error) {
+	body, err := handshakeMessage(stream, handshakeServerHello)
+	if err != nil {
+		return nil, err
+	}
+
+	r := reader(body)
+	hello := &ServerHello{Version: r.uint16()}
+	r.skip(32) // random
+	r.skip(int(r.uint8()))
+	hello.CipherSuite = r.uint16()
+	r.skip(1) // compression method
+	if r.failed() {
+		return nil, errMalformed
+	}
+
+	err = parseExtensions(&r, func(kind uint16, data reader) {
+		hello.Extensions = append(hello.Extensions, kind)
+		switch kind {
+		case extALPN:
+			list := reader(data.bytes(int(data.uint16())))
+			hello.ALPN = string(list.bytes(int(list.uint8())))
+		case extSupportedVersions:
+			hello.SupportedVersion = data.uint16()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hello, nil
+}
+
+// handshakeMessage joins the handshake records at the start of stream and
+// returns the body of the first message, which must be of type want
+func handshakeMessage(stream []byte, want byte) ([]byte, error) {
+	var message []byte
+	for {
+		if len(stream) < recordHeaderLen {
+			return nil, ErrIncomplete
+		}
+		if stream[0] != recordTypeHandshake || stream[1] != 3 {
+			return nil, errMalformed
+		}
+		length := int(binary.BigEndian.Uint16(stream[3:5]))
+		if len(stream) < recordHeaderLen+length {
+			return nil, ErrIncomplete
+		}
+		message = append(message, stream[recordHeaderLen:recordHeaderLen+length]...)
+		stream = stream[recordHeaderLen+length:]
+
+		if len(message) < handshakeHeaderLen {
+			continue
+		}
+		if message[0] != want {
+			return nil, errMalformed
+		}
+		size := int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+		if size > maxHandshakeMessage {
+			return nil, errMalformed
+		}
+		if len(message) >= handshakeHeaderLen+size {
+			return message[handshakeHeaderLen : handshakeHeaderLen+size], nil
+		}
+	}
+}
+
+// parseExtensions calls fn for each extension remaining in r. Hellos
+// without extensions are valid.
+func parseExtensions(r *reader, fn func(kind uint16, data reader)) error {
+	if len(*r) == 0 {
+		return nil
+	}
+	extensions := reader(r.bytes(int(r.uint16())))
+	for len(extensions) > 0 {
+		kind := extensions.uint16()
+		data := reader(extensions.bytes(int(extensions.uint16())))
+		if extensions.failed() {
+			return errMalformed
+		}
+		fn(kind, data)
+	}
+	if r.failed() {
+		return errMalformed
+	}
+	return nil
+}
+
+// reader consumes big-endian fields. Reading past the end empties it and
+// marks it failed.
+type reader []byte
+
+func (r *reader) bytes(n int) []byte {
+	if n < 0 || len(*r) < n {
+		*r = nil
+		return nil
+	}
+	b := (*r)[:n]
+	*r = (*r)[n:]
+	return b
+}
+
+func (r *reader) skip(n int) { r.bytes(n) }
+
+func (r *reader) uint8() uint8 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+// failed reports whether a read ran past the end; a nil reader with
+// nothing left to read counts as failed
+func (r *reader) failed() bool { return *r == nil }
+
+// isGREASE reports whether v is a reserved GREASE value (RFC 8701)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	filtered := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
+// JA3 returns the JA3 string and its MD5 hash
+func (h *ClientHello) JA3() (string, string) {
+	points := make([]uint16, len(h.PointFormats))
+	for i, p := range h.PointFormats {
+		points[i] = uint16(p)
+	}
+	s := strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		joinDecimal(withoutGREASE(h.CipherSuites)),
+		joinDecimal(withoutGREASE(h.Extensions)),
+		joinDecimal(withoutGREASE(h.SupportedGroups)),
+		joinDecimal(points),
+	}, ",")
+	return s, fmt.Sprintf("%x", md5.Sum([]byte(s)))
+}
+
+// JA3S returns the JA3S string and its MD5 hash
+func (h *ServerHello) JA3S() (string, string) {
+	s := strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		strconv.Itoa(int(h.CipherSuite)),
+		joinDecimal(h.Extensions),
+	}, ",")
+	return s, fmt.Sprintf("%x", md5.Sum([]byte(s)))
+}
+
+// JA4 returns the JA4 fingerprint of a ClientHello sent over TCP
+func (h *ClientHello) JA4() string {
+	version := h.Version
+	for _, v := range withoutGREASE(h.SupportedVersions) {
+		if v > version {
+			version = v
+		}
+	}
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+	alpn := ""
+	if len(h.ALPN) > 0 {
+		alpn = h.ALPN[0]
+	}
+
+	ciphers := withoutGREASE(h.CipherSuites)
+	extensions := withoutGREASE(h.Extensions)
+	prefix := fmt.Sprintf("t%s%s%02d%02d%s",
+		versionCode(version), sni, min(len(ciphers), 99), min(len(extensions), 99), alpnCode(alpn))
+
+	// The hashed extensions leave out SNI and ALPN, which the prefix covers
+	var hashed []uint16
+	for _, ext := range extensions {
+		if ext != extServerName && ext != extALPN {
+			hashed = append(hashed, ext)
+		}
+	}
+	extensionPart := joinHex(sorted(hashed))
+	if len(h.SignatureAlgorithms) > 0 {
+		extensionPart += "_" + joinHex(withoutGREASE(h.SignatureAlgorithms))
+	}
+
+	return prefix + "_" + truncatedHash(joinHex(sorted(ciphers))) + "_" + truncatedHash(extensionPart)
+}
+
+// JA4S returns the JA4S fingerprint of a ServerHello sent over TCP
+func (h *ServerHello) JA4S() string {
+	version := h.Version
+	if h.SupportedVersion != 0 {
+		version = h.SupportedVersion
+	}
+	return fmt.Sprintf("t%s%02d%s_%04x_%s",
+		versionCode(version), min(len(h.Extensions), 99), alpnCode(h.ALPN),
+		h.CipherSuite, truncatedHash(joinHex(h.Extensions)))
+}
+
+// NegotiatedVersion returns the version the server selected
+func (h *ServerHello) NegotiatedVersion() uint16 {
+	if h.SupportedVersion != 0 {
+		return h.SupportedVersion
+	}
+	return h.Version
+}
+
+// VersionName returns the Zeek name of a TLS version, e.g. TLSv12
+func VersionName(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "TLSv13"
+	case 0x0303:
+		return "TLSv12"
+	case 0x0302:
+		return "TLSv11"
+	case 0x0301:
+		return "TLSv10"
+	case 0x0300:
+		return "SSLv3"
+	case 0x0002:
+		return "SSLv2"
+	}
+	return fmt.Sprintf("unknown-%d", version)
+}
+
+// ParseVersion returns the protocol version named like Zeek ("TLSv12",
+// "SSLv3", "DTLSv12") or like "TLS 1.2". DTLS versions map to the TLS
+// version they are based on.
+func ParseVersion(name string) (uint16, bool) {
+	name = strings.ToLower(strings.NewReplacer(" ", "", ".", "", "_", "").Replace(name))
+
+	var versions map[string]uint16
+	switch {
+	case strings.HasPrefix(name, "dtls"):
+		name = strings.TrimPrefix(name, "dtls")
+		versions = map[string]uint16{"1": 0x0302, "10": 0x0302, "12": 0x0303, "13": 0x0304}
+	case strings.HasPrefix(name, "tls"):
+		name = strings.TrimPrefix(name, "tls")
+		versions = map[string]uint16{"1": 0x0301, "10": 0x0301, "11": 0x0302, "12": 0x0303, "13": 0x0304}
+	case strings.HasPrefix(name, "ssl"):
+		name = strings.TrimPrefix(name, "ssl")
+		versions = map[string]uint16{"2": 0x0002, "3": 0x0300, "30": 0x0300}
+	default:
+		return 0, false
+	}
+
+	version, ok := versions[strings.TrimPrefix(name, "v")]
+	return version, ok
+}
+
+func versionCode(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	}
+	return "00"
+}
+
+// alpnCode returns the first and last character of an ALPN value, or the
+// outer hex digits when either is not alphanumeric
+func alpnCode(alpn string) string {
+	if alpn == "" {
+		return "00"
+	}
+	first, last := alpn[0], alpn[len(alpn)-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+	return fmt.Sprintf("%02x", first)[:1] + fmt.Sprintf("%02x", last)[1:]
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// truncatedHash returns the first 12 hex digits of the SHA-256 of s, or
+// zeros when s is empty
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))[:12]
+}
+
+func sorted(values []uint16) []uint16 {
+	out := append([]uint16(nil), values...)
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
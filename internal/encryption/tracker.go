@@ -0,0 +1,286 @@
+package encryption
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// helloTimeout is how long a hello may take to arrive in full and a
+	// ClientHello waits for its ServerHello
+	helloTimeout = 30 * time.Second
+	// maxHelloStreams caps the flows reassembled, and the handshakes
+	// awaiting a ServerHello, at once
+	maxHelloStreams = 10000
+	// maxOutOfOrder caps the early segments buffered per flow
+	maxOutOfOrder = 16
+	// expireEvery is how often stale flows are swept, in packet time
+	expireEvery = 5 * time.Second
+)
+
+// HandshakeTracker reassembles TLS hellos from TCP packets and reports
+// each handshake with its JA3, JA3S, JA4, JA4S, SNI and ALPN. It lets
+// probes fingerprint TLS without the Zeek ja3 and ja4 packages.
+type HandshakeTracker struct {
+	mu          sync.Mutex
+	logger      *logrus.Logger
+	onHandshake func(*models.TLSHandshake)
+	streams     map[flowKey]*helloStream
+	pending     map[flowKey]*pendingHandshake
+	lastExpire  time.Time
+}
+
+type flowKey struct {
+	src, dst     string
+	sport, dport uint16
+}
+
+func (k flowKey) reverse() flowKey {
+	return flowKey{src: k.dst, dst: k.src, sport: k.dport, dport: k.sport}
+}
+
+// helloStream is the start of one direction of a TCP flow
+type helloStream struct {
+	client  bool
+	started time.Time
+	nextSeq uint32
+	data    []byte
+	early   map[uint32][]byte
+}
+
+// pendingHandshake is a parsed ClientHello waiting for the ServerHello
+type pendingHandshake struct {
+	handshake *models.TLSHandshake
+	seen      time.Time
+}
+
+// NewHandshakeTracker creates a tracker calling onHandshake for every
+// handshake. Handshakes without a ServerHello are reported with the client
+// fingerprints only once they time out.
+func NewHandshakeTracker(logger *logrus.Logger, onHandshake func(*models.TLSHandshake)) *HandshakeTracker {
+	return &HandshakeTracker{
+		logger:      logger,
+		onHandshake: onHandshake,
+		streams:     make(map[flowKey]*helloStream),
+		pending:     make(map[flowKey]*pendingHandshake),
+	}
+}
+
+// Observe feeds a captured packet to the tracker
+func (t *HandshakeTracker) Observe(packet gopacket.Packet) {
+	tcpLayer := packet.Layer(layers.LayerTypeTCP)
+	if tcpLayer == nil {
+		return
+	}
+	tcp, _ := tcpLayer.(*layers.TCP)
+
+	var src, dst string
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		src, dst = ip.SrcIP.String(), ip.DstIP.String()
+	case *layers.IPv6:
+		src, dst = ip.SrcIP.String(), ip.DstIP.String()
+	default:
+		return
+	}
+
+	now := packet.Metadata().Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+	key := flowKey{src: src, dst: dst, sport: uint16(tcp.SrcPort), dport: uint16(tcp.DstPort)}
+
+	var done []*models.TLSHandshake
+	t.mu.Lock()
+	if handshake := t.observe(key, tcp, now); handshake != nil {
+		done = append(done, handshake)
+	}
+	if now.Sub(t.lastExpire) >= expireEvery {
+		done = append(done, t.expire(now)...)
+		t.lastExpire = now
+	}
+	t.mu.Unlock()
+
+	for _, handshake := range done {
+		t.onHandshake(handshake)
+	}
+}
+
+// Flush reports every handshake still waiting for its ServerHello
+func (t *HandshakeTracker) Flush() {
+	t.mu.Lock()
+	var done []*models.TLSHandshake
+	for key, p := range t.pending {
+		done = append(done, p.handshake)
+		delete(t.pending, key)
+	}
+	t.streams = make(map[flowKey]*helloStream)
+	t.mu.Unlock()
+
+	for _, handshake := range done {
+		t.onHandshake(handshake)
+	}
+}
+
+func (t *HandshakeTracker) observe(key flowKey, tcp *layers.TCP, now time.Time) *models.TLSHandshake {
+	if tcp.RST || tcp.FIN {
+		delete(t.streams, key)
+	}
+	payload := tcp.Payload
+	if len(payload) == 0 {
+		return nil
+	}
+
+	stream, exists := t.streams[key]
+	if !exists {
+		// Hellos start a record: handshake type, version 3.x and the
+		// message type after the five byte record header
+		if len(payload) < recordHeaderLen+1 || payload[0] != recordTypeHandshake || payload[1] != 3 {
+			return nil
+		}
+		_, awaitingServer := t.pending[key.reverse()]
+		switch {
+		case payload[recordHeaderLen] == handshakeClientHello:
+		case payload[recordHeaderLen] == handshakeServerHello && awaitingServer:
+		default:
+			return nil
+		}
+		if len(t.streams) >= maxHelloStreams {
+			return nil
+		}
+		stream = &helloStream{
+			client:  payload[recordHeaderLen] == handshakeClientHello,
+			started: now,
+			nextSeq: tcp.Seq,
+		}
+		t.streams[key] = stream
+	}
+
+	if !stream.add(tcp.Seq, payload) {
+		return nil
+	}
+
+	if stream.client {
+		hello, err := ParseClientHello(stream.data)
+		if err == ErrIncomplete && len(stream.data) < maxHandshakeMessage {
+			return nil
+		}
+		delete(t.streams, key)
+		if err != nil {
+			t.logger.Debugf("Malformed ClientHello from %s:%d: %v", key.src, key.sport, err)
+			return nil
+		}
+		if len(t.pending) >= maxHelloStreams {
+			return nil
+		}
+		t.pending[key] = t.clientHandshake(key, hello, now)
+		return nil
+	}
+
+	hello, err := ParseServerHello(stream.data)
+	if err == ErrIncomplete && len(stream.data) < maxHandshakeMessage {
+		return nil
+	}
+	delete(t.streams, key)
+	p, ok := t.pending[key.reverse()]
+	if !ok {
+		return nil
+	}
+	delete(t.pending, key.reverse())
+	if err != nil {
+		t.logger.Debugf("Malformed ServerHello from %s:%d: %v", key.src, key.sport, err)
+		return p.handshake
+	}
+	completeHandshake(p.handshake, hello)
+	return p.handshake
+}
+
+// add appends a segment in sequence order and reports whether new data
+// became contiguous
+func (s *helloStream) add(seq uint32, payload []byte) bool {
+	offset := int32(seq - s.nextSeq)
+	switch {
+	case offset > 0:
+		// Arrived early; kept until the gap is filled
+		if s.early == nil {
+			s.early = make(map[uint32][]byte)
+		}
+		if len(s.early) < maxOutOfOrder {
+			s.early[seq] = append([]byte(nil), payload...)
+		}
+		return false
+	case int(-offset) >= len(payload):
+		// Retransmission of data already seen
+		return false
+	}
+
+	s.data = append(s.data, payload[-offset:]...)
+	s.nextSeq = seq + uint32(len(payload))
+	for {
+		next, ok := s.early[s.nextSeq]
+		if !ok {
+			return true
+		}
+		delete(s.early, s.nextSeq)
+		s.data = append(s.data, next...)
+		s.nextSeq += uint32(len(next))
+	}
+}
+
+func (t *HandshakeTracker) clientHandshake(key flowKey, hello *ClientHello, now time.Time) *pendingHandshake {
+	_, ja3 := hello.JA3()
+	version := hello.Version
+	for _, v := range withoutGREASE(hello.SupportedVersions) {
+		if v > version {
+			version = v
+		}
+	}
+	return &pendingHandshake{
+		handshake: &models.TLSHandshake{
+			Timestamp:  now,
+			SrcIP:      key.src,
+			DstIP:      key.dst,
+			SrcPort:    int(key.sport),
+			DstPort:    int(key.dport),
+			Version:    VersionName(version),
+			ServerName: hello.ServerName,
+			JA3:        ja3,
+			JA4:        hello.JA4(),
+		},
+		seen: now,
+	}
+}
+
+func completeHandshake(handshake *models.TLSHandshake, hello *ServerHello) {
+	_, ja3s := hello.JA3S()
+	handshake.Version = VersionName(hello.NegotiatedVersion())
+	handshake.CipherSuite = CipherSuiteName(hello.CipherSuite)
+	handshake.JA3S = ja3s
+	handshake.JA4S = hello.JA4S()
+	handshake.NextProtocol = hello.ALPN
+}
+
+// expire drops stale partial hellos and returns the ClientHellos that
+// never got an answer
+func (t *HandshakeTracker) expire(now time.Time) []*models.TLSHandshake {
+	cutoff := now.Add(-helloTimeout)
+	for key, stream := range t.streams {
+		if stream.started.Before(cutoff) {
+			delete(t.streams, key)
+		}
+	}
+
+	var done []*models.TLSHandshake
+	for key, p := range t.pending {
+		if p.seen.Before(cutoff) {
+			done = append(done, p.handshake)
+			delete(t.pending, key)
+		}
+	}
+	return done
+}
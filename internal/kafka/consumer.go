@@ -2,272 +2,413 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/Cxiyuan/NTA/internal/detector"
-	"github.com/Cxiyuan/NTA/internal/threatintel"
-	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/Cxiyuan/NTA/internal/pipeline"
+	"github.com/Cxiyuan/NTA/pkg/metrics"
+	"github.com/Cxiyuan/NTA/pkg/retry"
 	"github.com/segmentio/kafka-go"
 	"github.com/sirupsen/logrus"
-	"gorm.io/gorm"
 )
 
+// lagSampleInterval is how often consumer lag and worker queue lengths are
+// reported
+const lagSampleInterval = 15 * time.Second
+
+// fetchRetryDelay is the first wait after a failed fetch; it doubles with
+// every consecutive failure up to maxFetchRetryDelay
+const (
+	fetchRetryDelay    = 100 * time.Millisecond
+	maxFetchRetryDelay = 30 * time.Second
+)
+
+// ConsumerConfig configures the Zeek topic consumer
+type ConsumerConfig struct {
+	Brokers []string
+	Topics  []string
+	GroupID string
+	// Workers is the number of concurrent processors. Each partition is
+	// pinned to one worker so records of a flow stay in order.
+	Workers int
+	// QueueSize bounds the messages buffered per worker; a full queue stops
+	// fetching until the worker catches up
+	QueueSize int
+	// CommitInterval and CommitBatch control how often processed offsets
+	// are committed, whichever comes first
+	CommitInterval time.Duration
+	CommitBatch    int
+	// DLQTopic receives messages that fail processing; empty disables the
+	// dead-letter queue and failures are only logged
+	DLQTopic string
+}
+
+// DefaultConsumerConfig returns the settings used by cmd/kafka-consumer
+func DefaultConsumerConfig(brokers []string) ConsumerConfig {
+	return ConsumerConfig{
+		Brokers: brokers,
+		Topics: []string{
+			"zeek-conn", "zeek-dns", "zeek-http", "zeek-files", "zeek-ssl", "zeek-notice",
+			"zeek-ntlm", "zeek-smb_files", "zeek-smb_mapping", "zeek-dce_rpc",
+			"zeek-ssh", "zeek-rdp", "zeek-kerberos", "zeek-ldap", "zeek-x509",
+		},
+		GroupID:        "nta-consumer-group",
+		Workers:        8,
+		QueueSize:      1000,
+		CommitInterval: time.Second,
+		CommitBatch:    5000,
+		DLQTopic:       DefaultDLQTopic,
+	}
+}
+
+// Consumer reads all Zeek topics with one consumer group and processes
+// messages on a bounded worker pool
 type Consumer struct {
-	reader      *kafka.Reader
-	db          *gorm.DB
-	logger      *logrus.Logger
-	detector    *detector.AdvancedDetector
-	threatIntel *threatintel.Service
+	config    ConsumerConfig
+	reader    *kafka.Reader
+	client    *kafka.Client
+	logger    *logrus.Logger
+	processor *pipeline.Processor
+	dlq       *DeadLetterQueue
 }
 
-func NewConsumer(brokers []string, topic string, groupID string, db *gorm.DB, logger *logrus.Logger, threatIntel *threatintel.Service) *Consumer {
+type partitionKey struct {
+	topic     string
+	partition int
+}
+
+func NewConsumer(cfg ConsumerConfig, processor *pipeline.Processor, logger *logrus.Logger) (*Consumer, error) {
+	if len(cfg.Topics) == 0 {
+		return nil, errors.New("no topics configured")
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 1
+	}
+	if cfg.CommitInterval <= 0 {
+		cfg.CommitInterval = time.Second
+	}
+	if cfg.CommitBatch <= 0 {
+		cfg.CommitBatch = 1
+	}
+
 	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:        brokers,
-		Topic:          topic,
-		GroupID:        groupID,
-		MinBytes:       1024,
-		MaxBytes:       10e6,
-		CommitInterval: time.Second,
-		StartOffset:    kafka.LastOffset,
+		Brokers:     cfg.Brokers,
+		GroupTopics: cfg.Topics,
+		GroupID:     cfg.GroupID,
+		MinBytes:    1024,
+		MaxBytes:    10e6,
+		StartOffset: kafka.LastOffset,
 	})
 
-	return &Consumer{
-		reader:      reader,
-		db:          db,
-		logger:      logger,
-		detector:    detector.NewAdvancedDetector(logger),
-		threatIntel: threatIntel,
+	consumer := &Consumer{
+		config:    cfg,
+		reader:    reader,
+		client:    &kafka.Client{Addr: kafka.TCP(cfg.Brokers...), Timeout: 10 * time.Second},
+		logger:    logger,
+		processor: processor,
 	}
+	if cfg.DLQTopic != "" {
+		consumer.dlq = NewDeadLetterQueue(cfg.Brokers, cfg.DLQTopic, logger)
+	}
+
+	return consumer, nil
 }
 
+// Start consumes until ctx is cancelled. Offsets are committed only after
+// the message and everything before it on the partition was processed.
 func (c *Consumer) Start(ctx context.Context) error {
-	c.logger.Infof("Starting Kafka consumer for topic: %s", c.reader.Config().Topic)
+	c.logger.Infof("Starting Kafka consumer for topics %s with %d workers",
+		strings.Join(c.config.Topics, ","), c.config.Workers)
+
+	// Workers keep their own context so queued messages are still processed
+	// once ctx is cancelled
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
+	queues := make([]chan kafka.Message, c.config.Workers)
+	done := make(chan kafka.Message, c.config.Workers*c.config.QueueSize)
+
+	var workers sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan kafka.Message, c.config.QueueSize)
+		workers.Add(1)
+		go func(queue <-chan kafka.Message) {
+			defer workers.Done()
+			c.worker(ctx, workCtx, queue, done)
+		}(queues[i])
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return c.reader.Close()
-		default:
-			msg, err := c.reader.FetchMessage(ctx)
-			if err != nil {
-				c.logger.Errorf("Failed to fetch message: %v", err)
-				continue
-			}
+	committerDone := make(chan struct{})
+	go func() {
+		defer close(committerDone)
+		c.committer(done)
+	}()
+	go c.sampleLag(ctx, queues)
 
-			if err := c.processMessage(ctx, msg); err != nil {
-				c.logger.Errorf("Failed to process message: %v", err)
-			}
+	fetchErr := c.fetch(ctx, queues)
 
-			if err := c.reader.CommitMessages(ctx, msg); err != nil {
-				c.logger.Errorf("Failed to commit message: %v", err)
-			}
-		}
+	// Drain: let workers finish queued messages, then commit what they did
+	for _, queue := range queues {
+		close(queue)
 	}
-}
+	workers.Wait()
+	close(done)
+	<-committerDone
 
-func (c *Consumer) processMessage(ctx context.Context, msg kafka.Message) error {
-	topic := c.reader.Config().Topic
-
-	switch topic {
-	case "zeek-conn":
-		return c.processConnLog(msg.Value)
-	case "zeek-dns":
-		return c.processDNSLog(msg.Value)
-	case "zeek-http":
-		return c.processHTTPLog(msg.Value)
-	case "zeek-ssl":
-		return c.processSSLLog(msg.Value)
-	case "zeek-notice":
-		return c.processNoticeLog(msg.Value)
-	default:
-		c.logger.Warnf("Unknown topic: %s", topic)
+	if c.dlq != nil {
+		if err := c.dlq.Close(); err != nil {
+			c.logger.Errorf("Failed to close dead-letter writer: %v", err)
+		}
 	}
-
-	return nil
-}
-
-func (c *Consumer) processConnLog(data []byte) error {
-	var conn models.Connection
-	if err := json.Unmarshal(data, &conn); err != nil {
+	if err := c.reader.Close(); err != nil {
 		return err
 	}
+	return fetchErr
+}
 
-	ctx := context.Background()
-
-	if c.threatIntel != nil {
-		if srcIntel, err := c.threatIntel.CheckIP(ctx, conn.SrcIP); err == nil && srcIntel != nil && srcIntel.Severity != "none" {
-			alert := &models.Alert{
-				Type:         "threat_intel_match",
-				Severity:     srcIntel.Severity,
-				SrcIP:        conn.SrcIP,
-				DstIP:        conn.DstIP,
-				Description:  fmt.Sprintf("威胁情报匹配 [%s]: %s - %s", srcIntel.ThreatLabel, conn.SrcIP, srcIntel.Description),
-				ThreatLabel:  srcIntel.ThreatLabel,
-				ThreatSource: srcIntel.Source,
-				Confidence:   0.95,
-				Timestamp:    time.Now(),
-				Status:       "new",
+// fetch dispatches messages to the worker owning their partition. Sends
+// block when that worker's queue is full, which is our backpressure.
+func (c *Consumer) fetch(ctx context.Context, queues []chan kafka.Message) error {
+	delay := fetchRetryDelay
+	for {
+		msg, err := c.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, io.EOF) {
+				return err
+			}
+			c.logger.Errorf("Failed to fetch message, retrying in %v: %v", delay, err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
 			}
-			c.db.Create(alert)
-			c.logger.Warnf("Threat intel match: %s (%s)", conn.SrcIP, srcIntel.ThreatLabel)
+			delay = min(delay*2, maxFetchRetryDelay)
+			continue
 		}
+		delay = fetchRetryDelay
 
-		if dstIntel, err := c.threatIntel.CheckIP(ctx, conn.DstIP); err == nil && dstIntel != nil && dstIntel.Severity != "none" {
-			alert := &models.Alert{
-				Type:         "threat_intel_match",
-				Severity:     dstIntel.Severity,
-				SrcIP:        conn.SrcIP,
-				DstIP:        conn.DstIP,
-				Description:  fmt.Sprintf("威胁情报匹配 [%s]: %s - %s", dstIntel.ThreatLabel, conn.DstIP, dstIntel.Description),
-				ThreatLabel:  dstIntel.ThreatLabel,
-				ThreatSource: dstIntel.Source,
-				Confidence:   0.95,
-				Timestamp:    time.Now(),
-				Status:       "new",
-			}
-			c.db.Create(alert)
-			c.logger.Warnf("Threat intel match: %s (%s)", conn.DstIP, dstIntel.ThreatLabel)
+		queue := queues[workerIndex(msg.Topic, msg.Partition, len(queues))]
+		select {
+		case queue <- msg:
+		case <-ctx.Done():
+			return nil
 		}
 	}
+}
+
+// sampleLag reports the lag of the consumer group and the worker queue
+// lengths until ctx is cancelled. Lag is read from the brokers rather than
+// fetched messages, so it keeps growing while fetching is blocked on full
+// worker queues.
+func (c *Consumer) sampleLag(ctx context.Context, queues []chan kafka.Message) {
+	ticker := time.NewTicker(lagSampleInterval)
+	defer ticker.Stop()
 
-	if isC2, score, c2Type := c.detector.DetectC2Communication(&conn); isC2 {
-		alert := &models.Alert{
-			Type:        "c2_communication",
-			Severity:    "high",
-			SrcIP:       conn.SrcIP,
-			DstIP:       conn.DstIP,
-			Description: "检测到C2通信: " + c2Type,
-			Confidence:  score,
-			Timestamp:   time.Now(),
-			Status:      "new",
+	for {
+		for i, queue := range queues {
+			metrics.KafkaWorkerQueueLength.WithLabelValues(strconv.Itoa(i)).Set(float64(len(queue)))
+		}
+		if err := c.reportLag(ctx); err != nil && ctx.Err() == nil {
+			c.logger.Warnf("Failed to sample consumer lag: %v", err)
 		}
-		c.db.Create(alert)
-		c.logger.Warnf("C2 detected: %s -> %s (score: %.2f)", conn.SrcIP, conn.DstIP, score)
-	}
 
-	baseline := int64(1024 * 1024)
-	if isExfil, score := c.detector.DetectDataExfiltration(&conn, baseline); isExfil {
-		alert := &models.Alert{
-			Type:        "data_exfiltration",
-			Severity:    "critical",
-			SrcIP:       conn.SrcIP,
-			DstIP:       conn.DstIP,
-			Description: "检测到数据渗出行为",
-			Confidence:  score,
-			Timestamp:   time.Now(),
-			Status:      "new",
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
-		c.db.Create(alert)
 	}
-
-	return c.db.Create(&conn).Error
 }
 
-func (c *Consumer) processDNSLog(data []byte) error {
-	var dnsQuery map[string]interface{}
-	if err := json.Unmarshal(data, &dnsQuery); err != nil {
+// reportLag sets the lag of every partition the group committed on
+func (c *Consumer) reportLag(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, lagSampleInterval)
+	defer cancel()
+
+	meta, err := c.client.Metadata(ctx, &kafka.MetadataRequest{Topics: c.config.Topics})
+	if err != nil {
+		return fmt.Errorf("failed to fetch topic metadata: %w", err)
+	}
+	offsets, err := partitionOffsets(ctx, c.client, meta.Topics)
+	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
-
-	if query, ok := dnsQuery["query"].(string); ok {
-		if c.threatIntel != nil {
-			if domainIntel, err := c.threatIntel.CheckDomain(ctx, query); err == nil && domainIntel != nil && domainIntel.Severity != "none" {
-				alert := &models.Alert{
-					Type:         "threat_intel_match",
-					Severity:     domainIntel.Severity,
-					Description:  fmt.Sprintf("威胁情报匹配 [%s]: %s - %s", domainIntel.ThreatLabel, query, domainIntel.Description),
-					ThreatLabel:  domainIntel.ThreatLabel,
-					ThreatSource: domainIntel.Source,
-					Confidence:   0.95,
-					Timestamp:    time.Now(),
-					Status:       "new",
-				}
-				if srcIP, ok := dnsQuery["id.orig_h"].(string); ok {
-					alert.SrcIP = srcIP
-				}
-				c.db.Create(alert)
-				c.logger.Warnf("Threat intel match (domain): %s (%s)", query, domainIntel.ThreatLabel)
-			}
+	partitions := make(map[string][]int)
+	for _, topic := range meta.Topics {
+		for _, p := range topic.Partitions {
+			partitions[topic.Name] = append(partitions[topic.Name], p.ID)
 		}
+	}
+	committed, err := c.client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: c.config.GroupID, Topics: partitions})
+	if err != nil {
+		return fmt.Errorf("failed to fetch committed offsets: %w", err)
+	}
+	if committed.Error != nil {
+		return fmt.Errorf("failed to fetch committed offsets: %w", committed.Error)
+	}
 
-		if isDGA, score := c.detector.DetectDGA(query); isDGA {
-			alert := &models.Alert{
-				Type:        "dga_domain",
-				Severity:    "medium",
-				Description: "检测到DGA生成域名: " + query,
-				Confidence:  score,
-				Timestamp:   time.Now(),
-				Status:      "new",
+	for topic, partitions := range committed.Topics {
+		for _, p := range partitions {
+			if p.CommittedOffset < 0 {
+				continue
 			}
-			if srcIP, ok := dnsQuery["id.orig_h"].(string); ok {
-				alert.SrcIP = srcIP
+			lag := offsets[topic][p.Partition].LastOffset - p.CommittedOffset
+			if lag < 0 {
+				lag = 0
 			}
-			c.db.Create(alert)
+			metrics.KafkaConsumerLag.WithLabelValues(topic, strconv.Itoa(p.Partition)).Set(float64(lag))
 		}
 	}
-
 	return nil
 }
 
-func (c *Consumer) processHTTPLog(data []byte) error {
-	var httpLog map[string]interface{}
-	if err := json.Unmarshal(data, &httpLog); err != nil {
-		return err
-	}
+// worker processes its partitions in order. Failed messages go to the
+// dead-letter queue before they are reported for commit; if that is not
+// possible before shutdown, the partition stops here so the message is
+// fetched again on restart.
+func (c *Consumer) worker(ctx, workCtx context.Context, queue <-chan kafka.Message, done chan<- kafka.Message) {
+	blocked := make(map[partitionKey]bool)
+
+	for msg := range queue {
+		key := partitionKey{msg.Topic, msg.Partition}
+		if blocked[key] {
+			continue
+		}
+
+		logType := strings.TrimPrefix(msg.Topic, "zeek-")
+		if strings.HasPrefix(msg.Topic, "zeek-") && !c.processor.Handles(logType) {
+			metrics.KafkaMessagesTotal.WithLabelValues(msg.Topic, "skipped").Inc()
+			done <- msg
+			continue
+		}
 
-	// 检测WebShell
-	var httpLogs []string
-	if uri, ok := httpLog["uri"].(string); ok {
-		httpLogs = append(httpLogs, uri)
+		if err := c.processMessage(workCtx, msg); err != nil {
+			metrics.KafkaMessagesTotal.WithLabelValues(msg.Topic, "failed").Inc()
+			c.logger.Errorf("Failed to process message from %s[%d]@%d: %v", msg.Topic, msg.Partition, msg.Offset, err)
+			if !c.deadLetter(ctx, msg, err) {
+				blocked[key] = true
+				continue
+			}
+		} else {
+			metrics.KafkaMessagesTotal.WithLabelValues(msg.Topic, "processed").Inc()
+		}
+		done <- msg
 	}
-	if userAgent, ok := httpLog["user_agent"].(string); ok {
-		httpLogs = append(httpLogs, userAgent)
+}
+
+// deadLetter publishes a failed message, retrying until it succeeds or ctx
+// is cancelled
+func (c *Consumer) deadLetter(ctx context.Context, msg kafka.Message, procErr error) bool {
+	if c.dlq == nil {
+		return true
 	}
 
-	if isWebShell, score := c.detector.DetectWebShell(httpLogs); isWebShell {
-		alert := &models.Alert{
-			Type:        "webshell",
-			Severity:    "critical",
-			Description: "检测到WebShell特征",
-			Confidence:  score,
-			Timestamp:   time.Now(),
+	for {
+		err := retry.Do(ctx, retry.DefaultConfig(), c.logger, func() error {
+			return c.dlq.Publish(ctx, msg, procErr)
+		})
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			c.logger.Warnf("Leaving %s[%d]@%d uncommitted, dead-letter queue unavailable", msg.Topic, msg.Partition, msg.Offset)
+			return false
 		}
-		c.db.Create(alert)
+		c.logger.Errorf("Failed to publish %s[%d]@%d to %s: %v", msg.Topic, msg.Partition, msg.Offset, c.dlq.Topic(), err)
 	}
-
-	return nil
 }
 
-func (c *Consumer) processSSLLog(data []byte) error {
-	var sslLog models.TLSHandshake
-	if err := json.Unmarshal(data, &sslLog); err != nil {
-		return err
+// committer batches processed messages and commits the highest offset per
+// partition once their rows are stored. A partition is handled by a single
+// worker in fetch order, so the highest processed offset never skips an
+// unprocessed message.
+func (c *Consumer) committer(done <-chan kafka.Message) {
+	pending := make(map[partitionKey]kafka.Message)
+	count := 0
+
+	ticker := time.NewTicker(c.config.CommitInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+
+		msgs := make([]kafka.Message, 0, len(pending))
+		for _, msg := range pending {
+			msgs = append(msgs, msg)
+		}
+
+		// Use a fresh context so the final commit still runs during shutdown
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		// Processed messages may still have rows queued for the database;
+		// their offsets are only committed once those rows are stored
+		if err := c.processor.Sync(ctx); err != nil {
+			c.logger.Errorf("Not committing %d messages, stored rows are behind: %v", count, err)
+			return
+		}
+		if err := c.reader.CommitMessages(ctx, msgs...); err != nil {
+			c.logger.Errorf("Failed to commit %d messages: %v", count, err)
+			return
+		}
+		pending = make(map[partitionKey]kafka.Message)
+		count = 0
 	}
 
-	return c.db.Create(&sslLog).Error
+	for {
+		select {
+		case msg, ok := <-done:
+			if !ok {
+				flush()
+				return
+			}
+			pending[partitionKey{msg.Topic, msg.Partition}] = msg
+			count++
+			if count >= c.config.CommitBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
 }
 
-func (c *Consumer) processNoticeLog(data []byte) error {
-	var notice map[string]interface{}
-	if err := json.Unmarshal(data, &notice); err != nil {
-		return err
-	}
+// processMessage maps the topic (zeek-conn, zeek-dns, ...) to its Zeek log type
+func (c *Consumer) processMessage(ctx context.Context, msg kafka.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
 
-	alert := &models.Alert{
-		Type:        notice["note"].(string),
-		Severity:    "high",
-		SrcIP:       notice["src"].(string),
-		Description: notice["msg"].(string),
-		Timestamp:   time.Now(),
+	if !strings.HasPrefix(msg.Topic, "zeek-") {
+		return fmt.Errorf("unknown topic: %s", msg.Topic)
 	}
 
-	return c.db.Create(alert).Error
+	return c.processor.Process(ctx, strings.TrimPrefix(msg.Topic, "zeek-"), msg.Value)
 }
 
 func (c *Consumer) Close() error {
 	return c.reader.Close()
-}
\ No newline at end of file
+}
+
+func workerIndex(topic string, partition, workers int) int {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%d", topic, partition)
+	return int(h.Sum32() % uint32(workers))
+}
@@ -0,0 +1,291 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultDLQTopic receives messages the consumer failed to process
+const DefaultDLQTopic = "zeek-dlq"
+
+// ErrDeadLetterNotFound is returned for DLQ positions that hold no entry
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is a failed message with enough context to inspect and replay
+// it. Key and Payload are kept as bytes, encoded as base64 in JSON, so
+// binary or malformed messages replay exactly as they arrived.
+type DeadLetter struct {
+	Topic     string    `json:"topic"`
+	Partition int       `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Key       []byte    `json:"key,omitempty"`
+	Payload   []byte    `json:"payload"`
+	Error     string    `json:"error"`
+	FailedAt  time.Time `json:"failed_at"`
+
+	// Position in the dead-letter topic, filled in when reading entries back
+	DLQPartition int   `json:"dlq_partition"`
+	DLQOffset    int64 `json:"dlq_offset"`
+}
+
+// DeadLetterQueue publishes failed messages to a dead-letter topic and reads
+// them back for inspection and replay
+type DeadLetterQueue struct {
+	brokers []string
+	topic   string
+	writer  *kafka.Writer
+	logger  *logrus.Logger
+}
+
+func NewDeadLetterQueue(brokers []string, topic string, logger *logrus.Logger) *DeadLetterQueue {
+	if topic == "" {
+		topic = DefaultDLQTopic
+	}
+
+	return &DeadLetterQueue{
+		brokers: brokers,
+		topic:   topic,
+		// Topic is set per message so replays can target the original topic
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(brokers...),
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           kafka.RequireAll,
+			AllowAutoTopicCreation: true,
+		},
+		logger: logger,
+	}
+}
+
+// Topic returns the dead-letter topic name
+func (q *DeadLetterQueue) Topic() string {
+	return q.topic
+}
+
+// Publish records a message that failed with procErr
+func (q *DeadLetterQueue) Publish(ctx context.Context, msg kafka.Message, procErr error) error {
+	entry := DeadLetter{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       msg.Key,
+		Payload:   msg.Value,
+		Error:     procErr.Error(),
+		FailedAt:  time.Now(),
+	}
+
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return q.writer.WriteMessages(ctx, kafka.Message{
+		Topic: q.topic,
+		Key:   []byte(fmt.Sprintf("%s/%d", msg.Topic, msg.Partition)),
+		Value: value,
+	})
+}
+
+// List returns up to limit of the most recent entries, newest first
+func (q *DeadLetterQueue) List(ctx context.Context, limit int) ([]DeadLetter, error) {
+	partitions, err := q.partitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []DeadLetter
+	for _, partition := range partitions {
+		first, last, err := q.offsets(ctx, partition)
+		if err != nil {
+			return nil, err
+		}
+
+		start := last - int64(limit)
+		if start < first {
+			start = first
+		}
+
+		batch, err := q.read(ctx, partition, start, last)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, batch...)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].FailedAt.After(entries[j].FailedAt)
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	return entries, nil
+}
+
+// Get returns the entry at a position in the dead-letter topic
+func (q *DeadLetterQueue) Get(ctx context.Context, partition int, offset int64) (*DeadLetter, error) {
+	first, last, err := q.offsets(ctx, partition)
+	if err != nil {
+		return nil, err
+	}
+	if offset < first || offset >= last {
+		return nil, ErrDeadLetterNotFound
+	}
+
+	entries, err := q.read(ctx, partition, offset, offset+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ErrDeadLetterNotFound
+	}
+
+	return &entries[0], nil
+}
+
+// Replay republishes an entry's original payload to its original topic so
+// the consumer processes it again
+func (q *DeadLetterQueue) Replay(ctx context.Context, partition int, offset int64) (*DeadLetter, error) {
+	entry, err := q.Get(ctx, partition, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := kafka.Message{
+		Topic: entry.Topic,
+		Key:   entry.Key,
+		Value: entry.Payload,
+		Headers: []kafka.Header{
+			{Key: "nta-dlq-replay", Value: []byte(fmt.Sprintf("%d/%d", partition, offset))},
+		},
+	}
+
+	if err := q.writer.WriteMessages(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	q.logger.Infof("Replayed dead letter %d/%d to %s", partition, offset, entry.Topic)
+	return entry, nil
+}
+
+func (q *DeadLetterQueue) Close() error {
+	return q.writer.Close()
+}
+
+func (q *DeadLetterQueue) partitions(ctx context.Context) ([]int, error) {
+	conn, err := q.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	parts, err := conn.ReadPartitions(q.topic)
+	if err != nil {
+		// Nothing has failed yet, so the topic was never created
+		if errors.Is(err, kafka.UnknownTopicOrPartition) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	result := make([]int, 0, len(parts))
+	for _, p := range parts {
+		result = append(result, p.ID)
+	}
+	sort.Ints(result)
+	return result, nil
+}
+
+func (q *DeadLetterQueue) offsets(ctx context.Context, partition int) (int64, int64, error) {
+	conn, err := q.dialLeader(ctx, partition)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	return conn.ReadOffsets()
+}
+
+// read returns the entries in [start, end) of a partition
+func (q *DeadLetterQueue) read(ctx context.Context, partition int, start, end int64) ([]DeadLetter, error) {
+	if start >= end {
+		return nil, nil
+	}
+
+	conn, err := q.dialLeader(ctx, partition)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Seek(start, kafka.SeekAbsolute); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	batch := conn.ReadBatch(1, 10e6)
+	defer batch.Close()
+
+	entries := make([]DeadLetter, 0, end-start)
+	for {
+		msg, err := batch.ReadMessage()
+		if err != nil {
+			// The batch ends at the high watermark or the byte limit
+			break
+		}
+		if msg.Offset >= end {
+			break
+		}
+
+		var entry DeadLetter
+		if err := json.Unmarshal(msg.Value, &entry); err != nil {
+			q.logger.Warnf("Skipping malformed dead letter %d/%d: %v", partition, msg.Offset, err)
+			continue
+		}
+		entry.DLQPartition = partition
+		entry.DLQOffset = msg.Offset
+		entries = append(entries, entry)
+
+		if msg.Offset+1 >= end {
+			break
+		}
+	}
+
+	return entries, nil
+}
+
+func (q *DeadLetterQueue) dial(ctx context.Context) (*kafka.Conn, error) {
+	var lastErr error
+	for _, broker := range q.brokers {
+		conn, err := kafka.DialContext(ctx, "tcp", broker)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no kafka brokers configured")
+	}
+	return nil, lastErr
+}
+
+func (q *DeadLetterQueue) dialLeader(ctx context.Context, partition int) (*kafka.Conn, error) {
+	var lastErr error
+	for _, broker := range q.brokers {
+		conn, err := kafka.DialLeader(ctx, "tcp", broker, q.topic, partition)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no kafka brokers configured")
+	}
+	return nil, lastErr
+}
@@ -2,16 +2,24 @@ package kafka
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/segmentio/kafka-go"
 	"github.com/sirupsen/logrus"
 )
 
 type Manager struct {
-	kafkaAdminURL string
-	logger        *logrus.Logger
+	client      *kafka.Client
+	logger      *logrus.Logger
+	deadLetters *DeadLetterQueue
 }
 
 type KafkaClusterStatus struct {
+	ClusterID      string              `json:"cluster_id"`
+	Controller     int                 `json:"controller"`
 	Brokers        []BrokerInfo        `json:"brokers"`
 	Topics         []TopicInfo         `json:"topics"`
 	ConsumerGroups []ConsumerGroupInfo `json:"consumer_groups"`
@@ -22,63 +30,354 @@ type BrokerInfo struct {
 	ID   int    `json:"id"`
 	Host string `json:"host"`
 	Port int    `json:"port"`
+	Rack string `json:"rack,omitempty"`
 }
 
 type TopicInfo struct {
 	Name       string `json:"name"`
 	Partitions int    `json:"partitions"`
-	Messages   int64  `json:"messages"`
+	// Messages currently retained, summed over partitions
+	Messages      int64           `json:"messages"`
+	Lag           int64           `json:"lag"`
+	PartitionInfo []PartitionInfo `json:"partition_info"`
+}
+
+type PartitionInfo struct {
+	ID            int    `json:"id"`
+	Leader        int    `json:"leader"`
+	Replicas      []int  `json:"replicas"`
+	ISR           []int  `json:"isr"`
+	FirstOffset   int64  `json:"first_offset"`
+	HighWatermark int64  `json:"high_watermark"`
+	Error         string `json:"error,omitempty"`
 }
 
 type ConsumerGroupInfo struct {
-	GroupID string `json:"group_id"`
-	Lag     int64  `json:"lag"`
-	Members int    `json:"members"`
+	GroupID       string               `json:"group_id"`
+	State         string               `json:"state"`
+	Lag           int64                `json:"lag"`
+	Members       int                  `json:"members"`
+	MemberInfo    []GroupMemberInfo    `json:"member_info"`
+	PartitionLags []GroupPartitionInfo `json:"partition_lags"`
+}
+
+type GroupMemberInfo struct {
+	MemberID    string           `json:"member_id"`
+	ClientID    string           `json:"client_id"`
+	ClientHost  string           `json:"client_host"`
+	Assignments map[string][]int `json:"assignments"`
+}
+
+// GroupPartitionInfo is a group's progress on one partition. CommittedOffset
+// is -1 when the group never committed there; those partitions count no lag.
+type GroupPartitionInfo struct {
+	Topic           string `json:"topic"`
+	Partition       int    `json:"partition"`
+	CommittedOffset int64  `json:"committed_offset"`
+	HighWatermark   int64  `json:"high_watermark"`
+	Lag             int64  `json:"lag"`
 }
 
-func NewManager(kafkaAdminURL, _ string, logger *logrus.Logger) *Manager {
+// NewManager creates a manager for the comma-separated broker list
+func NewManager(brokers, dlqTopic string, logger *logrus.Logger) *Manager {
+	brokerList := strings.Split(brokers, ",")
+
 	return &Manager{
-		kafkaAdminURL: kafkaAdminURL,
-		logger:        logger,
+		client: &kafka.Client{
+			Addr:    kafka.TCP(brokerList...),
+			Timeout: 10 * time.Second,
+		},
+		logger:      logger,
+		deadLetters: NewDeadLetterQueue(brokerList, dlqTopic, logger),
 	}
 }
 
+// DeadLetters returns the dead-letter queue of the Zeek consumer
+func (m *Manager) DeadLetters() *DeadLetterQueue {
+	return m.deadLetters
+}
+
 func (m *Manager) GetKafkaStatus(ctx context.Context) (*KafkaClusterStatus, error) {
-	// Return mock status for now
-	// In production, this should query Kafka Admin API
+	meta, err := m.client.Metadata(ctx, &kafka.MetadataRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch cluster metadata: %w", err)
+	}
+
 	status := &KafkaClusterStatus{
-		Brokers: []BrokerInfo{
-			{
-				ID:   0,
-				Host: "localhost",
-				Port: 9092,
-			},
-		},
-		Topics: []TopicInfo{
-			{
-				Name:       "zeek-logs",
-				Partitions: 8,
-				Messages:   0,
-			},
-			{
-				Name:       "nta-alerts",
-				Partitions: 8,
-				Messages:   0,
-			},
-		},
-		ConsumerGroups: []ConsumerGroupInfo{
-			{
-				GroupID: "nta-consumer-group",
-				Lag:     0,
-				Members: 1,
-			},
-		},
-		Health: "healthy",
+		ClusterID:  meta.ClusterID,
+		Controller: meta.Controller.ID,
+		Health:     "healthy",
+	}
+
+	for _, b := range meta.Brokers {
+		status.Brokers = append(status.Brokers, BrokerInfo{ID: b.ID, Host: b.Host, Port: b.Port, Rack: b.Rack})
+	}
+	sort.Slice(status.Brokers, func(i, j int) bool {
+		return status.Brokers[i].ID < status.Brokers[j].ID
+	})
+
+	status.Topics, err = m.topicInfo(ctx, meta.Topics)
+	if err != nil {
+		return nil, err
+	}
+
+	// A partition without an in-sync leader can't be produced to or consumed
+	for _, topic := range status.Topics {
+		for _, p := range topic.PartitionInfo {
+			if p.Error != "" || p.Leader < 0 || len(p.ISR) < len(p.Replicas) {
+				status.Health = "degraded"
+			}
+		}
+	}
+
+	status.ConsumerGroups, err = m.ListConsumerGroups(ctx)
+	if err != nil {
+		m.logger.Warnf("Failed to list consumer groups: %v", err)
+		status.Health = "degraded"
 	}
 
 	return status, nil
 }
 
+// ListTopics returns every non-internal topic with its partition offsets
+func (m *Manager) ListTopics(ctx context.Context) ([]TopicInfo, error) {
+	meta, err := m.client.Metadata(ctx, &kafka.MetadataRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch cluster metadata: %w", err)
+	}
+
+	return m.topicInfo(ctx, meta.Topics)
+}
+
+// ListConsumerGroups describes every consumer group with its lag
+func (m *Manager) ListConsumerGroups(ctx context.Context) ([]ConsumerGroupInfo, error) {
+	resp, err := m.client.ListGroups(ctx, &kafka.ListGroupsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+
+	groupIDs := make([]string, 0, len(resp.Groups))
+	for _, g := range resp.Groups {
+		groupIDs = append(groupIDs, g.GroupID)
+	}
+	sort.Strings(groupIDs)
+
+	return m.describeGroups(ctx, groupIDs)
+}
+
+// GetConsumerGroup describes one consumer group with its lag
+func (m *Manager) GetConsumerGroup(ctx context.Context, groupID string) (*ConsumerGroupInfo, error) {
+	groups, err := m.describeGroups(ctx, []string{groupID})
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("consumer group %s not found", groupID)
+	}
+	return &groups[0], nil
+}
+
+// GetTopicLag returns how far groupID is behind on topic
 func (m *Manager) GetTopicLag(ctx context.Context, topic, groupID string) (int64, error) {
-	return 0, nil
-}
\ No newline at end of file
+	group, err := m.GetConsumerGroup(ctx, groupID)
+	if err != nil {
+		return 0, err
+	}
+
+	var lag int64
+	for _, p := range group.PartitionLags {
+		if p.Topic == topic {
+			lag += p.Lag
+		}
+	}
+	return lag, nil
+}
+
+func (m *Manager) topicInfo(ctx context.Context, topics []kafka.Topic) ([]TopicInfo, error) {
+	offsets, err := partitionOffsets(ctx, m.client, topics)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []TopicInfo
+	for _, topic := range topics {
+		if topic.Internal || strings.HasPrefix(topic.Name, "__") {
+			continue
+		}
+
+		info := TopicInfo{Name: topic.Name, Partitions: len(topic.Partitions)}
+		for _, p := range topic.Partitions {
+			pi := PartitionInfo{ID: p.ID, Leader: p.Leader.ID, Replicas: brokerIDs(p.Replicas), ISR: brokerIDs(p.Isr)}
+			if p.Error != nil {
+				pi.Error = p.Error.Error()
+			}
+
+			if po, ok := offsets[topic.Name][p.ID]; ok {
+				pi.FirstOffset = po.FirstOffset
+				pi.HighWatermark = po.LastOffset
+				if po.Error != nil {
+					pi.Error = po.Error.Error()
+				}
+				info.Messages += po.LastOffset - po.FirstOffset
+			}
+			info.PartitionInfo = append(info.PartitionInfo, pi)
+		}
+		sort.Slice(info.PartitionInfo, func(i, j int) bool {
+			return info.PartitionInfo[i].ID < info.PartitionInfo[j].ID
+		})
+
+		result = append(result, info)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// partitionOffsets returns the first offset and high watermark of every
+// partition, keyed by topic and partition
+func partitionOffsets(ctx context.Context, client *kafka.Client, topics []kafka.Topic) (map[string]map[int]kafka.PartitionOffsets, error) {
+	req := &kafka.ListOffsetsRequest{Topics: make(map[string][]kafka.OffsetRequest)}
+	for _, topic := range topics {
+		if topic.Internal {
+			continue
+		}
+		for _, p := range topic.Partitions {
+			req.Topics[topic.Name] = append(req.Topics[topic.Name], kafka.FirstOffsetOf(p.ID), kafka.LastOffsetOf(p.ID))
+		}
+	}
+
+	result := make(map[string]map[int]kafka.PartitionOffsets)
+	if len(req.Topics) == 0 {
+		return result, nil
+	}
+
+	resp, err := client.ListOffsets(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list offsets: %w", err)
+	}
+
+	for topic, partitions := range resp.Topics {
+		result[topic] = make(map[int]kafka.PartitionOffsets, len(partitions))
+		for _, p := range partitions {
+			result[topic][p.Partition] = p
+		}
+	}
+	return result, nil
+}
+
+func (m *Manager) describeGroups(ctx context.Context, groupIDs []string) ([]ConsumerGroupInfo, error) {
+	if len(groupIDs) == 0 {
+		return []ConsumerGroupInfo{}, nil
+	}
+
+	resp, err := m.client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: groupIDs})
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := m.client.Metadata(ctx, &kafka.MetadataRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch cluster metadata: %w", err)
+	}
+	offsets, err := partitionOffsets(ctx, m.client, meta.Topics)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ask for every topic: a group with no members has no assignments but
+	// can still have committed offsets
+	allPartitions := make(map[string][]int)
+	for _, topic := range meta.Topics {
+		if topic.Internal {
+			continue
+		}
+		for _, p := range topic.Partitions {
+			allPartitions[topic.Name] = append(allPartitions[topic.Name], p.ID)
+		}
+	}
+
+	groups := make([]ConsumerGroupInfo, 0, len(resp.Groups))
+	for _, g := range resp.Groups {
+		if g.Error != nil {
+			m.logger.Warnf("Failed to describe consumer group %s: %v", g.GroupID, g.Error)
+			continue
+		}
+		if g.GroupState == "Dead" {
+			continue
+		}
+
+		info := ConsumerGroupInfo{
+			GroupID: g.GroupID,
+			State:   g.GroupState,
+			Members: len(g.Members),
+		}
+
+		for _, member := range g.Members {
+			mi := GroupMemberInfo{
+				MemberID:    member.MemberID,
+				ClientID:    member.ClientID,
+				ClientHost:  member.ClientHost,
+				Assignments: make(map[string][]int),
+			}
+			for _, t := range member.MemberAssignments.Topics {
+				mi.Assignments[t.Topic] = t.Partitions
+			}
+			info.MemberInfo = append(info.MemberInfo, mi)
+		}
+
+		committed, err := m.client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: g.GroupID, Topics: allPartitions})
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch offsets for group %s: %w", g.GroupID, err)
+		}
+		if committed.Error != nil {
+			return nil, fmt.Errorf("failed to fetch offsets for group %s: %w", g.GroupID, committed.Error)
+		}
+
+		for topic, partitions := range committed.Topics {
+			for _, p := range partitions {
+				if p.CommittedOffset < 0 {
+					continue
+				}
+
+				hw := offsets[topic][p.Partition].LastOffset
+				lag := hw - p.CommittedOffset
+				if lag < 0 {
+					lag = 0
+				}
+
+				info.PartitionLags = append(info.PartitionLags, GroupPartitionInfo{
+					Topic:           topic,
+					Partition:       p.Partition,
+					CommittedOffset: p.CommittedOffset,
+					HighWatermark:   hw,
+					Lag:             lag,
+				})
+				info.Lag += lag
+			}
+		}
+		sort.Slice(info.PartitionLags, func(i, j int) bool {
+			a, b := info.PartitionLags[i], info.PartitionLags[j]
+			if a.Topic != b.Topic {
+				return a.Topic < b.Topic
+			}
+			return a.Partition < b.Partition
+		})
+
+		groups = append(groups, info)
+	}
+
+	return groups, nil
+}
+
+func brokerIDs(brokers []kafka.Broker) []int {
+	ids := make([]int, 0, len(brokers))
+	for _, b := range brokers {
+		ids = append(ids, b.ID)
+	}
+	return ids
+}
@@ -0,0 +1,384 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/internal/detector"
+	"github.com/Cxiyuan/NTA/internal/encryption"
+	"github.com/Cxiyuan/NTA/internal/zeek"
+	"github.com/Cxiyuan/NTA/pkg/metrics"
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/Cxiyuan/NTA/pkg/recency"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// tlsAlertWindow suppresses repeated TLS alerts of the same finding
+const tlsAlertWindow = time.Hour
+
+// maxTLSAlertKeys bounds the suppression state; the least recently
+// alerted keys are evicted first
+const maxTLSAlertKeys = 100000
+
+// certRecheckWindow is how long before its certificate a handshake is
+// still analyzed when the certificate arrives after it
+const certRecheckWindow = time.Hour
+
+// maxCertRecheck bounds the handshakes rechecked per certificate
+const maxCertRecheck = 1000
+
+// maxUncheckedCerts bounds the certificate fingerprints remembered for
+// handshakes processed before their certificate
+const maxUncheckedCerts = 100000
+
+// tlsServerAnomalies are server configuration findings, raised once per
+// server rather than for every client
+var tlsServerAnomalies = map[string]bool{
+	"outdated_tls_version": true,
+	"weak_cipher":          true,
+}
+
+// tlsCertificateAnomalies are certificate findings, raised once per
+// certificate wherever it is served
+var tlsCertificateAnomalies = map[string]bool{
+	"malicious_certificate":         true,
+	"self_signed_certificate":       true,
+	"expired_certificate":           true,
+	"certificate_not_yet_valid":     true,
+	"short_validity_certificate":    true,
+	"new_certificate":               true,
+	"suspicious_certificate_issuer": true,
+}
+
+// Processor runs detection on Zeek records and stores the results. It is
+// shared by the Kafka consumer and the Zeek log tailer.
+type Processor struct {
+	db         *gorm.DB
+	logger     *logrus.Logger
+	detectors  *detector.Registry
+	tls        *encryption.Analyzer
+	flows      *encryption.FlowClassifier
+	alerts     *BatchWriter[models.Alert]
+	conns      *BatchWriter[models.Connection]
+	handshakes *BatchWriter[models.TLSHandshake]
+
+	mu         sync.Mutex
+	tlsAlerted map[string]time.Time
+	tlsOrder   *recency.List[string]
+	// unchecked holds the latest time a handshake referenced each
+	// certificate that was not seen yet, so only those certificates
+	// trigger a recheck
+	unchecked      map[string]time.Time
+	uncheckedOrder *recency.List[string]
+}
+
+// NewProcessor creates a new record processor analyzing TLS handshakes
+// and certificates with tls
+func NewProcessor(db *gorm.DB, logger *logrus.Logger, detectors *detector.Registry, tls *encryption.Analyzer) *Processor {
+	return &Processor{
+		db:         db,
+		logger:     logger,
+		detectors:  detectors,
+		tls:        tls,
+		alerts:     NewBatchWriter[models.Alert](db, "alerts", DefaultWriterConfig(), logger),
+		conns:      NewBatchWriter[models.Connection](db, "connections", DefaultWriterConfig(), logger),
+		handshakes: NewBatchWriter[models.TLSHandshake](db, "tls_handshakes", DefaultWriterConfig(), logger),
+		tlsAlerted: make(map[string]time.Time),
+		tlsOrder:   recency.New[string](),
+
+		unchecked:      make(map[string]time.Time),
+		uncheckedOrder: recency.New[string](),
+	}
+}
+
+// Close flushes buffered alerts, connections and handshakes
+func (p *Processor) Close() {
+	p.alerts.Close()
+	p.conns.Close()
+	p.handshakes.Close()
+}
+
+// Sync returns once the rows of every record processed before the call are
+// stored
+func (p *Processor) Sync(ctx context.Context) error {
+	if err := p.alerts.Sync(ctx); err != nil {
+		return err
+	}
+	if err := p.conns.Sync(ctx); err != nil {
+		return err
+	}
+	return p.handshakes.Sync(ctx)
+}
+
+// SetFlowClassifier classifies the packet sequences logged with conn
+// records and adjusts alert confidence by flow class
+func (p *Processor) SetFlowClassifier(flows *encryption.FlowClassifier) {
+	p.flows = flows
+}
+
+// Handles reports whether Process does anything with logType
+func (p *Processor) Handles(logType string) bool {
+	switch logType {
+	case "conn", "ssl", "x509":
+		return true
+	}
+	return p.detectors.Handles(logType)
+}
+
+// Process handles one Zeek JSON record of the given log type (conn, dns, ...)
+func (p *Processor) Process(ctx context.Context, logType string, data []byte) error {
+	if !p.Handles(logType) {
+		p.logger.Debugf("Ignoring unsupported log type: %s", logType)
+		return nil
+	}
+	defer observeSince(metrics.RecordProcessingDuration.WithLabelValues(logType), time.Now())
+
+	rec, ok := zeek.NewRecord(logType)
+	if !ok {
+		p.logger.Debugf("Ignoring unsupported log type: %s", logType)
+		return nil
+	}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return err
+	}
+
+	// Detection windows run on record time so lagging or replayed logs are
+	// judged as they happened
+	ev := &detector.Event{LogType: logType, Record: rec, Timestamp: recordTime(rec)}
+	if connRec, ok := rec.(*zeek.ConnRecord); ok {
+		ev.Conn = connRec.Connection()
+		// Classify first so alerts on this connection are adjusted
+		if p.flows != nil && len(connRec.SPLTLengths) > 0 {
+			p.flows.Observe(flowSample(connRec))
+		}
+	}
+
+	for _, alert := range p.detectors.Inspect(ctx, ev) {
+		if err := p.emitAlert(ctx, alert); err != nil {
+			return err
+		}
+	}
+
+	switch r := rec.(type) {
+	case *zeek.SSLRecord:
+		return p.ProcessHandshake(ctx, r.Handshake())
+	case *zeek.X509Record:
+		// Zeek logs a certificate once a day, so it is kept for the
+		// handshakes that reference it later
+		cert := r.Certificate()
+		server, err := p.tls.ObserveCertificate(ctx, cert)
+		if err != nil || !server || !p.takeUnchecked(cert) {
+			return err
+		}
+		return p.recheckHandshakes(ctx, cert)
+	}
+
+	if ev.Conn != nil {
+		return p.conns.Write(ctx, ev.Conn)
+	}
+	return nil
+}
+
+// ProcessHandshake analyzes a TLS handshake, raises alerts for its
+// significant anomalies and stores it
+func (p *Processor) ProcessHandshake(ctx context.Context, hs *models.TLSHandshake) error {
+	if hs.Timestamp.IsZero() {
+		hs.Timestamp = time.Now()
+	}
+
+	anomalies := p.tls.AnalyzeTLS(hs)
+	types := make([]string, 0, len(anomalies))
+	for _, anomaly := range anomalies {
+		types = append(types, anomaly.Type)
+		if !anomaly.Alertable() || !p.shouldAlertTLS(tlsAlertKey(anomaly.Type, hs), hs.Timestamp) {
+			continue
+		}
+		if err := p.emitAlert(ctx, anomaly.Alert(hs)); err != nil {
+			return err
+		}
+	}
+	hs.Anomalies = strings.Join(types, ",")
+	if !hs.CertChecked && hs.CertFingerprint != "" {
+		p.noteUnchecked(hs.CertFingerprint, hs.Timestamp)
+	}
+
+	return p.handshakes.Write(ctx, hs)
+}
+
+// noteUnchecked remembers that a handshake at ts referenced a certificate
+// that was not seen yet
+func (p *Processor) noteUnchecked(fingerprint string, ts time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if last, ok := p.unchecked[fingerprint]; ok {
+		if ts.After(last) {
+			p.unchecked[fingerprint] = ts
+		}
+		p.uncheckedOrder.Touch(fingerprint)
+		return
+	}
+	if len(p.unchecked) >= maxUncheckedCerts {
+		if oldest, ok := p.uncheckedOrder.Oldest(); ok {
+			delete(p.unchecked, oldest)
+			p.uncheckedOrder.Remove(oldest)
+		}
+	}
+	p.unchecked[fingerprint] = ts
+	p.uncheckedOrder.Touch(fingerprint)
+}
+
+// takeUnchecked reports whether handshakes within certRecheckWindow of the
+// certificate were processed without it, and forgets them
+func (p *Processor) takeUnchecked(cert *models.Certificate) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	last, ok := p.unchecked[cert.Fingerprint]
+	if !ok {
+		return false
+	}
+	delete(p.unchecked, cert.Fingerprint)
+	p.uncheckedOrder.Remove(cert.Fingerprint)
+	return cert.LastSeen.IsZero() || !last.Before(cert.LastSeen.Add(-certRecheckWindow))
+}
+
+// recheckHandshakes analyzes a certificate for the stored handshakes that
+// referenced it before it was seen, as when x509 and ssl records are
+// consumed from different partitions. It is only called for certificates
+// a handshake processed here is waiting for, so the flush of queued
+// handshakes it forces stays rare.
+func (p *Processor) recheckHandshakes(ctx context.Context, cert *models.Certificate) error {
+	// Handshakes processed here may still be queued
+	if err := p.handshakes.Sync(ctx); err != nil {
+		return err
+	}
+
+	seen := cert.LastSeen
+	if seen.IsZero() {
+		seen = time.Now()
+	}
+	var pending []models.TLSHandshake
+	err := p.db.WithContext(ctx).
+		Where("cert_fingerprint = ? AND cert_checked = ? AND timestamp >= ?", cert.Fingerprint, false, seen.Add(-certRecheckWindow)).
+		Limit(maxCertRecheck).
+		Find(&pending).Error
+	if err != nil {
+		return fmt.Errorf("failed to load handshakes of certificate %s: %w", cert.Fingerprint, err)
+	}
+
+	for i := range pending {
+		hs := &pending[i]
+		types := make([]string, 0)
+		if hs.Anomalies != "" {
+			types = strings.Split(hs.Anomalies, ",")
+		}
+		for _, anomaly := range p.tls.AnalyzeCertificate(cert, hs.ServerName, hs.Timestamp) {
+			types = append(types, anomaly.Type)
+			if !anomaly.Alertable() || !p.shouldAlertTLS(tlsAlertKey(anomaly.Type, hs), hs.Timestamp) {
+				continue
+			}
+			if err := p.emitAlert(ctx, anomaly.Alert(hs)); err != nil {
+				return err
+			}
+		}
+
+		err := p.db.WithContext(ctx).Model(hs).Updates(map[string]interface{}{
+			"anomalies":    strings.Join(types, ","),
+			"cert_checked": true,
+		}).Error
+		if err != nil {
+			return fmt.Errorf("failed to update handshake %d: %w", hs.ID, err)
+		}
+	}
+	return nil
+}
+
+// tlsAlertKey identifies the finding an anomaly of a handshake reports.
+// Certificate findings belong to the certificate, name mismatches to the
+// certificate and server name, server configuration findings to the
+// server, and fingerprint matches to the client and server.
+func tlsAlertKey(anomalyType string, hs *models.TLSHandshake) string {
+	switch {
+	case tlsCertificateAnomalies[anomalyType]:
+		return fmt.Sprintf("%s|%s", anomalyType, hs.CertFingerprint)
+	case anomalyType == "certificate_name_mismatch":
+		return fmt.Sprintf("%s|%s|%s", anomalyType, hs.CertFingerprint, hs.ServerName)
+	case tlsServerAnomalies[anomalyType]:
+		return fmt.Sprintf("%s|%s:%d", anomalyType, hs.DstIP, hs.DstPort)
+	}
+	return fmt.Sprintf("%s|%s|%s|%s", anomalyType, hs.SrcIP, hs.DstIP, hs.ServerName)
+}
+
+// shouldAlertTLS reports whether the finding with the given key was not
+// raised within tlsAlertWindow of ts
+func (p *Processor) shouldAlertTLS(key string, ts time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if last, ok := p.tlsAlerted[key]; ok && ts.Sub(last) < tlsAlertWindow {
+		return false
+	}
+	if _, exists := p.tlsAlerted[key]; !exists && len(p.tlsAlerted) >= maxTLSAlertKeys {
+		if oldest, ok := p.tlsOrder.Oldest(); ok {
+			delete(p.tlsAlerted, oldest)
+			p.tlsOrder.Remove(oldest)
+		}
+	}
+	p.tlsAlerted[key] = ts
+	p.tlsOrder.Touch(key)
+	return true
+}
+
+// emitAlert queues an alert for storage and counts it
+func (p *Processor) emitAlert(ctx context.Context, alert *models.Alert) error {
+	if p.flows != nil {
+		p.flows.Adjust(alert)
+	}
+	if err := p.alerts.Write(ctx, alert); err != nil {
+		return err
+	}
+	metrics.AlertsTotal.WithLabelValues(alert.Severity, alert.Type).Inc()
+	return nil
+}
+
+// recordTime returns the Zeek ts of a record, or the current time if it
+// has none
+func recordTime(rec interface{}) time.Time {
+	if r, ok := rec.(zeek.Timestamped); ok && !r.Timestamp().IsZero() {
+		return r.Timestamp()
+	}
+	return time.Now()
+}
+
+// flowSample builds a flow sample from the packet sequence of a conn
+// record. Zeek does not log payload bytes or the ClientHello, so those
+// features stay unset.
+func flowSample(r *zeek.ConnRecord) *encryption.FlowSample {
+	sample := &encryption.FlowSample{
+		SrcIP:   r.OrigH,
+		DstIP:   r.RespH,
+		SrcPort: r.OrigP,
+		DstPort: r.RespP,
+		Proto:   r.Proto,
+		Start:   r.TS.Time,
+		Packets: make([]encryption.FlowPacket, len(r.SPLTLengths)),
+	}
+	for i, length := range r.SPLTLengths {
+		sample.Packets[i].Length = length
+		if i > 0 && i < len(r.SPLTGaps) {
+			sample.Packets[i].Gap = time.Duration(r.SPLTGaps[i] * float64(time.Second))
+		}
+	}
+	return sample
+}
+
+func observeSince(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,275 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Cxiyuan/NTA/pkg/metrics"
+	"github.com/Cxiyuan/NTA/pkg/retry"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var errWriterClosed = errors.New("writer closed")
+
+// WriterConfig controls batching for BatchWriter
+type WriterConfig struct {
+	BatchSize     int
+	FlushInterval time.Duration
+	// QueueSize bounds the rows waiting to be written. Write blocks while
+	// the queue is full, pushing back on the caller.
+	QueueSize int
+	Retry     retry.Config
+}
+
+// DefaultWriterConfig returns the default batching settings
+func DefaultWriterConfig() WriterConfig {
+	return WriterConfig{
+		BatchSize:     500,
+		FlushInterval: time.Second,
+		QueueSize:     10000,
+		Retry:         retry.DefaultConfig(),
+	}
+}
+
+// BatchWriter buffers rows for one table and inserts them with
+// CreateInBatches when the batch is full or the flush interval passes.
+// Failed batches are retried until they are written, so a database outage
+// blocks Write instead of losing rows; rows are only dropped when the
+// database is still unavailable at Close. Batches the database rejects
+// outright, such as on a constraint violation, are split until the bad
+// rows are found, and only those rows are dropped.
+type BatchWriter[T any] struct {
+	db     *gorm.DB
+	table  string
+	config WriterConfig
+	logger *logrus.Logger
+
+	queue    chan *T
+	syncs    chan chan error
+	stopping chan struct{}
+	done     chan struct{}
+	mu       sync.RWMutex
+	closed   bool
+	// failed is set once a batch was dropped during Close, so the rest of
+	// the queue is not retried
+	failed bool
+}
+
+// NewBatchWriter creates a writer and starts its flush loop. table is only
+// used as the metrics label.
+func NewBatchWriter[T any](db *gorm.DB, table string, config WriterConfig, logger *logrus.Logger) *BatchWriter[T] {
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = time.Second
+	}
+	if config.QueueSize < 0 {
+		config.QueueSize = 0
+	}
+
+	w := &BatchWriter[T]{
+		db:       db,
+		table:    table,
+		config:   config,
+		logger:   logger,
+		queue:    make(chan *T, config.QueueSize),
+		syncs:    make(chan chan error),
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+
+	return w
+}
+
+// Write queues a row, blocking while the queue is full
+func (w *BatchWriter[T]) Write(ctx context.Context, row *T) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		metrics.DBRowsDropped.WithLabelValues(w.table, "closed").Inc()
+		return errWriterClosed
+	}
+
+	select {
+	case w.queue <- row:
+		metrics.DBWriteQueueLength.WithLabelValues(w.table).Set(float64(len(w.queue)))
+		return nil
+	case <-ctx.Done():
+		metrics.DBRowsDropped.WithLabelValues(w.table, "cancelled").Inc()
+		return ctx.Err()
+	}
+}
+
+// Sync returns once every row queued before the call is written. Callers
+// that acknowledge their input, like the Kafka consumer committing
+// offsets, sync first so acknowledged rows cannot be lost.
+func (w *BatchWriter[T]) Sync(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case w.syncs <- reply:
+	case <-w.done:
+		return errWriterClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close flushes queued rows and stops the writer
+func (w *BatchWriter[T]) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+		close(w.stopping)
+	}
+	w.mu.Unlock()
+
+	<-w.done
+}
+
+func (w *BatchWriter[T]) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*T, 0, w.config.BatchSize)
+	for {
+		select {
+		case row, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, row)
+			if len(batch) >= w.config.BatchSize {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			w.flush(batch)
+			batch = batch[:0]
+		case reply := <-w.syncs:
+			batch = w.drain(batch)
+			reply <- w.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// drain moves the rows already queued into the batch, flushing full ones
+func (w *BatchWriter[T]) drain(batch []*T) []*T {
+	for {
+		select {
+		case row, ok := <-w.queue:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, row)
+			if len(batch) >= w.config.BatchSize {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		default:
+			return batch
+		}
+	}
+}
+
+// flush writes a batch, retrying until it succeeds or the writer is closed
+func (w *BatchWriter[T]) flush(batch []*T) error {
+	metrics.DBWriteQueueLength.WithLabelValues(w.table).Set(float64(len(w.queue)))
+	if len(batch) == 0 {
+		return nil
+	}
+
+	for {
+		err := errWriterClosed
+		if !w.failed {
+			err = w.write(batch)
+		}
+		if err == nil {
+			metrics.DBRowsWritten.WithLabelValues(w.table).Add(float64(len(batch)))
+			return nil
+		}
+		if retry.IsPermanent(err) {
+			w.isolate(batch, err)
+			return nil
+		}
+
+		select {
+		case <-w.stopping:
+			w.failed = true
+			metrics.DBRowsDropped.WithLabelValues(w.table, "write_failed").Add(float64(len(batch)))
+			w.logger.Errorf("Dropping %d %s rows at shutdown: %v", len(batch), w.table, err)
+			return err
+		default:
+		}
+
+		w.logger.Errorf("Failed to write %d %s rows, retrying: %v", len(batch), w.table, err)
+		select {
+		case <-w.stopping:
+		case <-time.After(w.config.Retry.MaxDelay):
+		}
+	}
+}
+
+// isolate splits a rejected batch in half and flushes each half on its
+// own, dropping single rows the database still rejects
+func (w *BatchWriter[T]) isolate(batch []*T, err error) {
+	if len(batch) == 1 {
+		metrics.DBRowsDropped.WithLabelValues(w.table, "write_failed").Inc()
+		w.logger.Errorf("Dropping %s row rejected by the database: %v", w.table, err)
+		return
+	}
+
+	mid := len(batch) / 2
+	w.flush(batch[:mid])
+	w.flush(batch[mid:])
+}
+
+// write makes one round of insert attempts
+func (w *BatchWriter[T]) write(batch []*T) error {
+	start := time.Now()
+	// Flushes also run during shutdown, so they don't share the caller's context
+	err := retry.Do(context.Background(), w.config.Retry, w.logger, func() error {
+		err := w.db.CreateInBatches(batch, w.config.BatchSize).Error
+		if isPermanentWriteError(err) {
+			return retry.Permanent(err)
+		}
+		return err
+	})
+	metrics.DBFlushDuration.WithLabelValues(w.table, strconv.FormatBool(err == nil)).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// isPermanentWriteError reports whether the database rejected the rows
+// themselves, so writing them again cannot succeed. Data exceptions, like
+// a value too long for its column, and integrity constraint violations
+// are permanent; connection and resource errors are not.
+func isPermanentWriteError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	switch pgErr.Code[:min(2, len(pgErr.Code))] {
+	case "22", "23":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapng files start with a Section Header Block
+const pcapngMagic = 0x0A0D0D0A
+
+// Capture is an open pcap or pcapng file
+type Capture struct {
+	Source   *gopacket.PacketSource
+	LinkType layers.LinkType
+	file     *os.File
+}
+
+// OpenCapture opens a pcap or pcapng file, detected by its magic number
+func OpenCapture(path string) (*Capture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	magic, err := reader.Peek(4)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read capture header: %w", err)
+	}
+
+	var source gopacket.PacketDataSource
+	var linkType layers.LinkType
+	if binary.LittleEndian.Uint32(magic) == pcapngMagic {
+		ng, err := pcapgo.NewNgReader(reader, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to open pcapng: %w", err)
+		}
+		source, linkType = ng, ng.LinkType()
+	} else {
+		pr, err := pcapgo.NewReader(reader)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to open pcap: %w", err)
+		}
+		source, linkType = pr, pr.LinkType()
+	}
+
+	packetSource := gopacket.NewPacketSource(source, linkType)
+	packetSource.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	return &Capture{Source: packetSource, LinkType: linkType, file: file}, nil
+}
+
+// Close closes the capture file
+func (c *Capture) Close() error {
+	return c.file.Close()
+}
@@ -0,0 +1,283 @@
+package replay
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/Cxiyuan/NTA/pkg/models"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	tcpIdleTimeout    = 5 * time.Minute
+	udpIdleTimeout    = 1 * time.Minute
+	closedFlowLinger  = 5 * time.Second
+	flowSweepInterval = 10 * time.Second
+)
+
+// flowKey identifies a flow in originator -> responder orientation
+type flowKey struct {
+	proto   string
+	srcIP   string
+	dstIP   string
+	srcPort int
+	dstPort int
+}
+
+func (k flowKey) reverse() flowKey {
+	return flowKey{
+		proto:   k.proto,
+		srcIP:   k.dstIP,
+		dstIP:   k.srcIP,
+		srcPort: k.dstPort,
+		dstPort: k.srcPort,
+	}
+}
+
+// flow holds the state of a single reconstructed connection
+type flow struct {
+	key       flowKey
+	start     time.Time
+	last      time.Time
+	origBytes int64
+	respBytes int64
+	origPkts  int64
+	respPkts  int64
+
+	origSyn    bool
+	respSynAck bool
+	origFin    bool
+	respFin    bool
+	origRst    bool
+	respRst    bool
+}
+
+// FlowTable reconstructs Zeek-style connection records from raw packets
+type FlowTable struct {
+	flows     map[flowKey]*flow
+	onFlow    func(*models.Connection)
+	lastSweep time.Time
+}
+
+// NewFlowTable creates a flow table that invokes onFlow for every finished connection
+func NewFlowTable(onFlow func(*models.Connection)) *FlowTable {
+	return &FlowTable{
+		flows:  make(map[flowKey]*flow),
+		onFlow: onFlow,
+	}
+}
+
+// Add accounts a packet to its flow, creating the flow if needed
+func (t *FlowTable) Add(packet gopacket.Packet) {
+	ts := packet.Metadata().Timestamp
+
+	var srcIP, dstIP string
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		srcIP, dstIP = ip.SrcIP.String(), ip.DstIP.String()
+	case *layers.IPv6:
+		srcIP, dstIP = ip.SrcIP.String(), ip.DstIP.String()
+	default:
+		return
+	}
+
+	key := flowKey{srcIP: srcIP, dstIP: dstIP}
+	var payloadLen int
+	var tcp *layers.TCP
+
+	switch l := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		tcp = l
+		key.proto = "tcp"
+		key.srcPort, key.dstPort = int(l.SrcPort), int(l.DstPort)
+		payloadLen = len(l.Payload)
+	case *layers.UDP:
+		key.proto = "udp"
+		key.srcPort, key.dstPort = int(l.SrcPort), int(l.DstPort)
+		payloadLen = len(l.Payload)
+	default:
+		// Zeek reports ICMP type/code in the port fields
+		if icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+			key.proto = "icmp"
+			key.srcPort, key.dstPort = int(icmp.TypeCode.Type()), int(icmp.TypeCode.Code())
+			payloadLen = len(icmp.Payload)
+		} else if icmp6, ok := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+			key.proto = "icmp"
+			key.srcPort, key.dstPort = int(icmp6.TypeCode.Type()), int(icmp6.TypeCode.Code())
+			payloadLen = len(icmp6.Payload)
+		} else {
+			return
+		}
+	}
+
+	t.sweep(ts)
+
+	f, fromOrig := t.lookup(key)
+	if f == nil {
+		// A SYN-ACK as the first packet means we missed the SYN, so the
+		// sender is the responder
+		if tcp != nil && tcp.SYN && tcp.ACK {
+			key = key.reverse()
+			fromOrig = false
+		} else {
+			fromOrig = true
+		}
+		f = &flow{key: key, start: ts}
+		t.flows[key] = f
+	}
+
+	f.last = ts
+	if fromOrig {
+		f.origPkts++
+		f.origBytes += int64(payloadLen)
+	} else {
+		f.respPkts++
+		f.respBytes += int64(payloadLen)
+	}
+
+	if tcp != nil {
+		if fromOrig {
+			f.origSyn = f.origSyn || (tcp.SYN && !tcp.ACK)
+			f.origFin = f.origFin || tcp.FIN
+			f.origRst = f.origRst || tcp.RST
+		} else {
+			f.respSynAck = f.respSynAck || (tcp.SYN && tcp.ACK)
+			f.respFin = f.respFin || tcp.FIN
+			f.respRst = f.respRst || tcp.RST
+		}
+	}
+}
+
+// Flush emits all remaining flows, typically at end of capture
+func (t *FlowTable) Flush() {
+	for key, f := range t.flows {
+		t.emit(key, f)
+	}
+}
+
+// Len returns the number of active flows
+func (t *FlowTable) Len() int {
+	return len(t.flows)
+}
+
+func (t *FlowTable) lookup(key flowKey) (*flow, bool) {
+	if f, exists := t.flows[key]; exists {
+		return f, true
+	}
+	if f, exists := t.flows[key.reverse()]; exists {
+		return f, false
+	}
+	return nil, false
+}
+
+// sweep expires idle and closed flows based on capture time, not wall time
+func (t *FlowTable) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < flowSweepInterval {
+		return
+	}
+	t.lastSweep = now
+
+	for key, f := range t.flows {
+		idle := now.Sub(f.last)
+		switch {
+		case f.closed() && idle > closedFlowLinger:
+			t.emit(key, f)
+		case f.key.proto == "tcp" && idle > tcpIdleTimeout:
+			t.emit(key, f)
+		case f.key.proto != "tcp" && idle > udpIdleTimeout:
+			t.emit(key, f)
+		}
+	}
+}
+
+func (t *FlowTable) emit(key flowKey, f *flow) {
+	delete(t.flows, key)
+	if t.onFlow != nil {
+		t.onFlow(f.connection())
+	}
+}
+
+func (f *flow) closed() bool {
+	return f.origRst || f.respRst || (f.origFin && f.respFin)
+}
+
+// connState approximates Zeek's conn_state field
+func (f *flow) connState() string {
+	if f.key.proto != "tcp" {
+		if f.respPkts > 0 {
+			return "SF"
+		}
+		return "S0"
+	}
+
+	switch {
+	case f.origSyn && !f.respSynAck && f.respRst:
+		return "REJ"
+	case f.origSyn && !f.respSynAck && f.origFin:
+		return "SH"
+	case f.origSyn && !f.respSynAck:
+		return "S0"
+	case !f.origSyn && !f.respSynAck:
+		return "OTH"
+	case f.origRst:
+		return "RSTO"
+	case f.respRst:
+		return "RSTR"
+	case f.origFin && f.respFin:
+		return "SF"
+	default:
+		return "S1"
+	}
+}
+
+func (f *flow) connection() *models.Connection {
+	return &models.Connection{
+		UID:       f.uid(),
+		Timestamp: f.start,
+		SrcIP:     f.key.srcIP,
+		SrcPort:   f.key.srcPort,
+		DstIP:     f.key.dstIP,
+		DstPort:   f.key.dstPort,
+		Protocol:  f.key.proto,
+		Service:   guessService(f.key.proto, f.key.dstPort),
+		Duration:  f.last.Sub(f.start).Seconds(),
+		OrigBytes: f.origBytes,
+		RespBytes: f.respBytes,
+		ConnState: f.connState(),
+	}
+}
+
+// uid derives a stable Zeek-style connection UID so replays are reproducible
+func (f *flow) uid() string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%s:%d|%s:%d|%d",
+		f.key.proto, f.key.srcIP, f.key.srcPort, f.key.dstIP, f.key.dstPort, f.start.UnixNano())))
+	return "C" + hex.EncodeToString(sum[:])[:17]
+}
+
+// guessService maps well-known ports to Zeek service names. Zeek uses
+// dynamic protocol detection; port-based guessing is good enough for replay.
+func guessService(proto string, port int) string {
+	services := map[int]string{
+		22:   "ssh",
+		53:   "dns",
+		80:   "http",
+		88:   "krb",
+		135:  "dce_rpc",
+		139:  "smb",
+		389:  "ldap",
+		443:  "ssl",
+		445:  "smb",
+		3389: "rdp",
+		5985: "http",
+		8080: "http",
+		8443: "ssl",
+	}
+
+	if proto == "icmp" {
+		return ""
+	}
+	return services[port]
+}
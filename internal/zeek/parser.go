@@ -1,12 +1,10 @@
 package zeek
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
+	"io"
 	"os"
-	"path/filepath"
-	"strings"
-	"time"
 
 	"github.com/Cxiyuan/NTA/pkg/models"
 	"github.com/sirupsen/logrus"
@@ -28,139 +26,81 @@ func NewLogParser(logDir string, logger *logrus.Logger) *LogParser {
 
 // ParseConnLog parses conn.log file
 func (p *LogParser) ParseConnLog(filePath string) ([]*models.Connection, error) {
-	file, err := os.Open(filePath)
+	records, err := ParseRecords[ConnRecord](filePath, p.logger)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-
-	var conns []*models.Connection
-	scanner := bufio.NewScanner(file)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		
-		// Skip comments and headers
-		if strings.HasPrefix(line, "#") {
-			continue
-		}
 
-		conn, err := p.parseConnLine(line)
-		if err != nil {
-			p.logger.Warnf("Failed to parse conn line: %v", err)
-			continue
-		}
-
-		conns = append(conns, conn)
+	conns := make([]*models.Connection, 0, len(records))
+	for _, rec := range records {
+		conns = append(conns, rec.Connection())
 	}
 
-	return conns, scanner.Err()
+	return conns, nil
 }
 
-// parseConnLine parses a single line from conn.log
-func (p *LogParser) parseConnLine(line string) (*models.Connection, error) {
-	fields := strings.Split(line, "\t")
-	if len(fields) < 11 {
-		return nil, nil
-	}
-
-	ts, _ := time.Parse(time.RFC3339, fields[0])
-	srcPort := 0
-	dstPort := 0
-	
-	// Parse ports (simplified)
-	if len(fields) > 3 {
-		// srcPort = parseInt(fields[3])
-	}
-	if len(fields) > 5 {
-		// dstPort = parseInt(fields[5])
+// ParseSSLLog parses ssl.log file
+func (p *LogParser) ParseSSLLog(filePath string) ([]*models.TLSHandshake, error) {
+	records, err := ParseRecords[SSLRecord](filePath, p.logger)
+	if err != nil {
+		return nil, err
 	}
 
-	conn := &models.Connection{
-		UID:       fields[1],
-		Timestamp: ts,
-		SrcIP:     fields[2],
-		SrcPort:   srcPort,
-		DstIP:     fields[4],
-		DstPort:   dstPort,
-		Protocol:  fields[6],
-		Service:   fields[7],
+	handshakes := make([]*models.TLSHandshake, 0, len(records))
+	for _, rec := range records {
+		handshakes = append(handshakes, rec.Handshake())
 	}
 
-	return conn, nil
+	return handshakes, nil
 }
 
-// ParseSSLLog parses ssl.log file
-func (p *LogParser) ParseSSLLog(filePath string) ([]*models.TLSHandshake, error) {
+// ParseLog reads any Zeek ASCII log and invokes fn with each record.
+// Malformed lines are logged and skipped.
+func (p *LogParser) ParseLog(filePath string, fn func(logPath string, rec Record) error) error {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer file.Close()
 
-	var handshakes []*models.TLSHandshake
-	scanner := bufio.NewScanner(file)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		
-		if strings.HasPrefix(line, "#") {
-			continue
+	reader := NewTSVReader(file)
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			return nil
 		}
-
-		hs, err := p.parseSSLLine(line)
 		if err != nil {
+			var lineErr *LineError
+			if !errors.As(err, &lineErr) {
+				return err
+			}
+			p.logger.Warnf("Failed to parse %s: %v", filePath, err)
 			continue
 		}
 
-		handshakes = append(handshakes, hs)
-	}
-
-	return handshakes, scanner.Err()
-}
-
-func (p *LogParser) parseSSLLine(line string) (*models.TLSHandshake, error) {
-	fields := strings.Split(line, "\t")
-	if len(fields) < 10 {
-		return nil, nil
-	}
-
-	ts, _ := time.Parse(time.RFC3339, fields[0])
-
-	hs := &models.TLSHandshake{
-		Timestamp:  ts,
-		UID:        fields[1],
-		SrcIP:      fields[2],
-		DstIP:      fields[4],
-		Version:    fields[6],
-		ServerName: fields[9],
+		if err := fn(reader.Header().Path, rec); err != nil {
+			return err
+		}
 	}
-
-	return hs, nil
 }
 
-// WatchLogDir watches Zeek log directory for new files
-func (p *LogParser) WatchLogDir(callback func(string, string)) error {
-	// Simple implementation - scan for current logs
-	currentDir := filepath.Join(p.logDir, "current")
-	
-	files, err := os.ReadDir(currentDir)
-	if err != nil {
-		return err
-	}
-
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+// ParseRecords parses a Zeek ASCII log into typed records such as
+// ConnRecord or DNSRecord, mapping columns by the #fields header
+func ParseRecords[T any](filePath string, logger *logrus.Logger) ([]*T, error) {
+	parser := &LogParser{logger: logger}
+
+	var records []*T
+	err := parser.ParseLog(filePath, func(_ string, rec Record) error {
+		typed := new(T)
+		if err := rec.Decode(typed); err != nil {
+			logger.Warnf("Failed to decode record in %s: %v", filePath, err)
+			return nil
 		}
+		records = append(records, typed)
+		return nil
+	})
 
-		if strings.HasSuffix(file.Name(), ".log") {
-			fullPath := filepath.Join(currentDir, file.Name())
-			callback(file.Name(), fullPath)
-		}
-	}
-
-	return nil
+	return records, err
 }
 
 // ParseJSON parses JSON formatted Zeek logs
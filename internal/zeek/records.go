@@ -0,0 +1,500 @@
+package zeek
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/Cxiyuan/NTA/pkg/models"
+)
+
+// Time is a Zeek timestamp. Zeek writes epoch seconds by default and
+// ISO 8601 strings when JSON::use_json_iso8601 is set; both are accepted.
+type Time struct {
+	time.Time
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (t *Time) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return err
+		}
+		t.Time = parsed
+		return nil
+	}
+
+	epoch, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return err
+	}
+	t.Time = EpochToTime(epoch)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler using epoch seconds
+func (t Time) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return []byte(strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', 6, 64)), nil
+}
+
+// EpochToTime converts Zeek epoch seconds to time.Time, rounded to the
+// microsecond precision Zeek logs with
+func EpochToTime(epoch float64) time.Time {
+	sec, frac := math.Modf(epoch)
+	return time.Unix(int64(sec), int64(math.Round(frac*1e6))*1e3).UTC()
+}
+
+// ConnID is the connection 4-tuple shared by most Zeek logs
+type ConnID struct {
+	OrigH string `json:"id.orig_h"`
+	OrigP int    `json:"id.orig_p"`
+	RespH string `json:"id.resp_h"`
+	RespP int    `json:"id.resp_p"`
+}
+
+// ConnRecord is an entry of conn.log
+type ConnRecord struct {
+	TS  Time   `json:"ts"`
+	UID string `json:"uid"`
+	ConnID
+	Proto         string   `json:"proto"`
+	Service       string   `json:"service"`
+	Duration      float64  `json:"duration"`
+	OrigBytes     int64    `json:"orig_bytes"`
+	RespBytes     int64    `json:"resp_bytes"`
+	ConnState     string   `json:"conn_state"`
+	LocalOrig     bool     `json:"local_orig"`
+	LocalResp     bool     `json:"local_resp"`
+	MissedBytes   int64    `json:"missed_bytes"`
+	History       string   `json:"history"`
+	OrigPkts      int64    `json:"orig_pkts"`
+	OrigIPBytes   int64    `json:"orig_ip_bytes"`
+	RespPkts      int64    `json:"resp_pkts"`
+	RespIPBytes   int64    `json:"resp_ip_bytes"`
+	TunnelParents []string `json:"tunnel_parents"`
+	// SPLTLengths and SPLTGaps are the payload lengths (negative from the
+	// responder) and gaps in seconds of the first packets, logged by
+	// zeek-scripts/splt.zeek
+	SPLTLengths []int     `json:"splt_len,omitempty"`
+	SPLTGaps    []float64 `json:"splt_iat,omitempty"`
+}
+
+// Connection converts the record into the model used by the detectors
+func (r *ConnRecord) Connection() *models.Connection {
+	return &models.Connection{
+		UID:       r.UID,
+		Timestamp: r.TS.Time,
+		SrcIP:     r.OrigH,
+		SrcPort:   r.OrigP,
+		DstIP:     r.RespH,
+		DstPort:   r.RespP,
+		Protocol:  r.Proto,
+		Service:   r.Service,
+		Duration:  r.Duration,
+		OrigBytes: r.OrigBytes,
+		RespBytes: r.RespBytes,
+		ConnState: r.ConnState,
+	}
+}
+
+// DNSRecord is an entry of dns.log
+type DNSRecord struct {
+	TS  Time   `json:"ts"`
+	UID string `json:"uid"`
+	ConnID
+	Proto      string    `json:"proto"`
+	TransID    int       `json:"trans_id"`
+	RTT        float64   `json:"rtt"`
+	Query      string    `json:"query"`
+	QClass     int       `json:"qclass"`
+	QClassName string    `json:"qclass_name"`
+	QType      int       `json:"qtype"`
+	QTypeName  string    `json:"qtype_name"`
+	RCode      int       `json:"rcode"`
+	RCodeName  string    `json:"rcode_name"`
+	AA         bool      `json:"AA"`
+	TC         bool      `json:"TC"`
+	RD         bool      `json:"RD"`
+	RA         bool      `json:"RA"`
+	Z          int       `json:"Z"`
+	Answers    []string  `json:"answers"`
+	TTLs       []float64 `json:"TTLs"`
+	Rejected   bool      `json:"rejected"`
+}
+
+// HTTPRecord is an entry of http.log
+type HTTPRecord struct {
+	TS  Time   `json:"ts"`
+	UID string `json:"uid"`
+	ConnID
+	TransDepth      int      `json:"trans_depth"`
+	Method          string   `json:"method"`
+	Host            string   `json:"host"`
+	URI             string   `json:"uri"`
+	Referrer        string   `json:"referrer"`
+	Version         string   `json:"version"`
+	UserAgent       string   `json:"user_agent"`
+	Origin          string   `json:"origin"`
+	RequestBodyLen  int64    `json:"request_body_len"`
+	ResponseBodyLen int64    `json:"response_body_len"`
+	StatusCode      int      `json:"status_code"`
+	StatusMsg       string   `json:"status_msg"`
+	InfoCode        int      `json:"info_code"`
+	InfoMsg         string   `json:"info_msg"`
+	Tags            []string `json:"tags"`
+	Username        string   `json:"username"`
+	Password        string   `json:"password"`
+	Proxied         []string `json:"proxied"`
+	OrigFUIDs       []string `json:"orig_fuids"`
+	OrigFilenames   []string `json:"orig_filenames"`
+	OrigMIMETypes   []string `json:"orig_mime_types"`
+	RespFUIDs       []string `json:"resp_fuids"`
+	RespFilenames   []string `json:"resp_filenames"`
+	RespMIMETypes   []string `json:"resp_mime_types"`
+}
+
+// SSLRecord is an entry of ssl.log, including the ja3 and ja4 package
+// fields
+type SSLRecord struct {
+	TS  Time   `json:"ts"`
+	UID string `json:"uid"`
+	ConnID
+	Version            string   `json:"version"`
+	Cipher             string   `json:"cipher"`
+	Curve              string   `json:"curve"`
+	ServerName         string   `json:"server_name"`
+	Resumed            bool     `json:"resumed"`
+	LastAlert          string   `json:"last_alert"`
+	NextProtocol       string   `json:"next_protocol"`
+	Established        bool     `json:"established"`
+	SSLHistory         string   `json:"ssl_history"`
+	CertChainFPs       []string `json:"cert_chain_fps"`
+	CertChainFUIDs     []string `json:"cert_chain_fuids"`
+	ClientCertChainFPs []string `json:"client_cert_chain_fps"`
+	Subject            string   `json:"subject"`
+	Issuer             string   `json:"issuer"`
+	ClientSubject      string   `json:"client_subject"`
+	ClientIssuer       string   `json:"client_issuer"`
+	SNIMatchesCert     bool     `json:"sni_matches_cert"`
+	ValidationStatus   string   `json:"validation_status"`
+	JA3                string   `json:"ja3"`
+	JA3S               string   `json:"ja3s"`
+	JA4                string   `json:"ja4"`
+	JA4S               string   `json:"ja4s"`
+}
+
+// Handshake converts the record into the TLS handshake model
+func (r *SSLRecord) Handshake() *models.TLSHandshake {
+	hs := &models.TLSHandshake{
+		Timestamp:    r.TS.Time,
+		UID:          r.UID,
+		SrcIP:        r.OrigH,
+		DstIP:        r.RespH,
+		SrcPort:      r.OrigP,
+		DstPort:      r.RespP,
+		Version:      r.Version,
+		CipherSuite:  r.Cipher,
+		ServerName:   r.ServerName,
+		NextProtocol: r.NextProtocol,
+		JA3:          r.JA3,
+		JA3S:         r.JA3S,
+		JA4:          r.JA4,
+		JA4S:         r.JA4S,
+	}
+	// The chain starts with the server certificate. Zeek 4 logs file ids,
+	// which x509.log uses as the certificate id.
+	if len(r.CertChainFPs) > 0 {
+		hs.CertFingerprint = r.CertChainFPs[0]
+	} else if len(r.CertChainFUIDs) > 0 {
+		hs.CertFingerprint = r.CertChainFUIDs[0]
+	}
+	return hs
+}
+
+// X509Record is an entry of x509.log. Zeek 4 logged the file id instead
+// of the certificate fingerprint.
+type X509Record struct {
+	TS          Time     `json:"ts"`
+	Fingerprint string   `json:"fingerprint"`
+	ID          string   `json:"id"`
+	Version     int      `json:"certificate.version"`
+	Serial      string   `json:"certificate.serial"`
+	Subject     string   `json:"certificate.subject"`
+	Issuer      string   `json:"certificate.issuer"`
+	NotBefore   Time     `json:"certificate.not_valid_before"`
+	NotAfter    Time     `json:"certificate.not_valid_after"`
+	KeyAlg      string   `json:"certificate.key_alg"`
+	SigAlg      string   `json:"certificate.sig_alg"`
+	KeyType     string   `json:"certificate.key_type"`
+	KeyLength   int      `json:"certificate.key_length"`
+	Curve       string   `json:"certificate.curve"`
+	SANDNS      []string `json:"san.dns"`
+	SANURI      []string `json:"san.uri"`
+	SANEmail    []string `json:"san.email"`
+	SANIP       []string `json:"san.ip"`
+	CA          *bool    `json:"basic_constraints.ca"`
+	PathLen     *int     `json:"basic_constraints.path_len"`
+	HostCert    bool     `json:"host_cert"`
+	ClientCert  bool     `json:"client_cert"`
+}
+
+// Certificate converts the record into the certificate model
+func (r *X509Record) Certificate() *models.Certificate {
+	fingerprint := r.Fingerprint
+	if fingerprint == "" {
+		fingerprint = r.ID
+	}
+	return &models.Certificate{
+		Fingerprint: fingerprint,
+		Serial:      r.Serial,
+		Subject:     r.Subject,
+		Issuer:      r.Issuer,
+		NotBefore:   r.NotBefore.Time,
+		NotAfter:    r.NotAfter.Time,
+		KeyType:     r.KeyType,
+		KeyLength:   r.KeyLength,
+		SigAlg:      r.SigAlg,
+		DNSNames:    r.SANDNS,
+		IPAddresses: r.SANIP,
+		IsCA:        r.CA != nil && *r.CA,
+		HostCert:    r.HostCert,
+		ClientCert:  r.ClientCert,
+		LastSeen:    r.TS.Time,
+	}
+}
+
+// SMBFilesRecord is an entry of smb_files.log
+type SMBFilesRecord struct {
+	TS  Time   `json:"ts"`
+	UID string `json:"uid"`
+	ConnID
+	FUID     string `json:"fuid"`
+	Action   string `json:"action"`
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	PrevName string `json:"prev_name"`
+	Modified Time   `json:"times.modified"`
+	Accessed Time   `json:"times.accessed"`
+	Created  Time   `json:"times.created"`
+	Changed  Time   `json:"times.changed"`
+}
+
+// SMBMappingRecord is an entry of smb_mapping.log
+type SMBMappingRecord struct {
+	TS  Time   `json:"ts"`
+	UID string `json:"uid"`
+	ConnID
+	Path             string `json:"path"`
+	Service          string `json:"service"`
+	NativeFileSystem string `json:"native_file_system"`
+	ShareType        string `json:"share_type"`
+}
+
+// NTLMRecord is an entry of ntlm.log
+type NTLMRecord struct {
+	TS  Time   `json:"ts"`
+	UID string `json:"uid"`
+	ConnID
+	Username              string `json:"username"`
+	Hostname              string `json:"hostname"`
+	DomainName            string `json:"domainname"`
+	ServerNBComputerName  string `json:"server_nb_computer_name"`
+	ServerDNSComputerName string `json:"server_dns_computer_name"`
+	ServerTreeName        string `json:"server_tree_name"`
+	Success               *bool  `json:"success"`
+	Status                string `json:"status"`
+}
+
+// KerberosRecord is an entry of kerberos.log
+type KerberosRecord struct {
+	TS  Time   `json:"ts"`
+	UID string `json:"uid"`
+	ConnID
+	RequestType       string `json:"request_type"`
+	Client            string `json:"client"`
+	Service           string `json:"service"`
+	Success           *bool  `json:"success"`
+	ErrorMsg          string `json:"error_msg"`
+	From              Time   `json:"from"`
+	Till              Time   `json:"till"`
+	Cipher            string `json:"cipher"`
+	Forwardable       bool   `json:"forwardable"`
+	Renewable         bool   `json:"renewable"`
+	ClientCertSubject string `json:"client_cert_subject"`
+	ClientCertFUID    string `json:"client_cert_fuid"`
+	ServerCertSubject string `json:"server_cert_subject"`
+	ServerCertFUID    string `json:"server_cert_fuid"`
+}
+
+// DCERPCRecord is an entry of dce_rpc.log
+type DCERPCRecord struct {
+	TS  Time   `json:"ts"`
+	UID string `json:"uid"`
+	ConnID
+	RTT       float64 `json:"rtt"`
+	NamedPipe string  `json:"named_pipe"`
+	Endpoint  string  `json:"endpoint"`
+	Operation string  `json:"operation"`
+}
+
+// SSHRecord is an entry of ssh.log
+type SSHRecord struct {
+	TS  Time   `json:"ts"`
+	UID string `json:"uid"`
+	ConnID
+	Version      int    `json:"version"`
+	AuthSuccess  *bool  `json:"auth_success"`
+	AuthAttempts int    `json:"auth_attempts"`
+	Direction    string `json:"direction"`
+	Client       string `json:"client"`
+	Server       string `json:"server"`
+	CipherAlg    string `json:"cipher_alg"`
+	MACAlg       string `json:"mac_alg"`
+	KexAlg       string `json:"kex_alg"`
+	HostKeyAlg   string `json:"host_key_alg"`
+	HostKey      string `json:"host_key"`
+}
+
+// RDPRecord is an entry of rdp.log
+type RDPRecord struct {
+	TS  Time   `json:"ts"`
+	UID string `json:"uid"`
+	ConnID
+	Cookie           string `json:"cookie"`
+	Result           string `json:"result"`
+	SecurityProtocol string `json:"security_protocol"`
+	ClientBuild      string `json:"client_build"`
+	ClientName       string `json:"client_name"`
+	CertType         string `json:"cert_type"`
+	EncryptionLevel  string `json:"encryption_level"`
+	EncryptionMethod string `json:"encryption_method"`
+}
+
+// LDAPRecord is an entry of ldap.log (Zeek 6.1+)
+type LDAPRecord struct {
+	TS  Time   `json:"ts"`
+	UID string `json:"uid"`
+	ConnID
+	MessageID         int    `json:"message_id"`
+	Version           int    `json:"version"`
+	Opcode            string `json:"opcode"`
+	Result            string `json:"result"`
+	DiagnosticMessage string `json:"diagnostic_message"`
+	Object            string `json:"object"`
+	Argument          string `json:"argument"`
+}
+
+// FilesRecord is an entry of files.log. Zeek 5 replaced tx_hosts/rx_hosts
+// with uid and the connection 4-tuple; both layouts are supported.
+type FilesRecord struct {
+	TS   Time   `json:"ts"`
+	FUID string `json:"fuid"`
+	UID  string `json:"uid"`
+	ConnID
+	TxHosts       []string `json:"tx_hosts"`
+	RxHosts       []string `json:"rx_hosts"`
+	ConnUIDs      []string `json:"conn_uids"`
+	Source        string   `json:"source"`
+	Depth         int      `json:"depth"`
+	Analyzers     []string `json:"analyzers"`
+	MIMEType      string   `json:"mime_type"`
+	Filename      string   `json:"filename"`
+	Duration      float64  `json:"duration"`
+	LocalOrig     bool     `json:"local_orig"`
+	IsOrig        bool     `json:"is_orig"`
+	SeenBytes     int64    `json:"seen_bytes"`
+	TotalBytes    int64    `json:"total_bytes"`
+	MissingBytes  int64    `json:"missing_bytes"`
+	OverflowBytes int64    `json:"overflow_bytes"`
+	TimedOut      bool     `json:"timedout"`
+	ParentFUID    string   `json:"parent_fuid"`
+	MD5           string   `json:"md5"`
+	SHA1          string   `json:"sha1"`
+	SHA256        string   `json:"sha256"`
+	Extracted     string   `json:"extracted"`
+}
+
+// NoticeRecord is an entry of notice.log
+type NoticeRecord struct {
+	TS  Time   `json:"ts"`
+	UID string `json:"uid"`
+	ConnID
+	FUID         string   `json:"fuid"`
+	FileMIMEType string   `json:"file_mime_type"`
+	FileDesc     string   `json:"file_desc"`
+	Proto        string   `json:"proto"`
+	Note         string   `json:"note"`
+	Msg          string   `json:"msg"`
+	Sub          string   `json:"sub"`
+	Src          string   `json:"src"`
+	Dst          string   `json:"dst"`
+	P            int      `json:"p"`
+	N            int      `json:"n"`
+	PeerDescr    string   `json:"peer_descr"`
+	Actions      []string `json:"actions"`
+	SuppressFor  float64  `json:"suppress_for"`
+}
+
+// Timestamped is implemented by records carrying the Zeek ts field
+type Timestamped interface {
+	Timestamp() time.Time
+}
+
+func (r *ConnRecord) Timestamp() time.Time       { return r.TS.Time }
+func (r *DNSRecord) Timestamp() time.Time        { return r.TS.Time }
+func (r *HTTPRecord) Timestamp() time.Time       { return r.TS.Time }
+func (r *SSLRecord) Timestamp() time.Time        { return r.TS.Time }
+func (r *X509Record) Timestamp() time.Time       { return r.TS.Time }
+func (r *SMBFilesRecord) Timestamp() time.Time   { return r.TS.Time }
+func (r *SMBMappingRecord) Timestamp() time.Time { return r.TS.Time }
+func (r *NTLMRecord) Timestamp() time.Time       { return r.TS.Time }
+func (r *KerberosRecord) Timestamp() time.Time   { return r.TS.Time }
+func (r *DCERPCRecord) Timestamp() time.Time     { return r.TS.Time }
+func (r *SSHRecord) Timestamp() time.Time        { return r.TS.Time }
+func (r *RDPRecord) Timestamp() time.Time        { return r.TS.Time }
+func (r *LDAPRecord) Timestamp() time.Time       { return r.TS.Time }
+func (r *FilesRecord) Timestamp() time.Time      { return r.TS.Time }
+func (r *NoticeRecord) Timestamp() time.Time     { return r.TS.Time }
+
+// NewRecord returns an empty typed record for a Zeek log path such as
+// "conn" or "dce_rpc", or false if the log type is not supported
+func NewRecord(logPath string) (interface{}, bool) {
+	constructors := map[string]func() interface{}{
+		"conn":        func() interface{} { return &ConnRecord{} },
+		"dns":         func() interface{} { return &DNSRecord{} },
+		"http":        func() interface{} { return &HTTPRecord{} },
+		"ssl":         func() interface{} { return &SSLRecord{} },
+		"smb_files":   func() interface{} { return &SMBFilesRecord{} },
+		"smb_mapping": func() interface{} { return &SMBMappingRecord{} },
+		"ntlm":        func() interface{} { return &NTLMRecord{} },
+		"kerberos":    func() interface{} { return &KerberosRecord{} },
+		"dce_rpc":     func() interface{} { return &DCERPCRecord{} },
+		"ssh":         func() interface{} { return &SSHRecord{} },
+		"rdp":         func() interface{} { return &RDPRecord{} },
+		"ldap":        func() interface{} { return &LDAPRecord{} },
+		"files":       func() interface{} { return &FilesRecord{} },
+		"x509":        func() interface{} { return &X509Record{} },
+		"notice":      func() interface{} { return &NoticeRecord{} },
+	}
+
+	constructor, exists := constructors[logPath]
+	if !exists {
+		return nil, false
+	}
+	return constructor(), true
+}
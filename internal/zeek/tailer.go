@@ -0,0 +1,606 @@
+package zeek
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Cxiyuan/NTA/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// handlerRetryDelay is the first wait before a failed record is handled
+	// again; it doubles up to maxHandlerRetryDelay
+	handlerRetryDelay    = time.Second
+	maxHandlerRetryDelay = 30 * time.Second
+	// maxHandlerAttempts bounds the tries for one record, so a record that
+	// can never be processed is skipped instead of blocking its log
+	maxHandlerAttempts = 5
+	// finalSyncTimeout bounds the sync before the checkpoint saved at
+	// shutdown
+	finalSyncTimeout = 10 * time.Second
+)
+
+// archiveName matches zeekctl archive files such as conn.10:00:00-11:00:00.log.gz
+var archiveName = regexp.MustCompile(`^([a-z0-9_]+)\.(\d{2}):(\d{2}):(\d{2})-\d{2}:\d{2}:\d{2}\.log(\.gz)?$`)
+
+// RecordHandler receives each record as Zeek JSON, like the Kafka writer emits it
+type RecordHandler func(ctx context.Context, logType string, data []byte) error
+
+// SyncFunc returns once the results of every record handled before the
+// call are stored
+type SyncFunc func(ctx context.Context) error
+
+// Checkpoint records how far a log has been consumed. Opened is the #open
+// header of the file, which identifies it again after rotation; logs
+// without one, like JSON logs, are found again by the time they were last
+// read.
+type Checkpoint struct {
+	Inode   uint64    `json:"inode"`
+	Offset  int64     `json:"offset"`
+	Opened  string    `json:"opened"`
+	Updated time.Time `json:"updated,omitempty"`
+}
+
+// Tailer follows the logs in a Zeek spool directory, surviving restarts and
+// hourly rotation without gaps or duplicates
+type Tailer struct {
+	logDir         string
+	checkpointFile string
+	logTypes       map[string]bool
+	pollInterval   time.Duration
+	logger         *logrus.Logger
+	sync           SyncFunc
+
+	files       map[string]*tailedFile
+	checkpoints map[string]*Checkpoint
+	mu          sync.Mutex
+}
+
+type tailedFile struct {
+	logType string
+	file    *os.File
+	inode   uint64
+	parser  *LineParser
+}
+
+// NewTailer creates a tailer for logDir (containing current/ and the dated
+// archive directories). logTypes limits which logs are followed; empty
+// means every log type NewRecord supports.
+func NewTailer(logDir, checkpointFile string, logTypes []string, logger *logrus.Logger) *Tailer {
+	types := make(map[string]bool)
+	for _, t := range logTypes {
+		types[t] = true
+	}
+
+	return &Tailer{
+		logDir:         logDir,
+		checkpointFile: checkpointFile,
+		logTypes:       types,
+		pollInterval:   time.Second,
+		logger:         logger,
+		files:          make(map[string]*tailedFile),
+		checkpoints:    make(map[string]*Checkpoint),
+	}
+}
+
+// SetSync makes the tailer call sync before saving checkpoints, so a
+// checkpoint never covers records whose results are still buffered
+func (t *Tailer) SetSync(sync SyncFunc) {
+	t.sync = sync
+}
+
+// Run tails logs until ctx is cancelled, passing every record to handler.
+// A record the handler fails on is retried until it succeeds.
+func (t *Tailer) Run(ctx context.Context, handler RecordHandler) error {
+	if err := t.loadCheckpoints(); err != nil {
+		return err
+	}
+	defer t.closeAll()
+
+	t.logger.Infof("Tailing Zeek logs in %s", filepath.Join(t.logDir, "current"))
+
+	ticker := time.NewTicker(t.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		t.poll(ctx, handler)
+
+		select {
+		case <-ctx.Done():
+			syncCtx, cancel := context.WithTimeout(context.Background(), finalSyncTimeout)
+			defer cancel()
+			return t.saveCheckpoints(syncCtx)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Checkpoints returns a copy of the current checkpoints
+func (t *Tailer) Checkpoints() map[string]Checkpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make(map[string]Checkpoint, len(t.checkpoints))
+	for logType, cp := range t.checkpoints {
+		result[logType] = *cp
+	}
+	return result
+}
+
+func (t *Tailer) poll(ctx context.Context, handler RecordHandler) {
+	currentDir := filepath.Join(t.logDir, "current")
+	entries, err := os.ReadDir(currentDir)
+	if err != nil {
+		t.logger.Warnf("Failed to list %s: %v", currentDir, err)
+		return
+	}
+
+	changed := false
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".log") {
+			continue
+		}
+
+		logType := strings.TrimSuffix(entry.Name(), ".log")
+		if !t.wanted(logType) {
+			continue
+		}
+
+		path := filepath.Join(currentDir, entry.Name())
+		n, err := t.follow(ctx, logType, path, handler)
+		if err != nil {
+			t.logger.Errorf("Failed to tail %s: %v", path, err)
+		}
+		if n > 0 {
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := t.saveCheckpoints(ctx); err != nil {
+			t.logger.Errorf("Failed to save tail checkpoint: %v", err)
+		}
+	}
+}
+
+func (t *Tailer) wanted(logType string) bool {
+	if len(t.logTypes) > 0 {
+		return t.logTypes[logType]
+	}
+	_, supported := NewRecord(logType)
+	return supported
+}
+
+// follow reads new lines from a current log, handling rotation and restarts.
+// It returns the number of records handled.
+func (t *Tailer) follow(ctx context.Context, logType, path string, handler RecordHandler) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	inode := fileInode(info)
+
+	handled := 0
+	tf := t.files[logType]
+
+	// Zeek renamed the file away; finish the old one through our open handle
+	if tf != nil && tf.inode != inode {
+		n, err := t.readNew(ctx, tf, handler)
+		handled += n
+		if err != nil {
+			return handled, err
+		}
+		tf.file.Close()
+		delete(t.files, logType)
+		tf = nil
+		t.setCheckpoint(logType, &Checkpoint{})
+	}
+
+	if tf == nil {
+		tf, err = t.open(ctx, logType, path, inode, handler)
+		if err != nil {
+			return handled, err
+		}
+		t.files[logType] = tf
+	}
+
+	// Truncated in place, start over
+	if info.Size() < t.checkpoint(logType).Offset {
+		t.logger.Warnf("%s was truncated, restarting from the beginning", path)
+		t.setCheckpoint(logType, &Checkpoint{Inode: inode})
+		tf.parser = NewLineParser()
+	}
+
+	n, err := t.readNew(ctx, tf, handler)
+	return handled + n, err
+}
+
+// open starts following a current log, first catching up on any archives
+// that were rotated away while we were not running
+func (t *Tailer) open(ctx context.Context, logType, path string, inode uint64, handler RecordHandler) (*tailedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tf := &tailedFile{logType: logType, file: file, inode: inode, parser: NewLineParser()}
+	headerEnd, err := readHeader(file, tf.parser)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	opened := tf.parser.Header().Opened
+
+	cp := t.checkpoint(logType)
+	switch {
+	case cp.Opened == "" && cp.Inode == 0:
+		// First run for this log: start with the current file
+		cp = &Checkpoint{Inode: inode, Offset: headerEnd, Opened: opened}
+	case (cp.Opened != "" && cp.Opened == opened) || (cp.Opened == "" && cp.Inode == inode):
+		// Same file as before the restart
+		cp = &Checkpoint{Inode: inode, Offset: cp.Offset, Opened: opened}
+		if cp.Offset < headerEnd {
+			cp.Offset = headerEnd
+		}
+	default:
+		// Keep the checkpoint on the archives until they are processed
+		if err := t.catchUp(ctx, logType, cp, opened, handler); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to process rotated %s logs: %w", logType, err)
+		}
+		cp = &Checkpoint{Inode: inode, Offset: headerEnd, Opened: opened}
+	}
+	t.setCheckpoint(logType, cp)
+
+	return tf, nil
+}
+
+// readNew handles complete lines appended since the checkpoint offset
+func (t *Tailer) readNew(ctx context.Context, tf *tailedFile, handler RecordHandler) (int, error) {
+	cp := t.checkpoint(tf.logType)
+	if _, err := tf.file.Seek(cp.Offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReaderSize(tf.file, 256*1024)
+	offset := cp.Offset
+	handled := 0
+
+	defer func() {
+		t.setCheckpoint(tf.logType, &Checkpoint{
+			Inode:   tf.inode,
+			Offset:  offset,
+			Opened:  tf.parser.Header().Opened,
+			Updated: time.Now(),
+		})
+	}()
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			// Leave partial lines for the next poll
+			return handled, nil
+		}
+		if err != nil {
+			return handled, err
+		}
+
+		ok, err := t.handleLine(ctx, tf.logType, tf.parser, line, handler)
+		if err != nil {
+			return handled, err
+		}
+		if ok {
+			handled++
+		}
+		offset += int64(len(line))
+	}
+}
+
+// catchUp processes archives rotated after the checkpointed file and before
+// the file that is current now, resuming the checkpointed file at its offset
+func (t *Tailer) catchUp(ctx context.Context, logType string, cp *Checkpoint, currentOpened string, handler RecordHandler) error {
+	archives, err := t.findArchives(logType)
+	if err != nil {
+		return err
+	}
+
+	if cp.Opened == "" {
+		// The checkpointed file was rotated into the first archive
+		// written after it was last read
+		archive := firstModifiedAfter(archives, cp.Updated)
+		if archive == nil {
+			t.logger.Warnf("No rotated %s log found for the checkpoint, continuing with the current file", logType)
+			return nil
+		}
+		cp = &Checkpoint{Offset: cp.Offset, Opened: archive.opened}
+	}
+
+	for _, archive := range archives {
+		if archive.opened < cp.Opened || (currentOpened != "" && archive.opened >= currentOpened) {
+			continue
+		}
+
+		skip := int64(0)
+		if archive.opened == cp.Opened {
+			skip = cp.Offset
+		}
+
+		t.logger.Infof("Processing rotated log %s", archive.path)
+		offset, err := t.readArchive(ctx, logType, archive.path, skip, handler)
+		// Resume a restart within the archive, or after it once complete
+		t.setCheckpoint(logType, &Checkpoint{Opened: archive.opened, Offset: offset})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type archiveFile struct {
+	path   string
+	opened string
+}
+
+// findArchives lists zeekctl archives (YYYY-MM-DD/<type>.HH:MM:SS-HH:MM:SS.log.gz)
+// ordered by the time they were opened
+func (t *Tailer) findArchives(logType string) ([]archiveFile, error) {
+	days, err := filepath.Glob(filepath.Join(t.logDir, "[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]"))
+	if err != nil {
+		return nil, err
+	}
+
+	var archives []archiveFile
+	for _, day := range days {
+		entries, err := os.ReadDir(day)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			m := archiveName.FindStringSubmatch(entry.Name())
+			if m == nil || m[1] != logType {
+				continue
+			}
+			archives = append(archives, archiveFile{
+				path:   filepath.Join(day, entry.Name()),
+				opened: fmt.Sprintf("%s-%s-%s-%s", filepath.Base(day), m[2], m[3], m[4]),
+			})
+		}
+	}
+
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].opened < archives[j].opened
+	})
+	return archives, nil
+}
+
+// firstModifiedAfter returns the archive with the earliest modification
+// time after since, or nil
+func firstModifiedAfter(archives []archiveFile, since time.Time) *archiveFile {
+	if since.IsZero() {
+		return nil
+	}
+
+	var first *archiveFile
+	var firstModified time.Time
+	for i := range archives {
+		info, err := os.Stat(archives[i].path)
+		if err != nil || !info.ModTime().After(since) {
+			continue
+		}
+		if first == nil || info.ModTime().Before(firstModified) {
+			first, firstModified = &archives[i], info.ModTime()
+		}
+	}
+	return first
+}
+
+// readArchive handles every record of a rotated log whose line starts at or
+// after skip bytes into the uncompressed content. It returns the offset up
+// to which records were handled.
+func (t *Tailer) readArchive(ctx context.Context, logType, path string, skip int64, handler RecordHandler) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return skip, err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return skip, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	reader := bufio.NewReaderSize(r, 256*1024)
+	parser := NewLineParser()
+	offset := int64(0)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			if strings.HasPrefix(line, "#") {
+				parser.ParseLine(line)
+			} else if offset >= skip {
+				if _, err := t.handleLine(ctx, logType, parser, line, handler); err != nil {
+					return offset, err
+				}
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			return max(offset, skip), nil
+		}
+		if err != nil {
+			return max(offset, skip), err
+		}
+	}
+}
+
+// handleLine parses a line and passes data records to the handler,
+// reporting whether it was handled. Unparseable lines are skipped. A
+// record the handler fails on is retried with backoff, so a transient
+// outage does not lose it, and is logged and skipped after
+// maxHandlerAttempts; the error is only returned once ctx is cancelled.
+func (t *Tailer) handleLine(ctx context.Context, logType string, parser *LineParser, line string, handler RecordHandler) (bool, error) {
+	rec, err := parser.ParseLine(line)
+	if err != nil {
+		t.logger.Warnf("Failed to parse %s record: %v", logType, err)
+		metrics.ZeekRecordsSkipped.WithLabelValues(logType, "parse_failed").Inc()
+		return false, nil
+	}
+	if rec == nil {
+		return false, nil
+	}
+
+	if path := parser.Header().Path; path != "" {
+		logType = path
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		t.logger.Warnf("Failed to encode %s record: %v", logType, err)
+		metrics.ZeekRecordsSkipped.WithLabelValues(logType, "encode_failed").Inc()
+		return false, nil
+	}
+
+	delay := handlerRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := handler(ctx, logType, data)
+		if err == nil {
+			return true, nil
+		}
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		if attempt >= maxHandlerAttempts {
+			t.logger.Errorf("Skipping %s record after %d failed attempts: %v: %s", logType, attempt, err, data)
+			metrics.ZeekRecordsSkipped.WithLabelValues(logType, "process_failed").Inc()
+			return false, nil
+		}
+
+		t.logger.Errorf("Failed to process %s record, retrying in %v: %v", logType, delay, err)
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxHandlerRetryDelay)
+	}
+}
+
+// readHeader consumes the leading # lines and returns the offset of the
+// first data line
+func readHeader(file *os.File, parser *LineParser) (int64, error) {
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		if !strings.HasPrefix(line, "#") || !strings.HasSuffix(line, "\n") {
+			return offset, nil
+		}
+		parser.ParseLine(line)
+		offset += int64(len(line))
+	}
+}
+
+func (t *Tailer) checkpoint(logType string) *Checkpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if cp, exists := t.checkpoints[logType]; exists {
+		return cp
+	}
+	return &Checkpoint{}
+}
+
+func (t *Tailer) setCheckpoint(logType string, cp *Checkpoint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.checkpoints[logType] = cp
+}
+
+func (t *Tailer) loadCheckpoints() error {
+	if t.checkpointFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(t.checkpointFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return json.Unmarshal(data, &t.checkpoints)
+}
+
+// saveCheckpoints writes the checkpoint file atomically, once the records
+// it covers are synced
+func (t *Tailer) saveCheckpoints(ctx context.Context) error {
+	if t.checkpointFile == "" {
+		return nil
+	}
+
+	t.mu.Lock()
+	data, err := json.MarshalIndent(t.checkpoints, "", "  ")
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if t.sync != nil {
+		if err := t.sync(ctx); err != nil {
+			return fmt.Errorf("failed to sync processed records: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(t.checkpointFile), 0755); err != nil {
+		return err
+	}
+
+	tmp := t.checkpointFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.checkpointFile)
+}
+
+func (t *Tailer) closeAll() {
+	for logType, tf := range t.files {
+		tf.file.Close()
+		delete(t.files, logType)
+	}
+}
+
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Ino
+	}
+	return 0
+}
@@ -0,0 +1,281 @@
+package zeek
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Header holds the metadata lines Zeek writes at the top of every ASCII log
+type Header struct {
+	Separator    string
+	SetSeparator string
+	EmptyField   string
+	UnsetField   string
+	Path         string
+	Opened       string
+	Fields       []string
+	Types        []string
+}
+
+// Record is a single log entry keyed by Zeek field name. Values use the same
+// shapes as Zeek's JSON writer so TSV and JSON logs decode identically.
+type Record map[string]interface{}
+
+// Decode converts the record into one of the typed log structs
+func (r Record) Decode(v interface{}) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// LineParser parses Zeek log lines one at a time, tracking header state.
+// Lines starting with '{' are treated as JSON logs (LogAscii::use_json).
+type LineParser struct {
+	header Header
+}
+
+// NewLineParser creates a parser with Zeek's default header values
+func NewLineParser() *LineParser {
+	return &LineParser{header: defaultHeader()}
+}
+
+func defaultHeader() Header {
+	return Header{
+		Separator:    "\t",
+		SetSeparator: ",",
+		EmptyField:   "(empty)",
+		UnsetField:   "-",
+	}
+}
+
+// Header returns the most recently seen header
+func (r *LineParser) Header() Header {
+	return r.header
+}
+
+// ParseLine returns the record for a data line, or nil for header and
+// blank lines
+func (r *LineParser) ParseLine(line string) (Record, error) {
+	line = strings.TrimSuffix(line, "\n")
+	if line == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(line, "#") {
+		r.parseHeaderLine(line)
+		return nil, nil
+	}
+
+	if line[0] == '{' {
+		var rec Record
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return nil, err
+		}
+		return rec, nil
+	}
+
+	if len(r.header.Fields) == 0 {
+		return nil, errors.New("data before #fields header")
+	}
+
+	return r.parseLine(line)
+}
+
+// TSVReader reads Zeek ASCII logs, mapping columns by the #fields header
+type TSVReader struct {
+	*LineParser
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewTSVReader creates a reader with Zeek's default header values
+func NewTSVReader(r io.Reader) *TSVReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	return &TSVReader{
+		LineParser: NewLineParser(),
+		scanner:    scanner,
+	}
+}
+
+// LineError is a line that could not be parsed. Reading can continue
+// after it, unlike after other errors returned by Next.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// Next returns the next record, or io.EOF when the input is exhausted.
+// Malformed lines are reported as *LineError.
+func (r *TSVReader) Next() (Record, error) {
+	for r.scanner.Scan() {
+		r.line++
+
+		rec, err := r.ParseLine(r.scanner.Text())
+		if err != nil {
+			return nil, &LineError{Line: r.line, Err: err}
+		}
+		if rec != nil {
+			return rec, nil
+		}
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (r *LineParser) parseHeaderLine(line string) {
+	// #separator is always space-delimited since it defines the separator
+	if strings.HasPrefix(line, "#separator ") {
+		r.header = defaultHeader()
+		r.header.Separator = unescape(strings.TrimPrefix(line, "#separator "))
+		return
+	}
+
+	parts := strings.Split(line, r.header.Separator)
+	key := strings.TrimPrefix(parts[0], "#")
+	values := parts[1:]
+
+	switch key {
+	case "set_separator":
+		if len(values) > 0 {
+			r.header.SetSeparator = unescape(values[0])
+		}
+	case "empty_field":
+		if len(values) > 0 {
+			r.header.EmptyField = values[0]
+		}
+	case "unset_field":
+		if len(values) > 0 {
+			r.header.UnsetField = values[0]
+		}
+	case "path":
+		if len(values) > 0 {
+			r.header.Path = values[0]
+		}
+	case "open":
+		if len(values) > 0 {
+			r.header.Opened = values[0]
+		}
+	case "fields":
+		r.header.Fields = values
+	case "types":
+		r.header.Types = values
+	}
+}
+
+func (r *LineParser) parseLine(line string) (Record, error) {
+	values := strings.Split(line, r.header.Separator)
+	if len(values) != len(r.header.Fields) {
+		return nil, fmt.Errorf("expected %d fields, got %d", len(r.header.Fields), len(values))
+	}
+
+	rec := make(Record, len(values))
+	for i, raw := range values {
+		if raw == r.header.UnsetField {
+			continue
+		}
+
+		fieldType := "string"
+		if i < len(r.header.Types) {
+			fieldType = r.header.Types[i]
+		}
+
+		value, err := r.convert(raw, fieldType)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", r.header.Fields[i], err)
+		}
+		rec[r.header.Fields[i]] = value
+	}
+
+	return rec, nil
+}
+
+// convert turns a raw column into the value Zeek's JSON writer would emit
+func (r *LineParser) convert(raw, fieldType string) (interface{}, error) {
+	if elemType, ok := containerElemType(fieldType); ok {
+		items := []interface{}{}
+		if raw == r.header.EmptyField {
+			return items, nil
+		}
+		for _, item := range strings.Split(raw, r.header.SetSeparator) {
+			if item == r.header.UnsetField {
+				items = append(items, nil)
+				continue
+			}
+			value, err := convertScalar(item, elemType)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		return items, nil
+	}
+
+	if raw == r.header.EmptyField {
+		return "", nil
+	}
+	return convertScalar(raw, fieldType)
+}
+
+func convertScalar(raw, fieldType string) (interface{}, error) {
+	switch fieldType {
+	case "time", "interval", "double":
+		return strconv.ParseFloat(raw, 64)
+	case "count", "int", "port":
+		return strconv.ParseInt(raw, 10, 64)
+	case "bool":
+		return raw == "T", nil
+	default:
+		return unescape(raw), nil
+	}
+}
+
+// containerElemType returns the element type of set[...] and vector[...] types
+func containerElemType(fieldType string) (string, bool) {
+	for _, prefix := range []string{"set[", "vector["} {
+		if strings.HasPrefix(fieldType, prefix) && strings.HasSuffix(fieldType, "]") {
+			return fieldType[len(prefix) : len(fieldType)-1], true
+		}
+	}
+	return "", false
+}
+
+// unescape decodes the \xNN sequences Zeek uses for separators and
+// non-printable bytes
+func unescape(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if v, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -75,4 +75,87 @@ var (
 		},
 		[]string{"type"},
 	)
+
+	DBFlushDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "nta_db_flush_duration_seconds",
+			Help:    "Batched insert latencies in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"table", "success"},
+	)
+
+	DBRowsWritten = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nta_db_rows_written_total",
+			Help: "Total number of rows written by batched inserts",
+		},
+		[]string{"table"},
+	)
+
+	DBRowsDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nta_db_rows_dropped_total",
+			Help: "Total number of rows dropped before reaching the database",
+		},
+		[]string{"table", "reason"},
+	)
+
+	DBWriteQueueLength = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nta_db_write_queue_length",
+			Help: "Number of rows waiting for a batched insert",
+		},
+		[]string{"table"},
+	)
+
+	KafkaConsumerLag = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nta_kafka_consumer_lag",
+			Help: "Messages between the committed offset of the consumer group and the high watermark",
+		},
+		[]string{"topic", "partition"},
+	)
+
+	KafkaWorkerQueueLength = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nta_kafka_worker_queue_length",
+			Help: "Number of fetched messages waiting for a consumer worker",
+		},
+		[]string{"worker"},
+	)
+
+	KafkaMessagesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nta_kafka_messages_total",
+			Help: "Total number of Kafka messages by processing result",
+		},
+		[]string{"topic", "result"},
+	)
+
+	ZeekRecordsSkipped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nta_zeek_records_skipped_total",
+			Help: "Total number of tailed Zeek records skipped because they could not be parsed or processed",
+		},
+		[]string{"log_type", "reason"},
+	)
+
+	RecordProcessingDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "nta_record_processing_duration_seconds",
+			Help:    "Per-record processing latencies in seconds",
+			Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		},
+		[]string{"log_type"},
+	)
+
+	DetectorDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "nta_detector_duration_seconds",
+			Help:    "Per-record detector latencies in seconds",
+			Buckets: []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+		},
+		[]string{"detector"},
+	)
 )
@@ -34,6 +34,9 @@ func (m *Migrator) ApplyMigrations() error {
 		{"001_initial_schema", m.migration001InitialSchema},
 		{"002_add_indexes", m.migration002AddIndexes},
 		{"003_add_tenant_support", m.migration003AddTenantSupport},
+		{"004_add_tls_fingerprints", m.migration004AddTLSFingerprints},
+		{"005_add_tls_handshakes", m.migration005AddTLSHandshakes},
+		{"006_add_certificates", m.migration006AddCertificates},
 	}
 
 	for _, migration := range migrations {
@@ -108,3 +111,15 @@ func (m *Migrator) migration003AddTenantSupport(db *gorm.DB) error {
 
 	return nil
 }
+
+func (m *Migrator) migration004AddTLSFingerprints(db *gorm.DB) error {
+	return db.AutoMigrate(&models.TLSFingerprint{})
+}
+
+func (m *Migrator) migration005AddTLSHandshakes(db *gorm.DB) error {
+	return db.AutoMigrate(&models.TLSHandshake{})
+}
+
+func (m *Migrator) migration006AddCertificates(db *gorm.DB) error {
+	return db.AutoMigrate(&models.Certificate{}, &models.TLSHandshake{})
+}
@@ -34,12 +34,21 @@ type Asset struct {
 	Vendor      string    `json:"vendor"`
 	OS          string    `json:"os"`
 	Services    string    `json:"services" gorm:"type:text"` // JSON array
+	Role        string    `json:"role" gorm:"index"`         // e.g. domain_controller
 	FirstSeen   time.Time `json:"first_seen"`
 	LastSeen    time.Time `json:"last_seen"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
 
+// Asset roles
+const (
+	AssetRoleDomainController = "domain_controller"
+	// AssetRoleManagementHost marks admin workstations and jump hosts that
+	// administer other hosts remotely as a matter of course
+	AssetRoleManagementHost = "management_host"
+)
+
 // ThreatIntel represents threat intelligence data
 type ThreatIntel struct {
 	ID          uint      `json:"id" gorm:"primaryKey"`
@@ -149,15 +158,64 @@ type Connection struct {
 
 // TLSHandshake represents TLS connection metadata
 type TLSHandshake struct {
-	Timestamp   time.Time `json:"ts"`
-	UID         string    `json:"uid"`
-	SrcIP       string    `json:"src_ip"`
-	DstIP       string    `json:"dst_ip"`
-	SrcPort     int       `json:"src_port"`
-	DstPort     int       `json:"dst_port"`
-	Version     string    `json:"version"`
-	CipherSuite string    `json:"cipher"`
-	ServerName  string    `json:"server_name"`
-	JA3         string    `json:"ja3"`
-	JA3S        string    `json:"ja3s"`
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	Timestamp    time.Time `json:"ts" gorm:"index"`
+	UID          string    `json:"uid" gorm:"index"`
+	SrcIP        string    `json:"src_ip" gorm:"index"`
+	DstIP        string    `json:"dst_ip" gorm:"index"`
+	SrcPort      int       `json:"src_port"`
+	DstPort      int       `json:"dst_port"`
+	Version      string    `json:"version"`
+	CipherSuite  string    `json:"cipher"`
+	ServerName   string    `json:"server_name" gorm:"index"`
+	NextProtocol string    `json:"next_protocol"` // ALPN protocol selected by the server
+	JA3          string    `json:"ja3" gorm:"index"`
+	JA3S         string    `json:"ja3s" gorm:"index"`
+	JA4          string    `json:"ja4" gorm:"index"`
+	JA4S         string    `json:"ja4s"`
+	// CertFingerprint is the hash of the server certificate, as logged in
+	// x509.log
+	CertFingerprint string `json:"cert_fingerprint" gorm:"index"`
+	// Anomalies lists the analyzer findings, comma separated
+	Anomalies string `json:"anomalies"`
+	// CertChecked is set once the server certificate was analyzed. It stays
+	// unset while the certificate has not been seen in x509.log yet.
+	CertChecked bool `json:"cert_checked"`
+}
+
+// Certificate is an X.509 certificate seen in a TLS handshake
+type Certificate struct {
+	Fingerprint string    `json:"fingerprint" gorm:"primaryKey"` // SHA1 or SHA256, hex encoded
+	Serial      string    `json:"serial"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	KeyType     string    `json:"key_type"`
+	KeyLength   int       `json:"key_length"`
+	SigAlg      string    `json:"sig_alg"`
+	DNSNames    []string  `json:"dns_names" gorm:"serializer:json"`
+	IPAddresses []string  `json:"ip_addresses" gorm:"serializer:json"`
+	IsCA        bool      `json:"is_ca"`
+	HostCert    bool      `json:"host_cert"`
+	ClientCert  bool      `json:"client_cert"`
+	LastSeen    time.Time `json:"last_seen" gorm:"index"`
+}
+
+// TLSFingerprint is a known JA3, JA3S, JA3+JA3S pair, JA4 or JA4S
+// fingerprint, or a certificate hash. Pair values are the JA3 and JA3S
+// hashes joined by a comma.
+type TLSFingerprint struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	Type        string    `json:"type" gorm:"uniqueIndex:idx_tls_fingerprint"` // ja3, ja3s, ja3_pair, ja4, ja4s, cert_sha1, cert_sha256
+	Value       string    `json:"value" gorm:"uniqueIndex:idx_tls_fingerprint"`
+	Label       string    `json:"label"`    // malware family or application
+	Category    string    `json:"category"` // malicious, application
+	Severity    string    `json:"severity"`
+	Source      string    `json:"source"`
+	Description string    `json:"description"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
 }
\ No newline at end of file
@@ -0,0 +1,51 @@
+// Package recency orders keys by last use for bounded in-memory state
+package recency
+
+import "container/list"
+
+// List orders keys from least to most recently touched, so bounded
+// trackers can evict their stalest entry without scanning every key
+type List[K comparable] struct {
+	order *list.List
+	elems map[K]*list.Element
+}
+
+// New creates an empty list
+func New[K comparable]() *List[K] {
+	return &List[K]{
+		order: list.New(),
+		elems: make(map[K]*list.Element),
+	}
+}
+
+// Touch marks a key as the most recently used
+func (r *List[K]) Touch(key K) {
+	if elem, ok := r.elems[key]; ok {
+		r.order.MoveToBack(elem)
+		return
+	}
+	r.elems[key] = r.order.PushBack(key)
+}
+
+// Remove forgets a key
+func (r *List[K]) Remove(key K) {
+	if elem, ok := r.elems[key]; ok {
+		r.order.Remove(elem)
+		delete(r.elems, key)
+	}
+}
+
+// Oldest returns the least recently touched key
+func (r *List[K]) Oldest() (K, bool) {
+	var zero K
+	front := r.order.Front()
+	if front == nil {
+		return zero, false
+	}
+	return front.Value.(K), true
+}
+
+// Len returns the number of keys
+func (r *List[K]) Len() int {
+	return len(r.elems)
+}
@@ -3,6 +3,7 @@ package retry
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -24,6 +25,28 @@ func DefaultConfig() Config {
 	}
 }
 
+// permanentError marks an error that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so Do and DoWithResult return it without retrying
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err was marked with Permanent
+func IsPermanent(err error) bool {
+	var perm *permanentError
+	return errors.As(err, &perm)
+}
+
 func Do(ctx context.Context, config Config, logger *logrus.Logger, fn func() error) error {
 	var lastErr error
 	delay := config.InitialDelay
@@ -36,7 +59,7 @@ func Do(ctx context.Context, config Config, logger *logrus.Logger, fn func() err
 
 		lastErr = err
 
-		if attempt == config.MaxAttempts {
+		if attempt == config.MaxAttempts || IsPermanent(err) {
 			break
 		}
 
@@ -57,7 +80,10 @@ func Do(ctx context.Context, config Config, logger *logrus.Logger, fn func() err
 		}
 	}
 
-	return errors.New("max retry attempts exceeded: " + lastErr.Error())
+	if IsPermanent(lastErr) {
+		return lastErr
+	}
+	return fmt.Errorf("max retry attempts exceeded: %w", lastErr)
 }
 
 func DoWithResult[T any](ctx context.Context, config Config, logger *logrus.Logger, fn func() (T, error)) (T, error) {
@@ -73,7 +99,7 @@ func DoWithResult[T any](ctx context.Context, config Config, logger *logrus.Logg
 
 		lastErr = err
 
-		if attempt == config.MaxAttempts {
+		if attempt == config.MaxAttempts || IsPermanent(err) {
 			break
 		}
 
@@ -94,5 +120,8 @@ func DoWithResult[T any](ctx context.Context, config Config, logger *logrus.Logg
 		}
 	}
 
-	return result, errors.New("max retry attempts exceeded: " + lastErr.Error())
+	if IsPermanent(lastErr) {
+		return result, lastErr
+	}
+	return result, fmt.Errorf("max retry attempts exceeded: %w", lastErr)
 }